@@ -0,0 +1,141 @@
+// Package client is a Go library for working with databases on a DBHub.io cloud.  It's what the dio command line
+// tool is built on.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to a DBHub.io cloud on behalf of a user
+type Client struct {
+	BaseURL    string       // Address of the DBHub.io cloud, eg https://db4s.dbhub.io
+	HTTPClient *http.Client // Uses TLSConfig for its connections when created by New()
+	Logger     *log.Logger  // Receives status messages, eg about retries and merged metadata
+	TLSConfig  *tls.Config  // Holds the user's client certificate
+	User       string       // The user name in the client certificate
+	UserAgent  string
+
+	// Number of times an upload is attempted before giving up, and the delay before the first retry.  The delay
+	// doubles after each failed attempt
+	UploadAttempts   int
+	UploadRetryDelay time.Duration
+
+	// If set, this is called at the start of each upload to display its progress
+	NewProgress func(desc string, total int64) Progress
+
+	// The capabilities of the server, once they've been asked for
+	caps   *Capabilities
+	capsMu sync.Mutex
+}
+
+// Creates a client for a DBHub.io cloud.  Status messages are discarded until a Logger is set
+func New(baseURL string, tlsConfig *tls.Config, user string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{
+			// There's no overall timeout, as large databases can take a long time to transfer
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		Logger:           log.New(ioutil.Discard, "", 0),
+		TLSConfig:        tlsConfig,
+		UploadAttempts:   5,
+		UploadRetryDelay: 2 * time.Second,
+		User:             user,
+		UserAgent:        "dio client",
+	}
+}
+
+// Returns the path of a database on the server, from the folder it's in and its name.  The path can be given to the
+// client methods wherever a database is needed
+func DatabasePath(folder, name string) string {
+	return path.Join("/", folder, name)
+}
+
+// Returns the query parameters which identify a database of the user
+func (c *Client) databaseQuery(db string) url.Values {
+	folder, name := splitDatabasePath(db)
+	query := url.Values{}
+	query.Set("dbname", name)
+	query.Set("folder", folder)
+	query.Set("username", c.User)
+	return query
+}
+
+// Returns the URL for a database of the user, including the folder it's in
+func (c *Client) databaseURL(db string) string {
+	folder, name := splitDatabasePath(db)
+	u := c.BaseURL + "/" + url.PathEscape(c.User)
+	for _, dir := range strings.Split(strings.Trim(folder, "/"), "/") {
+		if dir != "" {
+			u += "/" + url.PathEscape(dir)
+		}
+	}
+	return u + "/" + url.PathEscape(name)
+}
+
+// Sends a GET request to the server, returning the HTTP status code, headers and response body
+func (c *Client) get(ctx context.Context, path string, query url.Values) (status int, header http.Header,
+	body []byte, err error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.BaseURL+path, query, nil)
+	if err != nil {
+		return
+	}
+	return c.send(req)
+}
+
+// Creates a request to the server, with the given query parameters added to the URL
+func (c *Client) newRequest(ctx context.Context, method, reqURL string, query url.Values,
+	body io.Reader) (*http.Request, error) {
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	return req, nil
+}
+
+// Sends a POST request to the server, returning the HTTP status code and response body
+func (c *Client) post(ctx context.Context, path string, query url.Values) (status int, body []byte, err error) {
+	req, err := c.newRequest(ctx, http.MethodPost, c.BaseURL+path, query, nil)
+	if err != nil {
+		return
+	}
+	status, _, body, err = c.send(req)
+	return
+}
+
+// Sends a request, returning the HTTP status code, headers and response body
+func (c *Client) send(req *http.Request) (status int, header http.Header, body []byte, err error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, body, err
+}
+
+// Splits the path of a database on the server (eg "/finance/q1.sqlite") into the folder it's in and its name.  Names
+// without a leading slash are taken to be in the top level folder
+func splitDatabasePath(db string) (folder, name string) {
+	if !strings.HasPrefix(db, "/") {
+		return "/", db
+	}
+	return path.Dir(db), path.Base(db)
+}
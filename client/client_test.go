@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	chk "gopkg.in/check.v1"
+)
+
+type ClientSuite struct{}
+
+var _ = chk.Suite(&ClientSuite{})
+
+func Test(t *testing.T) {
+	chk.TestingT(t)
+}
+
+func (s *ClientSuite) TestMetadata(c *chk.C) {
+	// Serve the metadata for a single database
+	tree := DBTree{Entries: []DBTreeEntry{{EntryType: DATABASE, Name: "a.sqlite", Sha256: "abc", Size: 10}}}
+	tree.ID = TreeID(tree.Entries)
+	com := CommitEntry{AuthorName: "Some One", AuthorEmail: "someone@example.org", Tree: tree,
+		Timestamp: time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)}
+	com.ID = CommitID(com)
+	meta := MetaData{
+		Branches:  map[string]BranchEntry{"main": {Commit: com.ID, CommitCount: 1}},
+		Commits:   map[string]CommitEntry{com.ID: com},
+		DefBranch: "main",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/get" || r.URL.Query().Get("username") != "default" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("dbname") != "a.sqlite" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(meta)
+	}))
+	defer srv.Close()
+	cl := New(srv.URL, nil, "default")
+
+	// Known databases have their metadata returned
+	got, found, err := cl.Metadata(context.Background(), "a.sqlite")
+	c.Assert(err, chk.IsNil)
+	c.Check(found, chk.Equals, true)
+	c.Check(got.Branches, chk.DeepEquals, meta.Branches)
+	c.Check(got.Commits[com.ID].Tree.ID, chk.Equals, tree.ID)
+
+	// Unknown ones aren't an error
+	_, found, err = cl.Metadata(context.Background(), "b.sqlite")
+	c.Assert(err, chk.IsNil)
+	c.Check(found, chk.Equals, false)
+
+	// Merging the remote metadata with an older local copy brings in the new commit
+	var buf bytes.Buffer
+	cl.Logger.SetOutput(&buf)
+	newCom := CommitEntry{Parent: com.ID, Tree: tree, Timestamp: com.Timestamp.Add(time.Hour)}
+	newCom.ID = CommitID(newCom)
+	remote := MetaData{
+		Branches:  map[string]BranchEntry{"main": {Commit: newCom.ID, CommitCount: 2}},
+		Commits:   map[string]CommitEntry{com.ID: com, newCom.ID: newCom},
+		DefBranch: "main",
+	}
+	merged, err := cl.MergeMetadata(meta, remote, RemoteRefs{})
+	c.Assert(err, chk.IsNil)
+	c.Check(merged.Branches["main"].Commit, chk.Equals, newCom.ID)
+	c.Check(merged.Commits, chk.HasLen, 2)
+	c.Check(buf.String(), chk.Equals, "  * Remote branch 'main' has 1 new commit(s)... merged\n\n")
+}
+
+func (s *ClientSuite) TestMergeTags(c *chk.C) {
+	commits := map[string]CommitEntry{"a": {ID: "a"}, "b": {ID: "b"}}
+	base := map[string]TagEntry{"moved": {Commit: "a"}, "removed": {Commit: "a"}, "deleted": {Commit: "a"}}
+	local := map[string]TagEntry{"moved": {Commit: "a"}, "removed": {Commit: "a"}, "mine": {Commit: "b"}}
+	remote := map[string]TagEntry{"moved": {Commit: "b"}, "deleted": {Commit: "a"}, "theirs": {Commit: "b"},
+		"unknown": {Commit: "c"}}
+	cl := New("", nil, "default")
+	merged := cl.MergeTags(local, remote, base, commits)
+
+	// Tags moved on the server are updated, and ones removed on the server or deleted locally are left out.  New
+	// remote tags are only added when their commit is known
+	c.Check(merged, chk.DeepEquals, map[string]TagEntry{"mine": {Commit: "b"}, "moved": {Commit: "b"},
+		"theirs": {Commit: "b"}})
+}
+
+func (s *ClientSuite) TestDelta(c *chk.C) {
+	// Make deltas against a base of four 128 byte pages, checking their size and that the target can be rebuilt
+	base := bytes.Repeat([]byte("abcdefgh"), 64)
+	check := func(target []byte, wantLen int) {
+		var delta bytes.Buffer
+		n, err := WriteDelta(&delta, bytes.NewReader(base), bytes.NewReader(target), int64(len(target)), 128)
+		c.Assert(err, chk.IsNil)
+		c.Check(n, chk.Equals, int64(wantLen))
+		c.Check(delta.Len(), chk.Equals, wantLen)
+		var rebuilt bytes.Buffer
+		_, err = ApplyDelta(&rebuilt, bytes.NewReader(base), &delta)
+		c.Assert(err, chk.IsNil)
+		c.Check(rebuilt.Bytes(), chk.DeepEquals, target)
+	}
+	const header = 20
+
+	// An unchanged database needs just the header, and a change to one page needs only that page
+	check(base, header)
+	changed := append([]byte{}, base...)
+	changed[200] = 'z'
+	check(changed, header+8+128)
+
+	// Growing the database sends the new pages, including a partial last page.  Shrinking it sends nothing
+	grown := append(append([]byte{}, base...), bytes.Repeat([]byte("x"), 150)...)
+	check(grown, header+8+128+8+22)
+	check(base[:256], header)
+
+	// The size of the target has to be right
+	var delta bytes.Buffer
+	_, err := WriteDelta(&delta, bytes.NewReader(base), bytes.NewReader(base), 100, 128)
+	c.Check(err, chk.NotNil)
+
+	// Deltas which need pages the base doesn't have can't be applied
+	delta.Reset()
+	_, err = WriteDelta(&delta, bytes.NewReader(base), bytes.NewReader(grown), int64(len(grown)), 128)
+	c.Assert(err, chk.IsNil)
+	_, err = ApplyDelta(io.Discard, bytes.NewReader(base[:128]), &delta)
+	c.Check(err, chk.ErrorMatches, "Page 1 isn't in the database delta.*")
+}
+
+func (s *ClientSuite) TestTree(c *chk.C) {
+	// A tree for a single database is the same as one built by hand
+	db := DBTreeEntry{EntryType: DATABASE, Name: "a.sqlite", Sha256: "abc", Size: 10}
+	single := NewTree([]DBTreeEntry{db})
+	c.Check(single.Entries, chk.DeepEquals, []DBTreeEntry{db})
+	c.Check(single.ID, chk.Equals, TreeID([]DBTreeEntry{db}))
+
+	// Files in folders go into subtrees, whose sha256 covers their contents
+	readme := DBTreeEntry{EntryType: FILE, Name: "docs/README.md", Sha256: "def", Size: 5}
+	lookup := DBTreeEntry{EntryType: DATABASE, Name: "docs/data/lookup.sqlite", Sha256: "123", Size: 20}
+	tree := NewTree([]DBTreeEntry{readme, db, lookup})
+	c.Assert(tree.Entries, chk.HasLen, 2)
+	c.Check(tree.Entries[0], chk.DeepEquals, db)
+	docs := tree.Entries[1]
+	c.Check(docs.EntryType, chk.Equals, TREE)
+	c.Check(docs.Name, chk.Equals, "docs")
+	c.Check(docs.Sha256, chk.Equals, TreeID(docs.Entries))
+	c.Assert(docs.Entries, chk.HasLen, 2)
+	c.Check(docs.Entries[0].Name, chk.Equals, "README.md")
+	c.Check(docs.Entries[1].Name, chk.Equals, "data")
+	c.Check(tree.Files(), chk.DeepEquals, []DBTreeEntry{db, readme, lookup})
+
+	// Entries are found by their path, and the database by its name
+	e, ok := tree.Entry("docs/data/lookup.sqlite")
+	c.Check(ok, chk.Equals, true)
+	c.Check(e, chk.DeepEquals, lookup)
+	_, ok = tree.Entry("lookup.sqlite")
+	c.Check(ok, chk.Equals, false)
+	e, ok = tree.Database("a.sqlite")
+	c.Check(ok, chk.Equals, true)
+	c.Check(e, chk.DeepEquals, db)
+
+	// The only database at the top level is used when the name doesn't match, as the server names it itself
+	e, ok = single.Database("renamed.sqlite")
+	c.Check(ok, chk.Equals, true)
+	c.Check(e, chk.DeepEquals, db)
+	two := NewTree([]DBTreeEntry{db, {EntryType: DATABASE, Name: "b.sqlite"}})
+	_, ok = two.Database("renamed.sqlite")
+	c.Check(ok, chk.Equals, false)
+}
+
+func (s *ClientSuite) TestFolders(c *chk.C) {
+	cl := New("https://example.org", nil, "some user")
+
+	// Databases without a folder are at the top level
+	c.Check(cl.databaseURL("a.sqlite"), chk.Equals, "https://example.org/some%20user/a.sqlite")
+	c.Check(cl.databaseQuery("a.sqlite").Get("folder"), chk.Equals, "/")
+	c.Check(DatabasePath("", "a.sqlite"), chk.Equals, "/a.sqlite")
+
+	// Those in folders have them in both the URL and the query
+	db := DatabasePath("/finance/2024", "q 1.sqlite")
+	c.Check(db, chk.Equals, "/finance/2024/q 1.sqlite")
+	c.Check(cl.databaseURL(db), chk.Equals, "https://example.org/some%20user/finance/2024/q%201.sqlite")
+	query := cl.databaseQuery(db)
+	c.Check(query.Get("folder"), chk.Equals, "/finance/2024")
+	c.Check(query.Get("dbname"), chk.Equals, "q 1.sqlite")
+
+	// The database entry in a tree is found using just the database name
+	tree := NewTree([]DBTreeEntry{{EntryType: DATABASE, Name: "q 1.sqlite"}})
+	e, ok := tree.Database(db)
+	c.Check(ok, chk.Equals, true)
+	c.Check(e.Name, chk.Equals, "q 1.sqlite")
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by DownloadDatabase when the server sends a different part of the database than the one asked for
+var ErrBadResume = errors.New("The server didn't resume the download from the right place.  Please try again")
+
+// Retrieves the list of databases available to the user
+func (c *Client) Databases(ctx context.Context) (dbList []DBListEntry, err error) {
+	status, _, body, err := c.get(ctx, "/"+url.PathEscape(c.User), nil)
+	if err != nil {
+		err = fmt.Errorf("Errors when retrieving the database list: %w", err)
+		return
+	}
+	if status != http.StatusOK {
+		err = fmt.Errorf("Retrieving the database list failed with an error: HTTP status %d - '%v'", status,
+			http.StatusText(status))
+		return
+	}
+	err = json.Unmarshal(body, &dbList)
+	if err != nil {
+		err = fmt.Errorf("Error retrieving database list: '%v'", err)
+	}
+	return
+}
+
+// Starts downloading a database, from either the head of a branch or a specific commit.  When offset is greater than
+// zero, only the part of the database from there onwards is requested.  Servers which don't support that send the
+// whole database instead, which is indicated by the Offset of the returned download being zero
+func (c *Client) DownloadDatabase(ctx context.Context, db, branch, commit string, offset int64) (d *Download,
+	err error) {
+	query := url.Values{}
+	if branch != "" {
+		query.Set("branch", branch)
+	} else {
+		query.Set("commit", commit)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, c.databaseURL(db), query, nil)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("Error when downloading database: %w", err)
+		return
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			err = ErrBadResume
+			return
+		}
+	case http.StatusOK:
+		offset = 0
+	case http.StatusNotFound:
+		resp.Body.Close()
+		if branch != "" {
+			err = fmt.Errorf("That database & branch '%s' aren't known on DBHub.io", branch)
+			return
+		}
+		if commit != "" {
+			err = fmt.Errorf("Requested database not found with commit %s.", commit)
+			return
+		}
+		err = errors.New("Requested database not found")
+		return
+	default:
+		resp.Body.Close()
+		err = fmt.Errorf("Download failed with an error: HTTP status %d - '%v'", resp.StatusCode, resp.Status)
+		return
+	}
+	d = &Download{
+		Body:   resp.Body,
+		Header: resp.Header,
+		Offset: offset,
+		Size:   -1,
+	}
+	if resp.ContentLength >= 0 {
+		d.Size = offset + resp.ContentLength
+	}
+	return
+}
+
+// Sends a commit to the server, along with its database.  If the upload fails part way through, the server may have
+// received it anyway, so its metadata is checked before retrying
+func (c *Client) SendCommit(ctx context.Context, db string, commit CommitEntry, opts CommitOptions,
+	r io.ReadSeeker, size int64) (err error) {
+	return c.sendCommitBody(ctx, db, commit, commitQuery(db, commit, opts), r, size)
+}
+
+// Uploads the body of a commit, which is either the whole database or a delta
+func (c *Client) sendCommitBody(ctx context.Context, db string, commit CommitEntry, query url.Values, r io.ReadSeeker,
+	size int64) (err error) {
+	acknowledged := func() bool {
+		remoteMeta, found, err := c.Metadata(ctx, db)
+		if err != nil || !found {
+			return false
+		}
+		_, ok := remoteMeta.Commits[commit.ID]
+		return ok
+	}
+	body, acked, err := c.UploadDatabase(ctx, db, query, r, size, acknowledged)
+	if err != nil {
+		return err
+	}
+	if acked {
+		// The server already has the commit, so there's nothing more to check
+		return
+	}
+
+	// Check that the ID for the new commit as generated by the server matches the ID generated locally
+	parsedResponse := map[string]string{}
+	err = json.Unmarshal(body, &parsedResponse)
+	if err != nil {
+		return fmt.Errorf("Error parsing server response: '%v'", err)
+	}
+	remoteCommitID, ok := parsedResponse["commit_id"]
+	if !ok {
+		return errors.New("Unexpected response from server, doesn't contain new commit ID.")
+	}
+	if remoteCommitID != commit.ID {
+		return fmt.Errorf("Error.  The Commit ID generated on the server (%s) doesn't match the "+
+			"local Commit ID (%s)", remoteCommitID, commit.ID)
+	}
+	return
+}
+
+// Uploads a database to the server, streaming it with the given details in the query string.  Network errors and
+// server side (5xx) errors are retried with an increasing delay between attempts.  Before each retry, the
+// acknowledged function (if given) is called to check whether the server received the upload anyway, in which case
+// acked is returned as true instead of sending it again
+func (c *Client) UploadDatabase(ctx context.Context, db string, query url.Values, r io.ReadSeeker, size int64,
+	acknowledged func() bool) (body []byte, acked bool, err error) {
+	delay := c.UploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		var status int
+		status, body, err = c.uploadDatabaseOnce(ctx, db, query, r, size)
+		if err == nil && status == http.StatusCreated {
+			return
+		}
+		if err == nil && status < http.StatusInternalServerError {
+			// The server rejected the upload, so there's no point trying again
+			err = &UploadError{Body: body, Status: status}
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("Upload failed with a server error: HTTP status %d - '%s'", status, body)
+		}
+		if attempt >= c.UploadAttempts || ctx.Err() != nil {
+			return
+		}
+		c.Logger.Printf("  * %s.  Retrying in %v...", err, delay)
+		select {
+		case <-ctx.Done():
+			return body, false, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if acknowledged != nil && acknowledged() {
+			return nil, true, nil
+		}
+	}
+}
+
+// Generates the query string for sending a commit of a database to the server
+func commitQuery(db string, commit CommitEntry, opts CommitOptions) url.Values {
+	entry, _ := commit.Tree.Database(db)
+	query := url.Values{}
+	query.Set("authoremail", commit.AuthorEmail)
+	query.Set("authorname", commit.AuthorName)
+	query.Set("branch", opts.Branch)
+	query.Set("commit", commit.Parent)
+	query.Set("commitmsg", commit.Message)
+	query.Set("committeremail", commit.CommitterEmail)
+	query.Set("committername", commit.CommitterName)
+	query.Set("committimestamp", commit.Timestamp.UTC().Format(time.RFC3339))
+	query.Set("dbshasum", entry.Sha256)
+	query.Set("force", strconv.FormatBool(opts.Force))
+	query.Set("lastmodified", entry.LastModified.UTC().Format(time.RFC3339))
+	query.Set("otherparents", strings.Join(commit.OtherParents, ","))
+	query.Set("public", strconv.FormatBool(opts.Public))
+	if opts.Licence != "" {
+		query.Set("licence", opts.Licence)
+	}
+	return query
+}
+
+// Makes a single attempt at uploading a database, returning the HTTP status code and response body
+func (c *Client) uploadDatabaseOnce(ctx context.Context, db string, query url.Values, r io.ReadSeeker,
+	size int64) (status int, body []byte, err error) {
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	// Generate the multipart headers and trailer up front, so the database itself can be streamed between them
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	_, err = mw.CreateFormFile("file1", filepath.Base(db))
+	if err != nil {
+		return
+	}
+	headLen := head.Len()
+	err = mw.Close()
+	if err != nil {
+		return
+	}
+	trailer := head.Bytes()[headLen:]
+	var src io.Reader = r
+	if c.NewProgress != nil {
+		bar := c.NewProgress(fmt.Sprintf("Uploading %s", db), size)
+		defer bar.Finish()
+		src = io.TeeReader(r, bar)
+	}
+	reqBody := io.MultiReader(bytes.NewReader(head.Bytes()[:headLen]), io.LimitReader(src, size),
+		bytes.NewReader(trailer))
+
+	req, err := c.newRequest(ctx, http.MethodPost, c.databaseURL(db), query, reqBody)
+	if err != nil {
+		return
+	}
+	req.ContentLength = int64(headLen) + size + int64(len(trailer))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	status, _, body, err = c.send(req)
+	return
+}
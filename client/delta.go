@@ -0,0 +1,220 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// The delta format sent by SendCommitDelta.  A delta holds the pages of a database which differ from an earlier
+// version of it (the base), so the server can rebuild the new version from its copy of the base:
+//
+//	"DIOPAGE1"                 8 byte magic string
+//	page size                  uint32, big endian
+//	database size              uint64, big endian, the size of the new version
+//	changed pages              each being its page number (uint64, big endian) followed by the page
+//
+// Changed pages are in ascending order.  Every page is the page size long, apart from the last page of the database
+// which can be shorter.  Pages which aren't in the delta are copied from the base, and anything in the base past the
+// end of the new version is dropped
+const DeltaFormat = "pages"
+
+// Returned by SendCommitDelta when the server couldn't use the delta, eg because it doesn't have the base
+var ErrDeltaRejected = errors.New("The server couldn't apply the changes to its copy of the database")
+
+var deltaMagic = []byte("DIOPAGE1")
+
+// Counts the bytes written through it, remembering the first error so it only needs checking once
+type countingWriter struct {
+	err error
+	n   int64
+	w   io.Writer
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// Rebuilds a database from a delta and the base it was made against, writing the result to w
+func ApplyDelta(w io.Writer, base io.ReaderAt, delta io.Reader) (n int64, err error) {
+	br := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	_, err = io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, deltaMagic) {
+		return 0, errors.New("Not a database delta")
+	}
+	var pageSize uint32
+	var size, next uint64
+	err = binary.Read(br, binary.BigEndian, &pageSize)
+	if err == nil {
+		err = binary.Read(br, binary.BigEndian, &size)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("The database delta header is damaged: %v", err)
+	}
+	if pageSize == 0 {
+		return 0, errors.New("The database delta has a page size of zero")
+	}
+
+	// Read the number of the first changed page, if there is one
+	readNext := func() (more bool, err error) {
+		err = binary.Read(br, binary.BigEndian, &next)
+		if err == io.EOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	more, err := readNext()
+	if err != nil {
+		return
+	}
+
+	// Write each page of the new version in turn, from either the delta or the base
+	page := make([]byte, pageSize)
+	numPages := (size + uint64(pageSize) - 1) / uint64(pageSize)
+	for i := uint64(0); i < numPages; i++ {
+		p := page
+		if remaining := size - i*uint64(pageSize); remaining < uint64(pageSize) {
+			p = page[:remaining]
+		}
+		if more && next < i {
+			return n, errors.New("The pages in the database delta are out of order")
+		}
+		if more && next == i {
+			_, err = io.ReadFull(br, p)
+			if err != nil {
+				return n, fmt.Errorf("Page %d in the database delta is incomplete", i)
+			}
+			more, err = readNext()
+			if err != nil {
+				return
+			}
+		} else {
+			_, err = base.ReadAt(p, int64(i)*int64(pageSize))
+			if err != nil {
+				return n, fmt.Errorf("Page %d isn't in the database delta, and couldn't be read from the base: %v",
+					i, err)
+			}
+		}
+		var written int
+		written, err = w.Write(p)
+		n += int64(written)
+		if err != nil {
+			return
+		}
+	}
+	if more {
+		return n, fmt.Errorf("The database delta has page %d, which is past the end of the database", next)
+	}
+	return
+}
+
+// Returns true if the server accepts uploads in the given delta format.  Servers which don't list the formats they
+// accept are taken to accept none.  The answer is remembered for the life of the client
+func (c *Client) SupportsDelta(ctx context.Context, format string) (bool, error) {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	if c.caps == nil {
+		status, _, body, err := c.get(ctx, "/capabilities", nil)
+		if err != nil {
+			return false, fmt.Errorf("Error when checking the server capabilities: %w", err)
+		}
+		var caps Capabilities
+		if status == http.StatusOK {
+			err = json.Unmarshal(body, &caps)
+			if err != nil {
+				return false, fmt.Errorf("Error parsing the server capabilities: '%v'", err)
+			}
+		}
+		c.caps = &caps
+	}
+	for _, f := range c.caps.DeltaFormats {
+		if f == format {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Sends a commit to the server as a delta against the database of an earlier commit (usually its parent), which the
+// server must already have.  If the server can't use the delta, ErrDeltaRejected is returned so the whole database can
+// be sent with SendCommit instead
+func (c *Client) SendCommitDelta(ctx context.Context, db string, commit CommitEntry, opts CommitOptions,
+	baseSha string, delta io.ReadSeeker, size int64) error {
+	query := commitQuery(db, commit, opts)
+	query.Set("delta", DeltaFormat)
+	query.Set("deltabase", baseSha)
+	err := c.sendCommitBody(ctx, db, commit, query, delta, size)
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) && uploadErr.Status == http.StatusPreconditionFailed {
+		return ErrDeltaRejected
+	}
+	return err
+}
+
+// Writes a delta holding the pages of target which differ from base.  Both are read from start to finish just once
+func WriteDelta(w io.Writer, base, target io.Reader, targetSize, pageSize int64) (n int64, err error) {
+	if pageSize <= 0 || pageSize > 1<<16 {
+		return 0, fmt.Errorf("Unsupported page size: %d", pageSize)
+	}
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	cw.Write(deltaMagic)
+	binary.Write(cw, binary.BigEndian, uint32(pageSize))
+	binary.Write(cw, binary.BigEndian, uint64(targetSize))
+
+	// Compare each page of the target with the same page of the base, writing out the ones which differ
+	basePage := make([]byte, pageSize)
+	targetPage := make([]byte, pageSize)
+	baseDone := false
+	var read int64
+	for i := uint64(0); ; i++ {
+		var tn, bn int
+		tn, err = io.ReadFull(target, targetPage)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return cw.n, err
+		}
+		read += int64(tn)
+		if !baseDone {
+			bn, err = io.ReadFull(base, basePage)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				baseDone = true
+			} else if err != nil {
+				return cw.n, err
+			}
+		}
+		if bn != tn || !bytes.Equal(basePage[:bn], targetPage[:tn]) {
+			binary.Write(cw, binary.BigEndian, i)
+			cw.Write(targetPage[:tn])
+		}
+		if cw.err != nil {
+			return cw.n, cw.err
+		}
+		if tn < len(targetPage) {
+			break
+		}
+	}
+	if read != targetSize {
+		return cw.n, fmt.Errorf("The database is %d bytes rather than the expected %d.  Did it change while the "+
+			"delta was being made?", read, targetSize)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// Adds a licence to the list of known licences on the server.  The licence text is read from r, and name is the file
+// name it's uploaded with
+func (c *Client) AddLicence(ctx context.Context, id string, opts LicenceOptions, name string, r io.Reader) error {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file1", filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	if err != nil {
+		return err
+	}
+	err = mw.Close()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("display_order", strconv.Itoa(opts.DisplayOrder))
+	query.Set("licence_id", id)
+	if opts.FileFormat != "" {
+		query.Set("file_format", opts.FileFormat)
+	}
+	if opts.FullName != "" {
+		query.Set("licence_name", opts.FullName)
+	}
+	if opts.URL != "" {
+		query.Set("source_url", opts.URL)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, c.BaseURL+"/licence/add", query, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	status, _, body, err := c.send(req)
+	if err != nil {
+		return fmt.Errorf("Error when adding licence: %w", err)
+	}
+	if status == http.StatusConflict {
+		return errors.New(string(body))
+	}
+	if status != http.StatusCreated {
+		return fmt.Errorf("Adding licence failed with an error: HTTP status %d - '%v'", status,
+			http.StatusText(status))
+	}
+	return nil
+}
+
+// Retrieves the text of a licence.  The html return value is true when the text is HTML rather than plain text
+func (c *Client) LicenceText(ctx context.Context, id string) (text []byte, html bool, err error) {
+	query := url.Values{}
+	query.Set("licence", id)
+	status, header, body, err := c.get(ctx, "/licence/get", query)
+	if err != nil {
+		err = fmt.Errorf("Error when downloading licence text: %w", err)
+		return
+	}
+	if status == http.StatusNotFound {
+		err = errors.New("Requested licence not found")
+		return
+	}
+	if status != http.StatusOK {
+		err = fmt.Errorf("Download failed with an error: HTTP status %d - '%v'", status, http.StatusText(status))
+		return
+	}
+	return body, header.Get("Content-Type") == "text/html", nil
+}
+
+// Returns the list of licences known to the server
+func (c *Client) Licences(ctx context.Context) (list map[string]LicenceEntry, err error) {
+	status, _, body, err := c.get(ctx, "/licence/list", nil)
+	if err != nil {
+		err = fmt.Errorf("errors when retrieving the licence list: %w", err)
+		return
+	}
+	if status != http.StatusOK {
+		err = fmt.Errorf("retrieving the licence list failed with an error: HTTP status %d - '%v'", status,
+			http.StatusText(status))
+		return
+	}
+
+	// Convert the JSON response to our licence entry structure
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		err = fmt.Errorf("error retrieving licence list: '%v'", err)
+	}
+	return
+}
+
+// Removes a licence from the list of known licences on the server
+func (c *Client) RemoveLicence(ctx context.Context, id string) error {
+	query := url.Values{}
+	query.Set("licence_id", id)
+	req, err := c.newRequest(ctx, http.MethodPost, c.BaseURL+"/licence/remove", query, nil)
+	if err != nil {
+		return err
+	}
+	status, _, body, err := c.send(req)
+	if err != nil {
+		return fmt.Errorf("Error when removing licence: %w", err)
+	}
+	if status != http.StatusOK {
+		return errors.New(string(body))
+	}
+	return nil
+}
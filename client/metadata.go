@@ -0,0 +1,254 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Generates a stable SHA256 for a commit
+func CommitID(c CommitEntry) string {
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("tree %s\n", c.Tree.ID))
+	if c.Parent != "" {
+		b.WriteString(fmt.Sprintf("parent %s\n", c.Parent))
+	}
+	for _, j := range c.OtherParents {
+		b.WriteString(fmt.Sprintf("parent %s\n", j))
+	}
+	b.WriteString(fmt.Sprintf("author %s <%s> %v\n", c.AuthorName, c.AuthorEmail,
+		c.Timestamp.UTC().Format(time.UnixDate)))
+	if c.CommitterEmail != "" {
+		b.WriteString(fmt.Sprintf("committer %s <%s> %v\n", c.CommitterName, c.CommitterEmail,
+			c.Timestamp.UTC().Format(time.UnixDate)))
+	}
+	b.WriteString("\n" + c.Message)
+	b.WriteByte(0)
+	s := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(s[:])
+}
+
+// Merges the local metadata for a database with the metadata from the server.  base holds the tags and releases on
+// the server as of the last fetch, and the differences found are sent to the logger
+func (c *Client) MergeMetadata(origMeta MetaData, newMeta MetaData, base RemoteRefs) (mergedMeta MetaData,
+	err error) {
+	mergedMeta.Branches = make(map[string]BranchEntry)
+	mergedMeta.Commits = make(map[string]CommitEntry)
+	mergedMeta.Tags = make(map[string]TagEntry)
+	mergedMeta.Releases = make(map[string]ReleaseEntry)
+	if len(origMeta.Commits) > 0 {
+		// Start by check branches which exist locally
+		// TODO: Change sort order to be by alphabetical branch name, as the current unordered approach leads to
+		//       inconsistent output across runs
+		for brName, brData := range origMeta.Branches {
+			matchFound := false
+			for newBranch, newData := range newMeta.Branches {
+				if brName == newBranch {
+					// A branch with this name exists on both the local and remote server
+					matchFound = true
+					skipFurtherChecks := false
+
+					// Rewind back to the local root commit, making a list of the local commits IDs we pass through
+					var localList []string
+					localCommit := origMeta.Commits[brData.Commit]
+					localList = append(localList, localCommit.ID)
+					for localCommit.Parent != "" {
+						localCommit = origMeta.Commits[localCommit.Parent]
+						localList = append(localList, localCommit.ID)
+					}
+					localLength := len(localList) - 1
+
+					// Rewind back to the remote root commit, making a list of the remote commit IDs we pass through
+					var remoteList []string
+					remoteCommit := newMeta.Commits[newData.Commit]
+					remoteList = append(remoteList, remoteCommit.ID)
+					for remoteCommit.Parent != "" {
+						remoteCommit = newMeta.Commits[remoteCommit.Parent]
+						remoteList = append(remoteList, remoteCommit.ID)
+					}
+					remoteLength := len(remoteList) - 1
+
+					// Make sure the local and remote commits start out with the same commit ID
+					if localCommit.ID != remoteCommit.ID {
+						// The local and remote branches don't have a common root, so abort
+						err = errors.New(fmt.Sprintf("Local and remote branch %s don't have a common root.  "+
+							"Aborting.", brName))
+						return
+					}
+
+					// If there are more commits in the local branch than in the remote one, we keep the local branch
+					// as it probably means the user is adding stuff locally (prior to pushing to the server)
+					if localLength > remoteLength {
+						localCommit := origMeta.Commits[brData.Commit]
+						mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+						for localCommit.Parent != "" {
+							localCommit = origMeta.Commits[localCommit.Parent]
+							mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+						}
+
+						// Copy the local branch data
+						mergedMeta.Branches[brName] = brData
+					}
+
+					// We've wound back to the root commit for both the local and remote branch, and the root commit
+					// IDs match.  Now we walk forwards through the commits, comparing them.
+					branchesSame := true
+					for i := 0; i <= localLength; i++ {
+						lCommit := localList[localLength-i]
+						if i > remoteLength {
+							branchesSame = false
+						} else {
+							if lCommit != remoteList[remoteLength-i] {
+								// There are conflicting commits in this branch between the local metadata and the
+								// remote.  This will probably need to be resolved by user action.
+								branchesSame = false
+							}
+						}
+					}
+
+					// If the local branch commits are in the remote branch already, then we only need to check for
+					// newer commits in the remote branch
+					if branchesSame {
+						if remoteLength > localLength {
+							c.Logger.Printf("  * Remote branch '%s' has %d new commit(s)... merged\n",
+								brName, remoteLength-localLength)
+							for _, j := range remoteList {
+								mergedMeta.Commits[j] = newMeta.Commits[j]
+							}
+							mergedMeta.Branches[brName] = newMeta.Branches[brName]
+						} else {
+							// The local and remote branches are the same, so copy the local branch commits across to
+							// the merged data structure
+							c.Logger.Printf("  * Branch '%s' is unchanged\n", brName)
+							for _, j := range localList {
+								mergedMeta.Commits[j] = origMeta.Commits[j]
+							}
+							mergedMeta.Branches[brName] = brData
+						}
+						// No need to do further checks on this branch
+						skipFurtherChecks = true
+					}
+
+					if skipFurtherChecks == false && brData.Commit != newData.Commit {
+						c.Logger.Printf("  * Branch '%s' has local changes, not on the server\n",
+							brName)
+
+						// Copy across the commits from the local branch
+						localCommit := origMeta.Commits[brData.Commit]
+						mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+						for localCommit.Parent != "" {
+							localCommit = origMeta.Commits[localCommit.Parent]
+							mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+						}
+
+						// Copy across the branch data entry for the local branch
+						mergedMeta.Branches[brName] = brData
+					}
+					if skipFurtherChecks == false && brData.Description != newData.Description {
+						c.Logger.Printf("  * Description for branch %s differs between the local "+
+							"and remote\n"+
+							"    * Local: '%s'\n"+
+							"    * Remote: '%s'\n", brName, brData.Description, newData.Description)
+					}
+				}
+			}
+			if !matchFound {
+				// This seems to be a branch that's not on the server, so we keep it as-is
+				c.Logger.Printf("  * Branch '%s' is local only, not on the server\n", brName)
+				mergedMeta.Branches[brName] = brData
+
+				// Copy across the commits from the local branch
+				localCommit := origMeta.Commits[brData.Commit]
+				mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+				for localCommit.Parent != "" {
+					localCommit = origMeta.Commits[localCommit.Parent]
+					mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
+				}
+
+				// Copy across the branch data entry for the local branch
+				mergedMeta.Branches[brName] = brData
+			}
+		}
+
+		// Add new branches
+		for remoteName, remoteData := range newMeta.Branches {
+			if _, ok := origMeta.Branches[remoteName]; ok == false {
+				// Copy their commit data
+				newCommit := newMeta.Commits[remoteData.Commit]
+				mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
+				for newCommit.Parent != "" {
+					newCommit = newMeta.Commits[newCommit.Parent]
+					mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
+				}
+
+				// Copy their branch data
+				mergedMeta.Branches[remoteName] = remoteData
+
+				c.Logger.Printf("  * New remote branch '%s' merged\n", remoteName)
+			}
+		}
+
+		// Merge the tags and releases, including any which have been removed on the server
+		mergedMeta.Tags = c.MergeTags(origMeta.Tags, newMeta.Tags, base.Tags, mergedMeta.Commits)
+		mergedMeta.Releases = c.MergeReleases(origMeta.Releases, newMeta.Releases, base.Releases, mergedMeta.Commits)
+
+		// Copy the default branch name from the remote server
+		mergedMeta.DefBranch = newMeta.DefBranch
+
+		c.Logger.Println()
+	} else {
+		// No existing metadata, so just copy across the remote metadata
+		mergedMeta = newMeta
+	}
+	return
+}
+
+// Retrieves the metadata for a database of the user.  If the database isn't on the server, found is returned as false
+func (c *Client) Metadata(ctx context.Context, db string) (meta MetaData, found bool, err error) {
+	status, _, body, err := c.get(ctx, "/metadata/get", c.databaseQuery(db))
+	if err != nil {
+		err = fmt.Errorf("Error when downloading database metadata: %w", err)
+		return
+	}
+	if status == http.StatusNotFound {
+		return
+	}
+	if status != http.StatusOK {
+		err = fmt.Errorf("Metadata download failed with an error: HTTP status %d - '%v'", status,
+			http.StatusText(status))
+		return
+	}
+	err = json.Unmarshal(body, &meta)
+	if err != nil {
+		return
+	}
+	return meta, true, nil
+}
+
+// Generates the SHA256 for a tree.
+// Tree entry structure is:
+// * [ entry type ] [ licence sha256] [ file sha256 ] [ file name ] [ last modified (timestamp) ] [ file size (bytes) ]
+func TreeID(entries []DBTreeEntry) string {
+	var b bytes.Buffer
+	for _, j := range entries {
+		b.WriteString(string(j.EntryType))
+		b.WriteByte(0)
+		b.WriteString(string(j.LicenceSHA))
+		b.WriteByte(0)
+		b.WriteString(j.Sha256)
+		b.WriteByte(0)
+		b.WriteString(j.Name)
+		b.WriteByte(0)
+		b.WriteString(j.LastModified.Format(time.RFC3339))
+		b.WriteByte(0)
+		b.WriteString(fmt.Sprintf("%d\n", j.Size))
+	}
+	s := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(s[:])
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Creates a release for a database on the server.  The commit it points to needs to be on the server already
+func (c *Client) CreateRelease(ctx context.Context, db, name string, rel ReleaseEntry) error {
+	query := c.databaseQuery(db)
+	query.Set("commit", rel.Commit)
+	query.Set("date", rel.Date.UTC().Format(time.RFC3339))
+	query.Set("email", rel.ReleaserEmail)
+	query.Set("msg", rel.Description)
+	query.Set("name", rel.ReleaserName)
+	query.Set("release", name)
+	query.Set("size", strconv.FormatInt(rel.Size, 10))
+	status, body, err := c.post(ctx, "/release/create", query)
+	return refResult("Creating release", status, http.StatusCreated, body, err)
+}
+
+// Merges the releases from the server into the local ones, in the same way as MergeTags()
+func (c *Client) MergeReleases(local, remote, base map[string]ReleaseEntry,
+	commits map[string]CommitEntry) map[string]ReleaseEntry {
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]ReleaseEntry)
+	for _, name := range names {
+		l, inLocal := local[name]
+		r, inRemote := remote[name]
+		b, inBase := base[name]
+		switch {
+		case inLocal && inRemote && l.Commit != r.Commit:
+			if inBase && b.Commit == l.Commit {
+				c.Logger.Printf("  * Release '%s' was moved on the server... updated\n", name)
+				merged[name] = r
+				continue
+			}
+			c.Logger.Printf("  * Release '%s' conflicts: it points to commit %s locally, but %s on the server.  "+
+				"Keeping the local one\n", name, l.Commit, r.Commit)
+			merged[name] = l
+		case inLocal && !inRemote && inBase && b.Commit == l.Commit:
+			c.Logger.Printf("  * Release '%s' was removed on the server... removed\n", name)
+		case inLocal:
+			merged[name] = l
+		case inRemote && !inBase:
+			if _, ok := commits[r.Commit]; ok {
+				c.Logger.Printf("  * New release '%s' merged\n", name)
+				merged[name] = r
+			}
+		}
+	}
+	return merged
+}
+
+// Removes a release for a database on the server
+func (c *Client) RemoveRelease(ctx context.Context, db, name string) error {
+	query := c.databaseQuery(db)
+	query.Set("release", name)
+	status, body, err := c.post(ctx, "/release/remove", query)
+	return refResult("Removing release", status, http.StatusOK, body, err)
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned (wrapped) by the tag and release functions when the server has a different tag or release of the same name
+var ErrConflict = errors.New("The server has a different one with the same name")
+
+// Creates a tag for a database on the server.  The commit it points to needs to be on the server already
+func (c *Client) CreateTag(ctx context.Context, db, name string, tag TagEntry) error {
+	query := c.databaseQuery(db)
+	query.Set("commit", tag.Commit)
+	query.Set("date", tag.Date.UTC().Format(time.RFC3339))
+	query.Set("email", tag.TaggerEmail)
+	query.Set("msg", tag.Description)
+	query.Set("name", tag.TaggerName)
+	query.Set("tag", name)
+	status, body, err := c.post(ctx, "/tag/create", query)
+	return refResult("Creating tag", status, http.StatusCreated, body, err)
+}
+
+// Merges the tags from the server into the local ones.  The tags from the server as of the last fetch (base) are used
+// to tell apart tags which are new on one side from those which were deleted on the other.  Tags changed on both sides
+// are reported as conflicts, with the local one being kept.  Tags for commits which aren't known are skipped
+func (c *Client) MergeTags(local, remote, base map[string]TagEntry,
+	commits map[string]CommitEntry) map[string]TagEntry {
+	var names []string
+	for name := range local {
+		names = append(names, name)
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]TagEntry)
+	for _, name := range names {
+		l, inLocal := local[name]
+		r, inRemote := remote[name]
+		b, inBase := base[name]
+		switch {
+		case inLocal && inRemote && l.Commit != r.Commit:
+			if inBase && b.Commit == l.Commit {
+				c.Logger.Printf("  * Tag '%s' was moved on the server... updated\n", name)
+				merged[name] = r
+				continue
+			}
+			c.Logger.Printf("  * Tag '%s' conflicts: it points to commit %s locally, but %s on the server.  "+
+				"Keeping the local one\n", name, l.Commit, r.Commit)
+			merged[name] = l
+		case inLocal && !inRemote && inBase && b.Commit == l.Commit:
+			c.Logger.Printf("  * Tag '%s' was removed on the server... removed\n", name)
+		case inLocal:
+			merged[name] = l
+		case inRemote && !inBase:
+			if _, ok := commits[r.Commit]; ok {
+				c.Logger.Printf("  * New tag '%s' merged\n", name)
+				merged[name] = r
+			}
+		}
+		// Tags which are on the server and were there at the last fetch, but aren't local, have been removed
+		// locally.  That's sent to the server by pushing the tags, so they're left out here
+	}
+	return merged
+}
+
+// Removes a tag for a database on the server
+func (c *Client) RemoveTag(ctx context.Context, db, name string) error {
+	query := c.databaseQuery(db)
+	query.Set("tag", name)
+	status, body, err := c.post(ctx, "/tag/remove", query)
+	return refResult("Removing tag", status, http.StatusOK, body, err)
+}
+
+// Turns the response from a tag or release request into an error, if it wasn't successful
+func refResult(action string, status, want int, body []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", action, err)
+	}
+	switch status {
+	case want:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s", ErrConflict, strings.TrimSpace(string(body)))
+	}
+	return fmt.Errorf("%s failed with an error: HTTP status %d - '%s'", action, status,
+		strings.TrimSpace(string(body)))
+}
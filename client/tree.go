@@ -0,0 +1,102 @@
+package client
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Commit trees can hold several files: the database itself, other databases versioned along with it, and attachments
+// such as a licence or README.  Files in folders are held in subtrees, being TREE entries with the folder contents in
+// their Entries.  The sha256 of a subtree is the tree ID of its contents, so the ID of the top level tree covers every
+// file
+
+// Returns the entry for a database in a tree.  Databases are at the top level of their trees, named after their file
+// (so a database in a folder has the same entry as on the server).  If there's no database entry with that name, the
+// only database entry at the top level of the tree is used instead, as commits created by the server name it after the
+// database on the server (which can differ from the local name)
+func (t DBTree) Database(name string) (DBTreeEntry, bool) {
+	var found []DBTreeEntry
+	for _, e := range t.Entries {
+		if e.EntryType != DATABASE {
+			continue
+		}
+		if e.Name == name || e.Name == path.Base(name) {
+			return e, true
+		}
+		found = append(found, e)
+	}
+	if len(found) == 1 {
+		return found[0], true
+	}
+	return DBTreeEntry{}, false
+}
+
+// Returns the entry for a file in a tree, using its path (eg "data/lookup.sqlite")
+func (t DBTree) Entry(filePath string) (DBTreeEntry, bool) {
+	for _, e := range t.Files() {
+		if e.Name == filePath {
+			return e, true
+		}
+	}
+	return DBTreeEntry{}, false
+}
+
+// Returns every file in a tree, including those in subtrees, ordered by path.  The name of each entry is its full path
+func (t DBTree) Files() []DBTreeEntry {
+	var files []DBTreeEntry
+	var walk func(dir string, entries []DBTreeEntry)
+	walk = func(dir string, entries []DBTreeEntry) {
+		for _, e := range entries {
+			e.Name = path.Join(dir, e.Name)
+			if e.EntryType == TREE {
+				walk(e.Name, e.Entries)
+				continue
+			}
+			e.Entries = nil
+			files = append(files, e)
+		}
+	}
+	walk("", t.Entries)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// Builds a tree from a list of files, with the name of each being its path in the tree (eg "data/lookup.sqlite").
+// Files in folders are put into subtrees.  A tree for a single file is the same as the trees created by the server
+func NewTree(files []DBTreeEntry) DBTree {
+	var t DBTree
+	t.Entries = treeEntries(files)
+	t.ID = TreeID(t.Entries)
+	return t
+}
+
+// Returns the entries for one level of a tree, putting the files in folders into subtrees
+func treeEntries(files []DBTreeEntry) []DBTreeEntry {
+	var entries []DBTreeEntry
+	folders := make(map[string][]DBTreeEntry)
+	for _, f := range files {
+		dir, rest, inFolder := strings.Cut(f.Name, "/")
+		if !inFolder {
+			entries = append(entries, f)
+			continue
+		}
+		f.Name = rest
+		folders[dir] = append(folders[dir], f)
+	}
+	for dir, contents := range folders {
+		sub := treeEntries(contents)
+		entries = append(entries, DBTreeEntry{
+			Entries:   sub,
+			EntryType: TREE,
+			Name:      dir,
+			Sha256:    TreeID(sub),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type BranchEntry struct {
+	Commit      string `json:"commit"`
+	CommitCount int    `json:"commit_count"`
+	Description string `json:"description"`
+}
+
+// What a server supports beyond the basics.  Servers which don't say are taken to support none of it
+type Capabilities struct {
+	DeltaFormats []string `json:"delta_formats"` // The formats accepted by SendCommitDelta, eg "pages"
+}
+
+type CommitEntry struct {
+	AuthorEmail    string    `json:"author_email"`
+	AuthorName     string    `json:"author_name"`
+	CommitterEmail string    `json:"committer_email"`
+	CommitterName  string    `json:"committer_name"`
+	ID             string    `json:"id"`
+	Message        string    `json:"message"`
+	OtherParents   []string  `json:"other_parents"`
+	Parent         string    `json:"parent"`
+	Timestamp      time.Time `json:"timestamp"`
+	Tree           DBTree    `json:"tree"`
+}
+
+// Details of a commit being sent to the server, other than those in the commit itself
+type CommitOptions struct {
+	Branch  string
+	Force   bool // Rewind the remote branch to the parent of the commit first
+	Licence string
+	Public  bool
+}
+
+type DBListEntry struct {
+	CommitID     string `json:"commit_id"`
+	DefBranch    string `json:"default_branch"`
+	Folder       string `json:"folder,omitempty"` // Servers without folder support leave this out
+	LastModified string `json:"last_modified"`
+	Licence      string `json:"licence"`
+	Name         string `json:"name"`
+	OneLineDesc  string `json:"one_line_description"`
+	Public       bool   `json:"public"`
+	RepoModified string `json:"repo_modified"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+	Type         string `json:"type"`
+	URL          string `json:"url"`
+}
+
+type DBTreeEntryType string
+
+const (
+	TREE     DBTreeEntryType = "tree"
+	DATABASE                 = "db"
+	FILE                     = "file" // Any other file, eg a README
+	LICENCE                  = "licence"
+)
+
+type DBTree struct {
+	ID      string        `json:"id"`
+	Entries []DBTreeEntry `json:"entries"`
+}
+type DBTreeEntry struct {
+	Entries      []DBTreeEntry   `json:"entries,omitempty"` // The contents of a folder, for TREE entries
+	EntryType    DBTreeEntryType `json:"entry_type"`
+	LastModified time.Time       `json:"last_modified"`
+	LicenceSHA   string          `json:"licence"`
+	Name         string          `json:"name"`
+	Sha256       string          `json:"sha256"`
+	Size         int64           `json:"size"`
+}
+
+// A database download in progress.  The caller needs to close the body once it's finished with it
+type Download struct {
+	Body   io.ReadCloser
+	Header http.Header
+	Offset int64 // Where in the database the body starts.  Only non-zero when a download is being resumed
+	Size   int64 // The full size of the database, or -1 if the server didn't say
+}
+
+type LicenceEntry struct {
+	FileFormat string `json:"file_format"`
+	FullName   string `json:"full_name"`
+	Order      int    `json:"order"`
+	Sha256     string `json:"sha256"`
+	URL        string `json:"url"`
+}
+
+// Details of a licence being added to the server
+type LicenceOptions struct {
+	DisplayOrder int
+	FileFormat   string
+	FullName     string
+	URL          string
+}
+
+// The metadata for a database on the server
+type MetaData struct {
+	Branches  map[string]BranchEntry  `json:"branches"`
+	Commits   map[string]CommitEntry  `json:"commits"`
+	DefBranch string                  `json:"default_branch"`
+	Releases  map[string]ReleaseEntry `json:"releases"`
+	Tags      map[string]TagEntry     `json:"tags"`
+}
+
+// Receives updates on the progress of a transfer
+type Progress interface {
+	io.Writer
+	Finish()
+}
+
+type ReleaseEntry struct {
+	Commit        string    `json:"commit"`
+	Date          time.Time `json:"date"`
+	Description   string    `json:"description"`
+	ReleaserEmail string    `json:"email"`
+	ReleaserName  string    `json:"name"`
+	Size          int64     `json:"size"`
+}
+
+// The tags and releases on a remote, as of the last fetch or push
+type RemoteRefs struct {
+	Releases map[string]ReleaseEntry `json:"releases,omitempty"`
+	Tags     map[string]TagEntry     `json:"tags,omitempty"`
+}
+
+type TagEntry struct {
+	Commit      string    `json:"commit"`
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	TaggerEmail string    `json:"email"`
+	TaggerName  string    `json:"name"`
+}
+
+// Returned by UploadDatabase when the server rejects an upload
+type UploadError struct {
+	Body   []byte
+	Status int
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("Upload failed with an error: HTTP status %d - '%s'", e.Status, e.Body)
+}
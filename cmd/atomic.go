@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Flushes a file (or directory) which has already been written to disk.  Files are opened for writing, as not every
+// platform (eg Windows) allows flushing them otherwise
+func syncFile(path string) error {
+	flag := os.O_RDWR
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// Writes a file so that it's either completely written or not changed at all, even if dio is interrupted or the
+// computer crashes part way through.  The data is written to a temporary file in the same directory, flushed to disk,
+// then renamed over the top of the destination.  If fn returns an error, the destination isn't touched
+func writeAtomic(path string, perm os.FileMode, fn func(w io.Writer) error) (err error) {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	bw := bufio.NewWriter(f)
+	err = fn(bw)
+	if err != nil {
+		return
+	}
+	err = bw.Flush()
+	if err != nil {
+		return
+	}
+	err = f.Chmod(perm)
+	if err != nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return
+	}
+
+	// Flush the rename to disk too.  Not every platform allows opening directories (eg Windows), and the file has
+	// been written either way, so this is best effort
+	syncFile(dir)
+	return
+}
+
+// Writes a file atomically, in the same way as writeAtomic
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	return writeAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
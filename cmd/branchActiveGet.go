@@ -32,7 +32,7 @@ func branchActiveGet(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -3,9 +3,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -45,7 +43,7 @@ func branchActiveSet(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -54,6 +52,13 @@ func branchActiveSet(args []string) error {
 		return errors.New("Only one database can be changed at a time (for now)")
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Ensure a branch name was given
 	if branchActiveSetBranch == "" {
 		return errors.New("No branch name given")
@@ -89,26 +94,29 @@ func branchActiveSet(args []string) error {
 	if ok == false {
 		return errors.New("Something has gone wrong.  Head commit for the branch isn't in the commit list")
 	}
-	shaSum := commit.Tree.Entries[0].Sha256
-	lastMod := commit.Tree.Entries[0].LastModified
+	dbEntry, err := commitDBEntry(commit, db)
+	if err != nil {
+		return err
+	}
+	shaSum := dbEntry.Sha256
+	lastMod := dbEntry.LastModified
 
 	// Make sure the correct database from the target branch is in local cache
-	err = checkDBCache(db, shaSum)
+	err = checkDBCache(db, commit.ID, shaSum)
 	if err != nil {
 		return err
 	}
 
 	// Copy the database from local cache, so it matches the new branch head commit
-	var b []byte
-	b, err = ioutil.ReadFile(filepath.Join(".dio", db, "db", shaSum))
+	err = cacheCopyTo(db, shaSum, db)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(db, b, 0644)
+	err = os.Chtimes(db, time.Now(), lastMod)
 	if err != nil {
 		return err
 	}
-	err = os.Chtimes(db, time.Now(), lastMod)
+	err = writeCommitAttachments(db, commit)
 	if err != nil {
 		return err
 	}
@@ -37,7 +37,7 @@ func branchCreate(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -46,6 +46,13 @@ func branchCreate(args []string) error {
 		return errors.New("Only one database can be changed at a time (for now)")
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Ensure a new branch name and commit ID were given
 	if branchCreateBranch == "" {
 		return errors.New("No branch name given")
@@ -36,7 +36,7 @@ func branchList(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -48,7 +48,7 @@ func branchList(args []string) error {
 	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
 	// server first (without storing it)
 	meta = metaData{}
-	md, err := ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
+	md, err := ioutil.ReadFile(filepath.Join(dioDir(db), "metadata.json"))
 	if err == nil {
 		err = json.Unmarshal([]byte(md), &meta)
 		if err != nil {
@@ -62,6 +62,10 @@ func branchList(args []string) error {
 		}
 	}
 
+	if structuredOutput() {
+		return writeOutput(branchListOutput{ActiveBranch: meta.ActiveBranch, Branches: meta.Branches, Database: db})
+	}
+
 	// Sort the list alphabetically
 	var sortedKeys []string
 	for k := range meta.Branches {
@@ -35,7 +35,7 @@ func branchRemove(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -44,6 +44,13 @@ func branchRemove(args []string) error {
 		return errors.New("Only one database can be changed at a time (for now)")
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Ensure a branch name was given
 	if branchRemoveBranch == "" {
 		return errors.New("No branch name given")
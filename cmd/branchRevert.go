@@ -3,9 +3,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -48,7 +46,7 @@ func branchRevert(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -57,6 +55,13 @@ func branchRevert(args []string) error {
 		return errors.New("Only one database can be changed at a time (for now)")
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Ensure the required info was given
 	if branchRevertCommit == "" && branchRevertTag == "" {
 		return errors.New("Either a commit ID or tag must be given.")
@@ -142,11 +147,15 @@ func branchRevert(args []string) error {
 	var shaSum string
 	var lastMod time.Time
 	if branchRevertCommit != "" {
-		shaSum = meta.Commits[branchRevertCommit].Tree.Entries[0].Sha256
-		lastMod = meta.Commits[branchRevertCommit].Tree.Entries[0].LastModified
+		dbEntry, err := commitDBEntry(meta.Commits[branchRevertCommit], db)
+		if err != nil {
+			return err
+		}
+		shaSum = dbEntry.Sha256
+		lastMod = dbEntry.LastModified
 
 		// Fetch the database from DBHub.io if it's not in the local cache
-		err = checkDBCache(db, shaSum)
+		err = checkDBCache(db, branchRevertCommit, shaSum)
 		if err != nil {
 			return err
 		}
@@ -155,125 +164,9 @@ func branchRevert(args []string) error {
 	}
 
 	// Check if deleting the commits would leave isolated tags or releases.  If so, abort and warn the user
-	type isolCheck struct {
-		safe   bool
-		commit string
-	}
-	var isolatedTags []string
-	var isolatedReleases []string
-	commitTags := map[string]isolCheck{}
-	commitReleases := map[string]isolCheck{}
-	for delCommit := range delList {
-		// Ensure that deleting this commit won't result in any isolated/unreachable tags
-		for tName, tEntry := range meta.Tags {
-			// Scan through the database tag list, checking if any of the tags is for the commit we're deleting
-			if tEntry.Commit == delCommit {
-				commitTags[tName] = isolCheck{safe: false, commit: delCommit}
-			}
-		}
-
-		// Ensure that deleting this commit won't result in any isolated/unreachable releases
-		for rName, rEntry := range meta.Releases {
-			// Scan through the database release list, checking if any of the releases is for the commit we're
-			// deleting
-			if rEntry.Commit == delCommit {
-				commitReleases[rName] = isolCheck{safe: false, commit: delCommit}
-			}
-		}
-	}
-
-	if len(commitTags) > 0 {
-		// If a commit we're deleting has a tag on it, we need to check whether the commit is on other branches too
-		//   * If it is, we're ok to proceed as the tag can still be reached from the other branch(es)
-		//   * If it isn't, we need to abort this deletion (and tell the user), as the tag would become unreachable
-		for bName, bEntry := range meta.Branches {
-			if bName == branchRevertBranch {
-				// We only run this comparison from "other branches", not the branch whose history we're changing
-				continue
-			}
-			c, ok = meta.Commits[bEntry.Commit]
-			if !ok {
-				return fmt.Errorf("Broken commit history encountered when checking for isolated tags "+
-					"while reverting in branch '%s' of database '%s'\n", branchRevertBranch, db)
-			}
-			for tName, tEntry := range commitTags {
-				if c.ID == tEntry.commit {
-					// The commit is also on another branch, so we're ok to delete the commit
-					tmp := commitTags[tName]
-					tmp.safe = true
-					commitTags[tName] = tmp
-				}
-			}
-			for c.Parent != "" {
-				c, ok = meta.Commits[c.Parent]
-				if !ok {
-					return fmt.Errorf("Broken commit history encountered when checking for isolated tags "+
-						"while reverting in branch '%s' of database '%s'\n", branchRevertBranch, db)
-				}
-				for tName, tEntry := range commitTags {
-					if c.ID == tEntry.commit {
-						// The commit is also on another branch, so we're ok to delete the commit
-						tmp := commitTags[tName]
-						tmp.safe = true
-						commitTags[tName] = tmp
-					}
-				}
-			}
-		}
-
-		// Create a list of would-be-isolated tags
-		for tName, tEntry := range commitTags {
-			if tEntry.safe == false {
-				isolatedTags = append(isolatedTags, tName)
-			}
-		}
-	}
-
-	if len(commitReleases) > 0 {
-		// If a commit we're deleting has a release on it, we need to check whether the commit is on other branches too
-		//   * If it is, we're ok to proceed as the release can still be reached from the other branch(es)
-		//   * If it isn't, we need to abort this deletion (and tell the user), as the release would become unreachable
-		for bName, bEntry := range meta.Branches {
-			if bName == branchRevertBranch {
-				// We only run this comparison from "other branches", not the branch whose history we're changing
-				continue
-			}
-			c, ok = meta.Commits[bEntry.Commit]
-			if !ok {
-				return fmt.Errorf("Broken commit history encountered when checking for isolated releases "+
-					"while reverting in branch '%s' of database '%s'\n", branchRevertBranch, db)
-			}
-			for rName, rEntry := range commitReleases {
-				if c.ID == rEntry.commit {
-					// The commit is also on another branch, so we're ok to delete the commit
-					tmp := commitReleases[rName]
-					tmp.safe = true
-					commitReleases[rName] = tmp
-				}
-			}
-			for c.Parent != "" {
-				c, ok = meta.Commits[c.Parent]
-				if !ok {
-					return fmt.Errorf("Broken commit history encountered when checking for isolated "+
-						"releases while reverting in branch '%s' of database '%s'\n", branchRevertBranch, db)
-				}
-				for rName, rEntry := range commitReleases {
-					if c.ID == rEntry.commit {
-						// The commit is also on another branch, so we're ok to delete the commit
-						tmp := commitReleases[rName]
-						tmp.safe = true
-						commitReleases[rName] = tmp
-					}
-				}
-			}
-		}
-
-		// Create a list of would-be-isolated releases
-		for rName, rEntry := range commitReleases {
-			if rEntry.safe == false {
-				isolatedReleases = append(isolatedReleases, rName)
-			}
-		}
+	isolatedTags, isolatedReleases, err := findIsolatedTagsReleases(meta, branchRevertBranch, delList)
+	if err != nil {
+		return err
 	}
 
 	// If any tags or releases would be isolated, abort
@@ -299,10 +192,7 @@ func branchRevert(args []string) error {
 		}
 	}
 
-	// Revert the branch
-	// TODO: Remove the no-longer-referenced commits (if any) caused by this revert
-	//       * One alternative would be to leave them, and only clean up with with some kind of garbage collection
-	//         operation.  Even a "dio gc" to manually trigger it
+	// Revert the branch.  The commits no longer referenced by it are left in place, for "dio gc" to clean up
 	newHead := branchEntry{
 		Commit:      branchRevertCommit,
 		CommitCount: commitCount,
@@ -311,16 +201,15 @@ func branchRevert(args []string) error {
 	meta.Branches[branchRevertBranch] = newHead
 
 	// Copy the file from local cache to the working directory
-	var b []byte
-	b, err = ioutil.ReadFile(filepath.Join(".dio", db, "db", shaSum))
+	err = cacheCopyTo(db, shaSum, db)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(db, b, 0644)
+	err = os.Chtimes(db, time.Now(), lastMod)
 	if err != nil {
 		return err
 	}
-	err = os.Chtimes(db, time.Now(), lastMod)
+	err = writeCommitAttachments(db, meta.Commits[branchRevertCommit])
 	if err != nil {
 		return err
 	}
@@ -41,7 +41,7 @@ func branchUpdate(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -50,6 +50,13 @@ func branchUpdate(args []string) error {
 		return errors.New("Only one database can be changed at a time (for now)")
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Ensure a branch name and description text were given
 	if branchUpdateBranch == "" {
 		return errors.New("No branch name given")
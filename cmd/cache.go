@@ -0,0 +1,358 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// The local cache holds the database file for each commit, named after its SHA256 checksum.  With chunked storage
+// turned on (storage.chunked in the config file), database files are split into chunks on page boundaries instead, and
+// each chunk is stored once no matter how many database files it's part of.  Each chunk holds a small run of pages,
+// which keeps the number of files down for large databases while still sharing the unchanged parts.  A manifest named
+// after the database file (<sha256>.chunks) lists its chunks, so the file can be reassembled exactly when it's needed.
+//
+//   .dio/<db>/db/<sha256>                  A whole database file
+//   .dio/<db>/db/<sha256>.chunks           The manifest for a chunked database file
+//   .dio/<db>/chunks/<xx>/<chunk sha256>   A chunk, in a directory named after the first two characters of its checksum
+
+const (
+	// The number of pages in each chunk database files are split into
+	chunkPages = 16
+
+	// The page size used for files which aren't SQLite databases, or which have an unreadable page size
+	defaultPageSize = 65536
+)
+
+// Reads a chunked database file from its chunks, as if it were a single file
+type chunkReader struct {
+	cur      *os.File
+	curIdx   int
+	dir      string
+	manifest chunkManifest
+	pos      int64
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	err := c.cur.Close()
+	c.cur = nil
+	return err
+}
+
+func (c *chunkReader) Read(b []byte) (n int, err error) {
+	if c.pos >= c.manifest.Size {
+		return 0, io.EOF
+	}
+
+	// Open the chunk holding the current position, if it isn't open already
+	idx := int(c.pos / c.manifest.ChunkSize)
+	if c.cur == nil || idx != c.curIdx {
+		err = c.Close()
+		if err != nil {
+			return
+		}
+		c.cur, err = os.Open(chunkPath(c.dir, c.manifest.Chunks[idx]))
+		if err != nil {
+			return
+		}
+		c.curIdx = idx
+		_, err = c.cur.Seek(c.pos-int64(idx)*c.manifest.ChunkSize, io.SeekStart)
+		if err != nil {
+			return
+		}
+	}
+	n, err = c.cur.Read(b)
+	c.pos += int64(n)
+	if err == io.EOF {
+		// The end of the chunk is only the end of the database file when it's the last chunk
+		err = nil
+		if n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.manifest.Size
+	}
+	if offset < 0 {
+		return c.pos, errors.New("Can't seek to before the start of the database")
+	}
+	c.pos = offset
+	return c.pos, c.Close()
+}
+
+// Converts a whole database file already in the cache (eg a new download) to chunks, when chunked storage is turned
+// on.  The whole file is removed afterwards
+func cacheChunk(db, shaSum string) error {
+	if !chunkedStorage() {
+		return nil
+	}
+	path := filepath.Join(dioDir(db), "db", shaSum)
+	err := storeChunks(db, shaSum, path)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Copies a database file from the cache to dst, checking its SHA256 checksum along the way.  dst is written
+// atomically, so it's left untouched if the copy fails
+func cacheCopyTo(db, shaSum, dst string) (err error) {
+	r, _, err := cacheOpen(db, shaSum)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	return writeAtomic(dst, 0644, func(w io.Writer) error {
+		hasher := sha256.New()
+		_, err := io.Copy(io.MultiWriter(w, hasher), r)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != shaSum {
+			return fmt.Errorf("The cached copy of database file '%s' is damaged", shaSum)
+		}
+		return nil
+	})
+}
+
+// Returns true if the database file with the given SHA256 checksum is in the local cache, either whole or as chunks
+func cacheExists(db, shaSum string) bool {
+	if _, err := os.Stat(filepath.Join(dioDir(db), "db", shaSum)); err == nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dioDir(db), "db", shaSum+".chunks"))
+	return err == nil
+}
+
+// Opens a database file in the cache for reading.  Chunked database files are read straight from their chunks
+func cacheOpen(db, shaSum string) (r io.ReadSeekCloser, size int64, err error) {
+	f, err := os.Open(filepath.Join(dioDir(db), "db", shaSum))
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err != nil {
+			f.Close()
+			return
+		}
+		return f, fi.Size(), nil
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	m, err := loadChunkManifest(db, shaSum)
+	if err != nil {
+		return
+	}
+	return &chunkReader{dir: filepath.Join(dioDir(db), "chunks"), manifest: m}, m.Size, nil
+}
+
+// Returns the path to a database file in the cache, for opening with SQLite.  Chunked database files are reassembled
+// first.  The reassembled copy can be removed again with "dio gc"
+func cachePath(db, shaSum string) (path string, err error) {
+	path = filepath.Join(dioDir(db), "db", shaSum)
+	if _, err = os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	err = cacheCopyTo(db, shaSum, path)
+	return
+}
+
+// Removes a database file from the cache.  Any chunks it used are left for "dio gc" to clean up, as other database
+// files may use them too
+func cacheRemove(db, shaSum string) error {
+	for _, j := range []string{shaSum, shaSum + ".chunks"} {
+		err := os.Remove(filepath.Join(dioDir(db), "db", j))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a database file to the cache, unless it's already there
+func cacheStore(db, shaSum, src string) error {
+	if cacheExists(db, shaSum) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(dioDir(db), "db"), 0770)
+	if err != nil {
+		return err
+	}
+	if chunkedStorage() {
+		return storeChunks(db, shaSum, src)
+	}
+	return copyFile(src, filepath.Join(dioDir(db), "db", shaSum))
+}
+
+// Checks a database file in the cache against its SHA256 checksum
+func cacheVerify(db, shaSum string) (err error) {
+	r, _, err := cacheOpen(db, shaSum)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, r)
+	if err != nil {
+		return
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != shaSum {
+		return errors.New("doesn't match its checksum")
+	}
+	return
+}
+
+// Returns the path of a chunk
+func chunkPath(dir, chunkSum string) string {
+	return filepath.Join(dir, chunkSum[:2], chunkSum)
+}
+
+// Returns true if new database files should be stored in the cache as chunks
+func chunkedStorage() bool {
+	return viper.GetBool("storage.chunked")
+}
+
+// Returns the page size of a SQLite database file, or defaultPageSize for other files
+func databasePageSize(r io.Reader) int64 {
+	header := make([]byte, 100)
+	_, err := io.ReadFull(r, header)
+	if err != nil || !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		return defaultPageSize
+	}
+	size := int64(binary.BigEndian.Uint16(header[16:18]))
+	if size == 1 {
+		// Page sizes of 65536 don't fit in 16 bits, so are stored as 1
+		size = 65536
+	}
+	if size < 512 || size&(size-1) != 0 {
+		return defaultPageSize
+	}
+	return size
+}
+
+// Loads the manifest for a chunked database file
+func loadChunkManifest(db, shaSum string) (m chunkManifest, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), "db", shaSum+".chunks"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &m)
+	if err == nil && m.ChunkSize <= 0 {
+		err = fmt.Errorf("The chunk manifest for database file '%s' is damaged", shaSum)
+	}
+	return
+}
+
+// Splits a database file into chunks on page boundaries, adding any chunks which aren't already in the cache along with
+// a manifest listing them.  The SHA256 checksum of the file is checked along the way, so the manifest always
+// describes the exact file it's named after
+func storeChunks(db, shaSum, src string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	m := chunkManifest{ChunkSize: databasePageSize(f) * chunkPages}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	// Store each chunk which isn't already present
+	dir := filepath.Join(dioDir(db), "chunks")
+	hasher := sha256.New()
+	buf := make([]byte, m.ChunkSize)
+	newDirs := make(map[string]struct{})
+	for {
+		n, errRead := io.ReadFull(f, buf)
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil && errRead != io.ErrUnexpectedEOF {
+			return errRead
+		}
+		chunk := buf[:n]
+		hasher.Write(chunk)
+		z := sha256.Sum256(chunk)
+		chunkSum := hex.EncodeToString(z[:])
+		m.Chunks = append(m.Chunks, chunkSum)
+		m.Size += int64(n)
+		path := chunkPath(dir, chunkSum)
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			err = os.MkdirAll(filepath.Dir(path), 0770)
+			if err == nil {
+				err = writeChunk(path, chunk)
+			}
+			newDirs[filepath.Dir(path)] = struct{}{}
+		}
+		if err != nil {
+			return
+		}
+		if errRead == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != shaSum {
+		return fmt.Errorf("Database file '%s' changed while it was being stored", src)
+	}
+
+	// Flush the renames of the new chunks to disk before the manifest refers to them.  As with writeAtomic, this is
+	// best effort, and is done once per directory rather than once per chunk
+	if len(newDirs) > 0 {
+		newDirs[dir] = struct{}{}
+		for d := range newDirs {
+			syncFile(d)
+		}
+	}
+
+	// Write the manifest last, so the database file is only in the cache once all of its chunks are
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(filepath.Join(dioDir(db), "db", shaSum+".chunks"), b, 0644)
+}
+
+// Writes a chunk to the cache.  It's written to a temporary file and flushed to disk before being renamed into place,
+// so a chunk is never seen half written, even after a crash
+func writeChunk(path string, b []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Describes a command which applies the changes between a commit and its parent to the head of a branch as a new
+// commit, pausing for the conflicts to be resolved if there are any.  'dio cherry-pick' copies the changes made by the
+// commit, and 'dio revert-commit' undoes them
+type changesetOp struct {
+	cmd          string // The dio command, eg "cherry-pick"
+	name         string // What the command does, eg "revert"
+	stateFile    string // The file in the .dio folder of the database the state of a paused command is saved in
+	reverse      bool   // Undo the changes made by the commit, instead of copying them
+	conflictsMsg string // Displayed before the conflicts, given the commit and branch
+	cancelledMsg string // Displayed after cancelling, given the commit and branch
+	doneMsg      string // Displayed after creating the new commit, given the commit and branch
+
+	// Returns the author, message, etc for the new commit
+	newCommit func(meta metaData, state changesetState) (commitEntry, error)
+}
+
+// Applies the changes for a changeset command to the working database, starting from the head of the target branch.
+// If there are conflicts the command is paused so the user can resolve them, otherwise the new commit is created
+func applyChangeset(db string, meta metaData, op changesetOp, state changesetState) (err error) {
+	err = checkNewAttachments(db, meta, state.Branch, changesetAttachments(db, meta, op, state))
+	if err != nil {
+		return
+	}
+	err = writeCommitToWorkingFile(db, meta, state.Head)
+	if err != nil {
+		return
+	}
+	state.ActiveBranch = meta.ActiveBranch
+	if meta.ActiveBranch != state.Branch {
+		meta.ActiveBranch = state.Branch
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return
+		}
+	}
+	from, to := changesetCommits(meta, op, state)
+	state.Conflicts, err = applyChangesBetween(db, meta, from, to)
+	if err == nil {
+		err = writeAttachmentChanges(db, meta, state.Head, changesetAttachments(db, meta, op, state))
+	}
+	if err != nil {
+		// Put the working database back how it was
+		errInner := writeCommitToWorkingFile(db, meta, state.Head)
+		if errInner != nil {
+			return fmt.Errorf("%s: %s", err, errInner)
+		}
+		return
+	}
+
+	// If there were conflicts, save the state so the user can resolve them and then continue
+	if len(state.Conflicts) > 0 {
+		err = saveChangesetState(db, op, state)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(fOut, op.conflictsMsg, state.Commit, state.Branch)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprint(fOut, createConflictText(state.Conflicts))
+		if err != nil {
+			return
+		}
+		return fmt.Errorf("%s paused.  Fix the conflicts in '%s', then run 'dio %s --continue' to create the "+
+			"commit.  Or use 'dio %s --abort' to cancel the %s", strings.ToUpper(op.name[:1])+op.name[1:], db, op.cmd,
+			op.cmd, op.name)
+	}
+
+	// No conflicts, so create the commit straight away
+	return changesetCommit(db, meta, op, state)
+}
+
+// Cancels a paused changeset command, switching back to the branch which was active when it was started and
+// restoring the working database and the files committed along with it to the head of that branch
+func abortChangeset(db string, op changesetOp) error {
+	state, err := loadChangesetState(db, op)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No %s is in progress for '%s'", op.name, db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	head := state.Head
+	prev, ok := meta.Branches[state.ActiveBranch]
+	if ok && state.ActiveBranch != state.Branch {
+		head = prev.Commit
+	}
+	err = writeCommitToWorkingFile(db, meta, head)
+	if err != nil {
+		return err
+	}
+	err = restoreAttachments(db, meta, head, changesetAttachments(db, meta, op, *state))
+	if err != nil {
+		return err
+	}
+	if ok && meta.ActiveBranch != state.ActiveBranch {
+		meta.ActiveBranch = state.ActiveBranch
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(filepath.Join(dioDir(db), op.stateFile))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, op.cancelledMsg, state.Commit, state.Branch)
+	return err
+}
+
+// Returns the files to commit along with the database for a changeset command.  These are the ones from the head of
+// the target branch, with the changes made to the files between the changeset's commits done the same way
+func changesetAttachments(db string, meta metaData, op changesetOp, state changesetState) []dbTreeEntry {
+	from, to := changesetCommits(meta, op, state)
+	return applyAttachmentChanges(db, meta, state.Head, from, to)
+}
+
+// Creates the commit for a changeset command, using the current contents of the working database
+func changesetCommit(db string, meta metaData, op changesetOp, state changesetState) error {
+	details, err := op.newCommit(meta, state)
+	if err != nil {
+		return err
+	}
+
+	// The new commit keeps the licence of the target branch
+	dbEntry, err := commitDBEntry(meta.Commits[state.Head], db)
+	if err != nil {
+		return err
+	}
+	newCom, err := addCommit(db, meta, state.Branch, dbEntry.LicenceSHA, changesetAttachments(db, meta, op, state),
+		details)
+	if err != nil {
+		return err
+	}
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, op.doneMsg, state.Commit, state.Branch)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "  * Commit ID: %s\n", newCom.ID)
+	return err
+}
+
+// Returns the commits a changeset command applies the changes between, in the order they're applied
+func changesetCommits(meta metaData, op changesetOp, state changesetState) (from, to string) {
+	if op.reverse {
+		return state.Commit, meta.Commits[state.Commit].Parent
+	}
+	return meta.Commits[state.Commit].Parent, state.Commit
+}
+
+// Finishes a paused changeset command, once the user has resolved the conflicts
+func continueChangeset(db string, op changesetOp) error {
+	state, err := loadChangesetState(db, op)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No %s is in progress for '%s'", op.name, db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the target branch hasn't been moved in the meantime
+	if head, ok := meta.Branches[state.Branch]; !ok || head.Commit != state.Head {
+		return fmt.Errorf("Branch '%s' has changed since the %s was started.  Use --abort to cancel the %s",
+			state.Branch, op.name, op.name)
+	}
+	err = changesetCommit(db, meta, op, *state)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dioDir(db), op.stateFile))
+}
+
+// Loads the state of a paused changeset command.  Returns nil if the command isn't in progress
+func loadChangesetState(db string, op changesetOp) (state *changesetState, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), op.stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return
+	}
+	state = &changesetState{}
+	err = json.Unmarshal(b, state)
+	return
+}
+
+// Saves the state of a paused changeset command
+func saveChangesetState(db string, op changesetOp, state changesetState) (err error) {
+	var jsonString []byte
+	jsonString, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dioDir(db), op.stateFile), jsonString, 0644)
+	return
+}
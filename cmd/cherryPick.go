@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cherryPickCmdBranch                                           string
+	cherryPickCmdAbort, cherryPickCmdContinue, cherryPickCmdForce bool
+)
+
+// Copies the changes made by a single commit onto another branch
+var cherryPickCmd = &cobra.Command{
+	Use:   "cherry-pick [database name] commit [--branch xxx]",
+	Short: "Copies the changes made by a commit onto a branch",
+	Long: `Copies the changes made by a commit onto a branch
+
+The row level changes between the commit and its parent are applied to the head
+of the branch, then committed with the author and message of the original
+commit.  This is useful for bringing a fix made on one branch over to another,
+without merging everything else.  The commit can be given as a commit ID, or as
+a branch or tag name.
+
+If the changes conflict with the rows in the branch, the conflicts are listed
+and the cherry-pick is paused.  Fix the conflicting rows in the working database,
+then run 'dio cherry-pick --continue' to create the commit.  Alternatively,
+'dio cherry-pick --abort' cancels the cherry-pick.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cherryPick(args)
+	},
+}
+
+// Cherry-picks keep the author and message of the original commit
+var cherryPickOp = changesetOp{
+	cmd:          "cherry-pick",
+	name:         "cherry-pick",
+	stateFile:    "cherrypick.json",
+	conflictsMsg: "Cherry-picking commit %s onto branch '%s' has conflicts:\n\n",
+	cancelledMsg: "Cherry-pick of commit %s onto branch '%s' cancelled\n",
+	doneMsg:      "Commit %s cherry-picked onto branch '%s'\n",
+	newCommit: func(meta metaData, state changesetState) (commitEntry, error) {
+		return replayedCommit(meta.Commits[state.Commit]), nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cherryPickCmd)
+	cherryPickCmd.Flags().BoolVar(&cherryPickCmdAbort, "abort", false, "Cancel an in-progress cherry-pick")
+	cherryPickCmd.Flags().StringVar(&cherryPickCmdBranch, "branch", "",
+		"Branch to copy the changes onto (default is the active branch)")
+	cherryPickCmd.Flags().BoolVar(&cherryPickCmdContinue, "continue", false,
+		"Create the commit, after conflicts have been resolved")
+	cherryPickCmd.Flags().BoolVarP(&cherryPickCmdForce, "force", "f", false,
+		"Overwrite unsaved changes to the database?")
+}
+
+func cherryPick(args []string) error {
+	if cherryPickCmdAbort && cherryPickCmdContinue {
+		return errors.New("Either --abort or --continue can be given.  Not both!")
+	}
+
+	// Work out the database name and commit.  When only one argument is given it's the commit, unless an in-progress
+	// cherry-pick is being continued or aborted (in which case no commit is needed)
+	var db, ref string
+	var err error
+	switch len(args) {
+	case 0:
+	case 1:
+		if cherryPickCmdAbort || cherryPickCmdContinue {
+			db = args[0]
+		} else {
+			ref = args[0]
+		}
+	case 2:
+		db = args[0]
+		ref = args[1]
+	default:
+		return errors.New("Only one database and commit can be cherry-picked at a time")
+	}
+	if db == "" {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if cherryPickCmdAbort {
+		return abortChangeset(db, cherryPickOp)
+	}
+	if cherryPickCmdContinue {
+		return continueChangeset(db, cherryPickOp)
+	}
+	if ref == "" {
+		return errors.New("No commit given")
+	}
+
+	// Make sure there isn't already a merge, rebase, or cherry-pick underway
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+
+	// Load the metadata
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	commitID, err := resolveCommit(meta, ref)
+	if err != nil {
+		return err
+	}
+
+	// If no target branch was given, use the active branch
+	branch := cherryPickCmdBranch
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+
+	// Unless --force is specified, check whether the file has changed since the last commit, and let the user know
+	if !cherryPickCmdForce {
+		changed, err := dbChanged(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+				"really want to overwrite it\n", db)
+			return err
+		}
+	}
+
+	// If the commit is already part of the branch, there's nothing to do
+	history, err := commitHistory(meta, head.Commit)
+	if err != nil {
+		return err
+	}
+	if _, ok = history[commitID]; ok {
+		_, err = fmt.Fprintf(fOut, "Branch '%s' already contains commit %s.  Nothing to cherry-pick.\n", branch,
+			commitID)
+		return err
+	}
+
+	// The first commit in a history has no parent for its changes to be worked out from
+	if meta.Commits[commitID].Parent == "" {
+		return fmt.Errorf("Commit '%s' is the first commit in its history, so has no changes which can be "+
+			"applied elsewhere", commitID)
+	}
+
+	// Start from the head of the target branch, then apply the changes from the commit to it
+	return applyChangeset(db, meta, cherryPickOp, changesetState{
+		Branch: branch,
+		Commit: commitID,
+		Head:   head.Commit,
+	})
+}
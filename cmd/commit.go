@@ -1,10 +1,8 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -13,18 +11,34 @@ import (
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 var (
 	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdCommit string
 	commitCmdLicence, commitCmdMsg, commitCmdTimestamp                      string
+	commitCmdAttach, commitCmdDetach                                        []string
+	commitCmdJobs                                                           int
 )
 
 // Create a commit for the database on the currently active branch
 var (
 	commitCmd = &cobra.Command{
-		Use:   "commit [database file]",
+		Use:   "commit [database file...]",
 		Short: "Creates a new commit for the database",
+		Long: `Creates a new commit for the database
+
+Several databases can be given, including glob patterns such as "*.sqlite".
+They're committed concurrently, with --jobs controlling how many at once.
+
+Other files can be versioned along with the database, by attaching them with
+--attach (eg related databases, a licence, or a README).  Files in folders
+are kept in subtrees of the commit.  Once attached, a file is included in every
+later commit of the database until it's removed again with --detach.
+
+DBHub.io servers can't store attached files yet, so commits with them in can't
+be pushed.  Files can't be attached on branches which track a remote branch
+(eg 'origin/main'), so keep them on a local branch instead.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return commit(args)
 		},
@@ -33,12 +47,18 @@ var (
 
 func init() {
 	RootCmd.AddCommand(commitCmd)
+	commitCmd.Flags().StringSliceVar(&commitCmdAttach, "attach", nil,
+		"Other file to version along with the database (can be given several times)")
 	commitCmd.Flags().StringVar(&commitCmdBranch, "branch", "",
 		"The branch this commit will be appended to")
+	commitCmd.Flags().StringSliceVar(&commitCmdDetach, "detach", nil,
+		"Attached file to stop versioning along with the database")
 	commitCmd.Flags().StringVar(&commitCmdCommit, "commit", "",
 		"ID of the previous commit, for appending this new database to")
 	commitCmd.Flags().StringVar(&commitCmdAuthEmail, "email", "",
 		"Email address of the commit author")
+	commitCmd.Flags().IntVarP(&commitCmdJobs, "jobs", "j", defaultJobs,
+		"Number of databases to commit at once")
 	commitCmd.Flags().StringVar(&commitCmdLicence, "licence", "",
 		"The licence (ID) for the database, as per 'dio licence list'")
 	commitCmd.Flags().StringVar(&commitCmdMsg, "message", "",
@@ -48,34 +68,32 @@ func init() {
 }
 
 func commit(args []string) error {
-	// Ensure a database file was given
-	var db string
-	var err error
-	var meta metaData
-	if len(args) == 0 {
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
-		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
-		}
-	} else {
-		db = args[0]
-	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be uploaded at a time (for now)")
+	dbs, err := resolveDatabases(args, false)
+	if err != nil {
+		return err
 	}
+	return forEachDatabase(dbs, commitCmdJobs, commitDatabase)
+}
+
+// Creates a new commit for a single database, displaying the details on out
+func commitDatabase(out io.Writer, db string) error {
+	// Several databases can be committed at once, so the flags which get adjusted for each are copied
+	branch, licence, msg := commitCmdBranch, commitCmdLicence, commitCmdMsg
+	var meta metaData
 
 	// Ensure the database file exists
-	fi, err := os.Stat(db)
+	_, err := os.Stat(db)
 	if err != nil {
 		return err
 	}
 
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Grab author name & email from the dio config file, but allow command line flags to override them
 	var authorName, authorEmail, committerName, committerEmail string
 	if z, ok := viper.Get("user.name").(string); ok {
@@ -109,15 +127,19 @@ func commit(args []string) error {
 
 	// If the database metadata doesn't exist locally, check if it does exist on the server.
 	var newDB, localPresent bool
-	if _, err = os.Stat(filepath.Join(".dio", db, "db")); os.IsNotExist(err) {
+	if _, err = os.Stat(filepath.Join(dioDir(db), "db")); os.IsNotExist(err) {
 		// At the moment, since there's no better way to check for the existence of a remote database, we just
 		// grab the list of the users databases and check against that
 		dbList, errInner := getDatabases(cloud, certUser)
 		if errInner != nil {
 			return errInner
 		}
+		remoteDB, errInner := remoteDatabase(db, DEFAULT_REMOTE)
+		if errInner != nil {
+			return errInner
+		}
 		for _, j := range dbList {
-			if db == j.Name {
+			if remoteDB == client.DatabasePath(j.Folder, j.Name) {
 				// This database already exists on DBHub.io.  We need local metadata in order to proceed, but don't
 				// yet have it.  Safest option, at least for now, is to tell the user and abort
 				return errors.New("Aborting: the database exists on the remote server, but has no " +
@@ -127,7 +149,7 @@ func commit(args []string) error {
 
 		// This is a new database, so we generate new metadata
 		newDB = true
-		meta = newMetaStruct(commitCmdBranch)
+		meta = newMetaStruct(branch)
 	} else {
 		// We have local metaData
 		localPresent = true
@@ -142,32 +164,39 @@ func commit(args []string) error {
 	}
 
 	// If no branch name was passed, use the active branch
-	if commitCmdBranch == "" {
-		commitCmdBranch = meta.ActiveBranch
+	if branch == "" {
+		branch = meta.ActiveBranch
 	}
 
 	// Check if the database is unchanged from the previous commit, and if so we abort the commit
 	if localPresent {
+		// Merges and rebases have their own commit process, so don't allow a normal commit while one is in progress
+		err = checkInProgress(db)
+		if err != nil {
+			return err
+		}
+
 		changed, err := dbChanged(db, meta)
 		if err != nil {
 			return err
 		}
-		if !changed && commitCmdLicence == "" {
+		if !changed && licence == "" && len(commitCmdAttach) == 0 && len(commitCmdDetach) == 0 {
 			return fmt.Errorf("Database is unchanged from last commit.  No need to commit anything.")
 		}
 	}
 
 	// Get the current head commit for the selected branch, as that will be the parent commit for this new one
-	head, ok := meta.Branches[commitCmdBranch]
+	head, ok := meta.Branches[branch]
 	if !ok {
-		return errors.New(fmt.Sprintf("That branch ('%s') doesn't exist", commitCmdBranch))
+		return errors.New(fmt.Sprintf("That branch ('%s') doesn't exist", branch))
 	}
 	var existingLicSHA string
+	var attachments []dbTreeEntry
 	if newDB {
-		if commitCmdLicence == "" {
+		if licence == "" {
 			// If this is a new database, and no licence was given on the command line, then default to
 			// 'Not specified'
-			commitCmdLicence = "Not specified"
+			licence = "Not specified"
 		}
 	} else {
 		if localPresent {
@@ -176,10 +205,21 @@ func commit(args []string) error {
 			if !ok {
 				return errors.New("Aborting: info for the head commit isn't found in the local commit cache")
 			}
-			existingLicSHA = headCommit.Tree.Entries[0].LicenceSHA
+			dbEntry, err := commitDBEntry(headCommit, db)
+			if err != nil {
+				return err
+			}
+			existingLicSHA = dbEntry.LicenceSHA
+			attachments = commitAttachments(headCommit, db)
 		}
 	}
 
+	// Bring the files committed along with the database up to date
+	attachments, err = updateAttachments(db, attachments, commitCmdAttach, commitCmdDetach)
+	if err != nil {
+		return err
+	}
+
 	// Retrieve the list of known licences
 	licList, err := getLicences()
 	if err != nil {
@@ -188,10 +228,10 @@ func commit(args []string) error {
 
 	// Determine the SHA256 of the requested licence
 	var licID, licSHA string
-	if commitCmdLicence != "" {
+	if licence != "" {
 		// Scan the licence list for a matching licence name
 		matchFound := false
-		lwrLic := strings.ToLower(commitCmdLicence)
+		lwrLic := strings.ToLower(licence)
 		for i, j := range licList {
 			if strings.ToLower(i) == lwrLic {
 				licID = i
@@ -209,7 +249,7 @@ func commit(args []string) error {
 	}
 
 	// Generate an appropriate commit message if none was provided
-	if commitCmdMsg == "" {
+	if msg == "" {
 		if !newDB && existingLicSHA != licSHA {
 			// * The licence has changed, so we create a reasonable commit message indicating this *
 
@@ -226,88 +266,26 @@ func commit(args []string) error {
 			if !matchFound {
 				return errors.New("Aborting: could not locate the requested database licence")
 			}
-			commitCmdMsg = fmt.Sprintf("Database licence changed from '%s' to '%s'.", existingLicID, licID)
+			msg = fmt.Sprintf("Database licence changed from '%s' to '%s'.", existingLicID, licID)
 		}
 
 		// If it's a new database and there's still no commit message, generate a reasonable one
-		if newDB && commitCmdMsg == "" {
-			commitCmdMsg = "New database created"
+		if newDB && msg == "" {
+			msg = "New database created"
 		}
 	}
 
-	// * Collect info for the new commit *
-
-	// Get file size and last modified time for the database
-	fileSize := fi.Size()
-	lastModified := fi.ModTime()
-
-	// Verify we've read the file from disk ok
-	b, err := ioutil.ReadFile(db)
-	if err != nil {
-		return err
-	}
-	if int64(len(b)) != fileSize {
-		return errors.New(numFormat.Sprintf("Aborting: # of bytes read (%d) when generating commit don't "+
-			"match database file size (%d)", len(b), fileSize))
-	}
-
-	// Generate sha256
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
-
 	// * Generate the new commit *
-
-	// Create a new dbTree entry for the database file
-	var e dbTreeEntry
-	e.EntryType = DATABASE
-	e.LastModified = lastModified.UTC()
-	e.LicenceSHA = licSHA
-	e.Name = db
-	e.Sha256 = shaSum
-	e.Size = fileSize
-
-	// Create a new dbTree structure for the new database entry
-	var t dbTree
-	t.Entries = append(t.Entries, e)
-	t.ID = createDBTreeID(t.Entries)
-
-	// Create a new commit for the new tree
-	newCom := commitEntry{
+	newCom, err := addCommit(db, meta, branch, licSHA, attachments, commitEntry{
 		AuthorName:     authorName,
 		AuthorEmail:    authorEmail,
 		CommitterName:  committerName,
 		CommitterEmail: committerEmail,
-		Message:        commitCmdMsg,
-		Parent:         head.Commit,
+		Message:        msg,
 		Timestamp:      commitTime.UTC(),
-		Tree:           t,
-	}
-
-	// Calculate the new commit ID, which incorporates the updated tree ID (and thus the new licence sha256)
-	newCom.ID = createCommitID(newCom)
-
-	// Add the new commit info to the database commit list
-	meta.Commits[newCom.ID] = newCom
-
-	// Update the branch head info to point at the new commit
-	meta.Branches[commitCmdBranch] = branchEntry{
-		Commit:      newCom.ID,
-		CommitCount: head.CommitCount + 1,
-		Description: head.Description,
-	}
-
-	// If the database file isn't already in the local cache, then copy it there
-	if _, err = os.Stat(filepath.Join(".dio", db, "db", shaSum)); os.IsNotExist(err) {
-		if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
-			if err != nil {
-				return err
-			}
-		}
-		err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), b, 0644)
-		if err != nil {
-			return err
-		}
+	})
+	if err != nil {
+		return err
 	}
 
 	// Save the updated metadata back to disk
@@ -317,30 +295,40 @@ func commit(args []string) error {
 	}
 
 	// Display results to the user
-	_, err = fmt.Fprintf(fOut, "Commit created on '%s'\n", db)
+	_, err = fmt.Fprintf(out, "Commit created on '%s'\n", db)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(fOut, "  * Commit ID: %s\n", newCom.ID)
+	_, err = fmt.Fprintf(out, "  * Commit ID: %s\n", newCom.ID)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(fOut, "    Branch: %s\n", commitCmdBranch)
+	_, err = fmt.Fprintf(out, "    Branch: %s\n", branch)
 	if err != nil {
 		return err
 	}
 	if licID != "" {
-		_, err = fmt.Fprintf(fOut, "    Licence: %s\n", licID)
+		_, err = fmt.Fprintf(out, "    Licence: %s\n", licID)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = numFormat.Fprintf(fOut, "    Size: %d bytes\n", e.Size)
+	dbEntry, err := commitDBEntry(newCom, db)
+	if err != nil {
+		return err
+	}
+	_, err = numFormat.Fprintf(out, "    Size: %d bytes\n", dbEntry.Size)
 	if err != nil {
 		return err
 	}
-	if commitCmdMsg != "" {
-		_, err = fmt.Fprintf(fOut, "    Commit message: %s\n\n", commitCmdMsg)
+	for _, e := range commitAttachments(newCom, db) {
+		_, err = numFormat.Fprintf(out, "    File: %s (%d bytes)\n", e.Name, e.Size)
+		if err != nil {
+			return err
+		}
+	}
+	if msg != "" {
+		_, err = fmt.Fprintf(out, "    Commit message: %s\n\n", msg)
 		if err != nil {
 			return err
 		}
@@ -348,6 +336,72 @@ func commit(args []string) error {
 	return nil
 }
 
+// Adds a new commit for the database file to the end of a branch.  The author, committer, message, timestamp and any
+// other parents are taken from the given commit entry, with the tree being generated from the database file on disk
+// plus the files committed along with it (attachments).  The database file is copied to the local cache, but saving
+// the updated metadata is left to the caller
+func addCommit(db string, meta metaData, branch, licSHA string, attachments []dbTreeEntry,
+	newCom commitEntry) (commitEntry, error) {
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return commitEntry{}, fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+	err := checkNewAttachments(db, meta, branch, attachments)
+	if err != nil {
+		return commitEntry{}, err
+	}
+
+	// Get file size and last modified time for the database
+	fi, err := os.Stat(db)
+	if err != nil {
+		return commitEntry{}, err
+	}
+	fileSize := fi.Size()
+	lastModified := fi.ModTime()
+
+	// Generate sha256
+	shaSum, err := cachedFileSHA256(db)
+	if err != nil {
+		return commitEntry{}, err
+	}
+
+	// Create a new dbTree entry for the database file.  It's named after the file itself, even when the database is in
+	// a folder, as that's how the server names it
+	var e dbTreeEntry
+	e.EntryType = DATABASE
+	e.LastModified = lastModified.UTC()
+	e.LicenceSHA = licSHA
+	e.Name = filepath.Base(db)
+	e.Sha256 = shaSum
+	e.Size = fileSize
+
+	// Create a new dbTree structure for the new database entry and the attachments, with any in folders going into
+	// subtrees
+	t := client.NewTree(append([]dbTreeEntry{e}, attachments...))
+
+	// Calculate the new commit ID, which incorporates the updated tree ID (and thus the new licence sha256)
+	newCom.Parent = head.Commit
+	newCom.Tree = t
+	newCom.ID = client.CommitID(newCom)
+
+	// Add the new commit info to the database commit list
+	meta.Commits[newCom.ID] = newCom
+
+	// Update the branch head info to point at the new commit
+	meta.Branches[branch] = branchEntry{
+		Commit:      newCom.ID,
+		CommitCount: head.CommitCount + 1,
+		Description: head.Description,
+	}
+
+	// If the database file isn't already in the local cache, then copy it there
+	err = cacheStore(db, shaSum, db)
+	if err != nil {
+		return commitEntry{}, err
+	}
+	return newCom, nil
+}
+
 // Creates a new metadata structure in memory
 func newMetaStruct(branch string) (meta metaData) {
 	b := branchEntry{
@@ -362,12 +416,14 @@ func newMetaStruct(branch string) (meta metaData) {
 		initialBranch = branch
 	}
 	meta = metaData{
+		MetaData: client.MetaData{
+			Branches:  map[string]branchEntry{initialBranch: b},
+			Commits:   map[string]commitEntry{},
+			DefBranch: initialBranch,
+			Releases:  map[string]releaseEntry{},
+			Tags:      map[string]tagEntry{},
+		},
 		ActiveBranch: initialBranch,
-		Branches:     map[string]branchEntry{initialBranch: b},
-		Commits:      map[string]commitEntry{},
-		DefBranch:    initialBranch,
-		Releases:     map[string]releaseEntry{},
-		Tags:         map[string]tagEntry{},
 	}
 	return
 }
@@ -0,0 +1,649 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The special name used to refer to the database file in the working directory, rather than a commit
+	WORKING_DB = "working"
+)
+
+var diffCmdFrom, diffCmdTo string
+
+// Displays the schema and data differences between two versions of a database
+var diffCmd = &cobra.Command{
+	Use:   "diff [database name] --from xxx --to yyy",
+	Short: "Displays the differences between two versions of a database",
+	Long: `Displays the differences between two versions of a database
+
+Both sides of the comparison can be a commit ID, a branch name, a tag name, or
+a release name.
+The special name 'working' refers to the database file in the working directory.
+
+When not given, --from defaults to the active branch and --to defaults to the
+working database.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return diff(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVar(&diffCmdFrom, "from", "",
+		"Commit ID, branch, tag, or release to compare from (default is the active branch)")
+	diffCmd.Flags().StringVar(&diffCmdTo, "to", "",
+		"Commit ID, branch, tag, or release to compare to, or 'working' for the working database "+
+			"(default is 'working')")
+}
+
+func diff(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	var meta metaData
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be worked with at a time (for now)")
+	}
+
+	// Load the metadata
+	meta, err = loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Fill in the defaults for anything not given on the command line
+	from := diffCmdFrom
+	if from == "" {
+		from = meta.ActiveBranch
+	}
+	to := diffCmdTo
+	if to == "" {
+		to = WORKING_DB
+	}
+	if from == WORKING_DB && to == WORKING_DB {
+		return errors.New("The working database can't be compared against itself")
+	}
+
+	// Determine the database files to compare, retrieving them from DBHub.io if they're not in the local cache
+	fromPath, fromDesc, err := diffSource(db, meta, from)
+	if err != nil {
+		return err
+	}
+	toPath, toDesc, err := diffSource(db, meta, to)
+	if err != nil {
+		return err
+	}
+
+	// Calculate the differences
+	diffs, err := diffDatabases(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+
+	// Display the results
+	_, err = fmt.Fprintf(fOut, "Differences for '%s' between %s and %s:\n\n", db, fromDesc, toDesc)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(fOut, createDiffText(diffs))
+	return err
+}
+
+// Returns the path to the database file for a commit, branch, tag, release, or the working database, along with a user
+// friendly description of it.  Database files not in the local cache are downloaded from DBHub.io.
+func diffSource(db string, meta metaData, ref string) (path, desc string, err error) {
+	if ref == WORKING_DB {
+		if _, err = os.Stat(db); err != nil {
+			return
+		}
+		return db, "the working database", nil
+	}
+	var commitID string
+	commitID, err = resolveCommit(meta, ref)
+	if err != nil {
+		return
+	}
+	path, err = commitDBPath(db, meta, commitID)
+	if err != nil {
+		return
+	}
+	if commitID == ref {
+		desc = fmt.Sprintf("commit %s", commitID)
+	} else {
+		desc = fmt.Sprintf("'%s' (commit %s)", ref, commitID)
+	}
+	return
+}
+
+// Returns the path to the locally cached database file for a commit, downloading it first if needed
+func commitDBPath(db string, meta metaData, commitID string) (path string, err error) {
+	c, ok := meta.Commits[commitID]
+	if !ok {
+		err = fmt.Errorf("Commit '%s' isn't in the local commit cache", commitID)
+		return
+	}
+	dbEntry, err := commitDBEntry(c, db)
+	if err != nil {
+		return
+	}
+	shaSum := dbEntry.Sha256
+	err = checkDBCache(db, commitID, shaSum)
+	if err != nil {
+		return
+	}
+	return cachePath(db, shaSum)
+}
+
+// Creates the user visible text for a set of database differences
+func createDiffText(diffs dbDiffs) string {
+	if len(diffs.Diff) == 0 {
+		return "  No differences found\n\n"
+	}
+	var s string
+	for _, obj := range diffs.Diff {
+		s += fmt.Sprintf("  * %s '%s'", strings.ToUpper(obj.ObjectType[:1])+obj.ObjectType[1:], obj.ObjectName)
+		if obj.Schema != nil {
+			switch obj.Schema.ActionType {
+			case ACTION_ADD:
+				s += ": added"
+			case ACTION_DELETE:
+				s += ": removed"
+			case ACTION_MODIFY:
+				s += ": altered"
+			}
+		}
+		s += "\n"
+
+		// Summarise the row changes.  For tables which were added or removed entirely, the row count is enough
+		if len(obj.Data) == 0 {
+			continue
+		}
+		var added, changed, deleted int
+		for _, j := range obj.Data {
+			switch j.ActionType {
+			case ACTION_ADD:
+				added++
+			case ACTION_DELETE:
+				deleted++
+			case ACTION_MODIFY:
+				changed++
+			}
+		}
+		s += numFormat.Sprintf("      Rows: %d added, %d changed, %d deleted\n", added, changed, deleted)
+		if obj.Schema != nil && obj.Schema.ActionType != ACTION_MODIFY {
+			continue
+		}
+		for _, j := range obj.Data {
+			var marker string
+			switch j.ActionType {
+			case ACTION_ADD:
+				marker = "+"
+			case ACTION_DELETE:
+				marker = "-"
+			case ACTION_MODIFY:
+				marker = "~"
+			}
+			var keys []string
+			for _, k := range j.Pk {
+				keys = append(keys, fmt.Sprintf("%s=%s", k.Name, sqlValue(k.Value)))
+			}
+			s += fmt.Sprintf("        %s %s\n", marker, strings.Join(keys, ", "))
+		}
+	}
+	return s + "\n"
+}
+
+// Compares two SQLite databases, returning the schema and data changes which turn the first one into the second
+func diffDatabases(fromPath, toPath string) (diffs dbDiffs, err error) {
+	// Open the "from" database, then attach the "to" database to the same connection so they can be queried together
+	sdb, err := openSQLite(fromPath, true)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	_, err = sdb.Exec(`ATTACH DATABASE ? AS aux`, sqliteURI(toPath, true))
+	if err != nil {
+		return
+	}
+
+	// Retrieve the list of schema objects in each database
+	fromObjs, err := schemaObjects(sdb, "main")
+	if err != nil {
+		return
+	}
+	toObjs, err := schemaObjects(sdb, "aux")
+	if err != nil {
+		return
+	}
+
+	// Create a combined list of the object names, ordered by object type then name
+	var names []string
+	for name := range fromObjs {
+		names = append(names, name)
+	}
+	for name := range toObjs {
+		if _, ok := fromObjs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := objectTypeRank(fromObjs, toObjs, names[i]), objectTypeRank(fromObjs, toObjs, names[j])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+
+	// Compare each of the objects
+	for _, name := range names {
+		fromObj, inFrom := fromObjs[name]
+		toObj, inTo := toObjs[name]
+
+		// If the object was replaced with one of a different type (eg a table replaced by a view), we treat it as
+		// being removed and then added again
+		if inFrom && inTo && fromObj.Type != toObj.Type {
+			var chg diffObjectChangeset
+			chg, err = objectRemovedOrAdded(sdb, "main", fromObj, ACTION_DELETE)
+			if err != nil {
+				return
+			}
+			diffs.Diff = append(diffs.Diff, chg)
+			chg, err = objectRemovedOrAdded(sdb, "aux", toObj, ACTION_ADD)
+			if err != nil {
+				return
+			}
+			diffs.Diff = append(diffs.Diff, chg)
+			continue
+		}
+
+		// Objects only present on one side
+		if !inTo {
+			var chg diffObjectChangeset
+			chg, err = objectRemovedOrAdded(sdb, "main", fromObj, ACTION_DELETE)
+			if err != nil {
+				return
+			}
+			diffs.Diff = append(diffs.Diff, chg)
+			continue
+		}
+		if !inFrom {
+			var chg diffObjectChangeset
+			chg, err = objectRemovedOrAdded(sdb, "aux", toObj, ACTION_ADD)
+			if err != nil {
+				return
+			}
+			diffs.Diff = append(diffs.Diff, chg)
+			continue
+		}
+
+		// The object is present in both databases
+		chg := diffObjectChangeset{ObjectName: name, ObjectType: toObj.Type}
+		if fromObj.SQL != toObj.SQL {
+			chg.Schema = &schemaDiff{ActionType: ACTION_MODIFY, Before: fromObj.SQL, After: toObj.SQL}
+		}
+		if toObj.Type == "table" && !isVirtualTable(toObj.SQL) && !isVirtualTable(fromObj.SQL) {
+			var fromPk, toPk []string
+			chg.ColsBefore, fromPk, err = tableColumns(sdb, "main", name)
+			if err != nil {
+				return
+			}
+			chg.ColsAfter, toPk, err = tableColumns(sdb, "aux", name)
+			if err != nil {
+				return
+			}
+			if sameStrings(chg.ColsBefore, chg.ColsAfter) && sameStrings(fromPk, toPk) {
+				// The table structure is compatible, so compare the rows using their primary key (or rowid)
+				chg.Data, err = tableRowDiffs(sdb, name, toPk, chg.ColsAfter)
+			} else {
+				// The columns of the table have changed, so its contents are treated as being completely replaced
+				var removed, added []dataDiff
+				removed, err = tableRows(sdb, "main", name, fromPk, chg.ColsBefore, ACTION_DELETE)
+				if err != nil {
+					return
+				}
+				added, err = tableRows(sdb, "aux", name, toPk, chg.ColsAfter, ACTION_ADD)
+				chg.Data = append(removed, added...)
+			}
+			if err != nil {
+				return
+			}
+		}
+		if chg.Schema != nil || len(chg.Data) > 0 {
+			diffs.Diff = append(diffs.Diff, chg)
+		}
+	}
+	return
+}
+
+// Returns true if the SQL for a table is for a virtual table.  We don't look at the data in those
+func isVirtualTable(sqlText string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(sqlText)), "CREATE VIRTUAL")
+}
+
+// Creates the changeset for a schema object which only exists on one side of the comparison.  For tables, every row
+// is included so the change can be applied (or undone) without access to the original database
+func objectRemovedOrAdded(sdb *sql.DB, schema string, obj schemaObject, action diffType) (chg diffObjectChangeset,
+	err error) {
+	chg = diffObjectChangeset{ObjectName: obj.Name, ObjectType: obj.Type}
+	if action == ACTION_DELETE {
+		chg.Schema = &schemaDiff{ActionType: action, Before: obj.SQL}
+	} else {
+		chg.Schema = &schemaDiff{ActionType: action, After: obj.SQL}
+	}
+	if obj.Type != "table" || isVirtualTable(obj.SQL) {
+		return
+	}
+	cols, pk, err := tableColumns(sdb, schema, obj.Name)
+	if err != nil {
+		return
+	}
+	if action == ACTION_DELETE {
+		chg.ColsBefore = cols
+	} else {
+		chg.ColsAfter = cols
+	}
+	chg.Data, err = tableRows(sdb, schema, obj.Name, pk, cols, action)
+	return
+}
+
+// Returns the sort position for an object type, so tables are listed before the things which depend on them
+func objectTypeRank(fromObjs, toObjs map[string]schemaObject, name string) int {
+	obj, ok := toObjs[name]
+	if !ok {
+		obj = fromObjs[name]
+	}
+	switch obj.Type {
+	case "table":
+		return 0
+	case "index":
+		return 1
+	case "view":
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Opens a SQLite database file.  The connection pool is limited to a single connection, so attached databases remain
+// available to every query
+func openSQLite(path string, readOnly bool) (sdb *sql.DB, err error) {
+	sdb, err = sql.Open("sqlite3", sqliteURI(path, readOnly))
+	if err != nil {
+		return
+	}
+	sdb.SetMaxOpenConns(1)
+	err = sdb.Ping()
+	if err != nil {
+		sdb.Close()
+	}
+	return
+}
+
+// Returns true if two string slices have the same contents in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the list of tables, indexes, views and triggers in a database schema, keyed by name
+func schemaObjects(sdb dbQuerier, schema string) (objs map[string]schemaObject, err error) {
+	rows, err := sdb.Query(fmt.Sprintf(`
+		SELECT type, name, tbl_name, coalesce(sql, '')
+		FROM %s.sqlite_master
+		WHERE name NOT LIKE 'sqlite_%%'`, quoteIdent(schema)))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	objs = make(map[string]schemaObject)
+	for rows.Next() {
+		var o schemaObject
+		err = rows.Scan(&o.Type, &o.Name, &o.TblName, &o.SQL)
+		if err != nil {
+			return
+		}
+		objs[o.Name] = o
+	}
+	err = rows.Err()
+	return
+}
+
+// Returns a SQLite identifier, quoted so it's safe to include in SQL statements
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Returns a value formatted as a SQLite literal, suitable for including in SQL statements
+func sqlValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return fmt.Sprintf("X'%s'", strings.ToUpper(hex.EncodeToString(val)))
+	case string:
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'"
+	case bool:
+		if val {
+			return "1"
+		}
+		return "0"
+	case float64:
+		// SQL has no literal for infinity, but SQLite reads a value too large for a REAL as one
+		if math.IsInf(val, 1) {
+			return "9e999"
+		}
+		if math.IsInf(val, -1) {
+			return "-9e999"
+		}
+
+		// Make sure whole numbers still look like floating point values, so they keep the REAL type
+		f := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(f, ".eEIN") {
+			f += ".0"
+		}
+		return f
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// Returns the SQLite URI for a database file
+func sqliteURI(path string, readOnly bool) string {
+	p := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(path))
+	if readOnly {
+		return fmt.Sprintf("file:%s?mode=ro", p)
+	}
+	return fmt.Sprintf("file:%s?mode=rw", p)
+}
+
+// Returns the column names of a table, along with the columns making up its primary key.  For tables without an
+// explicit primary key the rowid is used instead
+func tableColumns(sdb dbQuerier, schema, table string) (cols []string, pk []string, err error) {
+	rows, err := sdb.Query(fmt.Sprintf(`PRAGMA %s.table_info(%s)`, quoteIdent(schema), quoteIdent(table)))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	pkCols := make(map[int]string)
+	for rows.Next() {
+		var cid, notNull, pkPos int
+		var name, colType string
+		var dflt interface{}
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pkPos)
+		if err != nil {
+			return
+		}
+		cols = append(cols, name)
+		if pkPos > 0 {
+			pkCols[pkPos] = name
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	for i := 1; i <= len(pkCols); i++ {
+		pk = append(pk, pkCols[i])
+	}
+	if len(pk) == 0 {
+		pk = []string{"rowid"}
+	}
+	return
+}
+
+// Returns the row level differences for a table which exists with the same structure in both databases
+func tableRowDiffs(sdb *sql.DB, table string, pk, cols []string) (diffs []dataDiff, err error) {
+	var keyMatch, orderBy, mCols, aCols, changed []string
+	for _, k := range pk {
+		keyMatch = append(keyMatch, fmt.Sprintf("a.%s IS m.%s", quoteIdent(k), quoteIdent(k)))
+		orderBy = append(orderBy, "m."+quoteIdent(k))
+	}
+	for _, c := range cols {
+		mCols = append(mCols, "+m."+quoteIdent(c))
+		aCols = append(aCols, "+a."+quoteIdent(c))
+		changed = append(changed, fmt.Sprintf("m.%s IS NOT a.%s", quoteIdent(c), quoteIdent(c)))
+	}
+	t := quoteIdent(table)
+
+	// Rows which have been deleted
+	dbQuery := fmt.Sprintf(`
+		SELECT %s, %s
+		FROM main.%s AS m
+		WHERE NOT EXISTS (SELECT 1 FROM aux.%s AS a WHERE %s)
+		ORDER BY %s`, keyList("m", pk), strings.Join(mCols, ", "), t, t, strings.Join(keyMatch, " AND "),
+		strings.Join(orderBy, ", "))
+	deleted, err := queryDataDiffs(sdb, dbQuery, ACTION_DELETE, pk, len(cols), 0)
+	if err != nil {
+		return
+	}
+
+	// Rows which have been changed
+	dbQuery = fmt.Sprintf(`
+		SELECT %s, %s, %s
+		FROM main.%s AS m INNER JOIN aux.%s AS a ON %s
+		WHERE %s
+		ORDER BY %s`, keyList("m", pk), strings.Join(mCols, ", "), strings.Join(aCols, ", "), t, t,
+		strings.Join(keyMatch, " AND "), strings.Join(changed, " OR "), strings.Join(orderBy, ", "))
+	modified, err := queryDataDiffs(sdb, dbQuery, ACTION_MODIFY, pk, len(cols), len(cols))
+	if err != nil {
+		return
+	}
+
+	// Rows which have been added
+	keyMatch = keyMatch[:0]
+	orderBy = orderBy[:0]
+	for _, k := range pk {
+		keyMatch = append(keyMatch, fmt.Sprintf("m.%s IS a.%s", quoteIdent(k), quoteIdent(k)))
+		orderBy = append(orderBy, "a."+quoteIdent(k))
+	}
+	dbQuery = fmt.Sprintf(`
+		SELECT %s, %s
+		FROM aux.%s AS a
+		WHERE NOT EXISTS (SELECT 1 FROM main.%s AS m WHERE %s)
+		ORDER BY %s`, keyList("a", pk), strings.Join(aCols, ", "), t, t, strings.Join(keyMatch, " AND "),
+		strings.Join(orderBy, ", "))
+	added, err := queryDataDiffs(sdb, dbQuery, ACTION_ADD, pk, 0, len(cols))
+	if err != nil {
+		return
+	}
+
+	// Deletions come first, so that applying the changes in order never runs into a duplicate key
+	diffs = append(diffs, deleted...)
+	diffs = append(diffs, modified...)
+	diffs = append(diffs, added...)
+	return
+}
+
+// Returns every row of a table as a data change of the given type
+func tableRows(sdb *sql.DB, schema, table string, pk, cols []string, action diffType) (diffs []dataDiff, err error) {
+	var sel, orderBy []string
+	for _, c := range cols {
+		sel = append(sel, "+t."+quoteIdent(c))
+	}
+	for _, k := range pk {
+		orderBy = append(orderBy, "t."+quoteIdent(k))
+	}
+	dbQuery := fmt.Sprintf(`SELECT %s, %s FROM %s.%s AS t ORDER BY %s`, keyList("t", pk), strings.Join(sel, ", "),
+		quoteIdent(schema), quoteIdent(table), strings.Join(orderBy, ", "))
+	if action == ACTION_DELETE {
+		return queryDataDiffs(sdb, dbQuery, action, pk, len(cols), 0)
+	}
+	return queryDataDiffs(sdb, dbQuery, action, pk, 0, len(cols))
+}
+
+// Returns the list of primary key columns for a table alias, ready for including in a SELECT
+func keyList(alias string, pk []string) string {
+	var keys []string
+	for _, k := range pk {
+		keys = append(keys, fmt.Sprintf("+%s.%s", alias, quoteIdent(k)))
+	}
+	return strings.Join(keys, ", ")
+}
+
+// Runs a query returning primary key values followed by the "before" and/or "after" column values of rows, and
+// converts the results into data changes
+func queryDataDiffs(sdb *sql.DB, dbQuery string, action diffType, pk []string, numBefore, numAfter int) (
+	diffs []dataDiff, err error) {
+	rows, err := sdb.Query(dbQuery)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	numCols := len(pk) + numBefore + numAfter
+	for rows.Next() {
+		vals := make([]interface{}, numCols)
+		ptrs := make([]interface{}, numCols)
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return
+		}
+		d := dataDiff{ActionType: action}
+		for i, k := range pk {
+			d.Pk = append(d.Pk, dataValue{Name: k, Value: vals[i]})
+		}
+		if numBefore > 0 {
+			d.DataBefore = vals[len(pk) : len(pk)+numBefore]
+		}
+		if numAfter > 0 {
+			d.DataAfter = vals[len(pk)+numBefore:]
+		}
+		diffs = append(diffs, d)
+	}
+	err = rows.Err()
+	return
+}
@@ -6,19 +6,26 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/client"
 	chk "gopkg.in/check.v1"
 )
 
@@ -1119,7 +1126,2389 @@ func (s *DioSuite) Test0320_PushOldLocalMetadataDBConflict(c *chk.C) {
 	c.Check(err, chk.Not(chk.IsNil))
 }
 
+// Tests displaying the differences between a commit and a changed working database
+func (s *DioSuite) Test0330_Diff(c *chk.C) {
+	// Recreate the working copy of our original test database, using the commit on its main branch
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	b, err := os.ReadFile(filepath.Join(".dio", s.dbName, "db", head.Tree.Entries[0].Sha256))
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(s.dbName, b, 0644)
+	c.Assert(err, chk.IsNil)
+
+	// With no changes to the database, there should be no differences
+	diffCmdFrom = "main"
+	diffCmdTo = "working"
+	err = diff([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "No differences found"), chk.Equals, true)
+	s.buf.Reset()
+
+	// Change the schema and some of the rows in the working database
+	err = modifyTestDB(s.dbName, `
+		UPDATE tiny SET col_name = 'changed' WHERE rowid = 1;
+		DELETE FROM tiny WHERE rowid = 2;
+		INSERT INTO tiny SELECT * FROM tiny WHERE rowid = 3;
+		CREATE INDEX tiny_name ON tiny (col_name);
+		DROP TABLE hundred;`)
+	c.Assert(err, chk.IsNil)
+
+	// Check the differences are detected
+	diffs, err := diffDatabases(filepath.Join(".dio", s.dbName, "db", head.Tree.Entries[0].Sha256), s.dbName)
+	c.Assert(err, chk.IsNil)
+	c.Assert(diffs.Diff, chk.HasLen, 3)
+	c.Check(diffs.Diff[0].ObjectName, chk.Equals, "hundred")
+	c.Check(diffs.Diff[0].Schema.ActionType, chk.Equals, ACTION_DELETE)
+	c.Check(diffs.Diff[0].Data, chk.HasLen, 10)
+	c.Check(diffs.Diff[1].ObjectName, chk.Equals, "tiny")
+	c.Check(diffs.Diff[1].Schema, chk.IsNil)
+	c.Assert(diffs.Diff[1].Data, chk.HasLen, 3)
+	c.Check(diffs.Diff[1].Data[0].ActionType, chk.Equals, ACTION_DELETE)
+	c.Check(diffs.Diff[1].Data[0].Pk, chk.DeepEquals, []dataValue{{Name: "rowid", Value: int64(2)}})
+	c.Check(diffs.Diff[1].Data[1].ActionType, chk.Equals, ACTION_MODIFY)
+	c.Check(diffs.Diff[1].Data[1].Pk, chk.DeepEquals, []dataValue{{Name: "rowid", Value: int64(1)}})
+	c.Check(diffs.Diff[1].Data[1].DataAfter[8], chk.Equals, "changed")
+	c.Check(diffs.Diff[1].Data[2].ActionType, chk.Equals, ACTION_ADD)
+	c.Check(diffs.Diff[1].Data[2].Pk, chk.DeepEquals, []dataValue{{Name: "rowid", Value: int64(11)}})
+	c.Check(diffs.Diff[2].ObjectName, chk.Equals, "tiny_name")
+	c.Check(diffs.Diff[2].Schema.ActionType, chk.Equals, ACTION_ADD)
+
+	// Verify the output given to the user, using the tag created in an earlier test as the "from" side
+	tagCreateTag = "difftag"
+	tagCreateCommit = head.ID
+	tagCreateMsg = ""
+	err = tagCreate([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	diffCmdFrom = "difftag"
+	diffCmdTo = ""
+	err = diff([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	out := s.buf.String()
+	c.Check(strings.Contains(out, "* Table 'hundred': removed"), chk.Equals, true)
+	c.Check(strings.Contains(out, "Rows: 1 added, 1 changed, 1 deleted"), chk.Equals, true)
+	c.Check(strings.Contains(out, "~ rowid=1"), chk.Equals, true)
+	c.Check(strings.Contains(out, "* Index 'tiny_name': added"), chk.Equals, true)
+}
+
+func (s *DioSuite) Test0340_Merge(c *chk.C) {
+	// Restore the working database to the head of the main branch, then create a new branch from it
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	err = writeCommitToWorkingFile(s.dbName, meta, meta.Branches["main"].Commit)
+	c.Assert(err, chk.IsNil)
+	branchCreateBranch = "mergetwo"
+	branchCreateCommit = meta.Branches["main"].Commit
+	branchCreateMsg = ""
+	err = branchCreate([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// Commit a change to the main branch
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'main side' WHERE rowid = 1;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	commitCmdMsg = "Change on main"
+	commitCmdTimestamp = ""
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// Commit different changes to the new branch
+	branchActiveSetBranch = "mergetwo"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `
+		UPDATE tiny SET col_code = 'branch side' WHERE rowid = 1;
+		DELETE FROM tiny WHERE rowid = 3;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "mergetwo"
+	commitCmdMsg = "Change on mergetwo"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// Merge the new branch into main
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	ours := meta.Branches["main"]
+	theirs := meta.Branches["mergetwo"]
+	mergeCmdInto = ""
+	mergeCmdMsg = ""
+	s.buf.Reset()
+	err = merge([]string{s.dbName, "mergetwo"})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'mergetwo' merged into 'main'"), chk.Equals, true)
+
+	// Verify the merge commit has both branch heads as parents
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	br := meta.Branches["main"]
+	c.Check(br.CommitCount, chk.Equals, ours.CommitCount+1)
+	com, ok := meta.Commits[br.Commit]
+	c.Assert(ok, chk.Equals, true)
+	c.Check(com.Parent, chk.Equals, ours.Commit)
+	c.Check(com.OtherParents, chk.DeepEquals, []string{theirs.Commit})
+	c.Check(com.Message, chk.Equals, "Merge branch 'mergetwo' into 'main'")
+
+	// Verify the working database has the changes from both branches
+	sdb, err := sql.Open("sqlite3", s.dbName)
+	c.Assert(err, chk.IsNil)
+	var name, code string
+	err = sdb.QueryRow(`SELECT col_name, col_code FROM tiny WHERE rowid = 1`).Scan(&name, &code)
+	c.Check(err, chk.IsNil)
+	c.Check(name, chk.Equals, "main side")
+	c.Check(code, chk.Equals, "branch side")
+	var count int
+	err = sdb.QueryRow(`SELECT count(*) FROM tiny WHERE rowid = 3`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 0)
+	sdb.Close()
+
+	// Change the same row differently on both branches
+	branchActiveSetBranch = "mergetwo"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'conflict two' WHERE rowid = 2;`)
+	c.Assert(err, chk.IsNil)
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'conflict main' WHERE rowid = 2;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// The merge should stop with the conflicting row reported, and normal commits should be refused
+	s.buf.Reset()
+	err = merge([]string{s.dbName, "mergetwo"})
+	c.Assert(err, chk.NotNil)
+	c.Check(strings.Contains(s.buf.String(), "* Table 'tiny', row rowid=2"), chk.Equals, true)
+	state, err := loadMergeState(s.dbName)
+	c.Assert(err, chk.IsNil)
+	c.Assert(state, chk.NotNil)
+	c.Check(state.Conflicts, chk.HasLen, 1)
+	err = commit([]string{s.dbName})
+	c.Check(err, chk.NotNil)
+
+	// Aborting a merge started from another branch switches back to that branch
+	mergeCmdAbort = true
+	err = merge([]string{s.dbName})
+	mergeCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "mergetwo"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	mergeCmdInto = "main"
+	err = merge([]string{s.dbName, "mergetwo"})
+	mergeCmdInto = ""
+	c.Assert(err, chk.NotNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "main")
+	mergeCmdAbort = true
+	err = merge([]string{s.dbName})
+	mergeCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "mergetwo")
+	changed, err := dbChanged(s.dbName, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = merge([]string{s.dbName, "mergetwo"})
+	c.Assert(err, chk.NotNil)
+
+	// Resolve the conflict, then finish the merge
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'resolved' WHERE rowid = 2;`)
+	c.Assert(err, chk.IsNil)
+	mergeCmdContinue = true
+	err = merge([]string{s.dbName})
+	mergeCmdContinue = false
+	c.Assert(err, chk.IsNil)
+	state, err = loadMergeState(s.dbName)
+	c.Assert(err, chk.IsNil)
+	c.Check(state, chk.IsNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	com = meta.Commits[meta.Branches["main"].Commit]
+	c.Check(com.OtherParents, chk.DeepEquals, []string{meta.Branches["mergetwo"].Commit})
+}
+
+// Tests force pushing a local branch which has diverged from the remote one
+func (s *DioSuite) Test0350_PushForce(c *chk.C) {
+	// Create a new local commit for 19kBv3.sqlite, on top of the original commit it was reverted to earlier
+	newDB := "19kBv3.sqlite"
+	err := modifyTestDB(newDB, `UPDATE tiny SET col_name = 'force pushed' WHERE rowid = 1;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	commitCmdLicence = ""
+	commitCmdMsg = "Diverging commit"
+	commitCmdTimestamp = ""
+	err = commit([]string{newDB})
+	c.Assert(err, chk.IsNil)
+
+	// Pushing without --force should fail, as the local and remote branches have conflicting commits
+	pushCmdName = ""
+	pushCmdBranch = ""
+	pushCmdCommit = ""
+	pushCmdDB = newDB
+	pushCmdEmail = ""
+	pushCmdForce = false
+	pushCmdLicence = ""
+	pushCmdMsg = ""
+	pushCmdPublic = false
+	err = push([]string{newDB})
+	c.Assert(err, chk.NotNil)
+	c.Check(strings.Contains(err.Error(), "conflicting commits"), chk.Equals, true)
+
+	// With --force, the remote branch should be overwritten with the local one
+	pushCmdForce = true
+	err = push([]string{newDB})
+	pushCmdForce = false
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	remoteMeta, _, err := retrieveMetadata(newDB)
+	c.Assert(err, chk.IsNil)
+	c.Check(remoteMeta.Branches["main"].Commit, chk.Equals, meta.Branches["main"].Commit)
+}
+
+// Tests fetching the latest metadata from the server, without changing the local branches
+func (s *DioSuite) Test0360_Fetch(c *chk.C) {
+	// Fetch the database force pushed in the previous test.  The local branch should match the remote one
+	newDB := "19kBv3.sqlite"
+	err := fetch([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'main' is up to date with 'origin/main'"), chk.Equals, true)
+	meta, err := localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches["main"]
+	c.Check(meta.RemoteBranches["origin/main"].Commit, chk.Equals, head.Commit)
+
+	// Move the local branch back a commit, then fetch again.  The local branch should now be behind the remote one,
+	// and be left unchanged by the fetch
+	branchRevertBranch = "main"
+	branchRevertCommit = meta.Commits[head.Commit].Parent
+	branchRevertTag = ""
+	err = branchRevert([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	err = fetch([]string{newDB})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'main' is 0 commit(s) ahead and 1 commit(s) behind "+
+		"'origin/main'"), chk.Equals, true)
+	meta, err = localFetchMetadata(newDB, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"].Commit, chk.Equals, branchRevertCommit)
+	c.Check(meta.RemoteBranches["origin/main"].Commit, chk.Equals, head.Commit)
+}
+
+// Tests replaying the local commits of a branch on top of another branch
+func (s *DioSuite) Test0370_Rebase(c *chk.C) {
+	// Create a new branch from the head of main, and commit a change to it
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	base := meta.Branches["main"]
+	branchCreateBranch = "rebasetwo"
+	branchCreateCommit = base.Commit
+	branchCreateMsg = ""
+	err = branchCreate([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "rebasetwo"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'rebase upstream' WHERE rowid = 4;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "rebasetwo"
+	commitCmdMsg = "Upstream change"
+	commitCmdTimestamp = ""
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// Commit two changes to main
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'rebase local' WHERE rowid = 5;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "First local change"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `DELETE FROM tiny WHERE rowid = 6;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Second local change"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+
+	// Rebase main onto the new branch
+	rebaseCmdBranch = ""
+	rebaseCmdOnto = "rebasetwo"
+	err = rebase([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Branch 'main' rebased"), chk.Equals, true)
+
+	// Verify the local commits were replayed on top of the new branch, keeping their messages
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	upstream := meta.Branches["rebasetwo"]
+	head := meta.Branches["main"]
+	c.Check(head.CommitCount, chk.Equals, upstream.CommitCount+2)
+	second := meta.Commits[head.Commit]
+	c.Check(second.Message, chk.Equals, "Second local change")
+	first := meta.Commits[second.Parent]
+	c.Check(first.Message, chk.Equals, "First local change")
+	c.Check(first.Parent, chk.Equals, upstream.Commit)
+
+	// Verify the working database has the changes from both branches
+	sdb, err := sql.Open("sqlite3", s.dbName)
+	c.Assert(err, chk.IsNil)
+	var count int
+	err = sdb.QueryRow(`
+		SELECT count(*)
+		FROM tiny
+		WHERE (rowid = 4 AND col_name = 'rebase upstream') OR (rowid = 5 AND col_name = 'rebase local')`).
+		Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 2)
+	err = sdb.QueryRow(`SELECT count(*) FROM tiny WHERE rowid = 6`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 0)
+	sdb.Close()
+
+	// Commit conflicting changes to both branches.  The rebase should stop, then be cancelled
+	branchActiveSetBranch = "rebasetwo"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'upstream conflict' WHERE rowid = 7;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "rebasetwo"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(s.dbName, `UPDATE tiny SET col_name = 'local conflict' WHERE rowid = 7;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdBranch = "main"
+	err = commit([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	origHead := meta.Branches["main"]
+	s.buf.Reset()
+	err = rebase([]string{s.dbName})
+	c.Assert(err, chk.NotNil)
+	c.Check(strings.Contains(s.buf.String(), "* Table 'tiny', row rowid=7"), chk.Equals, true)
+	rebaseCmdAbort = true
+	err = rebase([]string{s.dbName})
+	rebaseCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"], chk.DeepEquals, origHead)
+	changed, err := dbChanged(s.dbName, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+
+	// A branch without any commits of its own is just moved forward, and rebasing it again does nothing
+	branchCreateBranch = "rebasebehind"
+	branchCreateCommit = meta.Commits[origHead.Commit].Parent
+	err = branchCreate([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	rebaseCmdBranch = "rebasebehind"
+	rebaseCmdOnto = "main"
+	s.buf.Reset()
+	err = rebase([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("Branch 'rebasebehind' fast-forwarded to commit %s from "+
+		"'main'\n", origHead.Commit))
+	meta, err = localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["rebasebehind"].Commit, chk.Equals, origHead.Commit)
+	c.Check(meta.Branches["rebasebehind"].CommitCount, chk.Equals, origHead.CommitCount)
+	s.buf.Reset()
+	err = rebase([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Nothing to rebase"), chk.Equals, true)
+	rebaseCmdBranch, rebaseCmdOnto = "", ""
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+}
+
+// Tests resuming an interrupted database download
+func (s *DioSuite) Test0380_DownloadResume(c *chk.C) {
+	// Serve a database from a local test server, keeping track of the ranges requested
+	b, err := os.ReadFile(filepath.Join(s.dbName))
+	c.Assert(err, chk.IsNil)
+	z := sha256.Sum256(b)
+	shaSum := hex.EncodeToString(z[:])
+	var ranges []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "resume.sqlite", time.Now(), bytes.NewReader(b))
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure := cloud, TLSConfig.InsecureSkipVerify
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify = oldCloud, oldInsecure
+	}()
+
+	// Pretend an earlier download was interrupted half way through
+	db := "resume.sqlite"
+	commitID := "0000000000000000000000000000000000000000000000000000000000000001"
+	err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(filepath.Join(".dio", db, "db", "commit-"+commitID+".part"), b[:len(b)/2], 0644)
+	c.Assert(err, chk.IsNil)
+
+	// The download should carry on from where it stopped, with the result having the correct checksum
+	err = checkDBCache(db, commitID, shaSum)
+	c.Assert(err, chk.IsNil)
+	c.Check(ranges, chk.DeepEquals, []string{fmt.Sprintf("bytes=%d-", len(b)/2)})
+	cached, err := os.ReadFile(filepath.Join(".dio", db, "db", shaSum))
+	c.Assert(err, chk.IsNil)
+	c.Check(cached, chk.DeepEquals, b)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", "commit-"+commitID+".part"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// If the server sends a different database than the one asked for, the cached copy of that one is left alone
+	otherID := "0000000000000000000000000000000000000000000000000000000000000002"
+	otherSum := "0000000000000000000000000000000000000000000000000000000000000003"
+	err = checkDBCache(db, otherID, otherSum)
+	c.Check(err, chk.ErrorMatches, fmt.Sprintf("(?s)Aborting: newly downloaded database file should have checksum "+
+		"'%s', but data with checksum '%s' received.*", otherSum, shaSum))
+	c.Check(cacheExists(db, shaSum), chk.Equals, true)
+	c.Check(cacheExists(db, otherSum), chk.Equals, false)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", "commit-"+otherID+".part"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+}
+
+// Tests uploads being retried after server errors
+func (s *DioSuite) Test0390_UploadRetry(c *chk.C) {
+	// Run a local test server, which fails the first two upload attempts
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	attempts := 0
+	var received []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f, _, err := r.FormFile("file1")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received, _ = io.ReadAll(f)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"commit_id": "abc"}`)
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure, oldDelay := cloud, TLSConfig.InsecureSkipVerify, uploadRetryDelay
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	uploadRetryDelay = time.Millisecond
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify, uploadRetryDelay = oldCloud, oldInsecure, oldDelay
+	}()
+
+	// The upload should succeed on the third attempt, with the complete database being received
+	body, acked, err := uploadDatabase(fOut, s.dbName, url.Values{}, s.dbName, nil)
+	c.Assert(err, chk.IsNil)
+	c.Check(acked, chk.Equals, false)
+	c.Check(string(body), chk.Equals, `{"commit_id": "abc"}`)
+	c.Check(attempts, chk.Equals, 3)
+	c.Check(received, chk.DeepEquals, b)
+
+	// If the server says it already has the upload, it shouldn't be sent again
+	attempts = 0
+	_, acked, err = uploadDatabase(fOut, s.dbName, url.Values{}, s.dbName, func() bool { return true })
+	c.Assert(err, chk.IsNil)
+	c.Check(acked, chk.Equals, true)
+	c.Check(attempts, chk.Equals, 1)
+
+	// Client errors aren't retried
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusConflict)
+	})
+	attempts = 0
+	_, _, err = uploadDatabase(fOut, s.dbName, url.Values{}, s.dbName, nil)
+	c.Check(err, chk.NotNil)
+	c.Check(attempts, chk.Equals, 1)
+}
+
 // genTestCert retrieves a client certificate from the remote server
+func (s *DioSuite) Test0400_StatCache(c *chk.C) {
+	// Copy the test database to a new file, with a last modified time old enough to be cached
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	z := sha256.Sum256(b)
+	shaSum := hex.EncodeToString(z[:])
+	db := "statcache.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	lastMod := time.Now().Add(-time.Hour)
+	err = os.Chtimes(db, lastMod, lastMod)
+	c.Assert(err, chk.IsNil)
+
+	// The first call hashes the file and adds it to the stat cache
+	got, err := cachedFileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(got, chk.Equals, shaSum)
+	cache, err := loadStatCache(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(cache[db].Sha256, chk.Equals, shaSum)
+	c.Check(cache[db].Size, chk.Equals, int64(len(b)))
+
+	// While the file is untouched the cached value is used, without reading the file again
+	e := cache[db]
+	e.Sha256 = "cached"
+	cache[db] = e
+	err = saveStatCache(db, cache)
+	c.Assert(err, chk.IsNil)
+	got, err = cachedFileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(got, chk.Equals, "cached")
+
+	// Changing the last modified time means the file is hashed again
+	lastMod = lastMod.Add(time.Minute)
+	err = os.Chtimes(db, lastMod, lastMod)
+	c.Assert(err, chk.IsNil)
+	got, err = cachedFileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(got, chk.Equals, shaSum)
+
+	// Recently modified files are hashed, but not cached
+	err = os.Chtimes(db, time.Now(), time.Now())
+	c.Assert(err, chk.IsNil)
+	got, err = cachedFileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(got, chk.Equals, shaSum)
+	cache, err = loadStatCache(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(cache[db].LastModified.Equal(lastMod), chk.Equals, true)
+}
+
+func (s *DioSuite) Test0410_StructuredOutput(c *chk.C) {
+	oldFormat := outputFormat
+	defer func() {
+		outputFormat = oldFormat
+	}()
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+
+	// Branch list, as JSON
+	outputFormat = OUTPUT_JSON
+	err = branchList([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var branches branchListOutput
+	err = json.Unmarshal(s.buf.Bytes(), &branches)
+	c.Assert(err, chk.IsNil)
+	c.Check(branches.Database, chk.Equals, s.dbName)
+	c.Check(branches.ActiveBranch, chk.Equals, meta.ActiveBranch)
+	c.Check(branches.Branches, chk.DeepEquals, meta.Branches)
+
+	// Status, as JSON
+	s.buf.Reset()
+	err = status([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	var st []statusEntry
+	err = json.Unmarshal(s.buf.Bytes(), &st)
+	c.Assert(err, chk.IsNil)
+	c.Assert(st, chk.HasLen, 1)
+	c.Check(st[0].Database, chk.Equals, s.dbName)
+
+	// Log, as YAML.  The commits should be listed newest first
+	outputFormat = OUTPUT_YAML
+	s.buf.Reset()
+	err = branchLog([]string{s.dbName})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "branch: "+meta.ActiveBranch+"\n"), chk.Equals, true)
+	c.Check(strings.Contains(s.buf.String(), "- author_email: "), chk.Equals, true)
+	c.Check(strings.Index(s.buf.String(), "id: "+meta.Branches[meta.ActiveBranch].Commit) > 0, chk.Equals, true)
+
+	// A commit missing from the history is an error, rather than being listed as an empty commit
+	head := meta.Branches[meta.ActiveBranch]
+	broken := newMetaStruct(meta.ActiveBranch)
+	broken.Branches[meta.ActiveBranch] = head
+	headCommit := meta.Commits[head.Commit]
+	headCommit.Parent = "0000000000000000000000000000000000000000000000000000000000000001"
+	broken.Commits[head.Commit] = headCommit
+	err = saveMetadata("brokenlog.sqlite", broken)
+	c.Assert(err, chk.IsNil)
+	defer os.RemoveAll(dioDir("brokenlog.sqlite"))
+	err = branchLog([]string{"brokenlog.sqlite"})
+	c.Check(err, chk.ErrorMatches, "Broken commit history: commit '.*' isn't in the local commit cache")
+
+	// Errors should include a stable error code
+	outputFormat = OUTPUT_JSON
+	s.buf.Reset()
+	err = writeError(errNoDatabase)
+	c.Assert(err, chk.IsNil)
+	var e errorOutput
+	err = json.Unmarshal(s.buf.Bytes(), &e)
+	c.Assert(err, chk.IsNil)
+	c.Check(e.Code, chk.Equals, ERR_NO_DATABASE)
+	c.Check(e.Error, chk.Equals, errNoDatabase.Error())
+
+	// Unknown output formats are rejected
+	outputFormat = "xml"
+	c.Check(errorCode(checkOutputFormat()), chk.Equals, ERR_OUTPUT_FORMAT)
+}
+
+// Tests pushing tags to the server, including tags removed locally and conflicting ones
+func (s *DioSuite) Test0420_PushTags(c *chk.C) {
+	// Start with the metadata of the test database, and a server which has the same commits
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches[meta.ActiveBranch].Commit
+	remoteMeta := meta
+	remoteMeta.Tags = map[string]tagEntry{
+		"conflict": {Commit: "0000000000000000000000000000000000000000000000000000000000000001"},
+		"removed":  {Commit: head},
+	}
+	meta.Tags = map[string]tagEntry{
+		"conflict": {Commit: head},
+		"new":      {Commit: head, Description: "A new tag"},
+	}
+	meta.RemoteTags = remoteMeta.Tags
+	db := "tagpush.sqlite"
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+
+	// Run a local test server, keeping track of the tags created and removed
+	var created, removed []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/get":
+			json.NewEncoder(w).Encode(remoteMeta)
+		case "/tag/create":
+			c.Check(r.URL.Query().Get("commit"), chk.Equals, head)
+			c.Check(r.URL.Query().Get("msg"), chk.Equals, "A new tag")
+			created = append(created, r.URL.Query().Get("tag"))
+			w.WriteHeader(http.StatusCreated)
+		case "/tag/remove":
+			removed = append(removed, r.URL.Query().Get("tag"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure := cloud, TLSConfig.InsecureSkipVerify
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify = oldCloud, oldInsecure
+	}()
+
+	// The new tag should be created, the removed one removed, and the conflicting one reported
+	err = pushTags(&s.buf, db)
+	c.Check(err, chk.ErrorMatches, "1 tag.* couldn't be pushed")
+	c.Check(created, chk.DeepEquals, []string{"new"})
+	c.Check(removed, chk.DeepEquals, []string{"removed"})
+	c.Check(strings.Contains(s.buf.String(), "Tag 'conflict' conflicts"), chk.Equals, true)
+
+	// The tags now on the server should be remembered for the next push
+	newMeta, err := loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(newMeta.RemoteTags, chk.HasLen, 2)
+	c.Check(newMeta.RemoteTags["new"].Commit, chk.Equals, head)
+	_, ok := newMeta.RemoteTags["removed"]
+	c.Check(ok, chk.Equals, false)
+}
+
+// Tests working with several databases at once
+func (s *DioSuite) Test0430_MultipleDatabases(c *chk.C) {
+	// Make copies of the test database, each with the same local metadata.  One of them is then changed
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	fi, err := os.Stat(s.dbName)
+	c.Assert(err, chk.IsNil)
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	for _, j := range []string{"multi-a.sqlite", "multi-b.sqlite", "multi-c.sqlite"} {
+		err = os.WriteFile(j, b, 0644)
+		c.Assert(err, chk.IsNil)
+		err = os.Chtimes(j, fi.ModTime(), fi.ModTime())
+		c.Assert(err, chk.IsNil)
+		err = saveMetadata(j, meta)
+		c.Assert(err, chk.IsNil)
+	}
+	err = modifyTestDB("multi-b.sqlite", "CREATE TABLE multi (a INTEGER)")
+	c.Assert(err, chk.IsNil)
+
+	// Glob patterns are expanded in alphabetical order, with each database only being included once
+	dbs, err := expandDatabases([]string{"multi-c.sqlite", "multi-*.sqlite"}, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(dbs, chk.DeepEquals, []string{"multi-c.sqlite", "multi-a.sqlite", "multi-b.sqlite"})
+	_, err = expandDatabases([]string{"nothing-*.sqlite"}, false)
+	c.Check(err, chk.ErrorMatches, "No databases match 'nothing-.*")
+
+	// Each database has its status shown, with a database which can't be checked failing the command
+	err = status([]string{"multi-*.sqlite", "multi-missing.sqlite"})
+	c.Check(err, chk.ErrorMatches, "1 of 4 databases failed")
+	c.Check(s.buf.String(), chk.Matches, "(?s)  \\* 'multi-a.sqlite': unchanged\n.*"+
+		"  \\* 'multi-b.sqlite': has been changed\n.*"+
+		"  \\* 'multi-c.sqlite': unchanged\n.*"+
+		"  \\* 'multi-missing.sqlite': failed - .*\n")
+
+	// The output of each database is displayed in the order they were given, followed by a summary
+	s.buf.Reset()
+	err = forEachDatabase([]string{"a", "b", "c"}, 2, func(out io.Writer, db string) error {
+		fmt.Fprintf(out, "Working on %s\n", db)
+		if db == "b" {
+			return errors.New("broken")
+		}
+		return nil
+	})
+	c.Check(err, chk.ErrorMatches, "1 of 3 databases failed")
+	c.Check(s.buf.String(), chk.Equals, "==> a <==\nWorking on a\n\n==> b <==\nWorking on b\n\n"+
+		"==> c <==\nWorking on c\n\nSummary:\n  * 'a': ok\n  * 'b': failed - broken\n  * 'c': ok\n")
+}
+
+// Tests the status of all databases in a directory
+func (s *DioSuite) Test0440_WorkspaceStatus(c *chk.C) {
+	// Work in a new directory, so only the databases created here are seen
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	defer os.Chdir(oldDir)
+
+	// Create a database with two commits, only the first of which has been pushed
+	lastMod := time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)
+	err = os.WriteFile("ws-a.sqlite", b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = os.Chtimes("ws-a.sqlite", lastMod, lastMod)
+	c.Assert(err, chk.IsNil)
+	z := sha256.Sum256(b)
+	tree := dbTree{Entries: []dbTreeEntry{{EntryType: DATABASE, LastModified: lastMod, Name: "ws-a.sqlite",
+		Sha256: hex.EncodeToString(z[:]), Size: int64(len(b))}}}
+	tree.ID = client.TreeID(tree.Entries)
+	com1 := commitEntry{Message: "First", Timestamp: lastMod, Tree: tree}
+	com1.ID = client.CommitID(com1)
+	com2 := commitEntry{Message: "Second", Parent: com1.ID, Timestamp: lastMod.Add(time.Hour), Tree: tree}
+	com2.ID = client.CommitID(com2)
+	meta := newMetaStruct("main")
+	meta.Branches["main"] = branchEntry{Commit: com2.ID, CommitCount: 2}
+	meta.Commits = map[string]commitEntry{com1.ID: com1, com2.ID: com2}
+	setRemoteBranch(&meta, DEFAULT_REMOTE, "main", branchEntry{Commit: com1.ID, CommitCount: 1})
+	err = saveMetadata("ws-a.sqlite", meta)
+	c.Assert(err, chk.IsNil)
+
+	// And another whose file has been removed
+	setRemoteBranch(&meta, DEFAULT_REMOTE, "main", meta.Branches["main"])
+	err = saveMetadata("ws-b.sqlite", meta)
+	c.Assert(err, chk.IsNil)
+
+	// And one which has never been fetched, so the number of unpushed commits isn't known
+	meta.RemoteBranches = nil
+	err = saveMetadata("ws-c.sqlite", meta)
+	c.Assert(err, chk.IsNil)
+
+	// With no database given, all of them should be shown
+	err = status(nil)
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, "  * 'ws-a.sqlite': unchanged\n    Branch: main\n"+
+		"    Unpushed commits: 1\n  * 'ws-b.sqlite': missing\n    Branch: main\n  * 'ws-c.sqlite': missing\n"+
+		"    Branch: main\n    Unpushed commits: unknown (no remote-tracking branch, use 'dio fetch' to update)\n")
+
+	// Run a local test server, where the branch of the first database has a new commit
+	com3 := commitEntry{Message: "Third", Parent: com1.ID, Timestamp: lastMod.Add(2 * time.Hour), Tree: tree}
+	com3.ID = client.CommitID(com3)
+	remoteMeta := meta
+	remoteMeta.Branches = map[string]branchEntry{"main": {Commit: com3.ID, CommitCount: 2}}
+	remoteMeta.Commits = map[string]commitEntry{com1.ID: com1, com3.ID: com3}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata/get" || r.URL.Query().Get("dbname") != "ws-a.sqlite" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(remoteMeta)
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure := cloud, TLSConfig.InsecureSkipVerify
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	oldFormat := outputFormat
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify, outputFormat, statusCmdRemote = oldCloud, oldInsecure, oldFormat, ""
+		selectedRemote = DEFAULT_REMOTE
+	}()
+
+	// Checking the server should show the branch has moved there
+	statusCmdRemote = DEFAULT_REMOTE
+	outputFormat = OUTPUT_JSON
+	s.buf.Reset()
+	err = status(nil)
+	c.Assert(err, chk.IsNil)
+	var entries []statusEntry
+	err = json.Unmarshal(s.buf.Bytes(), &entries)
+	c.Assert(err, chk.IsNil)
+	one, zero := 1, 0
+	c.Check(entries, chk.DeepEquals, []statusEntry{
+		{ActiveBranch: "main", Database: "ws-a.sqlite", State: STATUS_UNCHANGED, Unpushed: &one,
+			Remote: &statusRemote{BranchOnServer: true, HeadMoved: true, NewCommits: 1, OnServer: true}},
+		{ActiveBranch: "main", Database: "ws-b.sqlite", State: STATUS_MISSING, Unpushed: &zero,
+			Remote: &statusRemote{}},
+		{ActiveBranch: "main", Database: "ws-c.sqlite", State: STATUS_MISSING, Remote: &statusRemote{}},
+	})
+
+	// Another remote can be chosen, whose remote-tracking branches are used for the unpushed commits
+	setRemoteBranch(&meta, "mirror", "main", branchEntry{Commit: com1.ID, CommitCount: 1})
+	err = saveMetadata("ws-c.sqlite", meta)
+	c.Assert(err, chk.IsNil)
+	err = saveRemotes("ws-c.sqlite", map[string]remoteEntry{"mirror": {URL: srv.URL}})
+	c.Assert(err, chk.IsNil)
+	statusCmdRemote = "mirror"
+	s.buf.Reset()
+	err = status([]string{"ws-c.sqlite"})
+	c.Assert(err, chk.IsNil)
+	entries = nil
+	err = json.Unmarshal(s.buf.Bytes(), &entries)
+	c.Assert(err, chk.IsNil)
+	c.Assert(entries, chk.HasLen, 1)
+	c.Check(entries[0].Unpushed, chk.DeepEquals, &one)
+}
+
+// Tests removing unreachable commits and unused database files from the local cache
+func (s *DioSuite) Test0450_GarbageCollection(c *chk.C) {
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	defer func() {
+		os.Chdir(oldDir)
+		gcCmdDryRun, gcCmdKeepRecent = false, 0
+	}()
+
+	// Create a branch with two commits, along with an old unreachable commit and a recent one
+	db := "gc.sqlite"
+	old := time.Now().Add(-48 * time.Hour)
+	newCommit := func(parent, shaSum string, timestamp time.Time) commitEntry {
+		com := commitEntry{Parent: parent, Timestamp: timestamp,
+			Tree: dbTree{Entries: []dbTreeEntry{{EntryType: DATABASE, Name: db, Sha256: shaSum}}}}
+		com.Tree.ID = client.TreeID(com.Tree.Entries)
+		com.ID = client.CommitID(com)
+		return com
+	}
+	shaSums := map[string]string{}
+	for _, j := range []string{"a", "b", "c", "d"} {
+		z := sha256.Sum256([]byte(j))
+		shaSums[j] = hex.EncodeToString(z[:])
+	}
+	com1 := newCommit("", shaSums["a"], old)
+	com2 := newCommit(com1.ID, shaSums["a"], old.Add(time.Hour))
+	oldCom := newCommit(com1.ID, shaSums["b"], old)
+	recentCom := newCommit(com1.ID, shaSums["d"], time.Now())
+	meta := newMetaStruct("main")
+	meta.Branches["main"] = branchEntry{Commit: com2.ID, CommitCount: 2}
+	meta.Commits = map[string]commitEntry{com1.ID: com1, com2.ID: com2, oldCom.ID: oldCom, recentCom.ID: recentCom}
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+
+	// Cache a database file for each commit, plus one which isn't used at all and a partial download
+	for _, j := range []string{"a", "b", "c", "d"} {
+		path := filepath.Join(".dio", db, "db", shaSums[j])
+		err = os.WriteFile(path, []byte(j), 0644)
+		c.Assert(err, chk.IsNil)
+		if j != "d" {
+			err = os.Chtimes(path, old, old)
+			c.Assert(err, chk.IsNil)
+		}
+	}
+	err = os.WriteFile(filepath.Join(".dio", db, "db", "commit-"+com1.ID+".part"), []byte("a"), 0644)
+	c.Assert(err, chk.IsNil)
+	cached := func() (names []string) {
+		files, err := os.ReadDir(filepath.Join(".dio", db, "db"))
+		c.Assert(err, chk.IsNil)
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return
+	}
+	before := cached()
+
+	// A dry run shouldn't change anything
+	gcCmdDryRun = true
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.HasPrefix(s.buf.String(), "Would remove 2 unreachable commit(s) and 3 unused cache file(s)"),
+		chk.Equals, true)
+	c.Check(cached(), chk.DeepEquals, before)
+	newMeta, err := loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(newMeta.Commits, chk.HasLen, 4)
+
+	// Anything recent should be kept when asked
+	gcCmdDryRun = false
+	gcCmdKeepRecent = 24 * time.Hour
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	newMeta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(newMeta.Commits, chk.HasLen, 3)
+	_, ok := newMeta.Commits[oldCom.ID]
+	c.Check(ok, chk.Equals, false)
+	c.Check(cached(), chk.HasLen, 3)
+
+	// Without the safety window, the recent commit and its database file go too
+	gcCmdKeepRecent = 0
+	err = gc([]string{db})
+	c.Assert(err, chk.IsNil)
+	newMeta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(newMeta.Commits, chk.HasLen, 2)
+	files := cached()
+	sort.Strings(files)
+	expected := []string{shaSums["a"], "commit-" + com1.ID + ".part"}
+	sort.Strings(expected)
+	c.Check(files, chk.DeepEquals, expected)
+}
+
+// Tests storing cached databases as chunks
+func (s *DioSuite) Test0460_ChunkedStorage(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	viper.Set("storage.chunked", true)
+	defer func() {
+		os.Chdir(oldDir)
+		viper.Set("storage.chunked", false)
+	}()
+
+	// Storing a database should split it into chunks on page boundaries, rather than keeping the whole file.  The
+	// database is made large enough to need several chunks
+	db := "chunks.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `
+		CREATE TABLE big (b BLOB);
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 30)
+		INSERT INTO big SELECT randomblob(100000) FROM n;`)
+	c.Assert(err, chk.IsNil)
+	b, err = os.ReadFile(db)
+	c.Assert(err, chk.IsNil)
+	shaSum, _, err := fileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	err = cacheStore(db, shaSum, db)
+	c.Assert(err, chk.IsNil)
+	c.Check(cacheExists(db, shaSum), chk.Equals, true)
+	_, err = os.Stat(filepath.Join(".dio", db, "db", shaSum))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	m, err := loadChunkManifest(db, shaSum)
+	c.Assert(err, chk.IsNil)
+	chunkSize := databasePageSize(bytes.NewReader(b)) * chunkPages
+	c.Check(m.ChunkSize, chk.Equals, chunkSize)
+	c.Check(m.Size, chk.Equals, int64(len(b)))
+	c.Check(m.Chunks, chk.HasLen, int((int64(len(b))+chunkSize-1)/chunkSize))
+	c.Check(len(m.Chunks) > 1, chk.Equals, true)
+
+	// A changed version of the database should share the chunks of its unchanged pages
+	err = modifyTestDB(db, "CREATE TABLE chunked (a INTEGER)")
+	c.Assert(err, chk.IsNil)
+	newSum, _, err := fileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	err = cacheStore(db, newSum, db)
+	c.Assert(err, chk.IsNil)
+	newM, err := loadChunkManifest(db, newSum)
+	c.Assert(err, chk.IsNil)
+	chunks, err := filepath.Glob(filepath.Join(".dio", db, "chunks", "*", "*"))
+	c.Assert(err, chk.IsNil)
+	c.Check(len(chunks) < len(m.Chunks)+len(newM.Chunks), chk.Equals, true)
+
+	// The original database should be reassembled exactly, including when reading across chunks
+	err = cacheCopyTo(db, shaSum, "copy.sqlite")
+	c.Assert(err, chk.IsNil)
+	copied, err := os.ReadFile("copy.sqlite")
+	c.Assert(err, chk.IsNil)
+	c.Check(copied, chk.DeepEquals, b)
+	r, size, err := cacheOpen(db, shaSum)
+	c.Assert(err, chk.IsNil)
+	c.Check(size, chk.Equals, int64(len(b)))
+	_, err = r.Seek(chunkSize-5, io.SeekStart)
+	c.Assert(err, chk.IsNil)
+	part := make([]byte, 10)
+	_, err = io.ReadFull(r, part)
+	c.Assert(err, chk.IsNil)
+	c.Check(part, chk.DeepEquals, b[chunkSize-5:chunkSize+5])
+	r.Close()
+
+	// SQLite needs a whole file, so one is reassembled when asked for
+	path, err := cachePath(db, shaSum)
+	c.Assert(err, chk.IsNil)
+	copied, err = os.ReadFile(path)
+	c.Assert(err, chk.IsNil)
+	c.Check(copied, chk.DeepEquals, b)
+
+	// Damaged chunks should be noticed
+	err = os.WriteFile(chunkPath(filepath.Join(".dio", db, "chunks"), newM.Chunks[0]), []byte("damaged"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = cacheCopyTo(db, newSum, "copy.sqlite")
+	c.Check(err, chk.NotNil)
+}
+
+// Tests sending commits as deltas against their parent
+func (s *DioSuite) Test0470_DeltaUpload(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	defer os.Chdir(oldDir)
+
+	// Cache two versions of a database, the second of which changes a few pages
+	db := "delta.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	baseSha, _, err := fileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	err = cacheStore(db, baseSha, db)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, "CREATE TABLE delta (a INTEGER); INSERT INTO delta VALUES (1)")
+	c.Assert(err, chk.IsNil)
+	newSha, newSize, err := fileSHA256(db)
+	c.Assert(err, chk.IsNil)
+	err = cacheStore(db, newSha, db)
+	c.Assert(err, chk.IsNil)
+	newB, err := os.ReadFile(db)
+	c.Assert(err, chk.IsNil)
+	newCommit := func(parent, shaSum string, size int64) commitEntry {
+		com := commitEntry{Parent: parent, Timestamp: time.Now().UTC().Truncate(time.Second),
+			Tree: dbTree{Entries: []dbTreeEntry{{EntryType: DATABASE, Name: db, Sha256: shaSum, Size: size}}}}
+		com.Tree.ID = client.TreeID(com.Tree.Entries)
+		com.ID = client.CommitID(com)
+		return com
+	}
+	com1 := newCommit("", baseSha, int64(len(b)))
+	com2 := newCommit(com1.ID, newSha, newSize)
+	meta := newMetaStruct("main")
+	meta.Commits = map[string]commitEntry{com1.ID: com1, com2.ID: com2}
+
+	// Run a local test server, which rebuilds databases sent as deltas from its own copy of the base, and checks
+	// the result has the checksum it was sent with
+	var deltas bool
+	var received []byte
+	stored := map[string][]byte{baseSha: b}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/capabilities" {
+			if !deltas {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprintf(w, `{"delta_formats": ["%s"]}`, client.DeltaFormat)
+			return
+		}
+		f, _, err := r.FormFile("file1")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received, _ = io.ReadAll(f)
+		body := received
+		if r.URL.Query().Get("delta") != "" {
+			base, ok := stored[r.URL.Query().Get("deltabase")]
+			if r.URL.Query().Get("delta") != client.DeltaFormat || !ok {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			var rebuilt bytes.Buffer
+			_, err = client.ApplyDelta(&rebuilt, bytes.NewReader(base), bytes.NewReader(received))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = rebuilt.Bytes()
+		}
+		z := sha256.Sum256(body)
+		if hex.EncodeToString(z[:]) != r.URL.Query().Get("dbshasum") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "dbshasum doesn't match")
+			return
+		}
+		stored[r.URL.Query().Get("dbshasum")] = body
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"commit_id": "%s"}`, com2.ID)
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure := cloud, TLSConfig.InsecureSkipVerify
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify = oldCloud, oldInsecure
+	}()
+
+	// Servers which don't support deltas are sent the whole database
+	err = sendCommit(fOut, meta, db, "main", com2.ID, false, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(received, chk.DeepEquals, newB)
+	c.Check(stored[newSha], chk.DeepEquals, newB)
+
+	// Servers which do are only sent the changed pages, from which they can rebuild the database
+	deltas = true
+	delete(stored, newSha)
+	s.buf.Reset()
+	err = sendCommit(fOut, meta, db, "main", com2.ID, false, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Matches, "(?s).*Sending the changed pages only.*")
+	c.Check(len(received) < len(newB), chk.Equals, true)
+	c.Check(stored[newSha], chk.DeepEquals, newB)
+
+	// If the server doesn't have the base, the whole database is sent instead
+	delete(stored, baseSha)
+	delete(stored, newSha)
+	s.buf.Reset()
+	err = sendCommit(fOut, meta, db, "main", com2.ID, false, false)
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Matches, "(?s).*sending the whole database.*")
+	c.Check(received, chk.DeepEquals, newB)
+	c.Check(stored[newSha], chk.DeepEquals, newB)
+}
+
+// Tests checking and repairing the local metadata and cache
+func (s *DioSuite) Test0480_Fsck(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	defer func() {
+		os.Chdir(oldDir)
+		fsckCmdRepair = false
+	}()
+
+	// Create a branch of two commits with the wrong commit count, a commit which has been tampered with, and a tag
+	// pointing to a commit which doesn't exist
+	db := "fsck.sqlite"
+	z := sha256.Sum256(b)
+	shaA := hex.EncodeToString(z[:])
+	z = sha256.Sum256([]byte("b"))
+	shaB := hex.EncodeToString(z[:])
+	newCommit := func(parent, shaSum, msg string) commitEntry {
+		com := commitEntry{Parent: parent, Message: msg, Timestamp: time.Now().UTC().Truncate(time.Second),
+			Tree: dbTree{Entries: []dbTreeEntry{{EntryType: DATABASE, Name: db, Sha256: shaSum}}}}
+		com.Tree.ID = client.TreeID(com.Tree.Entries)
+		com.ID = client.CommitID(com)
+		return com
+	}
+	com1 := newCommit("", shaA, "First")
+	com2 := newCommit(com1.ID, shaB, "Second")
+	com3 := newCommit(com1.ID, shaB, "Other")
+	tampered := com3
+	tampered.Message = "Changed"
+	meta := newMetaStruct("main")
+	meta.Branches["main"] = branchEntry{Commit: com2.ID, CommitCount: 5}
+	meta.Commits = map[string]commitEntry{com1.ID: com1, com2.ID: com2, com3.ID: tampered}
+	meta.Tags = map[string]tagEntry{"lost": {Commit: "0123"}}
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+
+	// Cache the database file for the head commit, and a damaged one for the first commit
+	err = os.WriteFile(filepath.Join(".dio", db, "db", shaB), []byte("b"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(filepath.Join(".dio", db, "db", shaA), []byte("damaged"), 0644)
+	c.Assert(err, chk.IsNil)
+
+	// Run a local test server, which has the undamaged versions
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, db, time.Now(), bytes.NewReader(b))
+	}))
+	defer srv.Close()
+	oldCloud, oldInsecure, oldRetrieve := cloud, TLSConfig.InsecureSkipVerify, retrieveMetadata
+	cloud = srv.URL
+	TLSConfig.InsecureSkipVerify = true
+	retrieveMetadata = func(string) (metaData, bool, error) {
+		remote := newMetaStruct("main")
+		remote.Commits = map[string]commitEntry{com1.ID: com1, com3.ID: com3}
+		return remote, true, nil
+	}
+	defer func() {
+		cloud, TLSConfig.InsecureSkipVerify, retrieveMetadata = oldCloud, oldInsecure, oldRetrieve
+	}()
+
+	// All of the problems should be found, without anything being changed
+	err = fsck([]string{db})
+	c.Check(err, chk.ErrorMatches, "4 problem\\(s\\) found in 'fsck.sqlite'.  Use --repair.*")
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("4 problem(s) found in 'fsck.sqlite'\n"+
+		"  * Commit %s: commit ID doesn't match its contents (should be %s)\n"+
+		"  * Branch 'main': has a commit count of 5, but has 2 commits\n"+
+		"  * Tag 'lost': commit 0123 is missing\n"+
+		"  * Database file %s: doesn't match its checksum\n", com3.ID, client.CommitID(tampered), shaA))
+	unchanged, err := loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(unchanged.Branches["main"].CommitCount, chk.Equals, 5)
+
+	// Repairing should fix everything apart from the tag
+	fsckCmdRepair = true
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.ErrorMatches, "1 problem\\(s\\) in 'fsck.sqlite' couldn't be repaired")
+	c.Check(s.buf.String(), chk.Matches, "(?s).*Tag 'lost': commit 0123 is missing... can't be repaired\n.*")
+	repaired, err := loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(repaired.Branches["main"].CommitCount, chk.Equals, 2)
+	c.Check(repaired.Commits[com3.ID], chk.DeepEquals, com3)
+	c.Check(cacheVerify(db, shaA), chk.IsNil)
+
+	// With the tag removed, there should be nothing left to find
+	delete(repaired.Tags, "lost")
+	err = saveMetadata(db, repaired)
+	c.Assert(err, chk.IsNil)
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, "No problems found in 'fsck.sqlite'\n")
+
+	// Hand edited metadata where commits are each other's parents should be reported, rather than followed forever
+	loop1, loop2 := newCommit(com1.ID, shaA, "Loop one"), newCommit(com1.ID, shaB, "Loop two")
+	loop1.Parent, loop2.Parent = loop2.ID, loop1.ID
+	repaired.Commits[loop1.ID], repaired.Commits[loop2.ID] = loop1, loop2
+	repaired.Branches["loop"] = branchEntry{Commit: loop1.ID, CommitCount: 2}
+	err = saveMetadata(db, repaired)
+	c.Assert(err, chk.IsNil)
+	fsckCmdRepair = false
+	s.buf.Reset()
+	err = fsck([]string{db})
+	c.Check(err, chk.NotNil)
+	c.Check(strings.Contains(s.buf.String(), fmt.Sprintf("  * Branch 'loop': Broken commit history: commit '%s' "+
+		"is its own ancestor\n", loop1.ID)), chk.Equals, true)
+}
+
+// Tests atomic writes, and the lock stopping two dio processes changing a database at once
+func (s *DioSuite) Test0490_AtomicWritesAndLocking(c *chk.C) {
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	defer os.Chdir(oldDir)
+
+	// A failed write should leave the existing file untouched, with nothing else left behind
+	err = writeFileAtomic("atomic.txt", []byte("original"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = writeAtomic("atomic.txt", 0644, func(w io.Writer) error {
+		fmt.Fprint(w, "partial")
+		return errors.New("interrupted")
+	})
+	c.Check(err, chk.ErrorMatches, "interrupted")
+	b, err := os.ReadFile("atomic.txt")
+	c.Assert(err, chk.IsNil)
+	c.Check(string(b), chk.Equals, "original")
+	files, err := filepath.Glob("*")
+	c.Assert(err, chk.IsNil)
+	c.Check(files, chk.DeepEquals, []string{"atomic.txt"})
+
+	// Only one process can hold the lock for a database at a time
+	db := "lock.sqlite"
+	meta := newMetaStruct("main")
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	unlock, err := lockDatabase(db)
+	c.Assert(err, chk.IsNil)
+	_, err = lockDatabase(db)
+	c.Check(err, chk.ErrorMatches, fmt.Sprintf("Another dio process \\(%d\\) is working on 'lock.sqlite'.*",
+		os.Getpid()))
+	err = gcDatabase(fOut, db)
+	c.Check(err, chk.ErrorMatches, "Another dio process .*")
+	unlock()
+	err = gcDatabase(fOut, db)
+	c.Check(err, chk.IsNil)
+
+	// Lock files left behind by processes which are no longer running don't block anyone, as nothing holds them
+	err = os.WriteFile(filepath.Join(".dio", db, "lock"), []byte("2147483646\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	unlock, err = lockDatabase(db)
+	c.Assert(err, chk.IsNil)
+	b, err = os.ReadFile(filepath.Join(".dio", db, "lock"))
+	c.Assert(err, chk.IsNil)
+	c.Check(string(b), chk.Equals, fmt.Sprintf("%d\n", os.Getpid()))
+	_, err = lockDatabase(db)
+	c.Check(err, chk.ErrorMatches, "Another dio process .*")
+	unlock()
+	_, err = os.Stat(filepath.Join(".dio", db, "lock"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// Locking a database which doesn't exist yet doesn't leave anything behind
+	unlock, err = lockDatabase("new.sqlite")
+	c.Assert(err, chk.IsNil)
+	unlock()
+	_, err = os.Stat(filepath.Join(".dio", "new.sqlite"))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+}
+
+// Tests selecting profiles from the config file
+func (s *DioSuite) Test0500_Profiles(c *chk.C) {
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldSettings := make(map[string]interface{})
+	for _, key := range profileSettings {
+		oldSettings[key] = viper.Get(key)
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		for key, value := range oldSettings {
+			viper.Set(key, value)
+		}
+		viper.Set("profiles", map[string]interface{}{})
+		profileName, profileUseCmdClear = "", false
+	}()
+
+	// Add two profiles, with the staging one only changing some of the settings
+	viper.Set("profiles.prod.cloud", "https://prod.example.org")
+	viper.Set("profiles.staging.cloud", "https://staging.example.org")
+	viper.Set("profiles.staging.name", "Staging User")
+	c.Check(configProfiles(), chk.DeepEquals, []string{"prod", "staging"})
+
+	// Selecting a profile for the directory shouldn't change the default database
+	err = saveDefaultDatabase("a.sqlite")
+	c.Assert(err, chk.IsNil)
+	profile, err := selectedProfile()
+	c.Assert(err, chk.IsNil)
+	c.Check(profile, chk.Equals, "")
+	err = profileUse([]string{"Staging"})
+	c.Assert(err, chk.IsNil)
+	profile, err = selectedProfile()
+	c.Assert(err, chk.IsNil)
+	c.Check(profile, chk.Equals, "staging")
+	db, err := getDefaultDatabase()
+	c.Assert(err, chk.IsNil)
+	c.Check(db, chk.Equals, "a.sqlite")
+	err = profileUse([]string{"missing"})
+	c.Check(err, chk.ErrorMatches, "There's no profile called 'missing' in the config file")
+
+	// The --profile option overrides the profile selected for the directory
+	profileName = "prod"
+	profile, err = selectedProfile()
+	c.Assert(err, chk.IsNil)
+	c.Check(profile, chk.Equals, "prod")
+	profileName = ""
+	s.buf.Reset()
+	err = profileList()
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, "Profiles:\n\n  * prod\n      Cloud: https://prod.example.org\n\n"+
+		"  * staging (selected)\n      Cloud: https://staging.example.org\n      Name: Staging User\n")
+
+	// Applying a profile replaces the settings it has, leaving the others alone
+	err = applyProfile("staging")
+	c.Assert(err, chk.IsNil)
+	c.Check(viper.GetString("general.cloud"), chk.Equals, "https://staging.example.org")
+	c.Check(viper.GetString("user.name"), chk.Equals, "Staging User")
+	c.Check(viper.Get("certs.cert"), chk.Equals, oldSettings["certs.cert"])
+	err = applyProfile("missing")
+	c.Check(err, chk.ErrorMatches, "There's no profile called 'missing' in the config file")
+
+	// Clearing the profile goes back to the top level settings
+	profileUseCmdClear = true
+	err = profileUse(nil)
+	c.Assert(err, chk.IsNil)
+	profile, err = selectedProfile()
+	c.Assert(err, chk.IsNil)
+	c.Check(profile, chk.Equals, "")
+}
+
+// Tests adding and removing remotes, and keeping track of the branches and tags on each separately
+func (s *DioSuite) Test0510_Remotes(c *chk.C) {
+	// Start with the metadata of the test database, which has been pushed to origin
+	meta, err := localFetchMetadata(s.dbName, false)
+	c.Assert(err, chk.IsNil)
+	head := meta.Branches[meta.ActiveBranch].Commit
+	meta.RemoteTags = map[string]tagEntry{"origintag": {Commit: head}}
+	setRemoteBranches(&meta, DEFAULT_REMOTE, meta.Branches)
+	db := "remotes.sqlite"
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	defer func() {
+		selectedRemote = DEFAULT_REMOTE
+		remoteAddCmdName, remoteAddCmdURL = "", ""
+		remoteRemoveCmdName = ""
+		remoteSetURLCmdName, remoteSetURLCmdURL = DEFAULT_REMOTE, ""
+	}()
+
+	// Run a local test server as the mirror, which has a tag the local database doesn't
+	remoteMeta := meta
+	remoteMeta.Tags = map[string]tagEntry{"mirrortag": {Commit: head}}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/get":
+			json.NewEncoder(w).Encode(remoteMeta)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	oldInsecure := TLSConfig.InsecureSkipVerify
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		TLSConfig.InsecureSkipVerify = oldInsecure
+	}()
+
+	// Origin uses the cloud from the config file until it's changed, and other remotes need adding first
+	u, err := remoteURL(db, DEFAULT_REMOTE)
+	c.Assert(err, chk.IsNil)
+	c.Check(u, chk.Equals, cloud)
+	_, err = remoteURL(db, "mirror")
+	c.Check(err, chk.ErrorMatches, "Database 'remotes.sqlite' doesn't have a remote called 'mirror'.*")
+	remoteAddCmdName, remoteAddCmdURL = "mirror", srv.URL
+	err = remoteAdd([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = remoteAdd([]string{db})
+	c.Check(err, chk.ErrorMatches, "Remote 'mirror' already exists.*")
+	remoteAddCmdName = DEFAULT_REMOTE
+	err = remoteAdd([]string{db})
+	c.Check(err, chk.ErrorMatches, "Remote 'origin' already exists.*")
+	remoteAddCmdName = "a/b"
+	err = remoteAdd([]string{db})
+	c.Check(err, chk.ErrorMatches, "Remote names can't contain slashes or whitespace")
+	remoteAddCmdName, remoteAddCmdURL = "other", "not a url"
+	err = remoteAdd([]string{db})
+	c.Check(err, chk.ErrorMatches, "'not a url' isn't a valid address for a DBHub.io cloud")
+	s.buf.Reset()
+	err = remoteList([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("Remotes for %s:\n\n  * mirror : %s\n  * origin : %s\n", db,
+		srv.URL, cloud))
+
+	// Merging the metadata from the mirror should track its branches and tags separately from origin's
+	selectedRemote = "mirror"
+	newMeta, found, err := retrieveMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Assert(found, chk.Equals, true)
+	merged, err := mergeMetadata(&s.buf, meta, newMeta)
+	c.Assert(err, chk.IsNil)
+	c.Check(merged.RemoteBranches[remoteBranchName("mirror", meta.ActiveBranch)].Commit, chk.Equals, head)
+	c.Check(merged.RemoteBranches[remoteBranchName(DEFAULT_REMOTE, meta.ActiveBranch)].Commit, chk.Equals, head)
+	c.Check(merged.OtherRemotes["mirror"].Tags, chk.DeepEquals, remoteMeta.Tags)
+	c.Check(merged.RemoteTags, chk.DeepEquals, meta.RemoteTags)
+	_, ok := merged.Tags["mirrortag"]
+	c.Check(ok, chk.Equals, true)
+	err = saveMetadata(db, merged)
+	c.Assert(err, chk.IsNil)
+
+	// Removing the mirror should remove its remote-tracking branches and tags too
+	remoteRemoveCmdName = DEFAULT_REMOTE
+	err = remoteRemove([]string{db})
+	c.Check(err, chk.ErrorMatches, "The 'origin' remote can't be removed.*")
+	remoteRemoveCmdName = "mirror"
+	err = remoteRemove([]string{db})
+	c.Assert(err, chk.IsNil)
+	_, err = remoteURL(db, "mirror")
+	c.Check(err, chk.NotNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.OtherRemotes, chk.HasLen, 0)
+	for name := range meta.RemoteBranches {
+		c.Check(strings.HasPrefix(name, DEFAULT_REMOTE+"/"), chk.Equals, true)
+	}
+
+	// Origin can be pointed at a different cloud
+	remoteSetURLCmdName, remoteSetURLCmdURL = DEFAULT_REMOTE, srv.URL
+	err = remoteSetURL([]string{db})
+	c.Assert(err, chk.IsNil)
+	u, err = remoteURL(db, DEFAULT_REMOTE)
+	c.Assert(err, chk.IsNil)
+	c.Check(u, chk.Equals, srv.URL)
+}
+
+// Tests commits with other files versioned along with the database, including some in folders
+func (s *DioSuite) Test0520_MultiFileCommits(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldLicences := getLicences
+	getLicences = func() (map[string]licenceEntry, error) {
+		return map[string]licenceEntry{"Not specified": {Sha256: ""}}, nil
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		getLicences = oldLicences
+		commitCmdAttach, commitCmdDetach = nil, nil
+		commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdMsg = "", "", "", ""
+		commitCmdLicence, commitCmdTimestamp = "", ""
+	}()
+
+	// Start with a database which has a single commit, plus a README and another database in folders
+	db := "multi.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	_, err = addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	err = os.MkdirAll("docs", 0755)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(filepath.Join("docs", "README.md"), []byte("Read me\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = os.MkdirAll("data", 0755)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(filepath.Join("data", "lookup.sqlite"), b, 0644)
+	c.Assert(err, chk.IsNil)
+
+	// Attaching the files should put them into subtrees of the commit
+	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch = "someone@example.org", "Some One", ""
+	commitCmdLicence, commitCmdMsg, commitCmdTimestamp = "", "Add the README and lookup database", ""
+	commitCmdAttach = []string{"docs/README.md", "data/lookup.sqlite"}
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	c.Assert(head.Tree.Entries, chk.HasLen, 3)
+	c.Check(head.Tree.Entries[0].EntryType, chk.Equals, dbTreeEntryType(TREE))
+	c.Check(head.Tree.Entries[0].Name, chk.Equals, "data")
+	c.Check(head.Tree.Entries[1].Name, chk.Equals, "docs")
+	c.Check(head.Tree.Entries[2].Name, chk.Equals, db)
+	files := commitAttachments(head, db)
+	c.Assert(files, chk.HasLen, 2)
+	c.Check(files[0].Name, chk.Equals, "data/lookup.sqlite")
+	c.Check(files[0].EntryType, chk.Equals, dbTreeEntryType(DATABASE))
+	c.Check(files[1].Name, chk.Equals, "docs/README.md")
+	c.Check(files[1].EntryType, chk.Equals, dbTreeEntryType(FILE))
+	c.Check(commitIntegrity(head), chk.IsNil)
+	dbEntry, err := commitDBEntry(head, db)
+	c.Assert(err, chk.IsNil)
+	c.Check(dbEntry.Size, chk.Equals, int64(len(b)))
+
+	// Changing an attached file counts as a change, and the next commit picks it up without attaching it again
+	changed, err := dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	err = os.WriteFile(filepath.Join("docs", "README.md"), []byte("Read me again\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	changed, err = dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, true)
+	commitCmdAttach, commitCmdMsg = nil, "Update the README"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head = meta.Commits[meta.Branches["main"].Commit]
+	readme, ok := head.Tree.Entry("docs/README.md")
+	c.Assert(ok, chk.Equals, true)
+	c.Check(readme.Size, chk.Equals, int64(len("Read me again\n")))
+
+	// The attached files are written back out along with the database
+	err = os.RemoveAll("docs")
+	c.Assert(err, chk.IsNil)
+	err = writeCommitAttachments(db, head)
+	c.Assert(err, chk.IsNil)
+	readmeData, err := os.ReadFile(filepath.Join("docs", "README.md"))
+	c.Assert(err, chk.IsNil)
+	c.Check(string(readmeData), chk.Equals, "Read me again\n")
+
+	// DBHub.io can't store the extra files, so the commit isn't pushed
+	err = sendCommit(&s.buf, meta, db, "main", head.ID, false, false)
+	c.Check(err, chk.ErrorMatches, "Commit .* can't be pushed, as it has files other than the database in it.*")
+
+	// Files outside the working directory can't be attached, and only attached files can be detached
+	commitCmdAttach = []string{"../outside.txt"}
+	err = commitDatabase(&s.buf, db)
+	c.Check(err, chk.ErrorMatches, "'../outside.txt' needs to be a path inside the current directory")
+	commitCmdAttach, commitCmdDetach = nil, []string{"missing.txt"}
+	err = commitDatabase(&s.buf, db)
+	c.Check(err, chk.ErrorMatches, "'missing.txt' isn't part of the commits for 'multi.sqlite'")
+
+	// Detaching a file leaves it out of the next commit
+	commitCmdDetach, commitCmdMsg = []string{"docs/README.md"}, "Remove the README"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head = meta.Commits[meta.Branches["main"].Commit]
+	files = commitAttachments(head, db)
+	c.Assert(files, chk.HasLen, 1)
+	c.Check(files[0].Name, chk.Equals, "data/lookup.sqlite")
+
+	// Files can't be attached on a branch which tracks a remote branch, as it could no longer be pushed
+	setRemoteBranch(&meta, "mirror", "main", meta.Branches["main"])
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	commitCmdAttach, commitCmdDetach, commitCmdMsg = []string{"docs/README.md"}, nil, "Add the README again"
+	err = os.WriteFile(filepath.Join("docs", "README.md"), []byte("Read me\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	err = commitDatabase(&s.buf, db)
+	c.Check(err, chk.ErrorMatches, "Branch 'main' tracks 'mirror/main', so files can't be attached to it.*")
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Commits[meta.Branches["main"].Commit].ID, chk.Equals, head.ID)
+}
+
+// Tests databases in folders, both on the server and locally
+func (s *DioSuite) Test0530_Folders(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldDatabases := getDatabases
+	defer func() {
+		os.Chdir(oldDir)
+		getDatabases = oldDatabases
+		pullCmdFolder = ""
+	}()
+
+	// Databases with the same name in different folders get their own local metadata
+	c.Check(dioDir(filepath.Join("finance", "q1.sqlite")), chk.Not(chk.Equals), dioDir(filepath.Join("hr",
+		"q1.sqlite")))
+	c.Check(dioDir("finance%2Fq1.sqlite"), chk.Not(chk.Equals), dioDir(filepath.Join("finance", "q1.sqlite")))
+	pullCmdFolder = "hr"
+	dbs, err := folderDatabases([]string{"q1.sqlite"})
+	c.Assert(err, chk.IsNil)
+	c.Check(dbs, chk.DeepEquals, []string{filepath.Join("hr", "q1.sqlite")})
+	c.Check(pullCmdFolder, chk.Equals, "/hr")
+	_, err = folderDatabases([]string{"other/q1.sqlite"})
+	c.Check(err, chk.ErrorMatches, "'other/q1.sqlite' should be just the database name when using --folder")
+	_, err = validateRemoteFolder("../elsewhere")
+	c.Check(err, chk.ErrorMatches, "'../elsewhere' isn't a valid folder name")
+
+	// A database in a local folder is committed under its own name, as it is on the server
+	db := filepath.Join("reports", "2024", "q1.sqlite")
+	err = os.MkdirAll(filepath.Dir(db), 0755)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	newCom, err := addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	c.Assert(newCom.Tree.Entries, chk.HasLen, 1)
+	c.Check(newCom.Tree.Entries[0].Name, chk.Equals, "q1.sqlite")
+	_, err = commitDBEntry(newCom, db)
+	c.Check(err, chk.IsNil)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	local, err := localDatabases()
+	c.Assert(err, chk.IsNil)
+	c.Check(local, chk.DeepEquals, []string{db})
+
+	// The folder for a remote is remembered, and used when talking to the server
+	remoteDB, err := remoteDatabase(db, DEFAULT_REMOTE)
+	c.Assert(err, chk.IsNil)
+	c.Check(remoteDB, chk.Equals, "/q1.sqlite")
+	err = setRemoteFolder(db, DEFAULT_REMOTE, "/finance/2024")
+	c.Assert(err, chk.IsNil)
+	remoteDB, err = remoteDatabase(db, DEFAULT_REMOTE)
+	c.Assert(err, chk.IsNil)
+	c.Check(remoteDB, chk.Equals, "/finance/2024/q1.sqlite")
+	u, err := remoteURL(db, DEFAULT_REMOTE)
+	c.Assert(err, chk.IsNil)
+	c.Check(u, chk.Equals, cloud)
+	var gotFolder, gotName string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotFolder, gotName = r.URL.Query().Get("folder"), r.URL.Query().Get("dbname")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	oldInsecure := TLSConfig.InsecureSkipVerify
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		TLSConfig.InsecureSkipVerify = oldInsecure
+	}()
+	oldCloud := cloud
+	cloud = srv.URL
+	defer func() {
+		cloud = oldCloud
+	}()
+	_, found, err := retrieveMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(found, chk.Equals, false)
+	c.Check(gotFolder, chk.Equals, "/finance/2024")
+	c.Check(gotName, chk.Equals, "q1.sqlite")
+
+	// Pulling from a folder a database which isn't on the server doesn't leave the local folder or its details behind
+	pullCmdFolder = "/hr"
+	missing := filepath.Join("hr", "missing.sqlite")
+	err = pullDatabase(&s.buf, missing)
+	c.Check(err, chk.NotNil)
+	c.Check(gotFolder, chk.Equals, "/hr")
+	c.Check(gotName, chk.Equals, "missing.sqlite")
+	_, err = os.Stat("hr")
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	_, err = os.Stat(dioDir(missing))
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+	pullCmdFolder = ""
+
+	// The database list is shown as a tree of folders
+	getDatabases = func(url string, user string) ([]dbListEntry, error) {
+		modified := "2024-01-02T03:04:05Z"
+		return []dbListEntry{
+			{Folder: "/finance/2024", Name: "q1.sqlite", DefBranch: "main", LastModified: modified,
+				RepoModified: modified},
+			{Name: "top.sqlite", DefBranch: "main", LastModified: modified, RepoModified: modified},
+			{Folder: "/finance", Name: "summary.sqlite", DefBranch: "main", LastModified: modified,
+				RepoModified: modified},
+			{Folder: "/finance-old", Name: "q1.sqlite", DefBranch: "main", LastModified: modified,
+				RepoModified: modified},
+		}, nil
+	}
+	s.buf.Reset()
+	err = list(nil)
+	c.Assert(err, chk.IsNil)
+	var shown []string
+	for _, line := range strings.Split(s.buf.String(), "\n") {
+		if strings.HasSuffix(line, "/") || strings.Contains(line, "* Database:") {
+			shown = append(shown, line)
+		}
+	}
+	c.Check(shown, chk.DeepEquals, []string{
+		"  * Database: top.sqlite",
+		"  finance/",
+		"    * Database: summary.sqlite",
+		"    2024/",
+		"      * Database: q1.sqlite",
+		"  finance-old/",
+		"    * Database: q1.sqlite",
+	})
+}
+
+// Tests copying the changes from single commits onto another branch
+func (s *DioSuite) Test0540_CherryPick(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldLicences := getLicences
+	getLicences = func() (map[string]licenceEntry, error) {
+		return map[string]licenceEntry{"Not specified": {Sha256: ""}}, nil
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		getLicences = oldLicences
+		branchActiveSetBranch, branchCreateBranch, branchCreateCommit, branchCreateMsg = "", "", "", ""
+		cherryPickCmdAbort, cherryPickCmdBranch, cherryPickCmdContinue = false, "", false
+		commitCmdAttach = nil
+		commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdMsg = "", "", "", ""
+		commitCmdLicence, commitCmdTimestamp = "", ""
+	}()
+
+	// Start with a database which has a single commit, and a feature branch with a fix and some other work on it
+	db := "pick.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	first, err := addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	branchCreateBranch, branchCreateCommit = "feature", first.ID
+	err = branchCreate([]string{db})
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "feature"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch = "fixer@example.org", "Fixer", "feature"
+	err = modifyTestDB(db, `UPDATE tiny SET col_name = 'hotfix' WHERE rowid = 4;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Fix row four"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE tiny SET col_name = 'feature work' WHERE rowid = 5;`)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile("notes.txt", []byte("Feature notes\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	commitCmdAttach, commitCmdMsg = []string{"notes.txt"}, "Feature work"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	commitCmdAttach = nil
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	featureHead := meta.Branches["feature"].Commit
+	fix := meta.Commits[featureHead].Parent
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = os.Remove("notes.txt")
+	c.Assert(err, chk.IsNil)
+
+	// Cherry-picking the fix onto main copies just its changes, keeping the original author and message
+	err = cherryPick([]string{db, fix})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Parent, chk.Equals, first.ID)
+	c.Check(head.Message, chk.Equals, "Fix row four")
+	c.Check(head.AuthorName, chk.Equals, "Fixer")
+	c.Check(head.AuthorEmail, chk.Equals, "fixer@example.org")
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 2)
+	sdb, err := sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	var count int
+	err = sdb.QueryRow(`
+		SELECT count(*)
+		FROM tiny
+		WHERE (rowid = 4 AND col_name = 'hotfix') OR (rowid = 5 AND col_name = 'feature work')`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 1)
+	sdb.Close()
+
+	// Commits already in the branch aren't picked again
+	s.buf.Reset()
+	err = cherryPick([]string{db, first.ID})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, fmt.Sprintf("Branch 'main' already contains commit %s.  Nothing to "+
+		"cherry-pick.\n", first.ID))
+
+	// Changes to rows which are different on the target branch are conflicts, which stop the cherry-pick
+	commitCmdBranch = "main"
+	err = modifyTestDB(db, `UPDATE tiny SET col_name = 'main work' WHERE rowid = 5;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Main work"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	origHead := meta.Branches["main"]
+	s.buf.Reset()
+	err = cherryPick([]string{db, "feature"})
+	c.Check(err, chk.ErrorMatches, "Cherry-pick paused.*")
+	c.Check(strings.Contains(s.buf.String(), "* Table 'tiny', row rowid=5"), chk.Equals, true)
+	c.Check(checkInProgress(db), chk.ErrorMatches, "A cherry-pick of commit .* is in progress.*")
+	_, err = os.Stat("notes.txt")
+	c.Check(err, chk.IsNil)
+	cherryPickCmdAbort = true
+	err = cherryPick([]string{db})
+	cherryPickCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"], chk.DeepEquals, origHead)
+	changed, err := dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	_, err = os.Stat("notes.txt")
+	c.Check(os.IsNotExist(err), chk.Equals, true)
+
+	// Aborting a cherry-pick onto another branch switches back to the branch which was active
+	branchActiveSetBranch = "feature"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	cherryPickCmdBranch = "main"
+	err = cherryPick([]string{db, "feature"})
+	cherryPickCmdBranch = ""
+	c.Check(err, chk.ErrorMatches, "Cherry-pick paused.*")
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "main")
+	cherryPickCmdAbort = true
+	err = cherryPick([]string{db})
+	cherryPickCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.ActiveBranch, chk.Equals, "feature")
+	changed, err = dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = os.Remove("notes.txt")
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+
+	// Picking a commit which attaches files isn't allowed onto a branch tracking one on a DBHub.io server
+	setRemoteBranch(&meta, DEFAULT_REMOTE, "main", origHead)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	err = cherryPick([]string{db, "feature"})
+	c.Check(err, chk.ErrorMatches, "Branch 'main' tracks 'origin/main', so files can't be attached to it.*")
+	c.Check(checkInProgress(db), chk.IsNil)
+	delete(meta.RemoteBranches, remoteBranchName(DEFAULT_REMOTE, "main"))
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+
+	// Once the conflicts are resolved, continuing creates the commit
+	err = cherryPick([]string{db, "feature"})
+	c.Check(err, chk.NotNil)
+	err = modifyTestDB(db, `UPDATE tiny SET col_name = 'resolved' WHERE rowid = 5;`)
+	c.Assert(err, chk.IsNil)
+	cherryPickCmdContinue = true
+	err = cherryPick([]string{db})
+	cherryPickCmdContinue = false
+	c.Assert(err, chk.IsNil)
+	c.Check(checkInProgress(db), chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head = meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Parent, chk.Equals, origHead.Commit)
+	c.Check(head.Message, chk.Equals, "Feature work")
+	files := commitAttachments(head, db)
+	c.Assert(files, chk.HasLen, 1)
+	c.Check(files[0].Name, chk.Equals, "notes.txt")
+
+	// Merging in another branch brings across the files attached on it as well
+	branchCreateBranch, branchCreateCommit = "other", first.ID
+	err = branchCreate([]string{db})
+	c.Assert(err, chk.IsNil)
+	branchActiveSetBranch = "other"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE tiny SET col_name = 'other work' WHERE rowid = 1;`)
+	c.Assert(err, chk.IsNil)
+	err = os.WriteFile("other.txt", []byte("Other notes\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	commitCmdAttach, commitCmdBranch, commitCmdMsg = []string{"other.txt"}, "other", "Other work"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	commitCmdAttach = nil
+	branchActiveSetBranch = "main"
+	err = branchActiveSet([]string{db})
+	c.Assert(err, chk.IsNil)
+	err = os.Remove("other.txt")
+	c.Assert(err, chk.IsNil)
+	err = merge([]string{db, "other"})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head = meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.OtherParents, chk.DeepEquals, []string{meta.Branches["other"].Commit})
+	var names []string
+	for _, f := range commitAttachments(head, db) {
+		names = append(names, f.Name)
+	}
+	c.Check(names, chk.DeepEquals, []string{"notes.txt", "other.txt"})
+	b, err = os.ReadFile("other.txt")
+	c.Check(err, chk.IsNil)
+	c.Check(string(b), chk.Equals, "Other notes\n")
+}
+
+// Tests undoing the changes from a single commit, with a new commit
+func (s *DioSuite) Test0550_RevertCommit(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldLicences := getLicences
+	getLicences = func() (map[string]licenceEntry, error) {
+		return map[string]licenceEntry{"Not specified": {Sha256: ""}}, nil
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		getLicences = oldLicences
+		commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdMsg = "", "", "", ""
+		commitCmdLicence, commitCmdTimestamp = "", ""
+		revertCommitCmdAbort, revertCommitCmdBranch, revertCommitCmdContinue = false, "", false
+		revertCommitCmdMsg = ""
+	}()
+
+	// Start with a database which has a commit adding a table and changing some rows, then a later commit
+	db := "revert.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `
+		CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO people VALUES (1, 'Ann'), (2, 'Bob'), (3, 'Cat');`)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	first, err := addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch = "someone@example.org", "Some One", "main"
+	err = modifyTestDB(db, `
+		CREATE TABLE extra (a INTEGER);
+		INSERT INTO extra VALUES (1);
+		UPDATE people SET name = 'Changed' WHERE id = 1;
+		DELETE FROM people WHERE id = 2;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Bad change"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE people SET name = 'Later' WHERE id = 3;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Later change"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	later := meta.Branches["main"].Commit
+	bad := meta.Commits[later].Parent
+
+	// Reverting the commit undoes just its changes, adding a new commit on top of the existing history
+	err = revertCommit([]string{db, bad})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Parent, chk.Equals, later)
+	c.Check(head.Message, chk.Equals, fmt.Sprintf("Revert \"Bad change\"\n\nThis reverts commit %s.", bad))
+	c.Check(meta.Branches["main"].CommitCount, chk.Equals, 4)
+	sdb, err := sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	var name string
+	err = sdb.QueryRow(`SELECT name FROM people WHERE id = 1`).Scan(&name)
+	c.Check(err, chk.IsNil)
+	c.Check(name, chk.Equals, "Ann")
+	var count int
+	err = sdb.QueryRow(`SELECT count(*) FROM people WHERE id = 2`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 1)
+	err = sdb.QueryRow(`SELECT count(*) FROM people WHERE id = 3 AND name = 'Later'`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 1)
+	err = sdb.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'extra'`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 0)
+	sdb.Close()
+
+	// The first commit has nothing to revert to, and commits from elsewhere can't be reverted
+	err = revertCommit([]string{db, first.ID})
+	c.Check(err, chk.ErrorMatches, "Commit '.*' is the first commit in its history, so can't be reverted")
+	revertCommitCmdBranch = "missing"
+	err = revertCommit([]string{db, bad})
+	c.Check(err, chk.ErrorMatches, "That branch \\('missing'\\) doesn't exist")
+	revertCommitCmdBranch = ""
+
+	// Reverting a commit whose rows have been changed again since is a conflict, which stops the revert
+	err = modifyTestDB(db, `UPDATE people SET name = 'Again' WHERE id = 3;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Change it again"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	origHead := meta.Branches["main"]
+	s.buf.Reset()
+	err = revertCommit([]string{db, later})
+	c.Check(err, chk.ErrorMatches, "Revert paused.*")
+	c.Check(strings.Contains(s.buf.String(), "* Table 'people', row id=3"), chk.Equals, true)
+	c.Check(checkInProgress(db), chk.ErrorMatches, "A revert of commit .* is in progress.*")
+	revertCommitCmdAbort = true
+	err = revertCommit([]string{db})
+	revertCommitCmdAbort = false
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.Branches["main"], chk.DeepEquals, origHead)
+	changed, err := dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+
+	// Once the conflicts are resolved, continuing creates the commit
+	revertCommitCmdMsg = "Put Cat back"
+	err = revertCommit([]string{db, later})
+	c.Check(err, chk.NotNil)
+	err = modifyTestDB(db, `UPDATE people SET name = 'Cat' WHERE id = 3;`)
+	c.Assert(err, chk.IsNil)
+	revertCommitCmdContinue = true
+	err = revertCommit([]string{db})
+	revertCommitCmdContinue = false
+	c.Assert(err, chk.IsNil)
+	c.Check(checkInProgress(db), chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head = meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Parent, chk.Equals, origHead.Commit)
+	c.Check(head.Message, chk.Equals, "Put Cat back")
+}
+
+func (s *DioSuite) Test0560_Patch(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldLicences := getLicences
+	getLicences = func() (map[string]licenceEntry, error) {
+		return map[string]licenceEntry{"Not specified": {Sha256: ""}}, nil
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		getLicences = oldLicences
+		commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdMsg = "", "", "", ""
+		commitCmdLicence, commitCmdTimestamp = "", ""
+		patchApplyCmdCommit, patchApplyCmdForce, patchApplyCmdMsg = false, false, ""
+		patchExportCmdFile, patchExportCmdFrom, patchExportCmdTo = "", "", ""
+	}()
+
+	// Start with a release of a database, then make schema and row changes to it in a later commit
+	db := "patch.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `
+		CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT);
+		CREATE INDEX people_name ON people (name);
+		CREATE TABLE things (a INTEGER, b TEXT);
+		CREATE TABLE scores (id INTEGER PRIMARY KEY, score INTEGER);
+		CREATE VIEW people_view AS SELECT name FROM people;
+		INSERT INTO people VALUES (1, 'Ann'), (2, 'Bob'), (3, 'Cat');
+		INSERT INTO scores VALUES (1, 10), (2, 15);
+		INSERT INTO things VALUES (1, 'x''y'), (2, NULL);`)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	first, err := addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	meta.Releases["v1"] = releaseEntry{Commit: first.ID}
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch = "someone@example.org", "Some One", "main"
+	err = modifyTestDB(db, `
+		UPDATE people SET name = 'Changed' WHERE id = 1;
+		DELETE FROM people WHERE id = 2;
+		INSERT INTO people VALUES (4, 'Dan');
+		ALTER TABLE people ADD COLUMN age INTEGER;
+		UPDATE people SET age = 42 WHERE id = 3;
+		DROP TABLE things;
+		CREATE TABLE things (a INTEGER, b TEXT NOT NULL DEFAULT '');
+		INSERT INTO things VALUES (1, 'x''y'), (2, ''), (3, X'0102');
+		DROP VIEW people_view;
+		CREATE VIEW people_view AS SELECT name, age FROM people;
+		CREATE TABLE extra (v REAL);
+		INSERT INTO extra VALUES (1.0), (2.5), (9e999), (-9e999);
+		UPDATE scores SET score = 20 WHERE id = 2;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Second"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	second := meta.Branches["main"].Commit
+
+	// Releases can be used anywhere a commit can
+	commitID, err := resolveCommit(meta, "v1")
+	c.Assert(err, chk.IsNil)
+	c.Check(commitID, chk.Equals, first.ID)
+
+	// Exporting the same changes twice gives the same patch
+	patchExportCmdFrom, patchExportCmdTo, patchExportCmdFile = "v1", "main", "changes.sql"
+	err = patchExport([]string{db})
+	c.Assert(err, chk.IsNil)
+	patch, err := os.ReadFile("changes.sql")
+	c.Assert(err, chk.IsNil)
+	patchExportCmdFile = ""
+	s.buf.Reset()
+	err = patchExport([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(s.buf.String(), chk.Equals, string(patch))
+	c.Check(strings.HasPrefix(string(patch), fmt.Sprintf("-- Patch for 'patch.sqlite'\n-- From: 'v1' (commit %s)\n",
+		first.ID)), chk.Equals, true)
+	c.Check(strings.Contains(string(patch), `UPDATE "scores" SET "score" = 20 WHERE "id" IS 2 AND "score" IS 15;`+
+		"\n"+patchCheckSQL), chk.Equals, true)
+	c.Check(strings.Contains(string(patch), `INSERT INTO "people" ("id", "name", "age") VALUES (1, 'Changed', NULL);`),
+		chk.Equals, true)
+	c.Check(strings.Contains(string(patch), `INSERT INTO "extra" ("rowid", "v") VALUES (1, 1.0);`), chk.Equals,
+		true)
+	c.Check(strings.Contains(string(patch), `INSERT INTO "extra" ("rowid", "v") VALUES (4, -9e999);`), chk.Equals,
+		true)
+	c.Check(strings.HasSuffix(string(patch), "COMMIT;\n"), chk.Equals, true)
+
+	// Applying the patch to the release gives the later version of the database, and can add a commit for it
+	err = writeCommitToWorkingFile(db, meta, first.ID)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE people SET name = 'Unsaved' WHERE id = 3;`)
+	c.Assert(err, chk.IsNil)
+	patchApplyCmdCommit = true
+	s.buf.Reset()
+	err = patchApply([]string{db, "changes.sql"})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "has been changed since the last commit"), chk.Equals, true)
+	err = writeCommitToWorkingFile(db, meta, first.ID)
+	c.Assert(err, chk.IsNil)
+	meta.Branches["main"] = branchEntry{Commit: first.ID, CommitCount: 1}
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	err = patchApply([]string{db, "changes.sql"})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Parent, chk.Equals, first.ID)
+	c.Check(head.Message, chk.Equals, "Applied patch changes.sql")
+	secondPath, err := commitDBPath(db, meta, second)
+	c.Assert(err, chk.IsNil)
+	diffs, err := diffDatabases(db, secondPath)
+	c.Assert(err, chk.IsNil)
+	c.Check(diffs.Diff, chk.HasLen, 0)
+	sdb, err := sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	var count int
+	err = sdb.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'people_name'`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 1)
+	sdb.Close()
+
+	// A patch which fails part way through leaves the database unchanged
+	err = os.WriteFile("broken.sql", []byte("BEGIN TRANSACTION;\nDELETE FROM people;\nINSERT INTO missing VALUES "+
+		"(1);\nCOMMIT;\n"), 0644)
+	c.Assert(err, chk.IsNil)
+	patchApplyCmdCommit = false
+	err = patchApply([]string{db, "broken.sql"})
+	c.Check(err, chk.ErrorMatches, "Applying the patch failed: .*")
+	changed, err := dbChanged(db, meta)
+	c.Assert(err, chk.IsNil)
+	c.Check(changed, chk.Equals, false)
+
+	// Applying the patch to a different version of the database fails, rather than changing the wrong rows
+	err = writeCommitToWorkingFile(db, meta, first.ID)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE scores SET score = 16 WHERE id = 2;`)
+	c.Assert(err, chk.IsNil)
+	err = patchApply([]string{db, "changes.sql"})
+	c.Check(err, chk.ErrorMatches, "Applying the patch failed: The database doesn't match the version this patch "+
+		"was created from")
+	sdb, err = sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	err = sdb.QueryRow(`SELECT score FROM scores WHERE id = 2`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 16)
+	err = sdb.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'extra'`).Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 0)
+	sdb.Close()
+}
+
+// Tests pulling a branch which has diverged from the server, then checking its status and rebasing it
+func (s *DioSuite) Test0570_PullDiverged(c *chk.C) {
+	b, err := os.ReadFile(s.dbName)
+	c.Assert(err, chk.IsNil)
+	oldDir, err := os.Getwd()
+	c.Assert(err, chk.IsNil)
+	err = os.Chdir(c.MkDir())
+	c.Assert(err, chk.IsNil)
+	oldLicences := getLicences
+	getLicences = func() (map[string]licenceEntry, error) {
+		return map[string]licenceEntry{"Not specified": {Sha256: ""}}, nil
+	}
+	defer func() {
+		os.Chdir(oldDir)
+		getLicences = oldLicences
+		commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch, commitCmdMsg = "", "", "", ""
+		commitCmdLicence, commitCmdTimestamp = "", ""
+		rebaseCmdBranch, rebaseCmdOnto = "", ""
+	}()
+
+	// Create a database with a commit on the server, which the local branch has diverged from
+	db := "diverged.sqlite"
+	err = os.WriteFile(db, b, 0644)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `
+		CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO people VALUES (1, 'Ann'), (2, 'Bob');`)
+	c.Assert(err, chk.IsNil)
+	meta := newMetaStruct("main")
+	first, err := addCommit(db, meta, "main", "", nil, commitEntry{AuthorName: "Some One",
+		AuthorEmail: "someone@example.org", Message: "First", Timestamp: time.Now().UTC()})
+	c.Assert(err, chk.IsNil)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	commitCmdAuthEmail, commitCmdAuthName, commitCmdBranch = "someone@example.org", "Some One", "main"
+	err = modifyTestDB(db, `UPDATE people SET name = 'Server' WHERE id = 1;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Server change"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+	serverMeta, err := loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	serverHead := serverMeta.Branches["main"].Commit
+
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	meta.Branches["main"] = branchEntry{Commit: first.ID, CommitCount: 1}
+	delete(meta.Commits, serverHead)
+	setRemoteBranches(&meta, DEFAULT_REMOTE, meta.Branches)
+	err = saveMetadata(db, meta)
+	c.Assert(err, chk.IsNil)
+	err = writeCommitToWorkingFile(db, meta, first.ID)
+	c.Assert(err, chk.IsNil)
+	err = modifyTestDB(db, `UPDATE people SET name = 'Local' WHERE id = 2;`)
+	c.Assert(err, chk.IsNil)
+	commitCmdMsg = "Local change"
+	err = commitDatabase(&s.buf, db)
+	c.Assert(err, chk.IsNil)
+
+	// Run a local test server as origin
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/get":
+			json.NewEncoder(w).Encode(serverMeta)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	oldInsecure := TLSConfig.InsecureSkipVerify
+	TLSConfig.InsecureSkipVerify = true
+	defer func() {
+		TLSConfig.InsecureSkipVerify = oldInsecure
+	}()
+	err = saveRemotes(db, map[string]remoteEntry{DEFAULT_REMOTE: {URL: srv.URL}})
+	c.Assert(err, chk.IsNil)
+
+	// Pulling keeps the local branch, with the remote-tracking branch pointing at a commit which is still known
+	err = pull([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	c.Check(meta.RemoteBranches["origin/main"].Commit, chk.Equals, serverHead)
+	_, ok := meta.Commits[serverHead]
+	c.Check(ok, chk.Equals, true)
+	localHead := meta.Branches["main"].Commit
+	c.Check(meta.Commits[localHead].Message, chk.Equals, "Local change")
+
+	// The status should count just the local commit as unpushed
+	s.buf.Reset()
+	err = status([]string{db})
+	c.Assert(err, chk.IsNil)
+	c.Check(strings.Contains(s.buf.String(), "Unpushed commits: 1\n"), chk.Equals, true)
+
+	// Rebasing onto the remote-tracking branch replays the local commit on top of the server's one
+	rebaseCmdBranch, rebaseCmdOnto = "", ""
+	err = rebase([]string{db})
+	c.Assert(err, chk.IsNil)
+	meta, err = loadMetadata(db)
+	c.Assert(err, chk.IsNil)
+	head := meta.Commits[meta.Branches["main"].Commit]
+	c.Check(head.Message, chk.Equals, "Local change")
+	c.Check(head.Parent, chk.Equals, serverHead)
+	sdb, err := sql.Open("sqlite3", db)
+	c.Assert(err, chk.IsNil)
+	var count int
+	err = sdb.QueryRow(`SELECT count(*) FROM people WHERE (id = 1 AND name = 'Server') OR (id = 2 AND name = 'Local')`).
+		Scan(&count)
+	c.Check(err, chk.IsNil)
+	c.Check(count, chk.Equals, 2)
+	sdb.Close()
+}
+
 func genTestCert(server, outputPath string) (err error) {
 	// Disable https cert validation for our tests
 	insecureTLS := tls.Config{InsecureSkipVerify: true}
@@ -1166,3 +3555,14 @@ func seedTests(server string) (err error) {
 	}
 	return
 }
+
+// modifyTestDB runs SQL statements against a database file, for creating changes to test against
+func modifyTestDB(path, statements string) (err error) {
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+	_, err = sdb.Exec(statements)
+	return
+}
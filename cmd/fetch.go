@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// The remote used when no other is chosen, which is the cloud from the config file unless changed
+	DEFAULT_REMOTE = "origin"
+)
+
+// Retrieves the latest metadata and databases from the cloud, without changing the working database
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [database name]",
+	Short: "Retrieves the latest commits for a database, without changing the local branches",
+	Long: `Retrieves the latest commits for a database, without changing the local branches
+
+The branch heads on the server are stored as remote-tracking branches (eg 'origin/main'),
+and any databases not already in the local cache are downloaded.  Neither the local
+branches nor the working database are changed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fetch(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().StringVar(&selectedRemote, "remote", DEFAULT_REMOTE, "Remote to fetch from")
+}
+
+func fetch(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be fetched at a time (for now)")
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Retrieve the metadata from the server
+	remoteCloud, err := remoteURL(db, selectedRemote)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Fetching '%s' from %s...\n", db, remoteCloud)
+	if err != nil {
+		return err
+	}
+	newMeta, found, err := retrieveMetadata(db)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Database '%s' doesn't exist on %s", db, remoteCloud)
+	}
+
+	// If there's no local metadata yet, the local branches start out the same as the ones on the server
+	var meta metaData
+	if _, err = os.Stat(filepath.Join(dioDir(db), "metadata.json")); err == nil {
+		meta, err = loadMetadata(db)
+		if err != nil {
+			return err
+		}
+	} else {
+		meta = newMeta
+		meta.ActiveBranch = newMeta.DefBranch
+	}
+
+	// Add the commits from the server.  Commit IDs are derived from their contents, so existing ones never change
+	for id, c := range newMeta.Commits {
+		meta.Commits[id] = c
+	}
+	meta.DefBranch = newMeta.DefBranch
+
+	// Bring the tags and releases up to date, including any which have been removed on the server
+	cl := newClient()
+	baseTags, baseReleases := remoteTagsReleases(meta, selectedRemote)
+	meta.Tags = cl.MergeTags(meta.Tags, newMeta.Tags, baseTags, meta.Commits)
+	meta.Releases = cl.MergeReleases(meta.Releases, newMeta.Releases, baseReleases, meta.Commits)
+	setRemoteTagsReleases(&meta, selectedRemote, newMeta)
+
+	// Download the databases which aren't already in the local cache
+	downloaded := 0
+	var ids []string
+	for id := range newMeta.Commits {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		dbEntry, err := commitDBEntry(newMeta.Commits[id], db)
+		if err != nil {
+			return err
+		}
+		shaSum := dbEntry.Sha256
+		if cacheExists(db, shaSum) {
+			continue
+		}
+		err = checkDBCache(db, id, shaSum)
+		if err != nil {
+			return err
+		}
+		downloaded++
+	}
+
+	// Update the remote-tracking branches
+	oldRemote := remoteBranches(meta, selectedRemote)
+	setRemoteBranches(&meta, selectedRemote, newMeta.Branches)
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+
+	// Let the user know how the local branches compare to the ones on the server
+	var brNames []string
+	for brName := range newMeta.Branches {
+		brNames = append(brNames, brName)
+	}
+	sort.Strings(brNames)
+	for _, brName := range brNames {
+		remoteName := remoteBranchName(selectedRemote, brName)
+		if _, ok := oldRemote[brName]; !ok {
+			_, err = fmt.Fprintf(fOut, "  * New remote branch '%s'\n", remoteName)
+			if err != nil {
+				return err
+			}
+		}
+		local, ok := meta.Branches[brName]
+		if !ok {
+			continue
+		}
+		ahead, behind, err := aheadBehind(meta, local.Commit, newMeta.Branches[brName].Commit)
+		if err != nil {
+			return err
+		}
+		if ahead == 0 && behind == 0 {
+			_, err = fmt.Fprintf(fOut, "  * Branch '%s' is up to date with '%s'\n", brName, remoteName)
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * Branch '%s' is %d commit(s) ahead and %d commit(s) behind '%s'\n",
+				brName, ahead, behind, remoteName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var goneNames []string
+	for brName := range oldRemote {
+		if _, ok := newMeta.Branches[brName]; !ok {
+			goneNames = append(goneNames, brName)
+		}
+	}
+	sort.Strings(goneNames)
+	for _, brName := range goneNames {
+		_, err = fmt.Fprintf(fOut, "  * Remote branch '%s' has been removed from the server\n",
+			remoteBranchName(selectedRemote, brName))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(fOut, "  * %d database(s) downloaded to the local cache\n", downloaded)
+	return err
+}
+
+// Returns the number of commits in the local history which aren't in the remote history, and vice versa
+func aheadBehind(meta metaData, localCommit, remoteCommit string) (ahead, behind int, err error) {
+	localHistory, err := commitHistory(meta, localCommit)
+	if err != nil {
+		return
+	}
+	remoteHistory, err := commitHistory(meta, remoteCommit)
+	if err != nil {
+		return
+	}
+	for id := range localHistory {
+		if _, ok := remoteHistory[id]; !ok {
+			ahead++
+		}
+	}
+	for id := range remoteHistory {
+		if _, ok := localHistory[id]; !ok {
+			behind++
+		}
+	}
+	return
+}
+
+// Returns the full name of a remote-tracking branch
+func remoteBranchName(remote, branch string) string {
+	return remote + "/" + branch
+}
+
+// Returns the remote-tracking branches for a remote, using the branch names from the remote server
+func remoteBranches(meta metaData, remote string) map[string]branchEntry {
+	branches := make(map[string]branchEntry)
+	for name, entry := range meta.RemoteBranches {
+		if strings.HasPrefix(name, remote+"/") {
+			branches[strings.TrimPrefix(name, remote+"/")] = entry
+		}
+	}
+	return branches
+}
+
+// Sets a single remote-tracking branch, eg after pushing to it
+func setRemoteBranch(meta *metaData, remote, branch string, entry branchEntry) {
+	if meta.RemoteBranches == nil {
+		meta.RemoteBranches = make(map[string]branchEntry)
+	}
+	meta.RemoteBranches[remoteBranchName(remote, branch)] = entry
+}
+
+// Replaces the remote-tracking branches for a remote with the given branches from the remote server
+func setRemoteBranches(meta *metaData, remote string, branches map[string]branchEntry) {
+	if meta.RemoteBranches == nil {
+		meta.RemoteBranches = make(map[string]branchEntry)
+	}
+	for name := range meta.RemoteBranches {
+		if strings.HasPrefix(name, remote+"/") {
+			delete(meta.RemoteBranches, name)
+		}
+	}
+	for name, entry := range branches {
+		meta.RemoteBranches[remoteBranchName(remote, name)] = entry
+	}
+}
+
+// Returns the tags and releases on a remote, as of the last fetch or push
+func remoteTagsReleases(meta metaData, remote string) (tags map[string]tagEntry, releases map[string]releaseEntry) {
+	if remote == DEFAULT_REMOTE {
+		return meta.RemoteTags, meta.RemoteReleases
+	}
+	refs := meta.OtherRemotes[remote]
+	return refs.Tags, refs.Releases
+}
+
+// Records the releases on a remote, so later merges and pushes can tell which have been added or removed on each side
+func setRemoteReleases(meta *metaData, remote string, releases map[string]releaseEntry) {
+	r := make(map[string]releaseEntry)
+	for name, rel := range releases {
+		r[name] = rel
+	}
+	if remote == DEFAULT_REMOTE {
+		meta.RemoteReleases = r
+		return
+	}
+	if meta.OtherRemotes == nil {
+		meta.OtherRemotes = make(map[string]remoteRefs)
+	}
+	refs := meta.OtherRemotes[remote]
+	refs.Releases = r
+	meta.OtherRemotes[remote] = refs
+}
+
+// Records the tags on a remote, so later merges and pushes can tell which have been added or removed on each side
+func setRemoteTags(meta *metaData, remote string, tags map[string]tagEntry) {
+	t := make(map[string]tagEntry)
+	for name, tag := range tags {
+		t[name] = tag
+	}
+	if remote == DEFAULT_REMOTE {
+		meta.RemoteTags = t
+		return
+	}
+	if meta.OtherRemotes == nil {
+		meta.OtherRemotes = make(map[string]remoteRefs)
+	}
+	refs := meta.OtherRemotes[remote]
+	refs.Tags = t
+	meta.OtherRemotes[remote] = refs
+}
+
+// Records the tags and releases on a remote server
+func setRemoteTagsReleases(meta *metaData, remote string, remoteMeta metaData) {
+	setRemoteTags(meta, remote, remoteMeta.Tags)
+	setRemoteReleases(meta, remote, remoteMeta.Releases)
+}
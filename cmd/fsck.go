@@ -0,0 +1,396 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
+)
+
+var (
+	fsckCmdJobs   int
+	fsckCmdRepair bool
+)
+
+// A problem found in the local metadata or cache of a database.  Problems with a repair function can be fixed by
+// --repair
+type fsckProblem struct {
+	desc   string
+	repair func() error
+}
+
+// Checks the local metadata and cached database files of a database for problems
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [database name...]",
+	Short: "Checks the local metadata and cached database files for problems",
+	Long: `Checks the local metadata and cached database files for problems
+
+Every commit and tree ID is recalculated from its contents, the parents of each
+commit are checked to be present, and the commit counts of branches are
+recounted.  Branches, tags, and releases are checked to point to known commits,
+and cached database files are checked against their SHA256 checksum.
+
+With --repair, commit counts are rebuilt, damaged commits are replaced with
+the copy on the server (if it has them), and missing or damaged database files
+are downloaded again.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fsck(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(fsckCmd)
+	fsckCmd.Flags().IntVarP(&fsckCmdJobs, "jobs", "j", defaultJobs, "Number of databases to check at once")
+	fsckCmd.Flags().BoolVar(&fsckCmdRepair, "repair", false, "Repair the problems found, where possible")
+}
+
+func fsck(args []string) error {
+	dbs, err := resolveDatabases(args, true)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, fsckCmdJobs, fsckDatabase)
+}
+
+// Checks that the tree and commit IDs of a commit match its contents
+func commitIntegrity(c commitEntry) error {
+	if len(c.Tree.Entries) == 0 {
+		return fmt.Errorf("has no database file")
+	}
+	if id := client.TreeID(c.Tree.Entries); id != c.Tree.ID {
+		return fmt.Errorf("tree ID doesn't match its contents (should be %s)", id)
+	}
+	var checkFolders func(dir string, entries []dbTreeEntry) error
+	checkFolders = func(dir string, entries []dbTreeEntry) error {
+		for _, e := range entries {
+			if e.EntryType != TREE {
+				continue
+			}
+			if id := client.TreeID(e.Entries); id != e.Sha256 {
+				return fmt.Errorf("folder '%s' doesn't match its contents (should be %s)", path.Join(dir, e.Name), id)
+			}
+			err := checkFolders(path.Join(dir, e.Name), e.Entries)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := checkFolders("", c.Tree.Entries)
+	if err != nil {
+		return err
+	}
+	if id := client.CommitID(c); id != c.ID {
+		return fmt.Errorf("commit ID doesn't match its contents (should be %s)", id)
+	}
+	return nil
+}
+
+// Checks the cached database files of a database against their checksums, and that the heads of the local branches
+// have their database file cached.  Missing or damaged database files used by a commit can be downloaded again
+func fsckCache(out io.Writer, db string, meta metaData) (problems []fsckProblem, err error) {
+	// Find a commit which uses each database file, for downloading it again if needed.  Files committed along with
+	// the database (attachments) are only stored locally, so can't be downloaded again
+	users := make(map[string]string)
+	attached := make(map[string]struct{})
+	ids := make([]string, 0, len(meta.Commits))
+	for id := range meta.Commits {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if e, ok := meta.Commits[id].Tree.Database(db); ok {
+			if _, ok = users[e.Sha256]; !ok && e.Sha256 != "" {
+				users[e.Sha256] = id
+			}
+		}
+		for _, e := range commitAttachments(meta.Commits[id], db) {
+			attached[e.Sha256] = struct{}{}
+		}
+	}
+	refetch := func(shaSum string) func() error {
+		commitID, ok := users[shaSum]
+		if _, isAttached := attached[shaSum]; !ok && isAttached {
+			return nil
+		}
+		if !ok {
+			// Nothing refers to the file, so removing it is enough
+			return func() error { return cacheRemove(db, shaSum) }
+		}
+		return func() error {
+			err := cacheRemove(db, shaSum)
+			if err != nil {
+				return err
+			}
+			_, thisSum, err := retrieveDatabase(out, db, "", commitID, shaSum)
+			if err != nil {
+				return err
+			}
+			if thisSum != shaSum {
+				return fmt.Errorf("the server sent a database with checksum '%s'", thisSum)
+			}
+			return nil
+		}
+	}
+
+	// Check every database file in the cache
+	files, err := ioutil.ReadDir(filepath.Join(dioDir(db), "db"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	checked := make(map[string]struct{})
+	for _, fi := range files {
+		shaSum := strings.TrimSuffix(fi.Name(), ".chunks")
+		if _, ok := checked[shaSum]; ok {
+			continue
+		}
+		if b, errInner := hex.DecodeString(shaSum); errInner != nil || len(b) != 32 || fi.IsDir() {
+			continue
+		}
+		checked[shaSum] = struct{}{}
+		if errInner := cacheVerify(db, shaSum); errInner != nil {
+			problems = append(problems, fsckProblem{
+				desc:   fmt.Sprintf("Database file %s: %v", shaSum, errInner),
+				repair: refetch(shaSum),
+			})
+		}
+	}
+
+	// The heads of the local branches are needed for checking out and checking for changes, so they should be cached
+	names := make([]string, 0, len(meta.Branches))
+	for name := range meta.Branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, ok := meta.Commits[meta.Branches[name].Commit]
+		if !ok {
+			continue
+		}
+		dbEntry, ok := c.Tree.Database(db)
+		if !ok {
+			continue
+		}
+		shaSum := dbEntry.Sha256
+		if _, ok = checked[shaSum]; ok || shaSum == "" {
+			continue
+		}
+		checked[shaSum] = struct{}{}
+		problems = append(problems, fsckProblem{
+			desc:   fmt.Sprintf("Branch '%s': database file %s for its head commit isn't cached", name, shaSum),
+			repair: refetch(shaSum),
+		})
+	}
+	return
+}
+
+// Checks a single database for problems, displaying the details on out.  An error is returned if any problems are
+// left unrepaired
+func fsckDatabase(out io.Writer, db string) error {
+	// Repairs can change the branches, so they're not done in the middle of a merge or rebase, or while another dio
+	// process is working on the database
+	if fsckCmdRepair {
+		unlock, err := lockDatabase(db)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		err = checkInProgress(db)
+		if err != nil {
+			return err
+		}
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return fmt.Errorf("The metadata for '%s' can't be read: %v", db, err)
+	}
+	problems := fsckMetadata(db, &meta)
+	blobProblems, err := fsckCache(out, db, meta)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, blobProblems...)
+	if len(problems) == 0 {
+		_, err = fmt.Fprintf(out, "No problems found in '%s'\n", db)
+		return err
+	}
+
+	// Let the user know what was found, repairing it if asked to
+	unrepaired := 0
+	_, err = fmt.Fprintf(out, "%d problem(s) found in '%s'\n", len(problems), db)
+	if err != nil {
+		return err
+	}
+	metaChanged := false
+	for _, p := range problems {
+		_, err = fmt.Fprintf(out, "  * %s", p.desc)
+		if err != nil {
+			return err
+		}
+		result := ""
+		switch {
+		case p.repair == nil:
+			unrepaired++
+			if fsckCmdRepair {
+				result = "... can't be repaired"
+			}
+		case !fsckCmdRepair:
+			unrepaired++
+		default:
+			if errInner := p.repair(); errInner != nil {
+				unrepaired++
+				result = fmt.Sprintf("... repair failed: %v", errInner)
+			} else {
+				metaChanged = true
+				result = "... repaired"
+			}
+		}
+		_, err = fmt.Fprintln(out, result)
+		if err != nil {
+			return err
+		}
+	}
+	if metaChanged {
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+	}
+	if unrepaired > 0 {
+		if !fsckCmdRepair {
+			return fmt.Errorf("%d problem(s) found in '%s'.  Use --repair to fix what can be fixed", unrepaired, db)
+		}
+		return fmt.Errorf("%d problem(s) in '%s' couldn't be repaired", unrepaired, db)
+	}
+	return nil
+}
+
+// Checks the commits, branches, tags, and releases in the metadata of a database.  Repairs change meta
+func fsckMetadata(db string, meta *metaData) (problems []fsckProblem) {
+	// Damaged commits can be replaced with the server's copy, if it has them.  The server is only asked once
+	var remoteMeta *metaData
+	fromServer := func(id string) func() error {
+		return func() error {
+			remoteCloud, err := remoteURL(db, selectedRemote)
+			if err != nil {
+				return err
+			}
+			if remoteMeta == nil {
+				m, found, err := retrieveMetadata(db)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return fmt.Errorf("the database isn't on %s", remoteCloud)
+				}
+				remoteMeta = &m
+			}
+			c, ok := remoteMeta.Commits[id]
+			if !ok || c.ID != id || commitIntegrity(c) != nil {
+				return fmt.Errorf("%s doesn't have an undamaged copy", remoteCloud)
+			}
+			meta.Commits[id] = c
+			return nil
+		}
+	}
+
+	// Check each commit
+	ids := make([]string, 0, len(meta.Commits))
+	for id := range meta.Commits {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		c := meta.Commits[id]
+		if errInner := commitIntegrity(c); errInner != nil {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Commit %s: %v", id, errInner),
+				repair: fromServer(id)})
+			continue
+		}
+		if c.ID != id {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Commit %s: is stored under the ID of "+
+				"another commit (%s)", id, c.ID), repair: fromServer(id)})
+			continue
+		}
+		for _, p := range append([]string{c.Parent}, c.OtherParents...) {
+			if _, ok := meta.Commits[p]; !ok && p != "" {
+				problems = append(problems, fsckProblem{desc: fmt.Sprintf("Commit %s: parent commit %s is "+
+					"missing", id, p)})
+			}
+		}
+	}
+
+	// Check the branches point to known commits, and have the right number of commits
+	names := make([]string, 0, len(meta.Branches))
+	for name := range meta.Branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		br := meta.Branches[name]
+		if _, ok := meta.Commits[br.Commit]; !ok {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Branch '%s': head commit %s is missing",
+				name, br.Commit)})
+			continue
+		}
+		count, errInner := countCommits(*meta, br.Commit)
+		if errInner != nil {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Branch '%s': %v", name, errInner)})
+			continue
+		}
+		if br.CommitCount != count {
+			name := name
+			problems = append(problems, fsckProblem{
+				desc: fmt.Sprintf("Branch '%s': has a commit count of %d, but has %d commits", name,
+					br.CommitCount, count),
+				repair: func() error {
+					br := meta.Branches[name]
+					count, err := countCommits(*meta, br.Commit)
+					if err != nil {
+						return err
+					}
+					br.CommitCount = count
+					meta.Branches[name] = br
+					return nil
+				},
+			})
+		}
+	}
+	if _, ok := meta.Branches[meta.ActiveBranch]; !ok {
+		problems = append(problems, fsckProblem{desc: fmt.Sprintf("The active branch '%s' doesn't exist",
+			meta.ActiveBranch)})
+	}
+
+	// Check the tags and releases point to known commits
+	names = names[:0]
+	for name := range meta.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := meta.Commits[meta.Tags[name].Commit]; !ok {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Tag '%s': commit %s is missing", name,
+				meta.Tags[name].Commit)})
+		}
+	}
+	names = names[:0]
+	for name := range meta.Releases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := meta.Commits[meta.Releases[name].Commit]; !ok {
+			problems = append(problems, fsckProblem{desc: fmt.Sprintf("Release '%s': commit %s is missing", name,
+				meta.Releases[name].Commit)})
+		}
+	}
+	return
+}
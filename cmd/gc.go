@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcCmdDryRun     bool
+	gcCmdJobs       int
+	gcCmdKeepRecent time.Duration
+)
+
+// Removes unreachable commits and unreferenced database files from the local cache
+var gcCmd = &cobra.Command{
+	Use:   "gc [database name...]",
+	Short: "Removes commits and cached database files which are no longer needed",
+	Long: `Removes commits and cached database files which are no longer needed
+
+Commits which can't be reached from any branch, tag, or release (including
+those on the server, as of the last fetch or push) are removed from the local
+metadata.  Cached database files and chunks which aren't used by any of the
+remaining commits are then deleted, as are database files which were
+reassembled from chunks.
+
+Use --dry-run to see what would be removed, and --keep-recent to keep anything
+newer than the given age (eg 24h).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return gc(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().BoolVar(&gcCmdDryRun, "dry-run", false,
+		"Display what would be removed, without removing anything")
+	gcCmd.Flags().IntVarP(&gcCmdJobs, "jobs", "j", defaultJobs, "Number of databases to clean up at once")
+	gcCmd.Flags().DurationVar(&gcCmdKeepRecent, "keep-recent", 0,
+		"Keep commits and cached database files newer than this (eg 24h)")
+}
+
+func gc(args []string) error {
+	dbs, err := resolveDatabases(args, true)
+	if err != nil {
+		return err
+	}
+	return forEachDatabase(dbs, gcCmdJobs, gcDatabase)
+}
+
+// Removes the unreachable commits and unreferenced cached database files for a single database, displaying the
+// details on out
+func gcDatabase(out io.Writer, db string) error {
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Merges and rebases refer to commits which may not be on any branch yet, so don't clean up during them
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	cutOff := time.Now().Add(-gcCmdKeepRecent)
+
+	// Remove the commits which can't be reached, unless they're recent
+	reachable, err := reachableCommits(meta)
+	if err != nil {
+		return err
+	}
+	var delCommits []string
+	for id, c := range meta.Commits {
+		if _, ok := reachable[id]; !ok && (gcCmdKeepRecent == 0 || c.Timestamp.Before(cutOff)) {
+			delCommits = append(delCommits, id)
+		}
+	}
+	sort.Strings(delCommits)
+	for _, id := range delCommits {
+		delete(meta.Commits, id)
+	}
+
+	// Work out which cached database files are still used by the remaining commits
+	used := make(map[string]struct{})
+	for _, c := range meta.Commits {
+		for _, e := range c.Tree.Files() {
+			used[e.Sha256] = struct{}{}
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dioDir(db), "db"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	type cacheFile struct {
+		desc string
+		path string
+		size int64
+	}
+	var delFiles []cacheFile
+	var delSize int64
+	usedChunks := make(map[string]struct{})
+	for _, fi := range files {
+		// Cached database files are named after their SHA256 checksum, with chunked ones having a manifest instead.
+		// Nothing else is removed
+		name := fi.Name()
+		shaSum := strings.TrimSuffix(name, ".chunks")
+		if b, errInner := hex.DecodeString(shaSum); errInner != nil || len(b) != 32 || fi.IsDir() {
+			continue
+		}
+		_, keep := used[shaSum]
+		if gcCmdKeepRecent != 0 && fi.ModTime().After(cutOff) {
+			keep = true
+		}
+		if keep && name != shaSum {
+			// The chunks of the manifests being kept are still needed
+			m, err := loadChunkManifest(db, shaSum)
+			if err != nil {
+				return err
+			}
+			for _, c := range m.Chunks {
+				usedChunks[c] = struct{}{}
+			}
+			continue
+		}
+		if keep {
+			// Whole database files are still needed, unless they were reassembled from chunks
+			if _, err = os.Stat(filepath.Join(dioDir(db), "db", shaSum+".chunks")); err != nil {
+				continue
+			}
+		}
+		delFiles = append(delFiles, cacheFile{desc: "Database file: " + name,
+			path: filepath.Join(dioDir(db), "db", name), size: fi.Size()})
+		delSize += fi.Size()
+	}
+
+	// Chunks which aren't used by any of the remaining chunked database files can go too
+	chunkDirs, err := ioutil.ReadDir(filepath.Join(dioDir(db), "chunks"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range chunkDirs {
+		chunks, err := ioutil.ReadDir(filepath.Join(dioDir(db), "chunks", dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fi := range chunks {
+			if b, errInner := hex.DecodeString(fi.Name()); errInner != nil || len(b) != 32 {
+				continue
+			}
+			if _, ok := usedChunks[fi.Name()]; ok || (gcCmdKeepRecent != 0 && fi.ModTime().After(cutOff)) {
+				continue
+			}
+			delFiles = append(delFiles, cacheFile{desc: "Chunk: " + fi.Name(),
+				path: filepath.Join(dioDir(db), "chunks", dir.Name(), fi.Name()), size: fi.Size()})
+			delSize += fi.Size()
+		}
+	}
+
+	// Let the user know what's being removed
+	if len(delCommits) == 0 && len(delFiles) == 0 {
+		_, err = fmt.Fprintf(out, "Nothing to clean up for '%s'\n", db)
+		return err
+	}
+	action := "Removing"
+	if gcCmdDryRun {
+		action = "Would remove"
+	}
+	_, err = numFormat.Fprintf(out, "%s %d unreachable commit(s) and %d unused cache file(s) (%d bytes) "+
+		"from '%s'\n", action, len(delCommits), len(delFiles), delSize, db)
+	if err != nil {
+		return err
+	}
+	for _, id := range delCommits {
+		_, err = fmt.Fprintf(out, "  * Commit: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range delFiles {
+		_, err = numFormat.Fprintf(out, "  * %s (%d bytes)\n", f.desc, f.size)
+		if err != nil {
+			return err
+		}
+	}
+	if gcCmdDryRun {
+		return nil
+	}
+
+	// Save the metadata before removing the database files, so it never refers to a file which isn't there
+	if len(delCommits) > 0 {
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range delFiles {
+		err = os.Remove(f.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the commits which can be reached from the branches, tags, and releases of a database.  This includes the
+// ones on the server as of the last fetch or push, though those which point to commits not known locally are skipped
+func reachableCommits(meta metaData) (reachable map[string]struct{}, err error) {
+	var heads []string
+	for _, b := range meta.Branches {
+		heads = append(heads, b.Commit)
+	}
+	for _, t := range meta.Tags {
+		heads = append(heads, t.Commit)
+	}
+	for _, r := range meta.Releases {
+		heads = append(heads, r.Commit)
+	}
+	var remoteHeads []string
+	for _, b := range meta.RemoteBranches {
+		remoteHeads = append(remoteHeads, b.Commit)
+	}
+	for _, t := range meta.RemoteTags {
+		remoteHeads = append(remoteHeads, t.Commit)
+	}
+	for _, r := range meta.RemoteReleases {
+		remoteHeads = append(remoteHeads, r.Commit)
+	}
+	for _, refs := range meta.OtherRemotes {
+		for _, t := range refs.Tags {
+			remoteHeads = append(remoteHeads, t.Commit)
+		}
+		for _, r := range refs.Releases {
+			remoteHeads = append(remoteHeads, r.Commit)
+		}
+	}
+	for _, head := range remoteHeads {
+		if _, ok := meta.Commits[head]; ok {
+			heads = append(heads, head)
+		}
+	}
+
+	reachable = make(map[string]struct{})
+	for _, head := range heads {
+		if _, ok := reachable[head]; ok || head == "" {
+			continue
+		}
+		history, err := commitHistory(meta, head)
+		if err != nil {
+			return nil, err
+		}
+		for id := range history {
+			reachable[id] = struct{}{}
+		}
+	}
+	return
+}
@@ -18,6 +18,9 @@ var infoCmd = &cobra.Command{
 		if confPath := viper.ConfigFileUsed(); confPath != "" {
 			fmt.Println("Configuration file used:", confPath)
 		}
+		if profile, err := selectedProfile(); err == nil && profile != "" {
+			fmt.Println("Profile used:", profile)
+		}
 
 		fmt.Printf("\n** Connection **\n\n")
 
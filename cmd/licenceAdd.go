@@ -3,12 +3,10 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
 	"os"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 var licenceAddFile, licenceAddFileFormat, licenceAddFullName, licenceAddURL string
@@ -55,50 +53,23 @@ func licenceAdd(args []string) error {
 	if licenceAddFile == "" {
 		return errors.New("A file containing the licence text is required")
 	}
-	_, err := os.Stat(licenceAddFile)
+	f, err := os.Open(licenceAddFile)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	// Send the licence info to the API server
 	name := args[0]
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(fmt.Sprintf("%s/licence/add", cloud)).
-		Type("multipart").
-		Query(fmt.Sprintf("licence_id=%s", url.QueryEscape(name))).
-		Query(fmt.Sprintf("display_order=%d", licenceAddDisplayOrder)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(licenceAddFile, "", "file1")
-	if licenceAddFileFormat != "" {
-		req.Query(fmt.Sprintf("file_format=%s", url.QueryEscape(licenceAddFileFormat)))
+	opts := client.LicenceOptions{
+		DisplayOrder: licenceAddDisplayOrder,
+		FileFormat:   licenceAddFileFormat,
+		FullName:     licenceAddFullName,
+		URL:          licenceAddURL,
 	}
-	if licenceAddFullName != "" {
-		req.Query(fmt.Sprintf("licence_name=%s", url.QueryEscape(licenceAddFullName)))
-	}
-	if licenceAddURL != "" {
-		req.Query(fmt.Sprintf("source_url=%s", url.QueryEscape(licenceAddURL)))
-	}
-	resp, body, errs := req.End()
-	if errs != nil {
-		_, err = fmt.Fprint(fOut, "Errors when adding licence:")
-		if err != nil {
-			return err
-		}
-		for _, errInner := range errs {
-			errTxt := errInner.Error()
-			_, errInnerInner := fmt.Fprint(fOut, errTxt)
-			if errInnerInner != nil {
-				return errInnerInner
-			}
-		}
-		return errors.New("Error when adding licence")
-	}
-	if resp.StatusCode != http.StatusCreated {
-		if resp.StatusCode == http.StatusConflict {
-			return errors.New(body)
-		}
-
-		return errors.New(fmt.Sprintf("Adding licence failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
+	err = newClient().AddLicence(cmdContext(), name, opts, licenceAddFile, f)
+	if err != nil {
+		return err
 	}
 
 	_, err = fmt.Fprintf(fOut, "Licence '%s' added\n", name)
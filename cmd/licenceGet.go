@@ -3,12 +3,8 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 	"strings"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
 )
 
@@ -57,37 +53,23 @@ func licenceGet(args []string) error {
 	// Download the licence text
 	dlStatus := make(map[string]string)
 	for _, lic := range licenceList {
-		resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/licence/get").
-			Query(fmt.Sprintf("licence=%s", lic)).
-			Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-			End()
-		if errs != nil {
-			for _, err := range errs {
-				log.Print(err.Error())
-			}
-			dlStatus[lic] = "Error when downloading licence text"
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			if resp.StatusCode == http.StatusNotFound {
-				dlStatus[lic] = "Requested licence not found"
-				continue
-			}
-			dlStatus[lic] = fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'",
-				resp.StatusCode, resp.Status)
+		body, html, err := newClient().LicenceText(cmdContext(), lic)
+		if err != nil {
+			dlStatus[lic] = err.Error()
 			continue
 		}
 
 		// Write the licence to disk
 		var ext string
-		if resp.Header.Get("Content-Type") == "text/html" {
+		if html {
 			ext = "html"
 		} else {
 			ext = "txt"
 		}
-		err := ioutil.WriteFile(fmt.Sprintf("%s.%s", lic, ext), []byte(body), 0644)
+		err = writeFileAtomic(fmt.Sprintf("%s.%s", lic, ext), body, 0644)
 		if err != nil {
 			dlStatus[lic] = err.Error()
+			continue
 		}
 		dlStatus[lic] = fmt.Sprintf("Licence '%s.%s' downloaded", lic, ext)
 	}
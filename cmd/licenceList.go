@@ -56,6 +56,9 @@ func licenceList() error {
 	}
 
 	// Display the list of licences
+	if structuredOutput() {
+		return writeOutput(licenceListOutput{Cloud: cloud, Licences: licList})
+	}
 	if len(licList) == 0 {
 		_, err = fmt.Fprintf(fOut, "Cloud '%s' knows no licences\n", cloud)
 		if err != nil {
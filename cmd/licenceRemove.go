@@ -3,10 +3,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"net/http"
-	"net/url"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/spf13/cobra"
 )
 
@@ -34,27 +31,11 @@ func licenceRemove(args []string) error {
 
 	// Remove the licence
 	name := args[0]
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Post(fmt.Sprintf("%s/licence/remove", cloud)).
-		Query(fmt.Sprintf("licence_id=%s", url.QueryEscape(name))).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
-	if errs != nil {
-		_, err := fmt.Fprint(fOut, "Errors when removing licence:")
-		if err != nil {
-			return err
-		}
-		for _, err := range errs {
-			_, errInner := fmt.Fprint(fOut, err.Error())
-			if errInner != nil {
-				return errInner
-			}
-		}
-		return errors.New("Error when removing licence")
-	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(body)
+	err := newClient().RemoveLicence(cmdContext(), name)
+	if err != nil {
+		return err
 	}
 
-	_, err := fmt.Fprintf(fOut, "Licence '%s' removed\n", name)
+	_, err = fmt.Fprintf(fOut, "Licence '%s' removed\n", name)
 	return err
 }
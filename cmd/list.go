@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -31,37 +33,68 @@ func list(args []string) error {
 	}
 
 	// Display the list of databases
+	if structuredOutput() {
+		if dbList == nil {
+			dbList = []dbListEntry{}
+		}
+		return writeOutput(dbListOutput{Cloud: cloud, Databases: dbList})
+	}
 	if len(dbList) == 0 {
 		_, err = fmt.Fprintf(fOut, "Cloud '%s' has no databases\n", cloud)
 		return err
 	}
 	fmt.Printf("Databases on %s\n\n", cloud)
+
+	// Databases in folders are shown in a tree, after the ones at the top level
+	sort.SliceStable(dbList, func(i, j int) bool {
+		a, b := folderParts(dbList[i].Folder), folderParts(dbList[j].Folder)
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	var shown []string
 	for _, j := range dbList {
-		_, err = fmt.Fprintf(fOut, "  * Database: %s\n", j.Name)
+		parts := folderParts(j.Folder)
+		same := 0
+		for same < len(shown) && same < len(parts) && shown[same] == parts[same] {
+			same++
+		}
+		for k := same; k < len(parts); k++ {
+			_, err = fmt.Fprintf(fOut, "%s  %s/\n", strings.Repeat("  ", k), parts[k])
+			if err != nil {
+				return err
+			}
+		}
+		shown = parts
+		indent := strings.Repeat("  ", len(parts))
+		_, err = fmt.Fprintf(fOut, "%s  * Database: %s\n", indent, j.Name)
 		if err != nil {
 			return err
 		}
 		if j.OneLineDesc != "" {
-			_, err = fmt.Fprintf(fOut, "      Description: %s\n", j.OneLineDesc)
+			_, err = fmt.Fprintf(fOut, "%s      Description: %s\n", indent, j.OneLineDesc)
 			if err != nil {
 				return err
 			}
 		}
-		_, err = fmt.Fprintf(fOut, "      Default branch: %s\n", j.DefBranch)
+		_, err = fmt.Fprintf(fOut, "%s      Default branch: %s\n", indent, j.DefBranch)
 		if err != nil {
 			return err
 		}
-		_, err := numFormat.Fprintf(fOut, "      Size: %d bytes\n", j.Size)
+		_, err := numFormat.Fprintf(fOut, "%s      Size: %d bytes\n", indent, j.Size)
 		if err != nil {
 			return err
 		}
 		if j.Licence != "" {
-			_, err = fmt.Fprintf(fOut, "      Licence: %s\n", j.Licence)
+			_, err = fmt.Fprintf(fOut, "%s      Licence: %s\n", indent, j.Licence)
 			if err != nil {
 				return err
 			}
 		} else {
-			_, err = fmt.Fprintf(fOut, "      Licence: Not specified")
+			_, err = fmt.Fprintf(fOut, "%s      Licence: Not specified", indent)
 			if err != nil {
 				return err
 			}
@@ -72,7 +105,7 @@ func list(args []string) error {
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprintf(fOut, "      File last modified: %s\n", z.Local().Format(time.RFC1123))
+		_, err = fmt.Fprintf(fOut, "%s      File last modified: %s\n", indent, z.Local().Format(time.RFC1123))
 		if err != nil {
 			return err
 		}
@@ -80,10 +113,21 @@ func list(args []string) error {
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprintf(fOut, "      Repository last updated: %s\n\n", z.Local().Format(time.RFC1123))
+		_, err = fmt.Fprintf(fOut, "%s      Repository last updated: %s\n\n", indent, z.Local().Format(time.RFC1123))
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// Returns the names of the nested folders making up a folder path on the server (eg "/finance/2024" gives "finance"
+// and "2024").  The top level folder has none
+func folderParts(folder string) (parts []string) {
+	for _, p := range strings.Split(folder, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Takes the lock for a database, so other dio processes can't change its metadata or cache at the same time.  The
+// lock is an advisory lock held on a file (.dio/<db>/lock) which also records the process ID of its owner.  As the
+// operating system releases the lock when its owner exits, locks are never left behind by processes which crashed.
+// The returned function releases the lock
+func lockDatabase(db string) (unlock func(), err error) {
+	dir := dioDir(db)
+	_, err = os.Stat(dir)
+	created := os.IsNotExist(err)
+	err = os.MkdirAll(dir, 0770)
+	if err != nil {
+		return
+	}
+	lockFile := filepath.Join(dir, "lock")
+	var f *os.File
+	for {
+		f, err = os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return
+		}
+		err = lockHandle(f)
+		if err != nil {
+			f.Close()
+			b, _ := ioutil.ReadFile(lockFile)
+			return nil, fmt.Errorf("Another dio process (%s) is working on '%s'.  Please try again once it has "+
+				"finished", strings.TrimSpace(string(b)), db)
+		}
+
+		// If the previous owner removed the lock file while releasing it, the file we locked is no longer the lock
+		// file, so try again with the current one
+		var lockedInfo, currentInfo os.FileInfo
+		lockedInfo, err = f.Stat()
+		if err == nil {
+			currentInfo, err = os.Stat(lockFile)
+		}
+		if err == nil && os.SameFile(lockedInfo, currentInfo) {
+			break
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	// Record who holds the lock, for the error message shown to other dio processes
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	if err != nil {
+		unlockHandle(f, lockFile)
+		return
+	}
+	unlock = func() {
+		unlockHandle(f, lockFile)
+		if created {
+			// Don't leave behind an empty directory for a database which was never used
+			os.Remove(dir)
+		}
+	}
+	return
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Takes an exclusive advisory lock on an open file, failing straight away if another process holds it
+func lockHandle(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
+
+// Releases a lock taken by lockHandle, removing the lock file.  The file is removed while it's still locked, so the
+// removed path can't belong to anyone else
+func unlockHandle(f *os.File, path string) {
+	os.Remove(path)
+	f.Close()
+}
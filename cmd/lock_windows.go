@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Takes an exclusive lock on an open file, failing straight away if another process holds it.  The locked byte is
+// well past the end of the file, so other processes can still read the process ID written in it
+func lockHandle(f *os.File) error {
+	ol := windows.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0) >> 1}
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|
+		windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+}
+
+// Releases a lock taken by lockHandle, removing the lock file.  Windows refuses to remove files other processes
+// have open, so the removal can't affect a lock someone else has just taken
+func unlockHandle(f *os.File, path string) {
+	f.Close()
+	os.Remove(path)
+}
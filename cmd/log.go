@@ -3,6 +3,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -36,7 +37,7 @@ func branchLog(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -62,6 +63,20 @@ func branchLog(args []string) error {
 		logBranch = meta.ActiveBranch
 	}
 
+	// If machine readable output was requested, return the commits as they are
+	if structuredOutput() {
+		out := logOutput{Branch: logBranch, Database: db}
+		for id := meta.Branches[logBranch].Commit; id != ""; {
+			c, ok := meta.Commits[id]
+			if !ok {
+				return fmt.Errorf("Broken commit history: commit '%s' isn't in the local commit cache", id)
+			}
+			out.Commits = append(out.Commits, c)
+			id = c.Parent
+		}
+		return writeOutput(out)
+	}
+
 	// Retrieve the list of known licences
 	l, err := getLicences()
 	if err != nil {
@@ -75,33 +90,39 @@ func branchLog(args []string) error {
 	}
 
 	// Display the commits for the branch
-	headID := meta.Branches[logBranch].Commit
-	localCommit := meta.Commits[headID]
 	_, err = fmt.Fprintf(fOut, "Branch \"%s\" history for %s:\n\n", logBranch, db)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprint(fOut, createCommitText(meta.Commits[localCommit.ID], licList))
-	if err != nil {
-		return err
-	}
-	for localCommit.Parent != "" {
-		localCommit = meta.Commits[localCommit.Parent]
-		_, err = fmt.Fprintf(fOut, createCommitText(meta.Commits[localCommit.ID], licList))
+	for id := meta.Branches[logBranch].Commit; id != ""; {
+		c, ok := meta.Commits[id]
+		if !ok {
+			return fmt.Errorf("Broken commit history: commit '%s' isn't in the local commit cache", id)
+		}
+		_, err = fmt.Fprint(fOut, createCommitText(db, c, licList))
 		if err != nil {
 			return err
 		}
+		id = c.Parent
 	}
 	return nil
 }
 
-// Creates the user visible commit text for a commit.
-func createCommitText(c commitEntry, licList map[string]string) string {
+// Creates the user visible commit text for a commit of a database.
+func createCommitText(db string, c commitEntry, licList map[string]string) string {
 	s := fmt.Sprintf("  * Commit: %s\n", c.ID)
 	s += fmt.Sprintf("    Author: %s <%s>\n", c.AuthorName, c.AuthorEmail)
 	s += fmt.Sprintf("    Date: %v\n", c.Timestamp.Local().Format(time.RFC1123))
-	if c.Tree.Entries[0].LicenceSHA != "" {
-		s += fmt.Sprintf("    Licence: %s\n\n", licList[c.Tree.Entries[0].LicenceSHA])
+	if files := commitAttachments(c, db); len(files) > 0 {
+		var names []string
+		for _, e := range files {
+			names = append(names, e.Name)
+		}
+		s += fmt.Sprintf("    Attached files: %s\n", strings.Join(names, ", "))
+	}
+	dbEntry, _ := c.Tree.Database(db)
+	if dbEntry.LicenceSHA != "" {
+		s += fmt.Sprintf("    Licence: %s\n\n", licList[dbEntry.LicenceSHA])
 	} else {
 		s += fmt.Sprintf("\n")
 	}
@@ -0,0 +1,1020 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	mergeCmdInto, mergeCmdMsg                      string
+	mergeCmdAbort, mergeCmdContinue, mergeCmdForce bool
+)
+
+// Merges the changes from one branch into another
+var mergeCmd = &cobra.Command{
+	Use:   "merge [database name] branch [--into yyy]",
+	Short: "Merges the changes from another branch into a branch",
+	Long: `Merges the changes from another branch into a branch
+
+The changes made on both branches since their common ancestor are combined row by
+row, with the result being written to the working database and committed with
+both branch heads as its parents.
+
+If the same rows were changed differently on both branches, the conflicts are
+listed and the merge is paused.  Fix the conflicting rows in the working database,
+then run 'dio merge --continue' to create the merge commit.  Alternatively,
+'dio merge --abort' cancels the merge.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return merge(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mergeCmd)
+	mergeCmd.Flags().BoolVar(&mergeCmdAbort, "abort", false, "Cancel an in-progress merge")
+	mergeCmd.Flags().BoolVar(&mergeCmdContinue, "continue", false,
+		"Create the merge commit, after conflicts have been resolved")
+	mergeCmd.Flags().BoolVarP(&mergeCmdForce, "force", "f", false,
+		"Overwrite unsaved changes to the database?")
+	mergeCmd.Flags().StringVar(&mergeCmdInto, "into", "",
+		"Branch to merge the changes into (default is the active branch)")
+	mergeCmd.Flags().StringVar(&mergeCmdMsg, "message", "", "Commit message for the merge commit")
+}
+
+func merge(args []string) error {
+	if mergeCmdAbort && mergeCmdContinue {
+		return errors.New("Either --abort or --continue can be given.  Not both!")
+	}
+
+	// Work out the database and branch names.  When only one argument is given it's the branch name, unless an
+	// in-progress merge is being continued or aborted (in which case no branch name is needed)
+	var db, branch string
+	var err error
+	switch len(args) {
+	case 0:
+	case 1:
+		if mergeCmdAbort || mergeCmdContinue {
+			db = args[0]
+		} else {
+			branch = args[0]
+		}
+	case 2:
+		db = args[0]
+		branch = args[1]
+	default:
+		return errors.New("Only one database and branch can be merged at a time")
+	}
+	if db == "" {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if mergeCmdAbort {
+		return mergeAbort(db)
+	}
+	if mergeCmdContinue {
+		return mergeContinue(db)
+	}
+	if branch == "" {
+		return errors.New("No branch name given")
+	}
+
+	// Make sure there isn't already a merge or rebase underway
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+
+	// Load the metadata
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// If no target branch was given, use the active branch
+	into := mergeCmdInto
+	if into == "" {
+		into = meta.ActiveBranch
+	}
+	if branch == into {
+		return errors.New("A branch can't be merged into itself")
+	}
+
+	// Make sure both branches exist
+	theirs, ok := meta.Branches[branch]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+	ours, ok := meta.Branches[into]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", into)
+	}
+
+	// Unless --force is specified, check whether the file has changed since the last commit, and let the user know
+	if !mergeCmdForce {
+		changed, err := dbChanged(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+				"really want to overwrite it\n", db)
+			return err
+		}
+	}
+
+	// Find the point where the branches diverged
+	base, err := findCommonAncestor(meta, ours.Commit, theirs.Commit)
+	if err != nil {
+		return err
+	}
+
+	// If all of the commits in the other branch are already in the target branch, there's nothing to do
+	if base == theirs.Commit {
+		_, err = fmt.Fprintf(fOut, "Branch '%s' already contains all of the commits from '%s'.  Nothing to "+
+			"merge.\n", into, branch)
+		return err
+	}
+
+	// If the target branch hasn't changed since the branches diverged, then we just move it forward
+	if base == ours.Commit {
+		err = writeCommitToWorkingFile(db, meta, theirs.Commit)
+		if err != nil {
+			return err
+		}
+		meta.Branches[into] = branchEntry{
+			Commit:      theirs.Commit,
+			CommitCount: theirs.CommitCount,
+			Description: ours.Description,
+		}
+		meta.ActiveBranch = into
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "Branch '%s' fast-forwarded to commit %s from '%s'\n", into, theirs.Commit,
+			branch)
+		return err
+	}
+
+	// * To get here, both branches have changes which need combining *
+
+	// Determine the changes made on the other branch
+	basePath, err := commitDBPath(db, meta, base)
+	if err != nil {
+		return err
+	}
+	theirsPath, err := commitDBPath(db, meta, theirs.Commit)
+	if err != nil {
+		return err
+	}
+	diffs, err := diffDatabases(basePath, theirsPath)
+	if err != nil {
+		return err
+	}
+
+	// Files committed along with the database are merged the same way as for cherry-picks
+	files := applyAttachmentChanges(db, meta, ours.Commit, base, theirs.Commit)
+	err = checkNewAttachments(db, meta, into, files)
+	if err != nil {
+		return err
+	}
+
+	// Start from the head of the target branch, then apply the changes from the other branch to it
+	err = writeCommitToWorkingFile(db, meta, ours.Commit)
+	if err != nil {
+		return err
+	}
+	active := meta.ActiveBranch
+	if meta.ActiveBranch != into {
+		meta.ActiveBranch = into
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+	}
+	conflicts, err := applyDiffs(db, diffs)
+	if err == nil {
+		err = writeAttachmentChanges(db, meta, ours.Commit, files)
+	}
+	if err != nil {
+		// Put the working database back how it was
+		errInner := writeCommitToWorkingFile(db, meta, ours.Commit)
+		if errInner != nil {
+			return fmt.Errorf("%s: %s", err, errInner)
+		}
+		return err
+	}
+
+	msg := mergeCmdMsg
+	if msg == "" {
+		msg = fmt.Sprintf("Merge branch '%s' into '%s'", branch, into)
+	}
+	state := &mergeState{
+		ActiveBranch: active,
+		Base:         base,
+		Branch:       branch,
+		Conflicts:    conflicts,
+		Into:         into,
+		Message:      msg,
+		Ours:         ours.Commit,
+		Theirs:       theirs.Commit,
+	}
+
+	// If there were conflicts, save the merge state so the user can resolve them and then continue the merge
+	if len(conflicts) > 0 {
+		err = saveMergeState(db, *state)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "Merging branch '%s' into '%s' has conflicts:\n\n", branch, into)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprint(fOut, createConflictText(conflicts))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Automatic merge failed.  Fix the conflicts in '%s', then run 'dio merge --continue' "+
+			"to create the merge commit.  Or use 'dio merge --abort' to cancel the merge", db)
+	}
+
+	// No conflicts, so create the merge commit straight away
+	return createMergeCommit(db, meta, *state)
+}
+
+// Cancels an in-progress merge, switching back to the branch which was active when it was started and restoring the
+// working database to the head of that branch
+func mergeAbort(db string) error {
+	state, err := loadMergeState(db)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No merge is in progress for '%s'", db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	head := state.Ours
+	prev, ok := meta.Branches[state.ActiveBranch]
+	if ok && state.ActiveBranch != state.Into {
+		head = prev.Commit
+	}
+	err = writeCommitToWorkingFile(db, meta, head)
+	if err != nil {
+		return err
+	}
+	err = restoreAttachments(db, meta, head, mergeAttachments(db, meta, *state))
+	if err != nil {
+		return err
+	}
+	if ok && meta.ActiveBranch != state.ActiveBranch {
+		meta.ActiveBranch = state.ActiveBranch
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(filepath.Join(dioDir(db), "merge.json"))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Merge of branch '%s' into '%s' cancelled\n", state.Branch, state.Into)
+	return err
+}
+
+// Finishes an in-progress merge, once the user has resolved the conflicts
+func mergeContinue(db string) error {
+	state, err := loadMergeState(db)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No merge is in progress for '%s'", db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the target branch hasn't been moved in the meantime
+	if head, ok := meta.Branches[state.Into]; !ok || head.Commit != state.Ours {
+		return fmt.Errorf("Branch '%s' has changed since the merge was started.  Use --abort to cancel the "+
+			"merge", state.Into)
+	}
+	err = createMergeCommit(db, meta, *state)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dioDir(db), "merge.json"))
+}
+
+// Creates the merge commit for a merge, using the current contents of the working database
+func createMergeCommit(db string, meta metaData, state mergeState) error {
+	var name, email string
+	if z, ok := viper.Get("user.name").(string); ok {
+		name = z
+	}
+	if z, ok := viper.Get("user.email").(string); ok {
+		email = z
+	}
+	if name == "" || email == "" {
+		return errors.New("Author and committer name and email addresses are required!")
+	}
+
+	// The merged database keeps the licence of the target branch
+	dbEntry, err := commitDBEntry(meta.Commits[state.Ours], db)
+	if err != nil {
+		return err
+	}
+	newCom, err := addCommit(db, meta, state.Into, dbEntry.LicenceSHA, mergeAttachments(db, meta, state), commitEntry{
+		AuthorName:     name,
+		AuthorEmail:    email,
+		CommitterName:  name,
+		CommitterEmail: email,
+		Message:        state.Message,
+		OtherParents:   []string{state.Theirs},
+		Timestamp:      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Branch '%s' merged into '%s'\n", state.Branch, state.Into)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "  * Commit ID: %s\n", newCom.ID)
+	return err
+}
+
+// Creates the user visible text for a list of conflicting changes
+func createConflictText(conflicts []changeConflict) string {
+	var s string
+	for _, j := range conflicts {
+		s += fmt.Sprintf("  * %s '%s'", strings.ToUpper(j.ObjectType[:1])+j.ObjectType[1:], j.ObjectName)
+		if len(j.Pk) > 0 {
+			var keys []string
+			for _, k := range j.Pk {
+				keys = append(keys, fmt.Sprintf("%s=%s", k.Name, sqlValue(k.Value)))
+			}
+			s += fmt.Sprintf(", row %s", strings.Join(keys, ", "))
+		}
+		s += fmt.Sprintf(": %s\n", j.Reason)
+	}
+	return s + "\n"
+}
+
+// Returns an error if a merge, rebase, cherry-pick, or revert is in progress for the database, as those need finishing
+// or cancelling before anything else changes the branches
+func checkInProgress(db string) error {
+	mState, err := loadMergeState(db)
+	if err != nil {
+		return err
+	}
+	if mState != nil {
+		return fmt.Errorf("A merge of branch '%s' into '%s' is in progress.  Use 'dio merge --continue' to "+
+			"finish it, or 'dio merge --abort' to cancel it", mState.Branch, mState.Into)
+	}
+	rState, err := loadRebaseState(db)
+	if err != nil {
+		return err
+	}
+	if rState != nil {
+		return fmt.Errorf("A rebase of branch '%s' is in progress.  Use 'dio rebase --continue' to finish it, "+
+			"or 'dio rebase --abort' to cancel it", rState.Branch)
+	}
+	cState, err := loadChangesetState(db, cherryPickOp)
+	if err != nil {
+		return err
+	}
+	if cState != nil {
+		return fmt.Errorf("A cherry-pick of commit %s onto branch '%s' is in progress.  Use 'dio cherry-pick "+
+			"--continue' to finish it, or 'dio cherry-pick --abort' to cancel it", cState.Commit, cState.Branch)
+	}
+	vState, err := loadChangesetState(db, revertCommitOp)
+	if err != nil {
+		return err
+	}
+	if vState != nil {
+		return fmt.Errorf("A revert of commit %s on branch '%s' is in progress.  Use 'dio revert-commit "+
+			"--continue' to finish it, or 'dio revert-commit --abort' to cancel it", vState.Commit, vState.Branch)
+	}
+	return nil
+}
+
+// Loads the state of an in-progress merge.  Returns nil if no merge is in progress
+func loadMergeState(db string) (state *mergeState, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), "merge.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return
+	}
+	state = &mergeState{}
+	err = json.Unmarshal(b, state)
+	return
+}
+
+// Returns the files to commit along with the database when merging.  These are the ones from the head of the target
+// branch, with the files added, changed, or removed on the other branch since they diverged done the same way
+func mergeAttachments(db string, meta metaData, state mergeState) []dbTreeEntry {
+	return applyAttachmentChanges(db, meta, state.Ours, state.Base, state.Theirs)
+}
+
+// Saves the state of an in-progress merge
+func saveMergeState(db string, state mergeState) (err error) {
+	var jsonString []byte
+	jsonString, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dioDir(db), "merge.json"), jsonString, 0644)
+	return
+}
+
+// Overwrites the working database and its attached files with the ones from a commit
+func writeCommitToWorkingFile(db string, meta metaData, commitID string) (err error) {
+	path, err := commitDBPath(db, meta, commitID)
+	if err != nil {
+		return
+	}
+	err = copyFile(path, db)
+	if err != nil {
+		return
+	}
+	dbEntry, err := commitDBEntry(meta.Commits[commitID], db)
+	if err != nil {
+		return
+	}
+	err = os.Chtimes(db, time.Now(), dbEntry.LastModified)
+	if err != nil {
+		return
+	}
+	return writeCommitAttachments(db, meta.Commits[commitID])
+}
+
+// Applies a set of database changes to a database file.  Each change is checked against the current contents of the
+// database first, and changes which would overwrite something different are skipped and returned as conflicts
+func applyDiffs(path string, diffs dbDiffs) (conflicts []changeConflict, err error) {
+	sdb, err := openSQLite(path, false)
+	if err != nil {
+		return
+	}
+	defer sdb.Close()
+
+	// Let tables be rebuilt without SQLite complaining about the views and triggers which refer to them
+	_, err = sdb.Exec(`PRAGMA legacy_alter_table = ON`)
+	if err != nil {
+		return
+	}
+	tx, err := sdb.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Remove the indexes, views, and triggers being removed or changed.  This is done in reverse order, so objects
+	// which depend on others are removed first
+	skip := make(map[string]bool)
+	for i := len(diffs.Diff) - 1; i >= 0; i-- {
+		chg := diffs.Diff[i]
+		if chg.ObjectType == "table" || chg.Schema == nil || chg.Schema.ActionType == ACTION_ADD {
+			continue
+		}
+		var current string
+		var found bool
+		current, found, err = objectSQL(tx, chg.ObjectName)
+		if err != nil {
+			return
+		}
+		switch {
+		case found && current == chg.Schema.Before:
+			_, err = tx.Exec(fmt.Sprintf(`DROP %s %s`, strings.ToUpper(chg.ObjectType),
+				quoteIdent(chg.ObjectName)))
+			if err != nil {
+				return
+			}
+		case chg.Schema.ActionType == ACTION_DELETE && !found:
+			// The object has already been removed
+		case chg.Schema.ActionType == ACTION_MODIFY && found && current == chg.Schema.After:
+			// The object already has the change
+			skip[chg.ObjectName] = true
+		default:
+			conflicts = append(conflicts, changeConflict{ObjectName: chg.ObjectName, ObjectType: chg.ObjectType,
+				Reason: "its definition has been changed on both sides"})
+			skip[chg.ObjectName] = true
+		}
+	}
+
+	// Apply the changes to tables
+	for _, chg := range diffs.Diff {
+		if chg.ObjectType != "table" {
+			continue
+		}
+		var c []changeConflict
+		c, err = applyTableChanges(tx, chg)
+		if err != nil {
+			return
+		}
+		conflicts = append(conflicts, c...)
+	}
+
+	// Create the new and changed indexes, views, and triggers
+	for _, chg := range diffs.Diff {
+		if chg.ObjectType == "table" || chg.Schema == nil || chg.Schema.ActionType == ACTION_DELETE ||
+			skip[chg.ObjectName] {
+			continue
+		}
+		var current string
+		var found bool
+		current, found, err = objectSQL(tx, chg.ObjectName)
+		if err != nil {
+			return
+		}
+		if found {
+			if current != chg.Schema.After {
+				conflicts = append(conflicts, changeConflict{ObjectName: chg.ObjectName,
+					ObjectType: chg.ObjectType, Reason: "it has been added on both sides with different definitions"})
+			}
+			continue
+		}
+		_, err = tx.Exec(chg.Schema.After)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
+// Applies the schema and row changes for a single table
+func applyTableChanges(tx *sql.Tx, chg diffObjectChangeset) (conflicts []changeConflict, err error) {
+	tableConflict := func(reason string) {
+		conflicts = append(conflicts, changeConflict{ObjectName: chg.ObjectName, ObjectType: chg.ObjectType,
+			Reason: reason})
+	}
+	current, found, err := objectSQL(tx, chg.ObjectName)
+	if err != nil {
+		return
+	}
+
+	// Tables with only row changes
+	if chg.Schema == nil {
+		if !found {
+			tableConflict("the table has been removed")
+			return
+		}
+		return applyRowChanges(tx, chg)
+	}
+
+	switch chg.Schema.ActionType {
+	case ACTION_ADD:
+		if found && current != chg.Schema.After {
+			tableConflict("it has been added on both sides with different definitions")
+			return
+		}
+		if !found {
+			_, err = tx.Exec(chg.Schema.After)
+			if err != nil {
+				return
+			}
+		}
+		return applyRowChanges(tx, chg)
+
+	case ACTION_DELETE:
+		if !found {
+			return
+		}
+		if current != chg.Schema.Before {
+			tableConflict("the table definition has been changed, so it can't be removed")
+			return
+		}
+		var same bool
+		same, err = tableHasRows(tx, chg.ObjectName, chg.ColsBefore, chg.Data)
+		if err != nil {
+			return
+		}
+		if !same {
+			tableConflict("rows in the table have been changed, so it can't be removed")
+			return
+		}
+		_, err = tx.Exec(fmt.Sprintf(`DROP TABLE %s`, quoteIdent(chg.ObjectName)))
+		return
+
+	case ACTION_MODIFY:
+		sameCols := sameStrings(chg.ColsBefore, chg.ColsAfter)
+		if found && current == chg.Schema.After {
+			// The table definition has already been changed
+			if sameCols {
+				return applyRowChanges(tx, chg)
+			}
+			return
+		}
+		if !found || current != chg.Schema.Before {
+			tableConflict("the table definition has been changed on both sides")
+			return
+		}
+		if sameCols {
+			// Only the table definition changed, so the rows are kept and then have their own changes applied
+			err = rebuildTable(tx, chg.ObjectName, chg.Schema.After, chg.ColsAfter, true)
+			if err != nil {
+				return
+			}
+			return applyRowChanges(tx, chg)
+		}
+
+		// The columns of the table have changed, which means its complete contents are replaced.  That's only safe
+		// when nothing else has changed the rows
+		var before, after []dataDiff
+		for _, j := range chg.Data {
+			if j.ActionType == ACTION_DELETE {
+				before = append(before, j)
+			} else {
+				after = append(after, j)
+			}
+		}
+		var same bool
+		same, err = tableHasRows(tx, chg.ObjectName, chg.ColsBefore, before)
+		if err != nil {
+			return
+		}
+		if !same {
+			tableConflict("the table columns have been changed, but its rows have also been changed")
+			return
+		}
+		err = rebuildTable(tx, chg.ObjectName, chg.Schema.After, chg.ColsAfter, false)
+		if err != nil {
+			return
+		}
+		for _, j := range after {
+			err = insertRow(tx, chg.ObjectName, j.Pk, chg.ColsAfter, j.DataAfter)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Applies the row changes for a table, checking each row's current values first.  Rows changed on both sides are
+// merged column by column where possible, otherwise they're left unchanged and returned as conflicts
+func applyRowChanges(tx *sql.Tx, chg diffObjectChangeset) (conflicts []changeConflict, err error) {
+	if len(chg.Data) == 0 {
+		return
+	}
+	cols := chg.ColsAfter
+	if len(cols) == 0 {
+		cols = chg.ColsBefore
+	}
+
+	// Make sure the table columns are the ones the changes are for
+	currentCols, _, err := tableColumns(tx, "main", chg.ObjectName)
+	if err != nil {
+		return
+	}
+	if !sameStrings(currentCols, cols) {
+		conflicts = append(conflicts, changeConflict{ObjectName: chg.ObjectName, ObjectType: chg.ObjectType,
+			Reason: "the table columns have been changed, so its row changes can't be applied"})
+		return
+	}
+
+	for _, row := range chg.Data {
+		rowConflict := func(reason string) {
+			conflicts = append(conflicts, changeConflict{ObjectName: chg.ObjectName, ObjectType: chg.ObjectType,
+				Pk: row.Pk, Reason: reason})
+		}
+		var current []interface{}
+		var found bool
+		current, found, err = fetchRow(tx, chg.ObjectName, row.Pk, cols)
+		if err != nil {
+			return
+		}
+		switch row.ActionType {
+		case ACTION_DELETE:
+			if !found {
+				// The row has already been deleted
+				continue
+			}
+			if !sameRow(current, row.DataBefore) {
+				rowConflict("the row was changed on one side and deleted on the other")
+				continue
+			}
+			err = deleteRow(tx, chg.ObjectName, row.Pk)
+
+		case ACTION_ADD:
+			if !found {
+				err = insertRow(tx, chg.ObjectName, row.Pk, cols, row.DataAfter)
+			} else if !sameRow(current, row.DataAfter) {
+				rowConflict("the row was added on both sides with different values")
+			}
+
+		case ACTION_MODIFY:
+			if !found {
+				rowConflict("the row was deleted on one side and changed on the other")
+				continue
+			}
+			if sameRow(current, row.DataAfter) {
+				// The row already has the change
+				continue
+			}
+			if sameRow(current, row.DataBefore) {
+				err = updateRow(tx, chg.ObjectName, row.Pk, cols, row.DataAfter)
+				break
+			}
+
+			// The row has been changed on both sides, so try merging the changes column by column
+			merged := make([]interface{}, len(cols))
+			clash := false
+			for i := range cols {
+				switch {
+				case sameValue(row.DataAfter[i], row.DataBefore[i]):
+					merged[i] = current[i]
+				case sameValue(current[i], row.DataBefore[i]), sameValue(current[i], row.DataAfter[i]):
+					merged[i] = row.DataAfter[i]
+				default:
+					clash = true
+				}
+			}
+			if clash {
+				rowConflict("the row was changed differently on both sides")
+				continue
+			}
+			err = updateRow(tx, chg.ObjectName, row.Pk, cols, merged)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Deletes a row from a table
+func deleteRow(tx *sql.Tx, table string, pk []dataValue) (err error) {
+	where, args := rowMatch(pk)
+	_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s`, quoteIdent(table), where), args...)
+	return
+}
+
+// Retrieves the values of a row from a table, using its primary key
+func fetchRow(tx *sql.Tx, table string, pk []dataValue, cols []string) (vals []interface{}, found bool, err error) {
+	var sel []string
+	for _, c := range cols {
+		sel = append(sel, "+"+quoteIdent(c))
+	}
+	where, args := rowMatch(pk)
+	rows, err := tx.Query(fmt.Sprintf(`SELECT %s FROM %s WHERE %s LIMIT 1`, strings.Join(sel, ", "),
+		quoteIdent(table), where), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		err = rows.Err()
+		return
+	}
+	vals = make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	err = rows.Scan(ptrs...)
+	found = err == nil
+	return
+}
+
+// Inserts a row into a table.  Primary key values which aren't one of the table columns (eg the rowid) are included
+func insertRow(tx *sql.Tx, table string, pk []dataValue, cols []string, vals []interface{}) (err error) {
+	var names, params []string
+	var args []interface{}
+	for _, k := range pk {
+		isCol := false
+		for _, c := range cols {
+			if c == k.Name {
+				isCol = true
+				break
+			}
+		}
+		if !isCol {
+			names = append(names, quoteIdent(k.Name))
+			params = append(params, "?")
+			args = append(args, k.Value)
+		}
+	}
+	for i, c := range cols {
+		names = append(names, quoteIdent(c))
+		params = append(params, "?")
+		args = append(args, vals[i])
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, quoteIdent(table), strings.Join(names, ", "),
+		strings.Join(params, ", ")), args...)
+	return
+}
+
+// Returns the SQL used to create a schema object, and whether the object exists
+func objectSQL(tx *sql.Tx, name string) (sqlText string, found bool, err error) {
+	err = tx.QueryRow(`SELECT coalesce(sql, '') FROM main.sqlite_master WHERE name = ?`, name).Scan(&sqlText)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	found = err == nil
+	return
+}
+
+// Recreates a table using a new definition.  The indexes and triggers for the table are recreated afterwards, and
+// when requested the existing rows are copied across too
+func rebuildTable(tx *sql.Tx, table, newSQL string, cols []string, keepRows bool) (err error) {
+	// Save the definitions of the indexes and triggers for the table, then remove them
+	rows, err := tx.Query(`
+		SELECT type, name, sql
+		FROM main.sqlite_master
+		WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL`, table)
+	if err != nil {
+		return
+	}
+	var deps []schemaObject
+	for rows.Next() {
+		var o schemaObject
+		err = rows.Scan(&o.Type, &o.Name, &o.SQL)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		deps = append(deps, o)
+	}
+	rows.Close()
+	for _, j := range deps {
+		_, err = tx.Exec(fmt.Sprintf(`DROP %s %s`, strings.ToUpper(j.Type), quoteIdent(j.Name)))
+		if err != nil {
+			return
+		}
+	}
+
+	if keepRows {
+		// Rowid tables also need their rowid values kept
+		var pk []string
+		_, pk, err = tableColumns(tx, "main", table)
+		if err != nil {
+			return
+		}
+		var names []string
+		if len(pk) == 1 && pk[0] == "rowid" {
+			names = append(names, "rowid")
+		}
+		for _, c := range cols {
+			names = append(names, quoteIdent(c))
+		}
+		oldTable := quoteIdent("_dio_old_" + table)
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, quoteIdent(table), oldTable))
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(newSQL)
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s) SELECT %s FROM %s`, quoteIdent(table),
+			strings.Join(names, ", "), strings.Join(names, ", "), oldTable))
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(fmt.Sprintf(`DROP TABLE %s`, oldTable))
+	} else {
+		_, err = tx.Exec(fmt.Sprintf(`DROP TABLE %s`, quoteIdent(table)))
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(newSQL)
+	}
+	if err != nil {
+		return
+	}
+
+	// Recreate the indexes and triggers
+	for _, j := range deps {
+		_, err = tx.Exec(j.SQL)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns the WHERE clause and arguments for matching a row using its primary key
+func rowMatch(pk []dataValue) (where string, args []interface{}) {
+	var match []string
+	for _, k := range pk {
+		match = append(match, fmt.Sprintf("%s IS ?", quoteIdent(k.Name)))
+		args = append(args, k.Value)
+	}
+	return strings.Join(match, " AND "), args
+}
+
+// Returns true if two rows have the same values
+func sameRow(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameValue(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if two database values are the same.  Integer and floating point values with the same numeric value
+// are treated as being the same, matching the behaviour of SQLite
+func sameValue(a, b interface{}) bool {
+	switch x := a.(type) {
+	case []byte:
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x == y
+		case float64:
+			return float64(x) == y
+		}
+		return false
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x == float64(y)
+		case float64:
+			return x == y
+		}
+		return false
+	}
+	if _, ok := b.([]byte); ok {
+		return false
+	}
+	return a == b
+}
+
+// Returns true if a table contains exactly the given rows, and nothing else
+func tableHasRows(tx *sql.Tx, table string, cols []string, rows []dataDiff) (same bool, err error) {
+	var count int
+	err = tx.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s`, quoteIdent(table))).Scan(&count)
+	if err != nil || count != len(rows) {
+		return
+	}
+	for _, j := range rows {
+		var current []interface{}
+		var found bool
+		current, found, err = fetchRow(tx, table, j.Pk, cols)
+		if err != nil || !found || !sameRow(current, j.DataBefore) {
+			return
+		}
+	}
+	return true, nil
+}
+
+// Updates the values of a row in a table
+func updateRow(tx *sql.Tx, table string, pk []dataValue, cols []string, vals []interface{}) (err error) {
+	var set []string
+	var args []interface{}
+	for i, c := range cols {
+		set = append(set, fmt.Sprintf("%s = ?", quoteIdent(c)))
+		args = append(args, vals[i])
+	}
+	where, whereArgs := rowMatch(pk)
+	_, err = tx.Exec(fmt.Sprintf(`UPDATE %s SET %s WHERE %s`, quoteIdent(table), strings.Join(set, ", "), where),
+		append(args, whereArgs...)...)
+	return
+}
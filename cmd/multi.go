@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The number of databases worked on at once by commands which accept several of them, unless --jobs says otherwise
+const defaultJobs = 4
+
+// Serialises writes to an io.Writer, so it can be shared between goroutines
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// Expands the database names given on the command line, with glob patterns (eg "*.sqlite") being replaced by the
+// database files they match.  When known is set, the names of databases with local metadata are matched too, so
+// databases without a local copy of the file can be selected.  Each database is only returned once
+func expandDatabases(args []string, known bool) (dbs []string, err error) {
+	var localDBs []string
+	if known {
+		localDBs, err = localDatabases()
+		if err != nil {
+			return
+		}
+	}
+	seen := make(map[string]struct{})
+	add := func(db string) {
+		if _, ok := seen[db]; !ok {
+			seen[db] = struct{}{}
+			dbs = append(dbs, db)
+		}
+	}
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			add(arg)
+			continue
+		}
+
+		// Only files are matched, as directories can't be databases
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Bad database pattern '%s': %v", arg, err)
+		}
+		found := false
+		for _, j := range matches {
+			fi, err := os.Stat(j)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+			add(j)
+			found = true
+		}
+		for _, j := range localDBs {
+			if ok, _ := filepath.Match(arg, j); ok {
+				add(j)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No databases match '%s'", arg)
+		}
+	}
+	return
+}
+
+// Runs a command against each of the given databases, using up to jobs of them at once.  When there's more than one
+// database, a summary of the results is displayed afterwards, and an error is returned if any of them failed
+func forEachDatabase(dbs []string, jobs int, fn func(out io.Writer, db string) error) error {
+	errs, err := runDatabases(dbs, jobs, fn)
+	if err != nil {
+		return err
+	}
+	if len(dbs) == 1 {
+		return errs[0]
+	}
+	_, err = fmt.Fprintln(fOut, "Summary:")
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i, db := range dbs {
+		if errs[i] != nil {
+			failed++
+			_, err = fmt.Fprintf(fOut, "  * '%s': failed - %s\n", db, errs[i])
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * '%s': ok\n", db)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d databases failed", failed, len(dbs))
+	}
+	return nil
+}
+
+// Returns the names of the databases with local metadata in the current directory, in alphabetical order
+func localDatabases() (dbs []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(".dio", "*", "metadata.json"))
+	if err != nil {
+		return
+	}
+	unescape := strings.NewReplacer("%2F", "/", "%25", "%")
+	for _, j := range matches {
+		dbs = append(dbs, filepath.FromSlash(unescape.Replace(filepath.Base(filepath.Dir(j)))))
+	}
+	return
+}
+
+// Returns the databases given on the command line, with glob patterns expanded.  If none were given, the default
+// database is used
+func resolveDatabases(args []string, known bool) ([]string, error) {
+	if len(args) == 0 {
+		db, err := getDefaultDatabase()
+		if err != nil {
+			return nil, err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return nil, errNoDatabase
+		}
+		return []string{db}, nil
+	}
+	return expandDatabases(args, known)
+}
+
+// Calls fn for each of the given databases, with up to jobs of them running at once.  A single database has its
+// output displayed directly.  With more than one, the output of each is collected and displayed in the order the
+// databases were given, once it has finished.  The error from each call is returned in errs, in the same order
+func runDatabases(dbs []string, jobs int, fn func(out io.Writer, db string) error) (errs []error, err error) {
+	errs = make([]error, len(dbs))
+	if len(dbs) == 1 {
+		errs[0] = fn(fOut, dbs[0])
+		return
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// Anything still written directly to the display while the workers run needs serialising
+	oldOut := fOut
+	fOut = &lockedWriter{w: oldOut}
+	defer func() {
+		fOut = oldOut
+	}()
+
+	// Start the workers
+	bufs := make([]bytes.Buffer, len(dbs))
+	done := make([]chan struct{}, len(dbs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	queue := make(chan int)
+	for w := 0; w < jobs && w < len(dbs); w++ {
+		go func() {
+			for i := range queue {
+				errs[i] = fn(&bufs[i], dbs[i])
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range dbs {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	// Display the output for each database as it becomes available.  If that fails, the remaining databases are
+	// still waited for, so none are left part way through
+	for i, db := range dbs {
+		<-done[i]
+		if err != nil || bufs[i].Len() == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(fOut, "==> %s <==\n", db)
+		if err != nil {
+			continue
+		}
+		_, err = fOut.Write(bufs[i].Bytes())
+		if err != nil {
+			continue
+		}
+		_, err = fmt.Fprintln(fOut)
+	}
+	return
+}
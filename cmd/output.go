@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Formats which command output can be given in
+	OUTPUT_JSON = "json"
+	OUTPUT_TEXT = "text"
+	OUTPUT_YAML = "yaml"
+)
+
+// Error codes included in structured error output.  Scripts rely on these, so existing ones shouldn't be changed
+const (
+	ERR_GENERAL       = "error"
+	ERR_NETWORK       = "network_error"
+	ERR_NO_DATABASE   = "no_database"
+	ERR_NOT_FOUND     = "not_found"
+	ERR_OUTPUT_FORMAT = "invalid_output_format"
+)
+
+var (
+	errNoDatabase = errors.New("No database file specified")
+	outputFormat  = OUTPUT_TEXT
+)
+
+// An error with a stable code, for structured output
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e codedError) Unwrap() error {
+	return e.err
+}
+
+// Checks the output format requested by the user is one we know about
+func checkOutputFormat() error {
+	switch outputFormat {
+	case OUTPUT_JSON, OUTPUT_TEXT, OUTPUT_YAML:
+		return nil
+	}
+	return codedError{code: ERR_OUTPUT_FORMAT, err: fmt.Errorf("Unknown output format '%s'.  It should be "+
+		"one of '%s', '%s' or '%s'", outputFormat, OUTPUT_JSON, OUTPUT_YAML, OUTPUT_TEXT)}
+}
+
+// Returns the stable error code for an error
+func errorCode(err error) string {
+	var ce codedError
+	var ue *url.Error
+	var ne net.Error
+	switch {
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, errNoDatabase):
+		return ERR_NO_DATABASE
+	case errors.Is(err, os.ErrNotExist):
+		return ERR_NOT_FOUND
+	case errors.As(err, &ue), errors.As(err, &ne):
+		return ERR_NETWORK
+	}
+	return ERR_GENERAL
+}
+
+// Returns true if the user asked for machine readable output instead of text
+func structuredOutput() bool {
+	return outputFormat == OUTPUT_JSON || outputFormat == OUTPUT_YAML
+}
+
+// Displays an error in the requested output format
+func writeError(err error) error {
+	if !structuredOutput() {
+		_, errOut := fmt.Fprintln(fOut, err)
+		return errOut
+	}
+	return writeOutput(errorOutput{Code: errorCode(err), Error: err.Error()})
+}
+
+// Displays data in the requested output format.  The field names come from the json struct tags for both JSON and
+// YAML, so they're the same no matter which is used
+func writeOutput(v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if outputFormat == OUTPUT_JSON {
+		_, err = fmt.Fprintln(fOut, string(j))
+		return err
+	}
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	err = dec.Decode(&generic)
+	if err != nil {
+		return err
+	}
+	y, err := yaml.Marshal(yamlNumbers(generic))
+	if err != nil {
+		return err
+	}
+	_, err = fOut.Write(y)
+	return err
+}
+
+// Converts the numbers in decoded JSON back to integers where possible, so large values (eg file sizes) aren't
+// displayed in exponent form in YAML
+func yamlNumbers(v interface{}) interface{} {
+	switch z := v.(type) {
+	case json.Number:
+		if i, err := z.Int64(); err == nil {
+			return i
+		}
+		f, _ := z.Float64()
+		return f
+	case map[string]interface{}:
+		for k, j := range z {
+			z[k] = yamlNumbers(j)
+		}
+	case []interface{}:
+		for i, j := range z {
+			z[i] = yamlNumbers(j)
+		}
+	}
+	return v
+}
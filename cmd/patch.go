@@ -0,0 +1,14 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var patchCmd = &cobra.Command{
+	Use:   "patch",
+	Short: "Export and apply the changes between versions of a database as SQL",
+}
+
+func init() {
+	RootCmd.AddCommand(patchCmd)
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	patchApplyCmdMsg                        string
+	patchApplyCmdCommit, patchApplyCmdForce bool
+)
+
+// Applies a SQL patch to the working database
+var patchApplyCmd = &cobra.Command{
+	Use:   "apply [database name] file [--commit]",
+	Short: "Applies a SQL patch to the working database",
+	Long: `Applies a SQL patch to the working database
+
+The SQL statements in the file (usually created by 'dio patch export') are run
+on the database in the working directory.  Patches created by 'dio patch
+export' run inside a single transaction, so if any part of them fails the
+database is left unchanged.  They also check the rows they update or delete
+still have their old values, so applying one to a different version of the
+database than it was created from fails.
+
+With --commit, the result is added to the active branch as a new commit.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return patchApply(args)
+	},
+}
+
+func init() {
+	patchCmd.AddCommand(patchApplyCmd)
+	patchApplyCmd.Flags().BoolVar(&patchApplyCmdCommit, "commit", false,
+		"Add the patched database to the active branch as a new commit")
+	patchApplyCmd.Flags().BoolVarP(&patchApplyCmdForce, "force", "f", false,
+		"Commit the patch even when the database has other changes since the last commit?")
+	patchApplyCmd.Flags().StringVar(&patchApplyCmdMsg, "message", "",
+		"Commit message for the new commit (default is 'Applied patch <file>')")
+}
+
+func patchApply(args []string) error {
+	// Work out the database name and patch file.  When only one argument is given it's the patch file
+	var db, file string
+	var err error
+	switch len(args) {
+	case 0:
+		return errors.New("No patch file given")
+	case 1:
+		file = args[0]
+	case 2:
+		db = args[0]
+		file = args[1]
+	default:
+		return errors.New("Only one patch can be applied at a time")
+	}
+	if db == "" {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	}
+	sqlText, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Make sure there isn't a merge, rebase, cherry-pick, or revert underway
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+
+	// When committing the result, the database needs to be unchanged since the last commit.  Otherwise the commit
+	// would include more than the patch.  Unless --force is specified, let the user know
+	var meta metaData
+	if patchApplyCmdCommit {
+		meta, err = loadMetadata(db)
+		if err != nil {
+			return err
+		}
+		if _, ok := meta.Branches[meta.ActiveBranch]; !ok {
+			return fmt.Errorf("That branch ('%s') doesn't exist", meta.ActiveBranch)
+		}
+		if !patchApplyCmdForce {
+			changed, err := dbChanged(db, meta)
+			if err != nil {
+				return err
+			}
+			if changed {
+				_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+					"really want to commit those changes along with the patch\n", db)
+				return err
+			}
+		}
+	}
+
+	// Apply the patch
+	err = applyPatch(db, string(sqlText))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Patch '%s' applied to '%s'\n", file, db)
+	if err != nil || !patchApplyCmdCommit {
+		return err
+	}
+
+	// Add the result to the active branch as a new commit
+	msg := patchApplyCmdMsg
+	if msg == "" {
+		msg = fmt.Sprintf("Applied patch %s", filepath.Base(file))
+	}
+	return createPatchCommit(db, meta, msg)
+}
+
+// Runs the SQL statements from a patch on a database.  If one of them fails, any transaction the patch started is
+// rolled back
+func applyPatch(db, sqlText string) error {
+	sdb, err := openSQLite(db, false)
+	if err != nil {
+		return err
+	}
+	defer sdb.Close()
+	_, err = sdb.Exec(sqlText)
+	if err != nil {
+		// There's no transaction to roll back if the patch didn't start one, so any error from this is ignored
+		sdb.Exec(`ROLLBACK`)
+		return fmt.Errorf("Applying the patch failed: %s", err)
+	}
+	return nil
+}
+
+// Creates a commit on the active branch for a patched database
+func createPatchCommit(db string, meta metaData, msg string) error {
+	var name, email string
+	if z, ok := viper.Get("user.name").(string); ok {
+		name = z
+	}
+	if z, ok := viper.Get("user.email").(string); ok {
+		email = z
+	}
+	if name == "" || email == "" {
+		return errors.New("Author and committer name and email addresses are required!")
+	}
+
+	// The new commit keeps the licence and other files of the branch
+	head := meta.Commits[meta.Branches[meta.ActiveBranch].Commit]
+	dbEntry, err := commitDBEntry(head, db)
+	if err != nil {
+		return err
+	}
+	newCom, err := addCommit(db, meta, meta.ActiveBranch, dbEntry.LicenceSHA, commitAttachments(head, db),
+		commitEntry{
+			AuthorName:     name,
+			AuthorEmail:    email,
+			CommitterName:  name,
+			CommitterEmail: email,
+			Message:        msg,
+			Timestamp:      time.Now().UTC(),
+		})
+	if err != nil {
+		return err
+	}
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Patch committed to branch '%s'\n", meta.ActiveBranch)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "  * Commit ID: %s\n", newCom.ID)
+	return err
+}
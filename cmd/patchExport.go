@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var patchExportCmdFile, patchExportCmdFrom, patchExportCmdTo string
+
+// Patches record the number of rows changed by each update and delete in a temporary table, which refuses anything
+// other than one.  As RAISE() only works in triggers, this is how the patch stops itself when run on a different
+// version of the database than it was created from, even when applied by other SQLite tools
+const (
+	patchCheckSQL = "INSERT INTO temp.dio_patch_changes VALUES (changes());\n"
+	patchSetupSQL = `CREATE TEMP TABLE dio_patch_changes (changed INTEGER);
+CREATE TEMP TRIGGER dio_patch_check BEFORE INSERT ON dio_patch_changes WHEN NEW.changed != 1 BEGIN
+  SELECT RAISE(ABORT, 'The database doesn''t match the version this patch was created from');
+END;
+`
+)
+
+// Exports the differences between two versions of a database as SQL statements
+var patchExportCmd = &cobra.Command{
+	Use:   "export [database name] --from xxx --to yyy [-o file]",
+	Short: "Exports the changes between two versions of a database as SQL",
+	Long: `Exports the changes between two versions of a database as SQL
+
+The schema and row changes needed to turn the --from version of the database
+into the --to version are written out as SQL statements (CREATE, DROP, INSERT,
+UPDATE, and DELETE), inside a single transaction.  The statements are always
+generated in the same order, so exporting the same two versions again gives
+an identical patch.  The patch can then be run on copies of the --from version
+elsewhere, either with 'dio patch apply' or any other SQLite tool.
+
+Both versions can be a commit ID, a branch name, a tag name, or a release name.
+The special name 'working' refers to the database file in the working
+directory.  When not given, --from defaults to the active branch and --to
+defaults to the working database.
+
+Tables whose definition has changed are recreated, with all of their rows
+included in the patch.  Updated and deleted rows are matched on all of their
+old values, and the patch stops with an error if one of them isn't found.  So
+applying it to a different version of the database fails, instead of silently
+changing the wrong rows.  When using other SQLite tools to apply it, make sure
+they stop at the first error (eg 'sqlite3 -bail').`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return patchExport(args)
+	},
+}
+
+func init() {
+	patchCmd.AddCommand(patchExportCmd)
+	patchExportCmd.Flags().StringVarP(&patchExportCmdFile, "file", "o", "",
+		"File to write the patch to (default is to display it)")
+	patchExportCmd.Flags().StringVar(&patchExportCmdFrom, "from", "",
+		"Commit ID, branch, tag, or release the patch applies to (default is the active branch)")
+	patchExportCmd.Flags().StringVar(&patchExportCmdTo, "to", "",
+		"Commit ID, branch, tag, or release the patch changes the database to, or 'working' for the working "+
+			"database (default is 'working')")
+}
+
+func patchExport(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be worked with at a time (for now)")
+	}
+
+	// Load the metadata
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Fill in the defaults for anything not given on the command line
+	from := patchExportCmdFrom
+	if from == "" {
+		from = meta.ActiveBranch
+	}
+	to := patchExportCmdTo
+	if to == "" {
+		to = WORKING_DB
+	}
+	if from == WORKING_DB && to == WORKING_DB {
+		return errors.New("The working database can't be compared against itself")
+	}
+
+	// Determine the database files to compare, retrieving them from DBHub.io if they're not in the local cache
+	fromPath, fromDesc, err := diffSource(db, meta, from)
+	if err != nil {
+		return err
+	}
+	toPath, toDesc, err := diffSource(db, meta, to)
+	if err != nil {
+		return err
+	}
+
+	// Create the patch
+	diffs, err := diffDatabases(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+	sqlText, err := createPatchSQL(fromPath, toPath, diffs)
+	if err != nil {
+		return err
+	}
+	sqlText = fmt.Sprintf("-- Patch for '%s'\n-- From: %s\n-- To: %s\n%s", db, fromDesc, toDesc, sqlText)
+
+	// Write it out
+	if patchExportCmdFile == "" {
+		_, err = fmt.Fprint(fOut, sqlText)
+		return err
+	}
+	err = writeFileAtomic(patchExportCmdFile, []byte(sqlText), 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Patch for '%s' from %s to %s written to '%s'\n", db, fromDesc, toDesc,
+		patchExportCmdFile)
+	return err
+}
+
+// Creates the SQL statements which turn one version of a database into another, from the differences between them.
+// The statements are wrapped in a single transaction, and tables with a changed definition are recreated with all
+// of their rows
+func createPatchSQL(fromPath, toPath string, diffs dbDiffs) (string, error) {
+	sdb, err := openSQLite(fromPath, true)
+	if err != nil {
+		return "", err
+	}
+	defer sdb.Close()
+	_, err = sdb.Exec(`ATTACH DATABASE ? AS aux`, sqliteURI(toPath, true))
+	if err != nil {
+		return "", err
+	}
+	fromObjs, err := schemaObjects(sdb, "main")
+	if err != nil {
+		return "", err
+	}
+	toObjs, err := schemaObjects(sdb, "aux")
+	if err != nil {
+		return "", err
+	}
+
+	var s strings.Builder
+	s.WriteString("BEGIN TRANSACTION;\n")
+	s.WriteString(patchSetupSQL)
+
+	// Remove the indexes, views, and triggers being removed or changed.  This is done in reverse order, so objects
+	// which depend on others are removed first
+	for i := len(diffs.Diff) - 1; i >= 0; i-- {
+		chg := diffs.Diff[i]
+		if chg.ObjectType == "table" || chg.Schema == nil || chg.Schema.ActionType == ACTION_ADD {
+			continue
+		}
+		fmt.Fprintf(&s, "DROP %s %s;\n", strings.ToUpper(chg.ObjectType), quoteIdent(chg.ObjectName))
+	}
+
+	// Apply the changes to tables
+	create := make(map[string]struct{})
+	for _, chg := range diffs.Diff {
+		if chg.ObjectType != "table" {
+			if chg.Schema != nil && chg.Schema.ActionType != ACTION_DELETE {
+				create[chg.ObjectName] = struct{}{}
+			}
+			continue
+		}
+		if chg.Schema == nil {
+			for _, j := range chg.Data {
+				s.WriteString(patchRowSQL(chg.ObjectName, chg.ColsAfter, j))
+			}
+			continue
+		}
+		switch chg.Schema.ActionType {
+		case ACTION_ADD:
+			s.WriteString(chg.Schema.After + ";\n")
+			for _, j := range chg.Data {
+				s.WriteString(patchRowSQL(chg.ObjectName, chg.ColsAfter, j))
+			}
+		case ACTION_DELETE:
+			fmt.Fprintf(&s, "DROP TABLE %s;\n", quoteIdent(chg.ObjectName))
+		case ACTION_MODIFY:
+			// Dropping the table removes its indexes and triggers too, so they're recreated afterwards
+			fmt.Fprintf(&s, "DROP TABLE %s;\n", quoteIdent(chg.ObjectName))
+			s.WriteString(chg.Schema.After + ";\n")
+			for name, obj := range toObjs {
+				if obj.TblName == chg.ObjectName && obj.Type != "table" && obj.Type != "view" && obj.SQL != "" {
+					create[name] = struct{}{}
+				}
+			}
+			if isVirtualTable(chg.Schema.After) {
+				continue
+			}
+			var cols, pk []string
+			cols, pk, err = tableColumns(sdb, "aux", chg.ObjectName)
+			if err != nil {
+				return "", err
+			}
+			var rows []dataDiff
+			rows, err = tableRows(sdb, "aux", chg.ObjectName, pk, cols, ACTION_ADD)
+			if err != nil {
+				return "", err
+			}
+			for _, j := range rows {
+				s.WriteString(patchRowSQL(chg.ObjectName, cols, j))
+			}
+		}
+	}
+
+	// Create the new and changed indexes, views, and triggers, along with those of the recreated tables
+	var names []string
+	for name := range create {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := objectTypeRank(fromObjs, toObjs, names[i]), objectTypeRank(fromObjs, toObjs, names[j])
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		s.WriteString(toObjs[name].SQL + ";\n")
+	}
+	s.WriteString("DROP TABLE temp.dio_patch_changes;\n")
+	s.WriteString("COMMIT;\n")
+	return s.String(), nil
+}
+
+// Returns the SQL statement for a single row change.  Primary key values which aren't one of the table columns (eg
+// the rowid) are included when inserting, and only the changed columns are included when updating.  Updates and
+// deletes only match the row when it still has its old values, and are followed by a check that they changed exactly
+// one row, so the patch fails instead of applying to a database which isn't at the version it was created from
+func patchRowSQL(table string, cols []string, row dataDiff) string {
+	var match []string
+	for _, k := range row.Pk {
+		match = append(match, fmt.Sprintf("%s IS %s", quoteIdent(k.Name), sqlValue(k.Value)))
+	}
+	if row.ActionType != ACTION_ADD {
+		for i, c := range cols {
+			isKey := false
+			for _, k := range row.Pk {
+				if c == k.Name {
+					isKey = true
+					break
+				}
+			}
+			if !isKey {
+				match = append(match, fmt.Sprintf("%s IS %s", quoteIdent(c), sqlValue(row.DataBefore[i])))
+			}
+		}
+	}
+	where := strings.Join(match, " AND ")
+	switch row.ActionType {
+	case ACTION_ADD:
+		var names, vals []string
+		for _, k := range row.Pk {
+			isCol := false
+			for _, c := range cols {
+				if c == k.Name {
+					isCol = true
+					break
+				}
+			}
+			if !isCol {
+				names = append(names, quoteIdent(k.Name))
+				vals = append(vals, sqlValue(k.Value))
+			}
+		}
+		for i, c := range cols {
+			names = append(names, quoteIdent(c))
+			vals = append(vals, sqlValue(row.DataAfter[i]))
+		}
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);\n", quoteIdent(table), strings.Join(names, ", "),
+			strings.Join(vals, ", "))
+	case ACTION_DELETE:
+		return fmt.Sprintf("DELETE FROM %s WHERE %s;\n%s", quoteIdent(table), where, patchCheckSQL)
+	default:
+		var set []string
+		for i, c := range cols {
+			if !sameValue(row.DataBefore[i], row.DataAfter[i]) {
+				set = append(set, fmt.Sprintf("%s = %s", quoteIdent(c), sqlValue(row.DataAfter[i])))
+			}
+		}
+		if len(set) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("UPDATE %s SET %s WHERE %s;\n%s", quoteIdent(table), strings.Join(set, ", "), where,
+			patchCheckSQL)
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The settings a profile can have, and the top level config file setting each one replaces
+var profileSettings = map[string]string{
+	"cachain": "certs.cachain",
+	"cert":    "certs.cert",
+	"cloud":   "general.cloud",
+	"email":   "user.email",
+	"name":    "user.name",
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Select the profile (DBHub.io cloud and account) used in this directory",
+	Long: `Select the profile (DBHub.io cloud and account) used in this directory
+
+Profiles are named sets of connection details in the config file, for working
+with more than one DBHub.io cloud or account.  For example:
+
+  [profiles.staging]
+  cloud = "https://staging.example.org"
+  cachain = "/home/username/.dio/staging-ca-chain.cert.pem"
+  cert = "/home/username/.dio/staging.cert.pem"
+  name = "Your Name"
+  email = "youremail@example.org"
+
+Anything not given in a profile is taken from the top level of the config
+file.  The profile used can be chosen for each command with --profile, or
+for everything in a directory with "dio profile use".`,
+}
+
+func init() {
+	RootCmd.AddCommand(profileCmd)
+}
+
+// Replaces the top level config file settings with those of a profile.  An empty profile name leaves them unchanged
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	if !viper.IsSet("profiles." + name) {
+		return fmt.Errorf("There's no profile called '%s' in the config file", name)
+	}
+	for setting, key := range profileSettings {
+		if k := profileKey(name, setting); viper.IsSet(k) {
+			viper.Set(key, viper.GetString(k))
+		}
+	}
+	return nil
+}
+
+// Returns the names of the profiles in the config file, in alphabetical order
+func configProfiles() (names []string) {
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Returns the config file key for a setting of a profile
+func profileKey(name, setting string) string {
+	return fmt.Sprintf("profiles.%s.%s", name, setting)
+}
+
+// Returns the name of the profile to use.  The --profile option takes priority over the one selected for the current
+// directory.  An empty string means the top level config file settings are used
+func selectedProfile() (string, error) {
+	if profileName != "" {
+		return profileName, nil
+	}
+	def, err := loadDefaults()
+	if err != nil {
+		return "", err
+	}
+	return def.Profile, nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Displays the profiles in the config file
+var profileListCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "Displays the profiles in the config file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return profileList()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(profileListCmd)
+}
+
+func profileList() error {
+	selected, err := selectedProfile()
+	if err != nil {
+		return err
+	}
+	list := profileListOutput{Profiles: make(map[string]profileEntry), Selected: selected}
+	for _, name := range configProfiles() {
+		list.Profiles[name] = profileEntry{
+			Cloud: viper.GetString(profileKey(name, "cloud")),
+			Cert:  viper.GetString(profileKey(name, "cert")),
+			Email: viper.GetString(profileKey(name, "email")),
+			Name:  viper.GetString(profileKey(name, "name")),
+		}
+	}
+	if structuredOutput() {
+		return writeOutput(list)
+	}
+	if len(list.Profiles) == 0 {
+		_, err = fmt.Fprintln(fOut, "There are no profiles in the config file")
+		return err
+	}
+
+	// Display the list of profiles
+	_, err = fmt.Fprintln(fOut, "Profiles:")
+	if err != nil {
+		return err
+	}
+	for _, name := range configProfiles() {
+		p := list.Profiles[name]
+		if name == selected {
+			_, err = fmt.Fprintf(fOut, "\n  * %s (selected)\n", name)
+		} else {
+			_, err = fmt.Fprintf(fOut, "\n  * %s\n", name)
+		}
+		if err != nil {
+			return err
+		}
+		for _, j := range []struct{ desc, value string }{{"Cloud", p.Cloud}, {"Certificate", p.Cert},
+			{"Name", p.Name}, {"Email", p.Email}} {
+			if j.value == "" {
+				continue
+			}
+			_, err = fmt.Fprintf(fOut, "      %s: %s\n", j.desc, j.value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
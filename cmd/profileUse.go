@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var profileUseCmdClear bool
+
+// Selects the profile used in the current directory
+var profileUseCmd = &cobra.Command{
+	Use:   "use [profile name]",
+	Short: "Selects the profile used in the current directory",
+	Long: `Selects the profile used in the current directory
+
+With no profile name given, the currently selected profile is displayed.  Use
+--clear to go back to the settings at the top level of the config file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return profileUse(args)
+	},
+}
+
+func init() {
+	profileCmd.AddCommand(profileUseCmd)
+	profileUseCmd.Flags().BoolVar(&profileUseCmdClear, "clear", false,
+		"Use the top level config file settings in this directory, rather than a profile")
+}
+
+func profileUse(args []string) error {
+	if len(args) > 1 {
+		return errors.New("Only one profile can be used at a time")
+	}
+	if len(args) == 1 && profileUseCmdClear {
+		return errors.New("Either a profile name or --clear can be given.  Not both at the same time!")
+	}
+	def, err := loadDefaults()
+	if err != nil {
+		return err
+	}
+
+	// If no profile name was given, display the current one
+	if len(args) == 0 && !profileUseCmdClear {
+		if def.Profile == "" {
+			_, err = fmt.Fprintln(fOut, "No profile is selected, so the top level config file settings are used")
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "Profile: '%s'\n", def.Profile)
+		return err
+	}
+	if profileUseCmdClear {
+		def.Profile = ""
+		err = saveDefaults(def)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(fOut, "The top level config file settings will be used in this directory")
+		return err
+	}
+
+	// Make sure the profile exists.  The config file reader ignores case, so the comparison does too
+	name := strings.ToLower(args[0])
+	found := false
+	for _, j := range configProfiles() {
+		if j == name {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("There's no profile called '%s' in the config file", args[0])
+	}
+	def.Profile = name
+	err = saveDefaults(def)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Profile '%s' will be used in this directory\n", name)
+	return err
+}
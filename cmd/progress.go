@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Displays the progress of a transfer.  Nothing is displayed unless the output is going to a terminal
+type progressBar struct {
+	desc    string
+	done    int64
+	enabled bool
+	last    time.Time
+	out     io.Writer
+	total   int64
+}
+
+// Creates a progress bar for a transfer of the given number of bytes, displayed on out.  If the total isn't known,
+// use -1
+func newProgressBar(out io.Writer, desc string, total int64) *progressBar {
+	return &progressBar{
+		desc:    desc,
+		enabled: isTerminal(out),
+		out:     out,
+		total:   total,
+	}
+}
+
+// Adds bytes which were transferred without going through the progress bar, eg when resuming a download
+func (p *progressBar) Add(n int64) {
+	p.done += n
+	p.draw(false)
+}
+
+// Completes the progress bar display
+func (p *progressBar) Finish() {
+	if p.enabled {
+		p.draw(true)
+		fmt.Fprintln(p.out)
+	}
+}
+
+// Counts the bytes passing through, updating the display as it goes.  Use it with io.TeeReader or io.MultiWriter
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	p.draw(false)
+	return len(b), nil
+}
+
+// Redraws the progress bar, at most a few times a second unless forced
+func (p *progressBar) draw(force bool) {
+	if !p.enabled || (!force && time.Since(p.last) < 100*time.Millisecond) {
+		return
+	}
+	p.last = time.Now()
+	if p.total <= 0 {
+		numFormat.Fprintf(p.out, "\r  %s: %d bytes", p.desc, p.done)
+		return
+	}
+	const width = 30
+	pct := float64(p.done) / float64(p.total)
+	if pct > 1 {
+		pct = 1
+	}
+	filled := int(pct * width)
+	numFormat.Fprintf(p.out, "\r  %s: [%s%s] %3.0f%% (%d of %d bytes)", p.desc, strings.Repeat("=", filled),
+		strings.Repeat(" ", width-filled), pct*100, p.done, p.total)
+}
+
+// Returns true if the given output is a terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -1,13 +1,13 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,13 +16,32 @@ import (
 
 var (
 	pullCmdBranch, pullCmdCommit string
+	pullCmdFolder                string
+	pullCmdJobs                  int
 	pullForce                    *bool
+
+	// Guards the selection of the default database
+	defaultDBMutex sync.Mutex
+
+	// The folders given with --folder for the databases being pulled.  These are used in place of any saved folder,
+	// and only saved once the pull has worked
+	pullFolders sync.Map
 )
 
 // Downloads a database from DBHub.io.
 var pullCmd = &cobra.Command{
-	Use:   "pull [database name]",
+	Use:   "pull [database name...]",
 	Short: "Download a database from DBHub.io",
+	Long: `Download a database from DBHub.io
+
+Several databases can be given, including glob patterns such as "*.sqlite".
+Patterns match both database files and databases with local metadata.  They're
+downloaded concurrently, with --jobs controlling how many at once.
+
+Databases in a folder on DBHub.io are pulled with --folder, and saved into a
+matching folder in the current directory.  For example, pulling 'q1.sqlite'
+with '--folder /finance/2024' saves it as 'finance/2024/q1.sqlite'.  Later
+pushes and pulls of it use the same folder on the server.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return pull(args)
 	},
@@ -34,44 +53,81 @@ func init() {
 		"Remote branch the database will be downloaded from")
 	pullCmd.Flags().StringVar(&pullCmdCommit, "commit", "",
 		"Commit ID of the database to download")
+	pullCmd.Flags().StringVar(&pullCmdFolder, "folder", "", "Folder the database is in on DBHub.io")
 	pullForce = pullCmd.Flags().BoolP("force", "f", false,
 		"Overwrite unsaved changes to the database?")
+	pullCmd.Flags().IntVarP(&pullCmdJobs, "jobs", "j", defaultJobs,
+		"Number of databases to download at once")
+	pullCmd.Flags().StringVar(&selectedRemote, "remote", DEFAULT_REMOTE, "Remote to download from")
 }
 
 func pull(args []string) error {
-	// Ensure a database file was given
-	var db, defDB string
+	var dbs []string
 	var err error
+	if pullCmdFolder != "" {
+		dbs, err = folderDatabases(args)
+	} else {
+		dbs, err = resolveDatabases(args, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Commit IDs are specific to a database, so can't be used when pulling several
+	if pullCmdCommit != "" && len(dbs) > 1 {
+		return errors.New("A commit ID can only be given when pulling a single database")
+	}
+	return forEachDatabase(dbs, pullCmdJobs, pullDatabase)
+}
+
+// Returns the local paths for databases pulled from the folder given with --folder, being the database names inside
+// a matching local folder
+func folderDatabases(args []string) (dbs []string, err error) {
+	pullCmdFolder, err = validateRemoteFolder(pullCmdFolder)
+	if err != nil {
+		return
+	}
 	if len(args) == 0 {
-		db, err = getDefaultDatabase()
-		if err != nil {
-			return err
-		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+		return nil, errors.New("The names of the databases to pull are needed when using --folder")
+	}
+	for _, name := range args {
+		if strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("'%s' should be just the database name when using --folder", name)
 		}
-	} else {
-		db = args[0]
+		dbs = append(dbs, filepath.FromSlash(path.Join(strings.TrimPrefix(pullCmdFolder, "/"), name)))
+	}
+	return
+}
+
+// Downloads a single database, displaying the details on out
+func pullDatabase(out io.Writer, db string) error {
+	// Several databases can be pulled at once, so the branch (which gets adjusted for each) is copied
+	branch := pullCmdBranch
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be downloaded at a time (for now)")
+	// The folder a database is pulled from isn't recorded for later pushes and pulls until the pull has worked, so
+	// nothing is left behind if it isn't on the server
+	if pullCmdFolder != "" {
+		pullFolders.Store(db, pullCmdFolder)
+		defer pullFolders.Delete(db)
 	}
 
 	// TODO: Add a --licence option, for automatically grabbing the licence as well
 	//       * Probably save it as <database name>-<license short name>.txt/html
 
 	// Ensure we weren't given potentially conflicting info on what to pull down
-	if pullCmdBranch != "" && pullCmdCommit != "" {
+	if branch != "" && pullCmdCommit != "" {
 		return errors.New("Either a branch name or commit ID can be given.  Not both at the same time!")
 	}
 
 	// Retrieve metadata for the database
-	var meta metaData
-	meta, err = updateMetadata(db, false) // Don't store the metadata to disk yet, in case the download fails
+	meta, err := updateMetadata(out, db, false) // Don't store the metadata to disk yet, in case the download fails
 	if err != nil {
 		return err
 	}
@@ -85,7 +141,7 @@ func pull(args []string) error {
 				return err
 			}
 			if changed {
-				_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+				_, err = fmt.Fprintf(out, "%s has been changed since the last commit.  Use --force if you "+
 					"really want to overwrite it\n", db)
 				return err
 			}
@@ -93,15 +149,15 @@ func pull(args []string) error {
 	}
 
 	// If given, make sure the requested branch exists
-	if pullCmdBranch != "" {
-		if _, ok := meta.Branches[pullCmdBranch]; ok == false {
+	if branch != "" {
+		if _, ok := meta.Branches[branch]; ok == false {
 			return errors.New("The requested branch doesn't exist")
 		}
 	}
 
 	// If no specific branch nor commit were requested, we use the active branch set in the metadata
-	if pullCmdBranch == "" && pullCmdCommit == "" {
-		pullCmdBranch = meta.ActiveBranch
+	if branch == "" && pullCmdCommit == "" {
+		branch = meta.ActiveBranch
 	}
 
 	// If given, make sure the requested commit exists
@@ -114,64 +170,65 @@ func pull(args []string) error {
 		if ok == false {
 			return errors.New("The requested commit doesn't exist")
 		}
-		thisSha = thisCommit.Tree.Entries[0].Sha256
-		lastMod = thisCommit.Tree.Entries[0].LastModified
 	} else {
 		// Determine the sha256 of the database file
-		c := meta.Branches[pullCmdBranch].Commit
+		c := meta.Branches[branch].Commit
 		thisCommit, ok = meta.Commits[c]
 		if ok == false {
 			return errors.New("The requested commit doesn't exist")
 		}
-		thisSha = thisCommit.Tree.Entries[0].Sha256
-		lastMod = thisCommit.Tree.Entries[0].LastModified
 	}
+	dbEntry, err := commitDBEntry(thisCommit, db)
+	if err != nil {
+		return err
+	}
+	thisSha = dbEntry.Sha256
+	lastMod = dbEntry.LastModified
 
 	// Check if the database file already exists in local cache
 	if thisSha != "" {
-		if _, err = os.Stat(filepath.Join(".dio", db, "db", thisSha)); err == nil {
+		if cacheExists(db, thisSha) {
 			// The database is already in the local cache, so use that instead of downloading from DBHub.io
-			var b []byte
-			b, err = ioutil.ReadFile(filepath.Join(".dio", db, "db", thisSha))
+			err = pullFromCache(db, thisSha)
 			if err != nil {
 				return err
 			}
-			err = ioutil.WriteFile(db, b, 0644)
+			err = os.Chtimes(db, time.Now(), lastMod)
 			if err != nil {
 				return err
 			}
-			err = os.Chtimes(db, time.Now(), lastMod)
+			err = writeCommitAttachments(db, thisCommit)
 			if err != nil {
 				return err
 			}
 
-			_, err = fmt.Fprintf(fOut, "Database '%s' refreshed from local cache\n", db)
+			_, err = fmt.Fprintf(out, "Database '%s' refreshed from local cache\n", db)
 			if err != nil {
 				return err
 			}
-			if pullCmdBranch != "" {
-				_, err = fmt.Fprintf(fOut, "  * Branch: '%s'\n", pullCmdBranch)
+			if branch != "" {
+				_, err = fmt.Fprintf(out, "  * Branch: '%s'\n", branch)
 				if err != nil {
 					return err
 				}
 			}
 			if pullCmdCommit != "" {
-				_, err = fmt.Fprintf(fOut, "  * Commit: %s\n", pullCmdCommit)
+				_, err = fmt.Fprintf(out, "  * Commit: %s\n", pullCmdCommit)
 				if err != nil {
 					return err
 				}
 			}
-			_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", len(b))
+			_, err = numFormat.Fprintf(out, "  * Size: %d bytes\n", dbEntry.Size)
 			if err != nil {
 				return err
 			}
 
 			// Update the branch metadata with the commit info
 			var oldBranch branchEntry
-			if pullCmdBranch == "" {
+			if branch == "" {
 				oldBranch = meta.Branches[meta.ActiveBranch]
 			} else {
-				oldBranch = meta.Branches[pullCmdBranch]
+				oldBranch = meta.Branches[branch]
 			}
 			commitCount := 1
 			z := meta.Commits[thisCommit.ID]
@@ -184,72 +241,50 @@ func pull(args []string) error {
 				CommitCount: commitCount,
 				Description: oldBranch.Description,
 			}
-			if pullCmdBranch == "" {
+			if branch == "" {
 				meta.Branches[meta.ActiveBranch] = newBranch
 			} else {
-				meta.Branches[pullCmdBranch] = newBranch
+				meta.Branches[branch] = newBranch
 			}
 
 			// Save the updated metadata to disk
-			err = saveMetadata(db, meta)
+			err = savePullMetadata(db, meta)
 			if err != nil {
 				return err
 			}
 
 			// If a default database isn't already selected, we use this one as the default
-			defDB, err = getDefaultDatabase()
-			if err != nil {
-				return err
-			}
-			if defDB == "" {
-				err = saveDefaultDatabase(db)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
+			return useAsDefaultDatabase(db)
 		}
 	}
 
-	// Download the database file
-	// TODO: Use a streaming download approach, so download progress can be shown.  Something like this should help:
-	//         https://stackoverflow.com/questions/22108519/how-do-i-read-a-streaming-response-body-using-golangs-net-http-package
-	_, err = fmt.Fprintf(fOut, "Downloading '%s' from %s...\n", db, cloud)
+	// Download the database file into the local cache
+	remoteCloud, err := remoteURL(db, selectedRemote)
 	if err != nil {
 		return err
 	}
-	resp, body, err := retrieveDatabase(db, pullCmdBranch, pullCmdCommit)
+	_, err = fmt.Fprintf(out, "Downloading '%s' from %s...\n", db, remoteCloud)
 	if err != nil {
 		return err
 	}
-
-	// Create the local database cache directory, if it doesn't yet exist
-	if _, err = os.Stat(filepath.Join(".dio", db, "db")); os.IsNotExist(err) {
-		err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
-		if err != nil {
-			return err
-		}
+	header, shaSum, err := retrieveDatabase(out, db, branch, pullCmdCommit, "")
+	if err != nil {
+		return err
 	}
 
-	// Calculate the sha256 of the database file
-	s := sha256.Sum256(body)
-	shaSum := hex.EncodeToString(s[:])
-
-	// Write the database file to disk in the cache directory
-	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), body, 0644)
+	// Copy the database file from the cache to the working directory
+	err = pullFromCache(db, shaSum)
 	if err != nil {
 		return err
 	}
-
-	// Write the database file to disk again, this time in the working directory
-	err = ioutil.WriteFile(db, body, 0644)
+	fi, err := os.Stat(db)
 	if err != nil {
 		return err
 	}
 
 	// If the headers included the modification-date parameter for the database, set the last accessed and last
 	// modified times on the new database file
-	if disp := resp.Header.Get("Content-Disposition"); disp != "" {
+	if disp := header.Get("Content-Disposition"); disp != "" {
 		s := strings.Split(disp, ";")
 		if len(s) == 4 {
 			a := strings.TrimLeft(s[2], " ")
@@ -269,46 +304,79 @@ func pull(args []string) error {
 	}
 
 	// If the server provided a branch name, add it to the local metadata cache
-	if branch := resp.Header.Get("Branch"); branch != "" {
+	if branch := header.Get("Branch"); branch != "" {
 		meta.ActiveBranch = branch
 	}
 
 	// The download succeeded, so save the updated metadata to disk
-	err = saveMetadata(db, meta)
+	err = savePullMetadata(db, meta)
 	if err != nil {
 		return err
 	}
 
 	// If a default database isn't already selected, we use this one as the default
-	defDB, err = getDefaultDatabase()
+	err = useAsDefaultDatabase(db)
 	if err != nil {
 		return err
 	}
-	if defDB == "" {
-		err = saveDefaultDatabase(db)
-		if err != nil {
-			return err
-		}
-	}
 
 	// Display success message to the user
-	comID := resp.Header.Get("Commit-Id")
-	_, err = fmt.Fprintln(fOut, "Downloaded complete")
+	comID := header.Get("Commit-Id")
+	_, err = fmt.Fprintln(out, "Downloaded complete")
 	if err != nil {
 		return err
 	}
-	if pullCmdBranch != "" {
-		_, err = fmt.Fprintf(fOut, "  * Branch: '%s'\n", pullCmdBranch)
+	if branch != "" {
+		_, err = fmt.Fprintf(out, "  * Branch: '%s'\n", branch)
 		if err != nil {
 			return err
 		}
 	}
 	if comID != "" {
-		_, err = fmt.Fprintf(fOut, "  * Commit: %s\n", comID)
+		_, err = fmt.Fprintf(out, "  * Commit: %s\n", comID)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = numFormat.Fprintf(fOut, "  * Size: %d bytes\n", len(body))
+	_, err = numFormat.Fprintf(out, "  * Size: %d bytes\n", fi.Size())
 	return err
 }
+
+// Copies a pulled database from the local cache into the working directory.  Databases pulled from a folder go into
+// a matching local folder
+func pullFromCache(db, shaSum string) error {
+	if pullCmdFolder != "" {
+		err := os.MkdirAll(filepath.Dir(db), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	return cacheCopyTo(db, shaSum, db)
+}
+
+// Saves the metadata for a pulled database.  When it was pulled from a folder, the folder is recorded too, for later
+// pushes and pulls
+func savePullMetadata(db string, meta metaData) error {
+	if pullCmdFolder != "" {
+		err := setRemoteFolder(db, selectedRemote, pullCmdFolder)
+		if err != nil {
+			return err
+		}
+	}
+	return saveMetadata(db, meta)
+}
+
+// Selects a database as the default one, if there isn't a default database already
+func useAsDefaultDatabase(db string) error {
+	// Several databases can be pulled at once, so make sure only one of them becomes the default
+	defaultDBMutex.Lock()
+	defer defaultDBMutex.Unlock()
+	defDB, err := getDefaultDatabase()
+	if err != nil {
+		return err
+	}
+	if defDB != "" {
+		return nil
+	}
+	return saveDefaultDatabase(db)
+}
@@ -1,35 +1,55 @@
 package cmd
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
-	rq "github.com/parnurzeal/gorequest"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/sqlitebrowser/dio/client"
 )
 
 var (
 	pushCmdBranch, pushCmdCommit, pushCmdDB  string
 	pushCmdEmail, pushCmdLicence, pushCmdMsg string
+	pushCmdFolder                            string
 	pushCmdName, pushCmdTimestamp            string
 	pushCmdForce, pushCmdPublic              bool
+	pushCmdReleases, pushCmdTags             bool
+	pushCmdJobs                              int
+
+	errNothingToPush = errors.New("Nothing to push.")
+)
+
+// The number of attempts made for each upload, and the delay before the first retry.  The delay doubles after each
+// failed attempt
+var (
+	uploadAttempts   = 5
+	uploadRetryDelay = 2 * time.Second
 )
 
 // Uploads a database to DBHub.io.
 var pushCmd = &cobra.Command{
-	Use:   "push [database file]",
+	Use:   "push [database file...]",
 	Short: "Upload a database",
+	Long: `Upload a database
+
+Several databases can be given, including glob patterns such as "*.sqlite".
+They're uploaded concurrently, with --jobs controlling how many at once.
+
+When the server supports it, only the pages of a database which changed since
+the previous commit are uploaded.
+
+Use --folder to put a database into a folder on DBHub.io.  The folder is
+remembered, so later pushes and pulls of the database use it too.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return push(args)
 	},
@@ -44,42 +64,75 @@ func init() {
 		"ID of the previous commit, for appending this new database to")
 	pushCmd.Flags().StringVar(&pushCmdDB, "dbname", "", "Override for the database name")
 	pushCmd.Flags().StringVar(&pushCmdEmail, "email", "", "Email address of the author")
+	pushCmd.Flags().StringVar(&pushCmdFolder, "folder", "", "Folder to store the database in on DBHub.io")
 	pushCmd.Flags().BoolVar(&pushCmdForce, "force", false, "Overwrite existing commit history?")
+	pushCmd.Flags().IntVarP(&pushCmdJobs, "jobs", "j", defaultJobs, "Number of databases to upload at once")
 	pushCmd.Flags().StringVar(&pushCmdLicence, "licence", "",
 		"The licence (ID) for the database, as per 'dio licence list'")
 	pushCmd.Flags().StringVar(&pushCmdMsg, "message", "",
 		"(Required) Commit message for this upload")
 	pushCmd.Flags().BoolVar(&pushCmdPublic, "public", false, "Should the database be public?")
+	pushCmd.Flags().BoolVar(&pushCmdReleases, "releases", false,
+		"Also create and remove releases on the server, to match the local ones")
+	pushCmd.Flags().StringVar(&selectedRemote, "remote", DEFAULT_REMOTE, "Remote to push to")
+	pushCmd.Flags().BoolVar(&pushCmdTags, "tags", false,
+		"Also create and remove tags on the server, to match the local ones")
 	pushCmd.Flags().StringVar(&pushCmdTimestamp, "timestamp", "", "Timestamp to use as the commit date")
 }
 
 func push(args []string) error {
-	// Ensure a database file was given
-	var db string
-	var err error
-	if len(args) == 0 {
-		db, err = getDefaultDatabase()
+	dbs, err := resolveDatabases(args, false)
+	if err != nil {
+		return err
+	}
+
+	// The database name override and commit ID are specific to a database, so can't be used when pushing several
+	if len(dbs) > 1 && (pushCmdDB != "" || pushCmdCommit != "") {
+		return errors.New("The --dbname and --commit options can only be used when pushing a single database")
+	}
+	if pushCmdFolder != "" {
+		pushCmdFolder, err = validateRemoteFolder(pushCmdFolder)
 		if err != nil {
 			return err
 		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
-		}
-	} else {
-		db = args[0]
 	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be uploaded at a time (for now)")
+	return forEachDatabase(dbs, pushCmdJobs, pushDatabase)
+}
+
+// Loads the local metadata for a database, along with its metadata from the selected remote
+func loadPushMetadata(db string) (meta, remoteMeta metaData, err error) {
+	meta, err = loadMetadata(db)
+	if err != nil {
+		return
+	}
+	remoteCloud, err := remoteURL(db, selectedRemote)
+	if err != nil {
+		return
+	}
+	remoteMeta, found, err := retrieveMetadata(db)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Database '%s' doesn't exist on %s", db, remoteCloud)
 	}
+	return
+}
+
+// Sends the commits on a branch which aren't yet on the server, displaying the details on out
+func pushCommits(out io.Writer, db string) error {
+	// Several databases can be pushed at once, so the flags which get adjusted for each are copied
+	branch, dbName := pushCmdBranch, pushCmdDB
 
 	// Ensure the database file exists
 	fi, err := os.Stat(db)
 	if err != nil {
 		return err
 	}
+	remoteCloud, err := remoteURL(db, selectedRemote)
+	if err != nil {
+		return err
+	}
 
 	// Grab author name & email from the dio config file, but allow command line flags to override them
 	var committerName, committerEmail, pushAuthor, pushEmail string
@@ -106,16 +159,18 @@ func push(args []string) error {
 	}
 
 	// Determine name to store database as
-	if pushCmdDB == "" {
-		pushCmdDB = filepath.Base(db)
+	if dbName == "" {
+		dbName, err = remoteDatabase(db, selectedRemote)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Check if there's local metadata.  If there is, we compare the local branch metadata with that on the server.
 	// Then we go through a simple loop, uploading each outstanding commit to the remote server along with it's
 	// metadata (via appropriate http headers)
 	var meta metaData
-	dbURL := fmt.Sprintf("%s/%s/%s", cloud, certUser, db)
-	if _, err = os.Stat(filepath.Join(".dio", db, "metadata.json")); err == nil {
+	if _, err = os.Stat(filepath.Join(dioDir(db), "metadata.json")); err == nil {
 		// Load the local metadata cache, without retrieving updated metadata from the cloud
 		meta, err = localFetchMetadata(db, false)
 		if err != nil {
@@ -123,14 +178,14 @@ func push(args []string) error {
 		}
 
 		// If no branch name was given on the command line, we use the active branch
-		if pushCmdBranch == "" {
-			pushCmdBranch = meta.ActiveBranch
+		if branch == "" {
+			branch = meta.ActiveBranch
 		}
 
 		// Check the branch exists locally
-		localHead, ok := meta.Branches[pushCmdBranch]
+		localHead, ok := meta.Branches[branch]
 		if !ok {
-			return errors.New(fmt.Sprintf("That branch ('%s') doesn't exist", pushCmdBranch))
+			return errors.New(fmt.Sprintf("That branch ('%s') doesn't exist", branch))
 		}
 
 		// Build a list of the commits in the local branch
@@ -156,47 +211,52 @@ func push(args []string) error {
 			// The database only exists locally, so we use the first commit to create the remote database,
 			// then loop around pushing the remaining commits
 			newCommit := meta.Commits[localCommitList[len(localCommitList)-1]].ID
-			err = sendCommit(meta, db, dbURL, newCommit, pushCmdPublic)
+			err = sendCommit(out, meta, db, branch, newCommit, pushCmdPublic, false)
 			if err != nil {
 				return err
 			}
 
 			// If there was only a single commit to push, there's nothing more to do
 			if len(localCommitList) == 1 {
-				_, err = fmt.Fprintf(fOut, "Database uploaded to %s\n\n", cloud)
+				setRemoteBranch(&meta, selectedRemote, branch, meta.Branches[branch])
+				err = saveMetadata(db, meta)
 				if err != nil {
 					return err
 				}
-				_, err = fmt.Fprintf(fOut, "  * Name: %s\n", pushCmdDB)
+				_, err = fmt.Fprintf(out, "Database uploaded to %s\n\n", remoteCloud)
 				if err != nil {
 					return err
 				}
-				_, err = fmt.Fprintf(fOut, "    Branch: %s\n", pushCmdBranch)
+				_, err = fmt.Fprintf(out, "  * Name: %s\n", dbName)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(out, "    Branch: %s\n", branch)
 				if err != nil {
 					return err
 				}
 				if pushCmdLicence != "" {
-					_, err = fmt.Fprintf(fOut, "    Licence: %s\n", pushCmdLicence)
+					_, err = fmt.Fprintf(out, "    Licence: %s\n", pushCmdLicence)
 					if err != nil {
 						return err
 					}
 				}
-				_, err = numFormat.Fprintf(fOut, "    Size: %d bytes\n", fi.Size())
+				_, err = numFormat.Fprintf(out, "    Size: %d bytes\n", fi.Size())
 				if err != nil {
 					return err
 				}
 				if pushCmdMsg != "" {
-					_, err = fmt.Fprintf(fOut, "    Commit message: %s\n", pushCmdMsg)
+					_, err = fmt.Fprintf(out, "    Commit message: %s\n", pushCmdMsg)
 					if err != nil {
 						return err
 					}
 				}
-				_, err = fmt.Fprintln(fOut)
+				_, err = fmt.Fprintln(out)
 				return err
 			}
 
 			// Let the user know the remote database has been created
-			_, err = fmt.Fprintf(fOut, "Created new database '%s' on %s\n", db, cloud)
+			_, err = fmt.Fprintf(out, "Created new database '%s' on %s\n", db, remoteCloud)
 			if err != nil {
 				return err
 			}
@@ -213,7 +273,7 @@ func push(args []string) error {
 		// * To get here, the database exists on the remote cloud and has local metadata *
 
 		// Check the branch exists remotely
-		remoteHead, ok := newMeta.Branches[pushCmdBranch]
+		remoteHead, ok := newMeta.Branches[branch]
 		if !ok {
 			// * The branch doesn't exist remotely, so create a fork on the remote cloud *
 
@@ -255,7 +315,7 @@ func push(args []string) error {
 
 			// Create the new (forked) branch on DBHub.io
 			newCommit := localCommitList[localCommitLength-baseBranchCounter]
-			err = sendCommit(meta, db, dbURL, newCommit, pushCmdPublic)
+			err = sendCommit(out, meta, db, branch, newCommit, pushCmdPublic, false)
 			if err != nil {
 				return err
 			}
@@ -269,21 +329,25 @@ func push(args []string) error {
 			}
 
 			// Add the new (forked) branch to the local list of remote metadata
-			newMeta.Branches[pushCmdBranch] = branchEntry{
+			newMeta.Branches[branch] = branchEntry{
 				Commit:      newCommit,
 				CommitCount: forkCommitCtr,
-				Description: meta.Branches[pushCmdBranch].Description,
+				Description: meta.Branches[branch].Description,
 			}
-			remoteHead = newMeta.Branches[pushCmdBranch]
+			remoteHead = newMeta.Branches[branch]
 
 			// Add the newly generated commit to the local list of remote metadata
 			newMeta.Commits[newCommit] = meta.Commits[newCommit]
 
 			// If this fork only had the one commit (eg no further commits to push), then finish here
 			if len(localCommitList) == forkCommitCtr {
-				_, err = fmt.Fprintf(fOut, "New branch '%s' created and all commits for it pushed to %s\n",
-					pushCmdBranch, cloud)
-				return err
+				_, err = fmt.Fprintf(out, "New branch '%s' created and all commits for it pushed to %s\n",
+					branch, remoteCloud)
+				if err != nil {
+					return err
+				}
+				setRemoteBranch(&meta, selectedRemote, branch, meta.Branches[branch])
+				return saveMetadata(db, meta)
 			}
 
 			// * Now that the initial commit for the new branch is on the remote server, we can continue on
@@ -307,78 +371,121 @@ func push(args []string) error {
 		if localCommitList[localCommitLength] != remoteCommitList[remoteCommitLength] {
 			// The local and remote branches don't have a common root, so abort
 			err = errors.New(fmt.Sprintf("Local and remote branch %s don't have a common root.  "+
-				"Aborting.", pushCmdBranch))
+				"Aborting.", branch))
 			return err
 		}
 
 		// * Compare the local branch to the head of the remote branch, to determine which commits need sending *
 
-		// If there are more commits in the remote branch than in the local one, then the branches have diverged
-		// so abort (for now).
-		// TODO: Write the code to allow --force overwriting for this
-		if remoteCommitLength > localCommitLength {
-			return fmt.Errorf("The remote branch has more commits than the local one.  Can't push the " +
-				"branch.  If you want to overwrite changes on the remote server, consider the --force option.")
-		}
-
 		// Check if the given branch is the same on the local and remote server.  If it is, nothing needs to be done
 		if remoteCommitLength == localCommitLength && remoteCommitList[0] == localCommitList[0] {
-			return fmt.Errorf("The local and remote branch '%s' are identical.  Nothing to push.",
-				pushCmdBranch)
+			return fmt.Errorf("The local and remote branch '%s' are identical.  %w", branch,
+				errNothingToPush)
 		}
 
-		// * To get here, the local branch has more commits than the remote one *
-
-		// Create the list of commits that need pushing
+		// Find the most recent commit the local and remote branches have in common.  The local commits after that
+		// are the ones that need pushing
+		remoteCommits := make(map[string]int)
+		for i, j := range remoteCommitList {
+			remoteCommits[j] = i
+		}
+		ancestor := 0
+		for ; ancestor < localCommitLength; ancestor++ {
+			if _, ok := remoteCommits[localCommitList[ancestor]]; ok {
+				break
+			}
+		}
 		var pushCommits []string
-		for i := 0; i <= localCommitLength; i++ {
-			lCommit := localCommitList[localCommitLength-i]
-			if i > remoteCommitLength {
-				pushCommits = append(pushCommits, lCommit)
-			} else {
-				rCommit := remoteCommitList[remoteCommitLength-i]
-				if lCommit != rCommit {
-					// There are conflicting commits in this branch between the local metadata and the
-					// remote.  Abort (for now)
-					// TODO: Consider how to allow --force pushing here.  Also remember that when doing this, there
-					//       needs a check added for potentially isolated tags and releases, same as branch revert
-					e := fmt.Sprintf("The local and remote branch have conflicting commits.\n\n")
-					e = fmt.Sprintf("%s  * local commit: %s\n", e, lCommit)
-					e = fmt.Sprintf("%s  * remote commit: %s\n\n", e, rCommit)
-					e = fmt.Sprintf("%sCan't push the branch.  If you want to overwrite changes on the "+
-						"remote server, consider the --force option.", e)
-					return errors.New(e)
+		for i := ancestor - 1; i >= 0; i-- {
+			pushCommits = append(pushCommits, localCommitList[i])
+		}
+
+		// If the remote branch has commits after the common one, then the branches have diverged.  Unless --force
+		// was given we abort, otherwise those remote commits are discarded
+		var forceFirst bool
+		if remoteIdx := remoteCommits[localCommitList[ancestor]]; remoteIdx > 0 {
+			if !pushCmdForce {
+				if len(pushCommits) == 0 {
+					return fmt.Errorf("The remote branch has more commits than the local one.  Can't push the " +
+						"branch.  If you want to overwrite changes on the remote server, consider the --force option.")
 				}
+				e := fmt.Sprintf("The local and remote branch have conflicting commits.\n\n")
+				e = fmt.Sprintf("%s  * local commit: %s\n", e, pushCommits[0])
+				e = fmt.Sprintf("%s  * remote commit: %s\n\n", e, remoteCommitList[remoteIdx-1])
+				e = fmt.Sprintf("%sCan't push the branch.  If you want to overwrite changes on the "+
+					"remote server, consider the --force option.", e)
+				return errors.New(e)
+			}
+
+			// A force push rewinds the remote branch to the common commit by sending the first new commit on top of
+			// it, so there needs to be at least one new commit
+			if len(pushCommits) == 0 {
+				return fmt.Errorf("The local branch '%s' has no commits which aren't already on the remote "+
+					"server, so there's nothing to overwrite the remote commits with.", branch)
+			}
+
+			// Check if discarding the remote commits would leave isolated tags or releases on the server.  If so,
+			// abort and warn the user
+			delList := make(map[string]struct{})
+			for _, j := range remoteCommitList[:remoteIdx] {
+				delList[j] = struct{}{}
+			}
+			isolatedTags, isolatedReleases, err := findIsolatedTagsReleases(newMeta, branch, delList)
+			if err != nil {
+				return err
+			}
+			if len(isolatedTags) > 0 || len(isolatedReleases) > 0 {
+				e := fmt.Sprint("You need to remove the following tags and releases from the remote server " +
+					"before force pushing this branch:\n\n")
+				for _, j := range isolatedTags {
+					e = fmt.Sprintf("%s  * tag '%s'\n", e, j)
+				}
+				for _, j := range isolatedReleases {
+					e = fmt.Sprintf("%s  * release '%s'\n", e, j)
+				}
+				return errors.New(e)
+			}
+			forceFirst = true
+			_, err = fmt.Fprintf(out, "Overwriting %d commit(s) on the remote branch '%s'\n", remoteIdx,
+				branch)
+			if err != nil {
+				return err
 			}
 		}
 
 		// Display useful info message to the user
 		numCommits := len(pushCommits) + extraCtr
 		if numCommits == 1 {
-			_, err = fmt.Fprintf(fOut, "Pushing 1 commit for branch '%s'", pushCmdBranch)
+			_, err = fmt.Fprintf(out, "Pushing 1 commit for branch '%s'", branch)
 			if err != nil {
 				return err
 			}
 		} else {
-			_, err = fmt.Fprintf(fOut, "Pushing %d commit(s) for branch '%s'", numCommits, pushCmdBranch)
+			_, err = fmt.Fprintf(out, "Pushing %d commit(s) for branch '%s'", numCommits, branch)
 			if err != nil {
 				return err
 			}
 		}
-		_, err = fmt.Fprintf(fOut, " to %s...\n", cloud)
+		_, err = fmt.Fprintf(out, " to %s...\n", remoteCloud)
 		if err != nil {
 			return err
 		}
 
 		// Send the commits to the cloud
-		for _, commitID := range pushCommits {
-			err = sendCommit(meta, db, dbURL, commitID, pushCmdPublic)
+		for i, commitID := range pushCommits {
+			err = sendCommit(out, meta, db, branch, commitID, pushCmdPublic, forceFirst && i == 0)
 			if err != nil {
 				return err
 			}
 		}
-		_, err = fmt.Fprintln(fOut, "All commits pushed.")
-		return err
+		_, err = fmt.Fprintln(out, "All commits pushed.")
+		if err != nil {
+			return err
+		}
+
+		// Record the new head of the branch on the server
+		setRemoteBranch(&meta, selectedRemote, branch, meta.Branches[branch])
+		return saveMetadata(db, meta)
 	}
 
 	// To get here, we don't have existing metadata.  We just use the original file upload code, which creates the
@@ -396,42 +503,43 @@ func push(args []string) error {
 	}
 	committerEmail = z
 
-	b, err := ioutil.ReadFile(db)
+	shaSum, err := cachedFileSHA256(db)
 	if err != nil {
 		return err
 	}
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(dbURL).
-		Type("multipart").
-		Query(fmt.Sprintf("authoremail=%s", url.QueryEscape(pushEmail))).
-		Query(fmt.Sprintf("authorname=%s", url.QueryEscape(pushAuthor))).
-		Query(fmt.Sprintf("branch=%s", url.QueryEscape(pushCmdBranch))).
-		Query(fmt.Sprintf("commit=%s", pushCmdCommit)).
-		Query(fmt.Sprintf("commitmsg=%s", url.QueryEscape(pushCmdMsg))).
-		Query(fmt.Sprintf("committeremail=%s", url.QueryEscape(committerEmail))).
-		Query(fmt.Sprintf("committername=%s", url.QueryEscape(committerName))).
-		Query(fmt.Sprintf("committimestamp=%v", pushCmdTimestamp)).
-		Query(fmt.Sprintf("dbshasum=%s", url.QueryEscape(shaSum))).
-		Query(fmt.Sprintf("force=%v", pushCmdForce)).
-		Query(fmt.Sprintf("lastmodified=%s", url.QueryEscape(fi.ModTime().UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("public=%v", pushCmdPublic)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(db, "", "file1")
+	query := url.Values{}
+	query.Set("authoremail", pushEmail)
+	query.Set("authorname", pushAuthor)
+	query.Set("branch", branch)
+	query.Set("commit", pushCmdCommit)
+	query.Set("commitmsg", pushCmdMsg)
+	query.Set("committeremail", committerEmail)
+	query.Set("committername", committerName)
+	query.Set("committimestamp", pushCmdTimestamp)
+	query.Set("dbshasum", shaSum)
+	query.Set("force", fmt.Sprintf("%v", pushCmdForce))
+	query.Set("lastmodified", fi.ModTime().UTC().Format(time.RFC3339))
+	query.Set("public", fmt.Sprintf("%v", pushCmdPublic))
 	if pushCmdLicence != "" {
-		req.Query(fmt.Sprintf("licence=%s", url.QueryEscape(pushCmdLicence)))
+		query.Set("licence", pushCmdLicence)
 	}
-	resp, _, errs := req.End()
-	if errs != nil {
-		log.Print("Errors when uploading database to the cloud:")
-		for _, err := range errs {
-			_, _ = fmt.Fprint(fOut, err)
+
+	// If an upload attempt fails part way through, check whether the server created the database anyway
+	acknowledged := func() bool {
+		remoteMeta, found, err := retrieveMetadata(db)
+		if err != nil || !found {
+			return false
 		}
-		return errors.New("Error when uploading database to the cloud")
+		for _, c := range remoteMeta.Commits {
+			if e, ok := c.Tree.Database(db); ok && e.Sha256 == shaSum {
+				return true
+			}
+		}
+		return false
 	}
-	if resp != nil && resp.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("Upload failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
+	_, _, err = uploadDatabase(out, db, query, db, acknowledged)
+	if err != nil {
+		return err
 	}
 
 	// Retrieve updated metadata
@@ -440,8 +548,8 @@ func push(args []string) error {
 		return err
 	}
 	meta.ActiveBranch = meta.DefBranch
-	if pushCmdBranch == "" {
-		pushCmdBranch = meta.ActiveBranch
+	if branch == "" {
+		branch = meta.ActiveBranch
 	}
 
 	// Save the updated metadata back to disk
@@ -451,116 +559,327 @@ func push(args []string) error {
 	}
 
 	// If the database isn't in the local metadata cache, then copy it there
-	err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), b, 0644)
+	err = cacheStore(db, shaSum, db)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprintf(fOut, "Database uploaded to %s\n\n", cloud)
+	_, err = fmt.Fprintf(out, "Database uploaded to %s\n\n", remoteCloud)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(fOut, "  * Name: %s\n", pushCmdDB)
+	_, err = fmt.Fprintf(out, "  * Name: %s\n", dbName)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(fOut, "    Branch: %s\n", pushCmdBranch)
+	_, err = fmt.Fprintf(out, "    Branch: %s\n", branch)
 	if err != nil {
 		return err
 	}
 	if pushCmdLicence != "" {
-		_, err = fmt.Fprintf(fOut, "    Licence: %s\n", pushCmdLicence)
+		_, err = fmt.Fprintf(out, "    Licence: %s\n", pushCmdLicence)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = numFormat.Fprintf(fOut, "    Size: %d bytes\n", fi.Size())
+	_, err = numFormat.Fprintf(out, "    Size: %d bytes\n", fi.Size())
 	if err != nil {
-		_, errInner := fmt.Fprintln(fOut)
+		_, errInner := fmt.Fprintln(out)
 		if errInner != nil {
 			return fmt.Errorf("%s: %s", err, errInner)
 		}
 		return err
 	}
 	if pushCmdMsg != "" {
-		_, err = fmt.Fprintf(fOut, "    Commit message: %s\n", pushCmdMsg)
+		_, err = fmt.Fprintf(out, "    Commit message: %s\n", pushCmdMsg)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = fmt.Fprintln(fOut)
+	_, err = fmt.Fprintln(out)
 	return err
 }
 
-// Sends a commit to the cloud
-func sendCommit(meta metaData, db string, dbURL string, newCommit string, public bool) (err error) {
+// Pushes a single database, along with its tags and releases if requested.  The details are displayed on out
+func pushDatabase(out io.Writer, db string) error {
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Remember the folder the database is going into, so it's also used for later pushes and pulls
+	if pushCmdFolder != "" {
+		err = setRemoteFolder(db, selectedRemote, pushCmdFolder)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send the commits, then any tags and releases.  When only the tags and releases have changed, there being no
+	// commits to send isn't an error
+	err = pushCommits(out, db)
+	if (pushCmdTags || pushCmdReleases) && errors.Is(err, errNothingToPush) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if pushCmdTags {
+		err = pushTags(out, db)
+	}
+	if pushCmdReleases {
+		errInner := pushReleases(out, db)
+		if err == nil {
+			err = errInner
+		}
+	}
+	return err
+}
+
+// The references to commits of one kind, eg tags, for pushNamedRefs to send to the server
+type namedRefs struct {
+	kind   string                  // What they're called, eg "tag"
+	local  map[string]string       // The commit each local one points to
+	server map[string]string       // The commit each one on the server points to
+	base   map[string]string       // The commit each one on the server pointed to as of the last fetch
+	create func(name string) error // Creates one on the server, pointing at the same commit as the local one
+	remove func(name string) error // Removes one from the server
+}
+
+// Creates and removes references on the server so they match the local ones.  Each one which can't be pushed is
+// reported individually on out, with the others still being sent, and the number of those is returned.
+// remoteCommits are the commits on the server
+func pushNamedRefs(out io.Writer, remoteCommits map[string]commitEntry, refs namedRefs) (failed int, err error) {
+	// Work through the local and remote references in alphabetical order
+	var names []string
+	for name := range refs.local {
+		names = append(names, name)
+	}
+	for name := range refs.server {
+		if _, ok := refs.local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	title := strings.ToUpper(refs.kind[:1]) + refs.kind[1:]
+	changes := 0
+	for _, name := range names {
+		local, inLocal := refs.local[name]
+		remote, inRemote := refs.server[name]
+		base, inBase := refs.base[name]
+		var msg string
+		ok := false
+		switch {
+		case inLocal && inRemote && local == remote:
+			continue
+		case inLocal && inRemote:
+			msg = fmt.Sprintf("conflicts: it points to commit %s locally, but %s on the server", local, remote)
+		case inLocal:
+			if _, ok := remoteCommits[local]; !ok {
+				msg = fmt.Sprintf("wasn't pushed, as its commit (%s) isn't on the server yet", local)
+				break
+			}
+			err = refs.create(name)
+			if err != nil {
+				msg = fmt.Sprintf("wasn't pushed: %s", err)
+				break
+			}
+			changes++
+			msg, ok = "created on the server", true
+		case inBase && base == remote:
+			// It was there at the last fetch, so it's been removed locally since
+			err = refs.remove(name)
+			if err != nil {
+				msg = fmt.Sprintf("wasn't removed from the server: %s", err)
+				break
+			}
+			changes++
+			msg, ok = "removed from the server", true
+		case inBase:
+			msg = "wasn't removed from the server, as it's been changed there since the last fetch"
+		default:
+			// New on the server, so it'll be picked up by the next fetch or pull
+			continue
+		}
+		if !ok {
+			failed++
+		}
+		_, err = fmt.Fprintf(out, "  * %s '%s' %s\n", title, name, msg)
+		if err != nil {
+			return
+		}
+	}
+	if changes == 0 && failed == 0 {
+		_, err = fmt.Fprintf(out, "  * %ss are up to date\n", title)
+	}
+	return
+}
+
+// Runs 'dio tag push' or 'dio release push' for the database given in args, with push sending the references
+func pushNamedRefsCmd(args []string, push func(out io.Writer, db string) error) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be worked with at a time (for now)")
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return push(fOut, db)
+}
+
+// Sends a commit to a branch in the cloud, displaying its progress on out.  When force is set, the remote branch is
+// rewound to the parent of the commit first
+func sendCommit(out io.Writer, meta metaData, db, branch, newCommit string, public bool, force bool) (err error) {
 	commitData, ok := meta.Commits[newCommit]
 	if !ok {
 		return fmt.Errorf("Something went wrong.  Could not retrieve data for commit '%s' from"+
 			"local metadata commit list.", newCommit)
 	}
-	shaSum := commitData.Tree.Entries[0].Sha256
-	var otherParents string
-	for i, j := range commitData.OtherParents {
-		if i != 1 {
-			otherParents += ","
-		}
-		otherParents += j
-	}
-
-	// Push the first commit to the remote cloud, to create the database there
-	req := rq.New().TLSClientConfig(&TLSConfig).Post(dbURL).
-		Type("multipart").
-		Query(fmt.Sprintf("branch=%s", url.QueryEscape(pushCmdBranch))).
-		Query(fmt.Sprintf("commitmsg=%s", url.QueryEscape(commitData.Message))).
-		Query(fmt.Sprintf("lastmodified=%s",
-			url.QueryEscape(commitData.Tree.Entries[0].LastModified.UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("commit=%s", commitData.Parent)).
-		Query(fmt.Sprintf("authoremail=%s", url.QueryEscape(commitData.AuthorEmail))).
-		Query(fmt.Sprintf("authorname=%s", url.QueryEscape(commitData.AuthorName))).
-		Query(fmt.Sprintf("committeremail=%s", url.QueryEscape(commitData.CommitterEmail))).
-		Query(fmt.Sprintf("committername=%s", url.QueryEscape(commitData.CommitterName))).
-		Query(fmt.Sprintf("committimestamp=%s",
-			url.QueryEscape(commitData.Timestamp.UTC().Format(time.RFC3339)))).
-		Query(fmt.Sprintf("otherparents=%s", url.QueryEscape(otherParents))).
-		Query(fmt.Sprintf("dbshasum=%s", url.QueryEscape(shaSum))).
-		Query(fmt.Sprintf("public=%v", pushCmdPublic)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		SendFile(filepath.Join(".dio", db, "db", shaSum), db, "file1")
-	if pushCmdLicence != "" {
-		req.Query(fmt.Sprintf("licence=%s", url.QueryEscape(pushCmdLicence)))
+	opts := client.CommitOptions{
+		Branch:  branch,
+		Force:   force,
+		Licence: pushCmdLicence,
+		Public:  public,
 	}
-	resp, body, errs := req.End()
-	if errs != nil {
-		e := fmt.Sprintln("Errors when uploading database to the cloud:")
-		for _, err := range errs {
-			e = err.Error()
-		}
-		return errors.New(e)
+
+	// DBHub.io servers only store the database itself in a commit, so commits with other files in them can't be sent
+	// without the commit IDs on the server no longer matching the local ones
+	dbEntry, err := commitDBEntry(commitData, db)
+	if err != nil {
+		return err
 	}
-	if resp != nil && resp.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("Upload failed with an error: '%v'", body))
+	if files := commitAttachments(commitData, db); len(files) > 0 {
+		return fmt.Errorf("Commit %s can't be pushed, as it has files other than the database in it (eg '%s'), "+
+			"which DBHub.io servers can't store yet", newCommit, files[0].Name)
 	}
 
-	// Process the JSON format response data
-	parsedResponse := map[string]string{}
-	err = json.Unmarshal([]byte(body), &parsedResponse)
+	// If the server supports it, only send the pages which changed since the parent commit
+	cl, remoteDB, err := newRemoteClient(out, db)
 	if err != nil {
-		_, errInner := fmt.Fprintf(fOut, "Error parsing server response: '%v'", err.Error())
-		if errInner != nil {
-			return fmt.Errorf("%s: %s", err, errInner)
-		}
+		return err
+	}
+	sent, err := sendCommitDelta(out, cl, meta, db, remoteDB, commitData, opts)
+	if err != nil || sent {
 		return err
 	}
 
-	// Check that the ID for the new commit as generated by the server matches the ID generated locally
-	remoteCommitID, ok := parsedResponse["commit_id"]
+	// Send the whole database
+	f, size, err := cacheOpen(db, dbEntry.Sha256)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return cl.SendCommit(cmdContext(), remoteDB, commitData, opts, f, size)
+}
+
+// Sends a commit as a delta against the database of its parent commit, returning true if that worked.  False is
+// returned when a delta can't be used (eg the server doesn't support them, or the parent database isn't cached
+// locally) or isn't worth using, so the whole database can be sent instead.  remoteDB is the path of the database on
+// the remote
+func sendCommitDelta(out io.Writer, cl *client.Client, meta metaData, db, remoteDB string, commitData commitEntry,
+	opts client.CommitOptions) (sent bool, err error) {
+	baseEntry, ok := meta.Commits[commitData.Parent].Tree.Database(db)
 	if !ok {
-		return errors.New("Unexpected response from server, doesn't contain new commit ID.")
+		return
 	}
-	if remoteCommitID != newCommit {
-		return fmt.Errorf("Error.  The Commit ID generated on the server (%s) doesn't match the "+
-			"local Commit ID (%s)", remoteCommitID, newCommit)
+	newEntry, ok := commitData.Tree.Database(db)
+	if !ok {
+		return
 	}
-	return
+	baseSha := baseEntry.Sha256
+	newSha := newEntry.Sha256
+	if baseSha == "" || baseSha == newSha || !cacheExists(db, baseSha) {
+		return
+	}
+	if ok, errInner := cl.SupportsDelta(cmdContext(), client.DeltaFormat); errInner != nil || !ok {
+		// If the server couldn't be asked, sending the whole database will report the problem
+		return
+	}
+
+	// Make the delta in a temporary file, so its size is known before sending it
+	base, _, err := cacheOpen(db, baseSha)
+	if err != nil {
+		return
+	}
+	defer base.Close()
+	target, size, err := cacheOpen(db, newSha)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	pageSize := databasePageSize(target)
+	_, err = target.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	delta, err := ioutil.TempFile("", "dio-delta-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		delta.Close()
+		os.Remove(delta.Name())
+	}()
+	deltaSize, err := client.WriteDelta(delta, base, target, size, pageSize)
+	if err != nil {
+		return
+	}
+	if deltaSize >= size {
+		// Most of the database changed, so there's nothing to gain from a delta
+		return
+	}
+
+	// Send the delta, falling back to the whole database if the server can't use it
+	_, err = numFormat.Fprintf(out, "  * Sending the changed pages only (%d of %d bytes)\n", deltaSize, size)
+	if err != nil {
+		return
+	}
+	err = cl.SendCommitDelta(cmdContext(), remoteDB, commitData, opts, baseSha, delta, deltaSize)
+	if err == client.ErrDeltaRejected {
+		_, err = fmt.Fprintln(out, "  * The server couldn't use the changed pages, so sending the whole database")
+		return
+	}
+	return err == nil, err
+}
+
+// Uploads a database file to the cloud, streaming it from disk with a progress display on out.  Failed uploads are
+// retried, with the acknowledged function (if given) being used to check whether the server received the upload
+// anyway
+func uploadDatabase(out io.Writer, db string, query url.Values, path string, acknowledged func() bool) (body []byte,
+	acked bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	cl, remoteDB, err := newRemoteClient(out, db)
+	if err != nil {
+		return
+	}
+	return cl.UploadDatabase(cmdContext(), remoteDB, query, f, fi.Size(), acknowledged)
 }
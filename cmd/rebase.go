@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	rebaseCmdBranch, rebaseCmdOnto                    string
+	rebaseCmdAbort, rebaseCmdContinue, rebaseCmdForce bool
+)
+
+// Replays the local commits of a branch on top of another branch or commit
+var rebaseCmd = &cobra.Command{
+	Use:   "rebase [database name] [--onto xxx]",
+	Short: "Replays the local commits of a branch on top of another branch or commit",
+	Long: `Replays the local commits of a branch on top of another branch or commit
+
+The commits in the branch which aren't part of the target's history are re-applied
+one at a time, row by row, on top of the target.  This is useful when someone else
+has pushed new commits to the server first.  By default the target is the remote-
+tracking branch (eg 'origin/main') from the last 'dio fetch'.  A branch without
+any commits of its own is simply moved forward to the target.
+
+If a commit's changes conflict with the rows in the target, the rebase is paused
+and the conflicts listed.  Fix the conflicting rows in the working database, then
+run 'dio rebase --continue'.  Alternatively, 'dio rebase --abort' puts the branch
+back how it was.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return rebase(args)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rebaseCmd)
+	rebaseCmd.Flags().BoolVar(&rebaseCmdAbort, "abort", false, "Cancel an in-progress rebase")
+	rebaseCmd.Flags().StringVar(&rebaseCmdBranch, "branch", "",
+		"Branch to rebase (default is the active branch)")
+	rebaseCmd.Flags().BoolVar(&rebaseCmdContinue, "continue", false,
+		"Continue the rebase, after conflicts have been resolved")
+	rebaseCmd.Flags().BoolVarP(&rebaseCmdForce, "force", "f", false,
+		"Overwrite unsaved changes to the database?")
+	rebaseCmd.Flags().StringVar(&rebaseCmdOnto, "onto", "",
+		"Branch, commit, or tag to replay the commits on top of (default is the remote-tracking branch)")
+}
+
+func rebase(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be rebased at a time (for now)")
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if rebaseCmdAbort && rebaseCmdContinue {
+		return errors.New("Either --abort or --continue can be given.  Not both!")
+	}
+	if rebaseCmdAbort {
+		return rebaseAbort(db)
+	}
+	if rebaseCmdContinue {
+		return rebaseContinue(db)
+	}
+
+	// Make sure there isn't already a merge or rebase underway
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+
+	// Load the metadata
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// If no branch name was given, use the active branch
+	branch := rebaseCmdBranch
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+
+	// If no target was given, use the remote-tracking branch
+	onto := rebaseCmdOnto
+	if onto == "" {
+		onto = remoteBranchName(DEFAULT_REMOTE, branch)
+		if _, ok = meta.RemoteBranches[onto]; !ok {
+			return fmt.Errorf("No remote-tracking branch '%s' is known.  Run 'dio fetch' first, or use --onto "+
+				"to choose what to rebase onto", onto)
+		}
+	}
+	ontoCommit, err := resolveCommit(meta, onto)
+	if err != nil {
+		return err
+	}
+
+	// Unless --force is specified, check whether the file has changed since the last commit, and let the user know
+	if !rebaseCmdForce {
+		changed, err := dbChanged(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+				"really want to overwrite it\n", db)
+			return err
+		}
+	}
+
+	// Work out which commits in the branch aren't part of the target's history.  Those are the ones to replay
+	ontoHistory, err := commitHistory(meta, ontoCommit)
+	if err != nil {
+		return err
+	}
+	var replay []string
+	for id := head.Commit; ; {
+		if _, ok = ontoHistory[id]; ok {
+			break
+		}
+		c, ok := meta.Commits[id]
+		if !ok {
+			return fmt.Errorf("Broken commit history: commit '%s' isn't in the local commit cache", id)
+		}
+		if c.Parent == "" {
+			return fmt.Errorf("Branch '%s' and '%s' don't have any history in common", branch, onto)
+		}
+		replay = append([]string{id}, replay...)
+		id = c.Parent
+	}
+	if head.Commit == ontoCommit || (len(replay) > 0 && meta.Commits[replay[0]].Parent == ontoCommit) {
+		_, err = fmt.Fprintf(fOut, "Branch '%s' already contains all of the commits from '%s'.  Nothing to "+
+			"rebase.\n", branch, onto)
+		return err
+	}
+
+	// If the branch doesn't have any commits of its own, then we just move it forward
+	ontoCount, err := countCommits(meta, ontoCommit)
+	if err != nil {
+		return err
+	}
+	if len(replay) == 0 {
+		err = writeCommitToWorkingFile(db, meta, ontoCommit)
+		if err != nil {
+			return err
+		}
+		meta.Branches[branch] = branchEntry{
+			Commit:      ontoCommit,
+			CommitCount: ontoCount,
+			Description: head.Description,
+		}
+		meta.ActiveBranch = branch
+		err = saveMetadata(db, meta)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "Branch '%s' fast-forwarded to commit %s from '%s'\n", branch, ontoCommit, onto)
+		return err
+	}
+
+	// Move the branch to the target, then replay the commits on top of it
+	state := rebaseState{
+		Branch:    branch,
+		OrigHead:  head,
+		Onto:      ontoCommit,
+		Remaining: replay,
+	}
+	meta.Branches[branch] = branchEntry{
+		Commit:      ontoCommit,
+		CommitCount: ontoCount,
+		Description: head.Description,
+	}
+	meta.ActiveBranch = branch
+	err = writeCommitToWorkingFile(db, meta, ontoCommit)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Rebasing %d commit(s) from branch '%s' onto %s\n", len(replay), branch, onto)
+	if err != nil {
+		return err
+	}
+	return rebaseReplay(db, meta, state)
+}
+
+// Cancels an in-progress rebase, putting the branch and working database back how they were
+func rebaseAbort(db string) error {
+	state, err := loadRebaseState(db)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No rebase is in progress for '%s'", db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	meta.Branches[state.Branch] = state.OrigHead
+	err = writeCommitToWorkingFile(db, meta, state.OrigHead.Commit)
+	if err != nil {
+		return err
+	}
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dioDir(db), "rebase.json"))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Rebase of branch '%s' cancelled\n", state.Branch)
+	return err
+}
+
+// Continues an in-progress rebase, once the user has resolved the conflicts
+func rebaseContinue(db string) error {
+	state, err := loadRebaseState(db)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("No rebase is in progress for '%s'", db)
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+
+	// Commit the resolved changes for the commit which had conflicts.  If resolving them left the database
+	// unchanged, then the commit is dropped
+	changed, err := dbChanged(db, meta)
+	if err != nil {
+		return err
+	}
+	if changed {
+		_, err = replayCommit(db, meta, state.Branch, state.Current)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = fmt.Fprintf(fOut, "  * Commit %s left no changes, so it's been dropped\n", state.Current)
+		if err != nil {
+			return err
+		}
+	}
+	state.Conflicts = nil
+	state.Current = ""
+	return rebaseReplay(db, meta, *state)
+}
+
+// Replays the remaining commits of a rebase.  If a commit has conflicts, the rebase state is saved so it can be
+// continued after the conflicts are resolved
+func rebaseReplay(db string, meta metaData, state rebaseState) error {
+	for len(state.Remaining) > 0 {
+		id := state.Remaining[0]
+		state.Remaining = state.Remaining[1:]
+		conflicts, err := applyCommitChanges(db, meta, id)
+		if err != nil {
+			// Put things back how they were
+			errInner := saveRebaseState(db, state)
+			if errInner == nil {
+				errInner = rebaseAbort(db)
+			}
+			if errInner != nil {
+				return fmt.Errorf("%s: %s", err, errInner)
+			}
+			return err
+		}
+		if len(conflicts) > 0 {
+			state.Current = id
+			state.Conflicts = conflicts
+			err = saveMetadata(db, meta)
+			if err != nil {
+				return err
+			}
+			err = saveRebaseState(db, state)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(fOut, "Replaying commit %s has conflicts:\n\n", id)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(fOut, createConflictText(conflicts))
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("Rebase paused.  Fix the conflicts in '%s', then run 'dio rebase --continue'.  Or "+
+				"use 'dio rebase --abort' to cancel the rebase", db)
+		}
+		newCom, err := replayCommit(db, meta, state.Branch, id)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fOut, "  * Commit %s replayed as %s\n", id, newCom.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// All of the commits have been replayed
+	err := saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dioDir(db), "rebase.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Branch '%s' rebased\n", state.Branch)
+	return err
+}
+
+// Applies the row level changes between two commits to the working database.  Changes which don't match the current
+// rows are skipped and returned as conflicts
+func applyChangesBetween(db string, meta metaData, from, to string) (conflicts []changeConflict, err error) {
+	fromPath, err := commitDBPath(db, meta, from)
+	if err != nil {
+		return
+	}
+	toPath, err := commitDBPath(db, meta, to)
+	if err != nil {
+		return
+	}
+	diffs, err := diffDatabases(fromPath, toPath)
+	if err != nil {
+		return
+	}
+	return applyDiffs(db, diffs)
+}
+
+// Applies the row level changes made by a commit to the working database.  Changes which don't match the current
+// rows are skipped and returned as conflicts
+func applyCommitChanges(db string, meta metaData, commitID string) (conflicts []changeConflict, err error) {
+	c, ok := meta.Commits[commitID]
+	if !ok {
+		err = fmt.Errorf("Commit '%s' isn't in the local commit cache", commitID)
+		return
+	}
+	if c.Parent == "" {
+		err = fmt.Errorf("Commit '%s' is the first commit in its history, so has no changes which can be "+
+			"applied elsewhere", commitID)
+		return
+	}
+	return applyChangesBetween(db, meta, c.Parent, commitID)
+}
+
+// Returns the number of commits in the history of a commit, following the first parent of each.  Damaged metadata can
+// have a commit as its own ancestor, which is reported rather than being followed forever
+func countCommits(meta metaData, commitID string) (count int, err error) {
+	seen := make(map[string]struct{})
+	for c, ok := meta.Commits[commitID]; ok; c, ok = meta.Commits[c.Parent] {
+		if _, ok = seen[c.ID]; ok {
+			return 0, fmt.Errorf("Broken commit history: commit '%s' is its own ancestor", c.ID)
+		}
+		seen[c.ID] = struct{}{}
+		count++
+	}
+	return
+}
+
+// Loads the state of an in-progress rebase.  Returns nil if no rebase is in progress
+func loadRebaseState(db string) (state *rebaseState, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), "rebase.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return
+	}
+	state = &rebaseState{}
+	err = json.Unmarshal(b, state)
+	return
+}
+
+// Creates a new commit on a branch from the working database, copying the details (and attached files) of an existing
+// commit
+func replayCommit(db string, meta metaData, branch, commitID string) (commitEntry, error) {
+	orig := meta.Commits[commitID]
+	dbEntry, err := commitDBEntry(orig, db)
+	if err != nil {
+		return commitEntry{}, err
+	}
+	return addCommit(db, meta, branch, dbEntry.LicenceSHA, commitAttachments(orig, db), replayedCommit(orig))
+}
+
+// Returns the details for a copy of an existing commit, keeping its author and message.  The person doing the copying
+// is recorded as the committer, when known
+func replayedCommit(orig commitEntry) commitEntry {
+	newCom := commitEntry{
+		AuthorName:     orig.AuthorName,
+		AuthorEmail:    orig.AuthorEmail,
+		CommitterName:  orig.CommitterName,
+		CommitterEmail: orig.CommitterEmail,
+		Message:        orig.Message,
+		Timestamp:      orig.Timestamp,
+	}
+	name, nameOk := viper.Get("user.name").(string)
+	email, emailOk := viper.Get("user.email").(string)
+	if nameOk && emailOk && name != "" && email != "" {
+		newCom.CommitterName = name
+		newCom.CommitterEmail = email
+	}
+	return newCom
+}
+
+// Saves the state of an in-progress rebase
+func saveRebaseState(db string, state rebaseState) (err error) {
+	var jsonString []byte
+	jsonString, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dioDir(db), "rebase.json"), jsonString, 0644)
+	return
+}
@@ -34,7 +34,7 @@ func releaseList(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -50,6 +50,12 @@ func releaseList(args []string) error {
 		return err
 	}
 
+	if structuredOutput() {
+		if meta.Releases == nil {
+			meta.Releases = make(map[string]releaseEntry)
+		}
+		return writeOutput(releaseListOutput{Database: db, Releases: meta.Releases})
+	}
 	if len(meta.Releases) == 0 {
 		_, err = fmt.Fprintf(fOut, "Database %s has no releases\n", db)
 		return err
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// Sends the releases for a database to the server
+var releasePushCmd = &cobra.Command{
+	Use:   "push [database name]",
+	Short: "Creates and removes releases on the server, to match the local ones",
+	Long: `Creates and removes releases on the server, to match the local ones
+
+Releases created locally are added to the server, and releases removed locally
+are removed from it.  A release with the same name pointing at a different
+commit on the server is reported as a conflict, and left alone.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return releasePush(args)
+	},
+}
+
+func init() {
+	releaseCmd.AddCommand(releasePushCmd)
+	releasePushCmd.Flags().StringVar(&selectedRemote, "remote", DEFAULT_REMOTE, "Remote to push to")
+}
+
+func releasePush(args []string) error {
+	return pushNamedRefsCmd(args, pushReleases)
+}
+
+// Creates and removes releases on the server so they match the local ones.  Each release which can't be pushed is
+// reported individually on out, with the others still being sent
+func pushReleases(out io.Writer, db string) error {
+	meta, remoteMeta, err := loadPushMetadata(db)
+	if err != nil {
+		return err
+	}
+	cl, remoteDB, err := newRemoteClient(out, db)
+	if err != nil {
+		return err
+	}
+	ctx := cmdContext()
+
+	// Keep track of the releases on the server as they're changed
+	serverReleases := make(map[string]releaseEntry)
+	for name, rel := range remoteMeta.Releases {
+		serverReleases[name] = rel
+	}
+	_, baseReleases := remoteTagsReleases(meta, selectedRemote)
+	failed, err := pushNamedRefs(out, remoteMeta.Commits, namedRefs{
+		kind:   "release",
+		local:  releaseCommits(meta.Releases),
+		server: releaseCommits(remoteMeta.Releases),
+		base:   releaseCommits(baseReleases),
+		create: func(name string) error {
+			err := cl.CreateRelease(ctx, remoteDB, name, meta.Releases[name])
+			if err == nil {
+				serverReleases[name] = meta.Releases[name]
+			}
+			return err
+		},
+		remove: func(name string) error {
+			err := cl.RemoveRelease(ctx, remoteDB, name)
+			if err == nil {
+				delete(serverReleases, name)
+			}
+			return err
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Save what's now on the server, so later pushes know which releases have been removed locally
+	setRemoteReleases(&meta, selectedRemote, serverReleases)
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d release(s) couldn't be pushed", failed)
+	}
+	return nil
+}
+
+// Returns the commit each of the given releases points to
+func releaseCommits(releases map[string]releaseEntry) map[string]string {
+	commits := make(map[string]string)
+	for name, rel := range releases {
+		commits[name] = rel.Commit
+	}
+	return commits
+}
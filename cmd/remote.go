@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sqlitebrowser/dio/client"
+)
+
+// The remote used by push, pull and fetch, as given by their --remote option
+var selectedRemote = DEFAULT_REMOTE
+
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Manage the DBHub.io clouds a database is pushed to and pulled from",
+	Long: `Manage the DBHub.io clouds a database is pushed to and pulled from
+
+Each database can have several named remotes, each pointing at a DBHub.io
+cloud.  The 'origin' remote always exists, and uses the cloud from the
+config file (or --cloud) unless it's been given a different address with
+'dio remote set-url'.  Push, pull and fetch use 'origin' unless another
+remote is chosen with their --remote option, and the branches on each remote
+are tracked separately (eg 'origin/main' and 'mirror/main').`,
+}
+
+func init() {
+	RootCmd.AddCommand(remoteCmd)
+}
+
+// Loads the remotes added for a database.  The default remote is only included if its address has been changed
+func loadRemotes(db string) (remotes map[string]remoteEntry, err error) {
+	remotes = make(map[string]remoteEntry)
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), "remotes.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(b, &remotes)
+	return
+}
+
+// Removes the remote-tracking branches, tags, and releases for a remote from the local metadata, if there is any
+func removeRemoteTracking(db, remote string) error {
+	if _, err := os.Stat(filepath.Join(dioDir(db), "metadata.json")); err != nil {
+		return nil
+	}
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	setRemoteBranches(&meta, remote, nil)
+	delete(meta.OtherRemotes, remote)
+	if remote == DEFAULT_REMOTE {
+		meta.RemoteReleases = nil
+		meta.RemoteTags = nil
+	}
+	return saveMetadata(db, meta)
+}
+
+// Returns the path of a database on a remote (eg "/finance/q1.sqlite"), being its file name in the folder recorded for
+// the remote
+func remoteDatabase(db, remote string) (string, error) {
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return "", err
+	}
+	folder := remotes[remote].Folder
+	if f, ok := pullFolders.Load(db); ok && remote == selectedRemote {
+		// The database is being pulled from a folder, which isn't saved until the pull has worked
+		folder = f.(string)
+	}
+	return client.DatabasePath(folder, filepath.Base(db)), nil
+}
+
+// Returns the address of the DBHub.io cloud for a remote of a database
+func remoteURL(db, remote string) (string, error) {
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return "", err
+	}
+	if r, ok := remotes[remote]; ok && r.URL != "" {
+		return r.URL, nil
+	}
+	if remote == DEFAULT_REMOTE {
+		return cloud, nil
+	}
+	return "", fmt.Errorf("Database '%s' doesn't have a remote called '%s'.  It can be added with 'dio remote "+
+		"add'", db, remote)
+}
+
+// Saves the remotes for a database
+func saveRemotes(db string, remotes map[string]remoteEntry) (err error) {
+	err = os.MkdirAll(dioDir(db), 0770)
+	if err != nil {
+		return
+	}
+	var jsonString []byte
+	jsonString, err = json.MarshalIndent(remotes, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dioDir(db), "remotes.json"), jsonString, 0644)
+	return
+}
+
+// Records the folder a database is in on a remote, for use by later pushes and pulls
+func setRemoteFolder(db, remote, folder string) error {
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return err
+	}
+	r := remotes[remote]
+	r.Folder = folder
+	remotes[remote] = r
+	return saveRemotes(db, remotes)
+}
+
+// Checks a remote name can be used.  As remote-tracking branches are named "<remote>/<branch>", the name can't have a
+// slash in it
+func validateRemoteName(name string) error {
+	if name == "" {
+		return errors.New("No remote name given")
+	}
+	if strings.ContainsAny(name, "/ \t\r\n") {
+		return errors.New("Remote names can't contain slashes or whitespace")
+	}
+	return nil
+}
+
+// Checks a folder name given on the command line, returning it in the form used on the server (eg "/finance/2024")
+func validateRemoteFolder(folder string) (string, error) {
+	if strings.ContainsAny(folder, "\\\r\n") {
+		return "", fmt.Errorf("'%s' isn't a valid folder name", folder)
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("'%s' isn't a valid folder name", folder)
+		}
+	}
+	return path.Clean("/" + folder), nil
+}
+
+// Checks the address of a remote looks like a DBHub.io cloud
+func validateRemoteURL(u string) error {
+	if u == "" {
+		return errors.New("No remote address given")
+	}
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("'%s' isn't a valid address for a DBHub.io cloud", u)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var remoteAddCmdName, remoteAddCmdURL string
+
+// Adds a remote to a database
+var remoteAddCmd = &cobra.Command{
+	Use:   "add [database name] --name xxx --url yyy",
+	Short: "Add a remote DBHub.io cloud for a database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return remoteAdd(args)
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteAddCmd)
+	remoteAddCmd.Flags().StringVar(&remoteAddCmdName, "name", "", "Name of the remote (eg mirror)")
+	remoteAddCmd.Flags().StringVar(&remoteAddCmdURL, "url", "", "Address of the DBHub.io cloud")
+}
+
+func remoteAdd(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be changed at a time (for now)")
+	}
+	err = validateRemoteName(remoteAddCmdName)
+	if err != nil {
+		return err
+	}
+	err = validateRemoteURL(remoteAddCmdURL)
+	if err != nil {
+		return err
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The default remote always exists, so can only have its address changed
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return err
+	}
+	if _, ok := remotes[remoteAddCmdName]; ok || remoteAddCmdName == DEFAULT_REMOTE {
+		return fmt.Errorf("Remote '%s' already exists.  Its address can be changed with 'dio remote set-url'",
+			remoteAddCmdName)
+	}
+	remotes[remoteAddCmdName] = remoteEntry{URL: remoteAddCmdURL}
+	err = saveRemotes(db, remotes)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Remote '%s' added for '%s', using %s\n", remoteAddCmdName, db, remoteAddCmdURL)
+	return err
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// Displays the remotes for a database
+var remoteListCmd = &cobra.Command{
+	Use:   "list [database name]",
+	Short: "Displays the remote DBHub.io clouds for a database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return remoteList(args)
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteListCmd)
+}
+
+func remoteList(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be worked with at a time (for now)")
+	}
+
+	// The default remote is always shown, even when its address hasn't been changed
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return err
+	}
+	if r := remotes[DEFAULT_REMOTE]; r.URL == "" {
+		r.URL = cloud
+		remotes[DEFAULT_REMOTE] = r
+	}
+	if structuredOutput() {
+		return writeOutput(remoteListOutput{Database: db, Remotes: remotes})
+	}
+
+	var names []string
+	for name := range remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_, err = fmt.Fprintf(fOut, "Remotes for %s:\n\n", db)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		r := remotes[name]
+		if r.Folder != "" && r.Folder != "/" {
+			_, err = fmt.Fprintf(fOut, "  * %s : %s (folder %s)\n", name, r.URL, r.Folder)
+		} else {
+			_, err = fmt.Fprintf(fOut, "  * %s : %s\n", name, r.URL)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var remoteRemoveCmdName string
+
+// Removes a remote from a database
+var remoteRemoveCmd = &cobra.Command{
+	Use:   "remove [database name] --name xxx",
+	Short: "Remove a remote DBHub.io cloud from a database",
+	Long: `Remove a remote DBHub.io cloud from a database
+
+The remote-tracking branches for the remote are removed too.  The 'origin'
+remote can't be removed, though its address can be changed with
+'dio remote set-url'.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return remoteRemove(args)
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteRemoveCmd)
+	remoteRemoveCmd.Flags().StringVar(&remoteRemoveCmdName, "name", "", "Name of the remote to remove")
+}
+
+func remoteRemove(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be changed at a time (for now)")
+	}
+	err = validateRemoteName(remoteRemoveCmdName)
+	if err != nil {
+		return err
+	}
+	if remoteRemoveCmdName == DEFAULT_REMOTE {
+		return fmt.Errorf("The '%s' remote can't be removed, though its address can be changed with 'dio remote "+
+			"set-url'", DEFAULT_REMOTE)
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return err
+	}
+	if _, ok := remotes[remoteRemoveCmdName]; !ok {
+		return fmt.Errorf("Database '%s' doesn't have a remote called '%s'", db, remoteRemoveCmdName)
+	}
+	delete(remotes, remoteRemoveCmdName)
+	err = saveRemotes(db, remotes)
+	if err != nil {
+		return err
+	}
+	err = removeRemoteTracking(db, remoteRemoveCmdName)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Remote '%s' removed from '%s'\n", remoteRemoveCmdName, db)
+	return err
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var remoteSetURLCmdName, remoteSetURLCmdURL string
+
+// Changes the address of a remote for a database
+var remoteSetURLCmd = &cobra.Command{
+	Use:   "set-url [database name] --name xxx --url yyy",
+	Short: "Change the DBHub.io cloud a remote points at",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return remoteSetURL(args)
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteSetURLCmd)
+	remoteSetURLCmd.Flags().StringVar(&remoteSetURLCmdName, "name", DEFAULT_REMOTE, "Name of the remote")
+	remoteSetURLCmd.Flags().StringVar(&remoteSetURLCmdURL, "url", "", "New address of the DBHub.io cloud")
+}
+
+func remoteSetURL(args []string) error {
+	// Ensure a database file was given
+	var db string
+	var err error
+	if len(args) == 0 {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	} else {
+		db = args[0]
+	}
+	if len(args) > 1 {
+		return errors.New("Only one database can be changed at a time (for now)")
+	}
+	err = validateRemoteName(remoteSetURLCmdName)
+	if err != nil {
+		return err
+	}
+	err = validateRemoteURL(remoteSetURLCmdURL)
+	if err != nil {
+		return err
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	remotes, err := loadRemotes(db)
+	if err != nil {
+		return err
+	}
+	if _, ok := remotes[remoteSetURLCmdName]; !ok && remoteSetURLCmdName != DEFAULT_REMOTE {
+		return fmt.Errorf("Database '%s' doesn't have a remote called '%s'.  It can be added with 'dio remote "+
+			"add'", db, remoteSetURLCmdName)
+	}
+	r := remotes[remoteSetURLCmdName]
+	r.URL = remoteSetURLCmdURL
+	remotes[remoteSetURLCmdName] = r
+	err = saveRemotes(db, remotes)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fOut, "Remote '%s' for '%s' now uses %s\n", remoteSetURLCmdName, db, remoteSetURLCmdURL)
+	return err
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	revertCommitCmdBranch, revertCommitCmdMsg                           string
+	revertCommitCmdAbort, revertCommitCmdContinue, revertCommitCmdForce bool
+)
+
+// Undoes the changes made by a single commit, with a new commit
+var revertCommitCmd = &cobra.Command{
+	Use:   "revert-commit [database name] commit [--branch xxx]",
+	Short: "Undoes the changes made by a commit, by adding a new commit",
+	Long: `Undoes the changes made by a commit, by adding a new commit
+
+The row level changes made by the commit are reversed on the head of the
+branch: inserted rows are deleted, deleted rows are inserted again, and updated
+rows get their old values back.  Schema changes are reversed too, where the
+data allows it.  The result is added to the branch as a new commit, so the
+history of the branch is left intact.  This makes it safe to use on branches
+which have already been pushed, unlike 'dio branch revert'.
+
+If the rows have been changed again since the commit, the conflicts are listed
+and the revert is paused.  Fix the conflicting rows in the working database,
+then run 'dio revert-commit --continue' to create the commit.  Alternatively,
+'dio revert-commit --abort' cancels the revert.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return revertCommit(args)
+	},
+}
+
+// Reverts are committed by the user running them, with the message chosen when the revert was started
+var revertCommitOp = changesetOp{
+	cmd:          "revert-commit",
+	name:         "revert",
+	stateFile:    "revert.json",
+	reverse:      true,
+	conflictsMsg: "Reverting commit %s on branch '%s' has conflicts:\n\n",
+	cancelledMsg: "Revert of commit %s on branch '%s' cancelled\n",
+	doneMsg:      "Commit %s reverted on branch '%s'\n",
+	newCommit: func(meta metaData, state changesetState) (commitEntry, error) {
+		var name, email string
+		if z, ok := viper.Get("user.name").(string); ok {
+			name = z
+		}
+		if z, ok := viper.Get("user.email").(string); ok {
+			email = z
+		}
+		if name == "" || email == "" {
+			return commitEntry{}, errors.New("Author and committer name and email addresses are required!")
+		}
+		return commitEntry{
+			AuthorName:     name,
+			AuthorEmail:    email,
+			CommitterName:  name,
+			CommitterEmail: email,
+			Message:        state.Message,
+			Timestamp:      time.Now().UTC(),
+		}, nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(revertCommitCmd)
+	revertCommitCmd.Flags().BoolVar(&revertCommitCmdAbort, "abort", false, "Cancel an in-progress revert")
+	revertCommitCmd.Flags().StringVar(&revertCommitCmdBranch, "branch", "",
+		"Branch to add the new commit to (default is the active branch)")
+	revertCommitCmd.Flags().BoolVar(&revertCommitCmdContinue, "continue", false,
+		"Create the commit, after conflicts have been resolved")
+	revertCommitCmd.Flags().BoolVarP(&revertCommitCmdForce, "force", "f", false,
+		"Overwrite unsaved changes to the database?")
+	revertCommitCmd.Flags().StringVar(&revertCommitCmdMsg, "message", "", "Commit message for the new commit")
+}
+
+func revertCommit(args []string) error {
+	if revertCommitCmdAbort && revertCommitCmdContinue {
+		return errors.New("Either --abort or --continue can be given.  Not both!")
+	}
+
+	// Work out the database name and commit.  When only one argument is given it's the commit, unless an in-progress
+	// revert is being continued or aborted (in which case no commit is needed)
+	var db, ref string
+	var err error
+	switch len(args) {
+	case 0:
+	case 1:
+		if revertCommitCmdAbort || revertCommitCmdContinue {
+			db = args[0]
+		} else {
+			ref = args[0]
+		}
+	case 2:
+		db = args[0]
+		ref = args[1]
+	default:
+		return errors.New("Only one database and commit can be reverted at a time")
+	}
+	if db == "" {
+		db, err = getDefaultDatabase()
+		if err != nil {
+			return err
+		}
+		if db == "" {
+			// No database name was given on the command line, and we don't have a default database selected
+			return errNoDatabase
+		}
+	}
+
+	// Stop other dio processes from changing the database at the same time
+	unlock, err := lockDatabase(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if revertCommitCmdAbort {
+		return abortChangeset(db, revertCommitOp)
+	}
+	if revertCommitCmdContinue {
+		return continueChangeset(db, revertCommitOp)
+	}
+	if ref == "" {
+		return errors.New("No commit given")
+	}
+
+	// Make sure there isn't already a merge, rebase, cherry-pick, or revert underway
+	err = checkInProgress(db)
+	if err != nil {
+		return err
+	}
+
+	// Load the metadata
+	meta, err := loadMetadata(db)
+	if err != nil {
+		return err
+	}
+	commitID, err := resolveCommit(meta, ref)
+	if err != nil {
+		return err
+	}
+	reverted := meta.Commits[commitID]
+	if reverted.Parent == "" {
+		return fmt.Errorf("Commit '%s' is the first commit in its history, so can't be reverted", commitID)
+	}
+
+	// If no branch was given, use the active branch.  The commit needs to be part of its history
+	branch := revertCommitCmdBranch
+	if branch == "" {
+		branch = meta.ActiveBranch
+	}
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+	history, err := commitHistory(meta, head.Commit)
+	if err != nil {
+		return err
+	}
+	if _, ok = history[commitID]; !ok {
+		return fmt.Errorf("Commit %s isn't part of branch '%s'", commitID, branch)
+	}
+
+	// Unless --force is specified, check whether the file has changed since the last commit, and let the user know
+	if !revertCommitCmdForce {
+		changed, err := dbChanged(db, meta)
+		if err != nil {
+			return err
+		}
+		if changed {
+			_, err = fmt.Fprintf(fOut, "%s has been changed since the last commit.  Use --force if you "+
+				"really want to overwrite it\n", db)
+			return err
+		}
+	}
+
+	// Start from the head of the branch, then apply the changes from the commit back to its parent
+	msg := revertCommitCmdMsg
+	if msg == "" {
+		msg = fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.", reverted.Message, commitID)
+	}
+	return applyChangeset(db, meta, revertCommitOp, changesetState{
+		Branch:  branch,
+		Commit:  commitID,
+		Head:    head.Commit,
+		Message: msg,
+	})
+}
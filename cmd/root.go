@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 
 	"github.com/mitchellh/go-homedir"
@@ -25,6 +27,7 @@ var (
 	cfgFile, cloud string
 	fOut           = io.Writer(os.Stdout)
 	numFormat      *message.Printer
+	profileName    string
 	TLSConfig      tls.Config
 )
 
@@ -36,6 +39,9 @@ var RootCmd = &cobra.Command{
 
 With dio you can send and receive database files to a DBHub.io cloud,
 and manipulate its tags and branches.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkOutputFormat()
+	},
 	SilenceErrors: true,
 	SilenceUsage:  true,
 }
@@ -43,8 +49,13 @@ and manipulate its tags and branches.`,
 // Execute adds all child commands to the root command & sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+	// Cancel any transfers in progress if the user interrupts us
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := RootCmd.ExecuteContext(ctx); err != nil {
+		if errOut := writeError(err); errOut != nil {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
 }
@@ -63,8 +74,17 @@ func init() {
 		fmt.Sprintf("config file (default is %s)", filepath.Join("$HOME", ".dio", "config.toml")))
 	RootCmd.PersistentFlags().StringVar(&cloud, "cloud", "https://db4s.dbhub.io",
 		"Address of the DBHub.io cloud")
+	RootCmd.PersistentFlags().StringVar(&outputFormat, "output", OUTPUT_TEXT,
+		fmt.Sprintf("Output format for command results (%s, %s or %s)", OUTPUT_TEXT, OUTPUT_JSON, OUTPUT_YAML))
+	RootCmd.PersistentFlags().StringVar(&profileName, "profile", "",
+		"Profile from the config file to use, instead of the one selected for this directory")
+
+	// The configuration is read once the command line has been parsed, so --config and --profile can be used
+	cobra.OnInitialize(loadConfig)
+}
 
-	// Read all of our configuration data now
+// Reads all of our configuration data, and sets up the connection to DBHub.io for the selected profile
+func loadConfig() {
 	if cfgFile != "" {
 		// Use config file from the flag
 		viper.SetConfigFile(cfgFile)
@@ -97,6 +117,19 @@ func init() {
 		return
 	}
 
+	// Use the settings of the selected profile, in place of the ones at the top level of the config file
+	profile, err := selectedProfile()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = applyProfile(profile)
+	if err != nil && profileName == "" {
+		log.Fatalf("%s.  It's selected for this directory in %s", err, filepath.Join(".dio", "defaults.json"))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Make sure the paths to our CA Chain and user certificate have been set
 	if found := viper.IsSet("certs.cachain"); found == false {
 		log.Fatal("Path to Certificate Authority chain file not set in the config file")
@@ -107,9 +140,9 @@ func init() {
 		return
 	}
 
-	// If an alternative DBHub.io cloud address is set in the config file, use that
-	if found := viper.IsSet("general.cloud"); found == true {
-		// If the user provided an override on the command line, that will override this anyway
+	// If an alternative DBHub.io cloud address is set in the config file, use that.  An address given on the command
+	// line overrides it
+	if found := viper.IsSet("general.cloud"); found == true && !RootCmd.PersistentFlags().Changed("cloud") {
 		cloud = viper.GetString("general.cloud")
 	}
 
@@ -147,11 +180,14 @@ func init() {
 		RootCAs:                  ourCAPool,
 	}
 
-	// Extract the username and email from the TLS certificate
+	// Extract the username and email from the TLS certificate.  A profile can give a different email address for
+	// commits
 	var email string
 	certUser, email, _, err = getUserAndServer()
 	if err != nil {
 		log.Fatal(err)
 	}
-	viper.Set("user.email", email)
+	if profile == "" || !viper.IsSet(profileKey(profile, "email")) {
+		viper.Set("user.email", email)
+	}
 }
@@ -1,7 +1,7 @@
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -9,89 +9,111 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/mitchellh/go-homedir"
 	rq "github.com/parnurzeal/gorequest"
+	"github.com/sqlitebrowser/dio/client"
 )
 
-// Check if the database with the given SHA256 checksum is in local cache.  If it's not then download and cache it
-func checkDBCache(db, shaSum string) (err error) {
-	if _, err = os.Stat(filepath.Join(".dio", db, "db", shaSum)); os.IsNotExist(err) {
-		var body []byte
-		_, body, err = retrieveDatabase(db, pullCmdBranch, pullCmdCommit)
+// Check if the database with the given SHA256 checksum is in local cache.  If it's not then download (using the given
+// commit ID) and cache it
+func checkDBCache(db, commit, shaSum string) (err error) {
+	if !cacheExists(db, shaSum) {
+		var thisSum string
+		_, thisSum, err = retrieveDatabase(fOut, db, "", commit, shaSum)
 		if err != nil {
 			return
 		}
 
-		// Verify the SHA256 checksum of the new download
-		s := sha256.Sum256(body)
-		thisSum := hex.EncodeToString(s[:])
+		// Verify the SHA256 checksum of the new download.  A mismatched one isn't added to the cache, so there's
+		// nothing to clean up
 		if thisSum != shaSum {
-			// The newly downloaded database file doesn't have the expected checksum.  Abort.
 			return errors.New(fmt.Sprintf("Aborting: newly downloaded database file should have "+
 				"checksum '%s', but data with checksum '%s' received\n", shaSum, thisSum))
 		}
+	}
+	return
+}
 
-		// Write the database file to disk in the cache directory
-		err = ioutil.WriteFile(filepath.Join(".dio", db, "db", shaSum), body, 0644)
+// Returns the context for the running command.  It's cancelled if the user interrupts dio, so network transfers
+// stop promptly
+func cmdContext() context.Context {
+	if ctx := RootCmd.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// Returns the IDs of a commit and all of its ancestors, including those from any merged in branches
+func commitHistory(meta metaData, commitID string) (history map[string]struct{}, err error) {
+	history = make(map[string]struct{})
+	queue := []string{commitID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := history[id]; ok {
+			continue
+		}
+		c, ok := meta.Commits[id]
+		if !ok {
+			err = fmt.Errorf("Broken commit history: commit '%s' isn't in the local commit cache", id)
+			return
+		}
+		history[id] = struct{}{}
+		if c.Parent != "" {
+			queue = append(queue, c.Parent)
+		}
+		queue = append(queue, c.OtherParents...)
 	}
 	return
 }
 
-// Generate a stable SHA256 for a commit.
-func createCommitID(c commitEntry) string {
-	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("tree %s\n", c.Tree.ID))
-	if c.Parent != "" {
-		b.WriteString(fmt.Sprintf("parent %s\n", c.Parent))
-	}
-	for _, j := range c.OtherParents {
-		b.WriteString(fmt.Sprintf("parent %s\n", j))
-	}
-	b.WriteString(fmt.Sprintf("author %s <%s> %v\n", c.AuthorName, c.AuthorEmail,
-		c.Timestamp.UTC().Format(time.UnixDate)))
-	if c.CommitterEmail != "" {
-		b.WriteString(fmt.Sprintf("committer %s <%s> %v\n", c.CommitterName, c.CommitterEmail,
-			c.Timestamp.UTC().Format(time.UnixDate)))
-	}
-	b.WriteString("\n" + c.Message)
-	b.WriteByte(0)
-	s := sha256.Sum256(b.Bytes())
-	return hex.EncodeToString(s[:])
+// Copies a commit and all of its ancestors (including those from any merged in branches) from one set of commits to
+// another.  Commits missing from the source are skipped, as are those the destination already has
+func copyCommitHistory(dst, src map[string]commitEntry, commitID string) {
+	queue := []string{commitID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := dst[id]; ok {
+			continue
+		}
+		c, ok := src[id]
+		if !ok {
+			continue
+		}
+		dst[id] = c
+		if c.Parent != "" {
+			queue = append(queue, c.Parent)
+		}
+		queue = append(queue, c.OtherParents...)
+	}
 }
 
-// Generate the SHA256 for a tree.
-// Tree entry structure is:
-// * [ entry type ] [ licence sha256] [ file sha256 ] [ file name ] [ last modified (timestamp) ] [ file size (bytes) ]
-func createDBTreeID(entries []dbTreeEntry) string {
-	var b bytes.Buffer
-	for _, j := range entries {
-		b.WriteString(string(j.EntryType))
-		b.WriteByte(0)
-		b.WriteString(string(j.LicenceSHA))
-		b.WriteByte(0)
-		b.WriteString(j.Sha256)
-		b.WriteByte(0)
-		b.WriteString(j.Name)
-		b.WriteByte(0)
-		b.WriteString(j.LastModified.Format(time.RFC3339))
-		b.WriteByte(0)
-		b.WriteString(fmt.Sprintf("%d\n", j.Size))
-	}
-	s := sha256.Sum256(b.Bytes())
-	return hex.EncodeToString(s[:])
+// Copies a file, streaming it rather than reading it all into memory.  The destination is written atomically
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	return writeAtomic(dst, 0644, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
 }
 
-// Returns true if a database has been changed on disk since the last commit
+// Returns true if a database (or a file committed along with it) has been changed on disk since the last commit
 func dbChanged(db string, meta metaData) (changed bool, err error) {
 	// Retrieve the sha256, file size, and last modified date from the head commit of the active branch
 	head, ok := meta.Branches[meta.ActiveBranch]
@@ -104,9 +126,13 @@ func dbChanged(db string, meta metaData) (changed bool, err error) {
 		err = errors.New("Aborting: info for the head commit isn't found in the local commit cache")
 		return
 	}
-	metaSHASum := c.Tree.Entries[0].Sha256
-	metaFileSize := c.Tree.Entries[0].Size
-	metaLastModified := c.Tree.Entries[0].LastModified.Truncate(time.Second).UTC()
+	dbEntry, err := commitDBEntry(c, db)
+	if err != nil {
+		return
+	}
+	metaSHASum := dbEntry.Sha256
+	metaFileSize := dbEntry.Size
+	metaLastModified := dbEntry.LastModified.Truncate(time.Second).UTC()
 
 	// If the file size or last modified date in the metadata are different from the current file info, then the
 	// local file has probably changed.  Well, "probably" for the last modified day, but "definitely" if the file
@@ -125,56 +151,120 @@ func dbChanged(db string, meta metaData) (changed bool, err error) {
 		return
 	}
 
-	// * If the file size and last modified date are still the same, we SHA256 checksum and compare the file *
-
-	// TODO: Should we only do this for smaller files (below some TBD threshold)?
-
-	// Read the database from disk, and calculate it's sha256
-	b, err := ioutil.ReadFile(db)
+	// * If the file size and last modified date are still the same, we check the SHA256 of the file.  This comes
+	//   from the stat cache when the file hasn't been touched since it was last hashed *
+	shaSum, err := cachedFileSHA256(db)
 	if err != nil {
 		return
 	}
-	if int64(len(b)) != fileSize {
-		err = errors.New(numFormat.Sprintf("Aborting: # of bytes read (%d) when reading the database "+
-			"doesn't match the database file size (%d)", len(b), fileSize))
-		return
-	}
-	s := sha256.Sum256(b)
-	shaSum := hex.EncodeToString(s[:])
 
 	// Check if a change has been made
 	if metaSHASum != shaSum {
 		changed = true
+		return
 	}
-	return
+
+	// The database itself is unchanged, so check the files committed along with it
+	return attachmentsChanged(db, c)
 }
 
-// Retrieves the list of databases available to the user
-var getDatabases = func(url string, user string) (dbList []dbListEntry, err error) {
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).
-		Get(fmt.Sprintf("%s/%s", url, user)).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		EndBytes()
-	if errs != nil {
-		e := fmt.Sprintln("Errors when retrieving the database list:")
-		for _, err := range errs {
-			e += fmt.Sprintf(err.Error())
-		}
-		err = errors.New(e)
+// Returns the directory holding the metadata and cache for a database.  Databases in folders (eg "finance/q1.sqlite")
+// get a directory named after their whole path with the slashes escaped, so databases with the same name in
+// different folders don't collide
+func dioDir(db string) string {
+	name := filepath.ToSlash(filepath.Clean(db))
+	name = strings.ReplaceAll(name, "%", "%25")
+	name = strings.ReplaceAll(name, "/", "%2F")
+	return filepath.Join(".dio", name)
+}
+
+// Returns the most recent commit which is an ancestor of both of the given commits.  A commit counts as being its own
+// ancestor, so if one commit is an ancestor of the other then that one is returned
+func findCommonAncestor(meta metaData, commitA, commitB string) (ancestor string, err error) {
+	// Gather the complete history of the first commit, including any merged in branches
+	historyA, err := commitHistory(meta, commitA)
+	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
-	err = json.Unmarshal(body, &dbList)
-	if err != nil {
-		_, errInner := fmt.Fprintf(fOut, "Error retrieving database list: '%v'\n", err.Error())
-		if errInner != nil {
-			err = fmt.Errorf("%s: %s", err, errInner)
+
+	// Walk backwards through the history of the second commit, stopping at the first commit also in the first history
+	seen := make(map[string]struct{})
+	queue := []string{commitB}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if _, ok := historyA[id]; ok {
+			return id, nil
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		c, ok := meta.Commits[id]
+		if !ok {
+			err = fmt.Errorf("Broken commit history: commit '%s' isn't in the local commit cache", id)
 			return
 		}
+		if c.Parent != "" {
+			queue = append(queue, c.Parent)
+		}
+		queue = append(queue, c.OtherParents...)
 	}
+	err = errors.New("The commits don't have any history in common")
 	return
 }
 
+// Returns the tags and releases which would become unreachable if the given commits were removed from a branch.  Tags
+// and releases on those commits are fine if the commit is still part of another branch's history
+func findIsolatedTagsReleases(meta metaData, branch string, delList map[string]struct{}) (isolatedTags,
+	isolatedReleases []string, err error) {
+	// Gather the commits which are still reachable from the other branches
+	reachable := make(map[string]struct{})
+	for bName, bEntry := range meta.Branches {
+		if bName == branch {
+			// We only run this comparison from "other branches", not the branch whose history is being changed
+			continue
+		}
+		var history map[string]struct{}
+		history, err = commitHistory(meta, bEntry.Commit)
+		if err != nil {
+			err = fmt.Errorf("Broken commit history encountered when checking for isolated tags and releases "+
+				"in branch '%s': %s", bName, err)
+			return
+		}
+		for id := range history {
+			reachable[id] = struct{}{}
+		}
+	}
+
+	// Any tag or release on a commit being removed, which isn't reachable from elsewhere, would be isolated
+	for tName, tEntry := range meta.Tags {
+		_, del := delList[tEntry.Commit]
+		_, ok := reachable[tEntry.Commit]
+		if del && !ok {
+			isolatedTags = append(isolatedTags, tName)
+		}
+	}
+	for rName, rEntry := range meta.Releases {
+		_, del := delList[rEntry.Commit]
+		_, ok := reachable[rEntry.Commit]
+		if del && !ok {
+			isolatedReleases = append(isolatedReleases, rName)
+		}
+	}
+	sort.Strings(isolatedTags)
+	sort.Strings(isolatedReleases)
+	return
+}
+
+// Retrieves the list of databases available to the user
+var getDatabases = func(url string, user string) (dbList []dbListEntry, err error) {
+	cl := newClient()
+	cl.BaseURL = url
+	cl.User = user
+	return cl.Databases(cmdContext())
+}
+
 // Generates an initial default (production) configuration file.  Before it's useful, the user will need to fill out
 // their display name + provide a DB4S certificate file
 func generateConfig(cfgFile string) (err error) {
@@ -205,79 +295,43 @@ func generateConfig(cfgFile string) (err error) {
 		return errors.New(e)
 	}
 	defer resp.Body.Close()
-	err = ioutil.WriteFile(chainFile, body, 0644)
+	err = writeFileAtomic(chainFile, body, 0644)
 	if err != nil {
 		return err
 	}
 
 	// Generate the initial config file
-	var f *os.File
-	f, err = os.Create(cfgFile)
-	if err != nil {
-		return
-	}
-	defer f.Close()
 	lineEnd := "\n"
 	if runtime.GOOS == "windows" {
 		lineEnd = "\r\n"
 	}
 	certPath := fmt.Sprintf("%c%s", os.PathSeparator, filepath.Join("path", "to", "your", "certificate", "here"))
-	_, err = fmt.Fprint(f, `[certs]`+lineEnd)
-	_, err = fmt.Fprint(f, fmt.Sprintf(`cachain = '%s'%s`, chainFile, lineEnd))
-	_, err = fmt.Fprint(f, fmt.Sprintf(`cert = '%s'%s`, certPath, lineEnd))
-	_, err = fmt.Fprint(f, lineEnd)
-	_, err = fmt.Fprint(f, `[general]`+lineEnd)
-	_, err = fmt.Fprint(f, `cloud = 'https://db4s.dbhub.io'`+lineEnd)
-	_, err = fmt.Fprint(f, lineEnd)
-	_, err = fmt.Fprint(f, `[user]`+lineEnd)
-	_, err = fmt.Fprint(f, `name = 'Your Name'`+lineEnd)
-	return
+	return writeAtomic(cfgFile, 0644, func(f io.Writer) (err error) {
+		_, err = fmt.Fprint(f, `[certs]`+lineEnd)
+		_, err = fmt.Fprint(f, fmt.Sprintf(`cachain = '%s'%s`, chainFile, lineEnd))
+		_, err = fmt.Fprint(f, fmt.Sprintf(`cert = '%s'%s`, certPath, lineEnd))
+		_, err = fmt.Fprint(f, lineEnd)
+		_, err = fmt.Fprint(f, `[general]`+lineEnd)
+		_, err = fmt.Fprint(f, `cloud = 'https://db4s.dbhub.io'`+lineEnd)
+		_, err = fmt.Fprint(f, lineEnd)
+		_, err = fmt.Fprint(f, `[user]`+lineEnd)
+		_, err = fmt.Fprint(f, `name = 'Your Name'`+lineEnd)
+		return
+	})
 }
 
 // Returns the name of the default database, if one has been selected.  Returns an empty string if not
 func getDefaultDatabase() (db string, err error) {
-	// Check if the local defaults info exists
-	var z []byte
-	if z, err = ioutil.ReadFile(filepath.Join(".dio", "defaults.json")); err != nil {
-		if os.IsNotExist(err) {
-			return "", nil
-		}
-		return
-	}
-
-	// Read and parse the metadata
-	var y defaultSettings
-	err = json.Unmarshal([]byte(z), &y)
+	def, err := loadDefaults()
 	if err != nil {
 		return
 	}
-	if y.SelectedDatabase != "" {
-		db = y.SelectedDatabase
-	}
-	return
+	return def.SelectedDatabase, nil
 }
 
 // Returns a map with the list of licences available on the remote server
 var getLicences = func() (list map[string]licenceEntry, err error) {
-	// Retrieve the database list from the cloud
-	resp, body, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/licence/list").
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
-	if errs != nil {
-		e := fmt.Sprintln("errors when retrieving the licence list:")
-		for _, err := range errs {
-			e += fmt.Sprintf(err.Error())
-		}
-		return list, errors.New(e)
-	}
-	defer resp.Body.Close()
-
-	// Convert the JSON response to our licence entry structure
-	err = json.Unmarshal([]byte(body), &list)
-	if err != nil {
-		return list, errors.New(fmt.Sprintf("error retrieving licence list: '%v'\n", err.Error()))
-	}
-	return list, err
+	return newClient().Licences(cmdContext())
 }
 
 // getUserAndServer() returns the user name and server from a DBHub.io client certificate
@@ -287,8 +341,7 @@ func getUserAndServer() (userAcc string, email string, certServer string, err er
 		return
 	}
 
-	// Parse the client certificate
-	// TODO: Add support for multiple certificates
+	// Parse the client certificate.  Each profile in the config file has its own certificate, so there's only the one
 	cert, err := x509.ParseCertificate(TLSConfig.Certificates[0].Certificate[0])
 	if err != nil {
 		err = errors.New("Couldn't parse cert")
@@ -317,6 +370,20 @@ func getUserAndServer() (userAcc string, email string, certServer string, err er
 	return
 }
 
+// Loads the per-directory default settings, such as the default database.  If none have been saved, the returned
+// settings are empty
+func loadDefaults() (def defaultSettings, err error) {
+	z, err := ioutil.ReadFile(filepath.Join(".dio", "defaults.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(z, &def)
+	return
+}
+
 // Loads the local metadata from disk (if present).  If not, then grab it from the remote server, storing it locally.
 //     Note - This is subtly different than calling updateMetadata() itself.  This function
 //     (loadMetadata()) is for use by commands which can use a local metadata cache all by itself
@@ -324,8 +391,8 @@ func getUserAndServer() (userAcc string, email string, certServer string, err er
 //     remote server when a local metadata cache doesn't exist.
 func loadMetadata(db string) (meta metaData, err error) {
 	// Check if the local metadata exists.  If not, pull it from the remote server
-	if _, err = os.Stat(filepath.Join(".dio", db, "metadata.json")); os.IsNotExist(err) {
-		_, err = updateMetadata(db, true)
+	if _, err = os.Stat(filepath.Join(dioDir(db), "metadata.json")); os.IsNotExist(err) {
+		_, err = updateMetadata(fOut, db, true)
 		if err != nil {
 			return
 		}
@@ -333,7 +400,7 @@ func loadMetadata(db string) (meta metaData, err error) {
 
 	// Read and parse the metadata
 	var md []byte
-	md, err = ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
+	md, err = ioutil.ReadFile(filepath.Join(dioDir(db), "metadata.json"))
 	if err != nil {
 		return
 	}
@@ -355,7 +422,7 @@ func loadMetadata(db string) (meta metaData, err error) {
 //   Note - this is suitable for use by read-only functions (eg: branch/tag list, log)
 //   as it doesn't store or change any metadata on disk
 var localFetchMetadata = func(db string, getRemote bool) (meta metaData, err error) {
-	md, err := ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
+	md, err := ioutil.ReadFile(filepath.Join(dioDir(db), "metadata.json"))
 	if err == nil {
 		err = json.Unmarshal([]byte(md), &meta)
 		return
@@ -372,353 +439,248 @@ var localFetchMetadata = func(db string, getRemote bool) (meta metaData, err err
 	return
 }
 
-// Merges old and new metadata
-func mergeMetadata(origMeta metaData, newMeta metaData) (mergedMeta metaData, err error) {
-	mergedMeta.Branches = make(map[string]branchEntry)
-	mergedMeta.Commits = make(map[string]commitEntry)
-	mergedMeta.Tags = make(map[string]tagEntry)
-	mergedMeta.Releases = make(map[string]releaseEntry)
-	if len(origMeta.Commits) > 0 {
-		// Start by check branches which exist locally
-		// TODO: Change sort order to be by alphabetical branch name, as the current unordered approach leads to
-		//       inconsistent output across runs
-		for brName, brData := range origMeta.Branches {
-			matchFound := false
-			for newBranch, newData := range newMeta.Branches {
-				if brName == newBranch {
-					// A branch with this name exists on both the local and remote server
-					matchFound = true
-					skipFurtherChecks := false
-
-					// Rewind back to the local root commit, making a list of the local commits IDs we pass through
-					var localList []string
-					localCommit := origMeta.Commits[brData.Commit]
-					localList = append(localList, localCommit.ID)
-					for localCommit.Parent != "" {
-						localCommit = origMeta.Commits[localCommit.Parent]
-						localList = append(localList, localCommit.ID)
-					}
-					localLength := len(localList) - 1
-
-					// Rewind back to the remote root commit, making a list of the remote commit IDs we pass through
-					var remoteList []string
-					remoteCommit := newMeta.Commits[newData.Commit]
-					remoteList = append(remoteList, remoteCommit.ID)
-					for remoteCommit.Parent != "" {
-						remoteCommit = newMeta.Commits[remoteCommit.Parent]
-						remoteList = append(remoteList, remoteCommit.ID)
-					}
-					remoteLength := len(remoteList) - 1
-
-					// Make sure the local and remote commits start out with the same commit ID
-					if localCommit.ID != remoteCommit.ID {
-						// The local and remote branches don't have a common root, so abort
-						err = errors.New(fmt.Sprintf("Local and remote branch %s don't have a common root.  "+
-							"Aborting.", brName))
-						return
-					}
-
-					// If there are more commits in the local branch than in the remote one, we keep the local branch
-					// as it probably means the user is adding stuff locally (prior to pushing to the server)
-					if localLength > remoteLength {
-						c := origMeta.Commits[brData.Commit]
-						mergedMeta.Commits[c.ID] = origMeta.Commits[c.ID]
-						for c.Parent != "" {
-							c = origMeta.Commits[c.Parent]
-							mergedMeta.Commits[c.ID] = origMeta.Commits[c.ID]
-						}
-
-						// Copy the local branch data
-						mergedMeta.Branches[brName] = brData
-					}
-
-					// We've wound back to the root commit for both the local and remote branch, and the root commit
-					// IDs match.  Now we walk forwards through the commits, comparing them.
-					branchesSame := true
-					for i := 0; i <= localLength; i++ {
-						lCommit := localList[localLength-i]
-						if i > remoteLength {
-							branchesSame = false
-						} else {
-							if lCommit != remoteList[remoteLength-i] {
-								// There are conflicting commits in this branch between the local metadata and the
-								// remote.  This will probably need to be resolved by user action.
-								branchesSame = false
-							}
-						}
-					}
-
-					// If the local branch commits are in the remote branch already, then we only need to check for
-					// newer commits in the remote branch
-					if branchesSame {
-						if remoteLength > localLength {
-							_, err = fmt.Fprintf(fOut, "  * Remote branch '%s' has %d new commit(s)... merged\n",
-								brName, remoteLength-localLength)
-							if err != nil {
-								return
-							}
-							for _, j := range remoteList {
-								mergedMeta.Commits[j] = newMeta.Commits[j]
-							}
-							mergedMeta.Branches[brName] = newMeta.Branches[brName]
-						} else {
-							// The local and remote branches are the same, so copy the local branch commits across to
-							// the merged data structure
-							_, err = fmt.Fprintf(fOut, "  * Branch '%s' is unchanged\n", brName)
-							if err != nil {
-								return
-							}
-							for _, j := range localList {
-								mergedMeta.Commits[j] = origMeta.Commits[j]
-							}
-							mergedMeta.Branches[brName] = brData
-						}
-						// No need to do further checks on this branch
-						skipFurtherChecks = true
-					}
-
-					if skipFurtherChecks == false && brData.Commit != newData.Commit {
-						_, err = fmt.Fprintf(fOut, "  * Branch '%s' has local changes, not on the server\n",
-							brName)
-						if err != nil {
-							return
-						}
-
-						// Copy across the commits from the local branch
-						localCommit := origMeta.Commits[brData.Commit]
-						mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-						for localCommit.Parent != "" {
-							localCommit = origMeta.Commits[localCommit.Parent]
-							mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-						}
-
-						// Copy across the branch data entry for the local branch
-						mergedMeta.Branches[brName] = brData
-					}
-					if skipFurtherChecks == false && brData.Description != newData.Description {
-						_, err = fmt.Fprintf(fOut, "  * Description for branch %s differs between the local "+
-							"and remote\n"+
-							"    * Local: '%s'\n"+
-							"    * Remote: '%s'\n", brName, brData.Description, newData.Description)
-						if err != nil {
-							return
-						}
-					}
-				}
-			}
-			if !matchFound {
-				// This seems to be a branch that's not on the server, so we keep it as-is
-				_, err = fmt.Fprintf(fOut, "  * Branch '%s' is local only, not on the server\n", brName)
-				if err != nil {
-					return
-				}
-				mergedMeta.Branches[brName] = brData
-
-				// Copy across the commits from the local branch
-				localCommit := origMeta.Commits[brData.Commit]
-				mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-				for localCommit.Parent != "" {
-					localCommit = origMeta.Commits[localCommit.Parent]
-					mergedMeta.Commits[localCommit.ID] = origMeta.Commits[localCommit.ID]
-				}
-
-				// Copy across the branch data entry for the local branch
-				mergedMeta.Branches[brName] = brData
-			}
-		}
+// Merges old and new metadata, with any messages about the changes being written to out
+func mergeMetadata(out io.Writer, origMeta metaData, newMeta metaData) (mergedMeta metaData, err error) {
+	// The tags and releases merge against those on the remote being pulled from, as of the last fetch
+	var base remoteRefs
+	base.Tags, base.Releases = remoteTagsReleases(origMeta, selectedRemote)
+	mergedMeta.MetaData, err = newClientWriter(out).MergeMetadata(origMeta.MetaData, newMeta.MetaData, base)
+	if err != nil {
+		return
+	}
 
-		// Add new branches
-		for remoteName, remoteData := range newMeta.Branches {
-			if _, ok := origMeta.Branches[remoteName]; ok == false {
-				// Copy their commit data
-				newCommit := newMeta.Commits[remoteData.Commit]
-				mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
-				for newCommit.Parent != "" {
-					newCommit = newMeta.Commits[newCommit.Parent]
-					mergedMeta.Commits[newCommit.ID] = newMeta.Commits[newCommit.ID]
-				}
-
-				// Copy their branch data
-				mergedMeta.Branches[remoteName] = remoteData
-
-				_, err = fmt.Fprintf(fOut, "  * New remote branch '%s' merged\n", remoteName)
-				if err != nil {
-					return
-				}
-			}
-		}
+	// Keep the active (local) branch, using the default branch on the server if one hasn't been set
+	mergedMeta.ActiveBranch = origMeta.ActiveBranch
+	if mergedMeta.ActiveBranch == "" {
+		mergedMeta.ActiveBranch = newMeta.DefBranch
+	}
 
-		// Preserve existing tags
-		for tagName, tagData := range origMeta.Tags {
-			mergedMeta.Tags[tagName] = tagData
-		}
+	// Keep the remote-tracking branches separate from the local ones, so it's clear what the server has
+	mergedMeta.OtherRemotes = origMeta.OtherRemotes
+	mergedMeta.RemoteBranches = origMeta.RemoteBranches
+	mergedMeta.RemoteReleases = origMeta.RemoteReleases
+	mergedMeta.RemoteTags = origMeta.RemoteTags
+	setRemoteBranches(&mergedMeta, selectedRemote, newMeta.Branches)
+	setRemoteTagsReleases(&mergedMeta, selectedRemote, newMeta)
 
-		// Add new tags
-		for tagName, tagData := range newMeta.Tags {
-			// Only add tags which aren't already in the merged metadata structure
-			if _, tagFound := mergedMeta.Tags[tagName]; tagFound == false {
-				// Also make sure its commit is in the commit list.  If it's not, then skip adding the tag
-				if _, commitFound := mergedMeta.Commits[tagData.Commit]; commitFound == true {
-					_, err = fmt.Fprintf(fOut, "  * New tag '%s' merged\n", tagName)
-					if err != nil {
-						return
-					}
-					mergedMeta.Tags[tagName] = tagData
-				}
-			}
-		}
+	// The merge only keeps the commits of the local branches.  The remote-tracking branches need theirs too, which
+	// for diverged branches (and the other remotes) aren't part of the local history
+	for _, br := range newMeta.Branches {
+		copyCommitHistory(mergedMeta.Commits, newMeta.Commits, br.Commit)
+	}
+	for _, br := range mergedMeta.RemoteBranches {
+		copyCommitHistory(mergedMeta.Commits, origMeta.Commits, br.Commit)
+	}
+	return
+}
 
-		// Preserve existing releases
-		for relName, relData := range origMeta.Releases {
-			mergedMeta.Releases[relName] = relData
-		}
+// Returns a client for the DBHub.io cloud, using the current settings
+func newClient() *client.Client {
+	return newClientWriter(fOut)
+}
 
-		// Add new releases
-		for relName, relData := range newMeta.Releases {
-			// Only add releases which aren't already in the merged metadata structure
-			if _, relFound := mergedMeta.Releases[relName]; relFound == false {
-				// Also make sure its commit is in the commit list.  If it's not, then skip adding the release
-				if _, commitFound := mergedMeta.Commits[relData.Commit]; commitFound == true {
-					_, err = fmt.Fprintf(fOut, "  * New release '%s' merged\n", relName)
-					if err != nil {
-						return
-					}
-					mergedMeta.Releases[relName] = relData
-				}
-			}
-		}
+// Returns a client for the DBHub.io cloud which displays its messages and progress on out
+func newClientWriter(out io.Writer) *client.Client {
+	cl := client.New(cloud, &TLSConfig, certUser)
+	cl.Logger = log.New(out, "", 0)
+	cl.NewProgress = func(desc string, total int64) client.Progress {
+		return newProgressBar(out, desc, total)
+	}
+	cl.UploadAttempts = uploadAttempts
+	cl.UploadRetryDelay = uploadRetryDelay
+	cl.UserAgent = fmt.Sprintf("Dio %s", DIO_VERSION)
+	return cl
+}
 
-		// Copy the default branch name from the remote server
-		mergedMeta.DefBranch = newMeta.DefBranch
+// Returns a client for the remote a database is pushed to and pulled from (as chosen with --remote), which displays
+// its messages and progress on out.  The path of the database on the remote is returned too, for passing to the client
+func newRemoteClient(out io.Writer, db string) (cl *client.Client, remoteDB string, err error) {
+	remoteCloud, err := remoteURL(db, selectedRemote)
+	if err != nil {
+		return
+	}
+	remoteDB, err = remoteDatabase(db, selectedRemote)
+	if err != nil {
+		return
+	}
+	cl = newClientWriter(out)
+	cl.BaseURL = remoteCloud
+	return
+}
 
-		// If an active (local) branch has been set, then copy it to the merged metadata.  Otherwise use the default
-		// branch as given by the remote server
-		if origMeta.ActiveBranch != "" {
-			mergedMeta.ActiveBranch = origMeta.ActiveBranch
-		} else {
-			mergedMeta.ActiveBranch = newMeta.DefBranch
-		}
+// Resolves a user provided commit ID, branch name, tag name, or release name to the commit ID it refers to
+func resolveCommit(meta metaData, ref string) (commitID string, err error) {
+	if ref == "" {
+		err = errors.New("No commit, branch, tag, or release name given")
+		return
+	}
+	if _, ok := meta.Commits[ref]; ok {
+		return ref, nil
+	}
+	if br, ok := meta.Branches[ref]; ok {
+		return br.Commit, nil
+	}
+	if br, ok := meta.RemoteBranches[ref]; ok {
+		return br.Commit, nil
+	}
+	if tag, ok := meta.Tags[ref]; ok {
+		return tag.Commit, nil
+	}
+	if rel, ok := meta.Releases[ref]; ok {
+		return rel.Commit, nil
+	}
+	err = fmt.Errorf("'%s' isn't a known commit ID, branch, tag, or release", ref)
+	return
+}
 
-		_, err = fmt.Fprintln(fOut)
+// Retrieves a database from DBHub.io, streaming it into the local cache.  The download is written to a temporary file
+// first, and only moved into place (named after its SHA256 checksum) once it's complete.  When downloading a specific
+// commit, an interrupted download is resumed from where it stopped the next time it's requested.  If the checksum the
+// database should have is given (want), a download with a different one is thrown away rather than being cached, so it
+// can't replace or remove a cached database file something else needs.  Its checksum is still returned, for the
+// caller to report.  Progress is displayed on out
+func retrieveDatabase(out io.Writer, db, branch, commit, want string) (header http.Header, shaSum string,
+	err error) {
+	// Create the local database cache directory, if it doesn't yet exist
+	cacheDir := filepath.Join(dioDir(db), "db")
+	if _, err = os.Stat(cacheDir); os.IsNotExist(err) {
+		err = os.MkdirAll(cacheDir, 0770)
 		if err != nil {
 			return
 		}
-	} else {
-		// No existing metadata, so just copy across the remote metadata
-		mergedMeta = newMeta
-
-		// Use the remote default branch as the initial active (local) branch
-		mergedMeta.ActiveBranch = newMeta.DefBranch
 	}
-	return
-}
 
-// Retrieves a database from DBHub.io
-func retrieveDatabase(db string, branch string, commit string) (resp rq.Response, body []byte, err error) {
-	dbURL := fmt.Sprintf("%s/%s/%s", cloud, certUser, db)
-	req := rq.New().TLSClientConfig(&TLSConfig).Get(dbURL).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION))
+	// Branch heads can move between attempts, so only downloads of a specific commit are resumed
+	var partFile string
 	if branch != "" {
-		req.Query(fmt.Sprintf("branch=%s", url.QueryEscape(branch)))
+		partFile = filepath.Join(cacheDir, fmt.Sprintf("branch-%x.part", branch))
+		err = os.Remove(partFile)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
 	} else {
-		req.Query(fmt.Sprintf("commit=%s", url.QueryEscape(commit)))
+		partFile = filepath.Join(cacheDir, fmt.Sprintf("commit-%s.part", commit))
 	}
-	var errs []error
-	resp, body, errs = req.EndBytes()
-	if errs != nil {
-		log.Print("Errors when downloading database:")
-		for _, err := range errs {
-			log.Print(err.Error())
+
+	// Include anything already downloaded in the checksum
+	f, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	offset, err := io.Copy(hasher, f)
+	if err != nil {
+		return
+	}
+
+	// Request the database, asking for just the remaining part if some of it has already been downloaded
+	cl, remoteDB, err := newRemoteClient(out, db)
+	if err != nil {
+		return
+	}
+	dl, err := cl.DownloadDatabase(cmdContext(), remoteDB, branch, commit, offset)
+	if errors.Is(err, client.ErrBadResume) {
+		errInner := os.Remove(partFile)
+		if errInner != nil {
+			err = errInner
 		}
-		err = errors.New("Error when downloading database")
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusNotFound {
-			if branch != "" {
-				err = errors.New(fmt.Sprintf("That database & branch '%s' aren't known on DBHub.io",
-					branch))
-				return
-			}
-			if commit != "" {
-				err = errors.New(fmt.Sprintf("Requested database not found with commit %s.",
-					commit))
-				return
-			}
-			err = errors.New("Requested database not found")
+	if err != nil {
+		return
+	}
+	defer dl.Body.Close()
+	if dl.Offset != offset {
+		// The server sent the whole database, so start again from the beginning
+		hasher.Reset()
+		offset = 0
+		err = f.Truncate(0)
+		if err != nil {
 			return
 		}
-		err = errors.New(fmt.Sprintf("Download failed with an error: HTTP status %d - '%v'\n",
-			resp.StatusCode, resp.Status))
 	}
-	return
-}
-
-// Retrieves database metadata from DBHub.io
-var retrieveMetadata = func(db string) (meta metaData, onCloud bool, err error) {
-	// Download the database metadata
-	resp, md, errs := rq.New().TLSClientConfig(&TLSConfig).Get(cloud+"/metadata/get").
-		Query(fmt.Sprintf("username=%s", url.QueryEscape(certUser))).
-		Query(fmt.Sprintf("folder=%s", "/")).
-		Query(fmt.Sprintf("dbname=%s", url.QueryEscape(db))).
-		Set("User-Agent", fmt.Sprintf("Dio %s", DIO_VERSION)).
-		End()
 
-	if errs != nil {
-		log.Print("Errors when downloading database metadata:")
-		for _, err := range errs {
-			log.Print(err.Error())
+	// Stream the database to disk, checksumming it along the way
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+	bar := newProgressBar(out, fmt.Sprintf("Downloading %s", db), dl.Size)
+	bar.Add(offset)
+	_, err = io.Copy(io.MultiWriter(f, hasher, bar), dl.Body)
+	bar.Finish()
+	if err != nil {
+		if commit != "" {
+			err = fmt.Errorf("Download of '%s' was interrupted: %s.  Run the command again to resume it", db, err)
 		}
-		return metaData{}, false, errors.New("Error when downloading database metadata")
+		return
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		return metaData{}, false, nil
+	err = f.Sync()
+	if err != nil {
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return metaData{}, false,
-			errors.New(fmt.Sprintf("Metadata download failed with an error: HTTP status %d - '%v'\n",
-				resp.StatusCode, resp.Status))
+	err = f.Close()
+	if err != nil {
+		return
 	}
-	err = json.Unmarshal([]byte(md), &meta)
+
+	// Move the completed download into place, splitting it into chunks if chunked storage is turned on
+	shaSum = hex.EncodeToString(hasher.Sum(nil))
+	if want != "" && shaSum != want {
+		err = os.Remove(partFile)
+		return
+	}
+	err = os.Rename(partFile, filepath.Join(cacheDir, shaSum))
 	if err != nil {
 		return
 	}
-	return meta, true, nil
+	header = dl.Header
+	err = cacheChunk(db, shaSum)
+	return
 }
 
-// Returns the name of the default database, if one has been selected.  Returns an empty string if not
-func saveDefaultDatabase(db string) (err error) {
-	// Load the local default info
-	var z []byte
-	var def defaultSettings
-	if z, err = ioutil.ReadFile(filepath.Join(".dio", "defaults.json")); err == nil {
-		err = json.Unmarshal([]byte(z), &def)
-		if err != nil {
-			return
-		}
-	} else {
-		// No local default info, so we use a new blank set instead
-		def = defaultSettings{}
+// Retrieves database metadata from the DBHub.io cloud of the selected remote
+var retrieveMetadata = func(db string) (meta metaData, onCloud bool, err error) {
+	cl, remoteDB, err := newRemoteClient(fOut, db)
+	if err != nil {
+		return
 	}
+	meta.MetaData, onCloud, err = cl.Metadata(cmdContext(), remoteDB)
+	return
+}
 
-	// Save the new default database setting to disk
+// Saves the name of the default database
+func saveDefaultDatabase(db string) (err error) {
+	def, err := loadDefaults()
+	if err != nil {
+		return
+	}
 	def.SelectedDatabase = db
+	return saveDefaults(def)
+}
+
+// Saves the per-directory default settings
+func saveDefaults(def defaultSettings) (err error) {
+	err = os.MkdirAll(".dio", 0770)
+	if err != nil {
+		return
+	}
 	var j []byte
 	j, err = json.MarshalIndent(def, "", "  ")
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(filepath.Join(".dio", "defaults.json"), j, 0644)
-	return
+	return writeFileAtomic(filepath.Join(".dio", "defaults.json"), j, 0644)
 }
 
 // Saves the metadata to a local cache
 func saveMetadata(db string, meta metaData) (err error) {
 	// Create the metadata directory if needed
-	if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
+	if _, err = os.Stat(dioDir(db)); os.IsNotExist(err) {
 		// We create the "db" directory instead, as that'll be needed anyway and MkdirAll() ensures the .dio/<db>
 		// directory will be created on the way through
-		err = os.MkdirAll(filepath.Join(".dio", db, "db"), 0770)
+		err = os.MkdirAll(filepath.Join(dioDir(db), "db"), 0770)
 		if err != nil {
 			return
 		}
@@ -732,17 +694,18 @@ func saveMetadata(db string, meta metaData) (err error) {
 	}
 
 	// Write the updated metadata to disk
-	mdFile := filepath.Join(".dio", db, "metadata.json")
-	err = ioutil.WriteFile(mdFile, jsonString, 0644)
+	mdFile := filepath.Join(dioDir(db), "metadata.json")
+	err = writeFileAtomic(mdFile, jsonString, 0644)
 	return err
 }
 
-// Saves metadata to the local cache, merging in with any existing metadata
-func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
+// Saves metadata to the local cache, merging in with any existing metadata.  Messages about the update are written
+// to out
+func updateMetadata(out io.Writer, db string, saveMeta bool) (mergedMeta metaData, err error) {
 	// Check for existing metadata file, loading it if present
 	var md []byte
 	origMeta := metaData{}
-	md, err = ioutil.ReadFile(filepath.Join(".dio", db, "metadata.json"))
+	md, err = ioutil.ReadFile(filepath.Join(dioDir(db), "metadata.json"))
 	if err == nil {
 		err = json.Unmarshal([]byte(md), &origMeta)
 		if err != nil {
@@ -751,7 +714,7 @@ func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
 	}
 
 	// Download the latest database metadata
-	_, err = fmt.Fprintln(fOut, "Updating metadata")
+	_, err = fmt.Fprintln(out, "Updating metadata")
 	if err != nil {
 		return
 	}
@@ -762,7 +725,7 @@ func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
 
 	// If we have existing local metadata, then merge the metadata from DBHub.io with it
 	if len(origMeta.Commits) > 0 {
-		mergedMeta, err = mergeMetadata(origMeta, newMeta)
+		mergedMeta, err = mergeMetadata(out, origMeta, newMeta)
 		if err != nil {
 			return
 		}
@@ -772,6 +735,7 @@ func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
 
 		// Use the remote default branch as the initial active (local) branch
 		mergedMeta.ActiveBranch = newMeta.DefBranch
+		setRemoteBranches(&mergedMeta, selectedRemote, newMeta.Branches)
 	}
 
 	// Serialise the updated metadata to JSON
@@ -785,14 +749,14 @@ func updateMetadata(db string, saveMeta bool) (mergedMeta metaData, err error) {
 
 	// If requested, write the updated metadata to disk
 	if saveMeta {
-		if _, err = os.Stat(filepath.Join(".dio", db)); os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Join(".dio", db), 0770)
+		if _, err = os.Stat(dioDir(db)); os.IsNotExist(err) {
+			err = os.MkdirAll(dioDir(db), 0770)
 			if err != nil {
 				return
 			}
 		}
-		mdFile := filepath.Join(".dio", db, "metadata.json")
-		err = ioutil.WriteFile(mdFile, []byte(jsonString), 0644)
+		mdFile := filepath.Join(dioDir(db), "metadata.json")
+		err = writeFileAtomic(mdFile, jsonString, 0644)
 	}
 	return
 }
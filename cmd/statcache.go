@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files modified more recently than this aren't added to the stat cache, as a later change within the same file system
+// timestamp tick wouldn't be noticed
+const statCacheMinAge = 2 * time.Second
+
+// Returns the SHA256 of a database file in the working directory.  If the file size, last modified time and inode
+// haven't changed since it was last hashed, the SHA256 is taken from the stat cache instead of reading the file again
+func cachedFileSHA256(db string) (shaSum string, err error) {
+	fi, err := os.Stat(db)
+	if err != nil {
+		return
+	}
+	cache, err := loadStatCache(db)
+	if err != nil {
+		return
+	}
+	name := filepath.Base(db)
+	if e, ok := cache[name]; ok && statCacheMatch(e, fi) {
+		shaSum = e.Sha256
+		return
+	}
+
+	// Not in the cache (or the file has changed), so hash the file
+	shaSum, size, err := fileSHA256(db)
+	if err != nil {
+		return
+	}
+
+	// Only cache the result when the file wasn't changed while it was being hashed, and it's old enough that a
+	// further change wouldn't have the same last modified time
+	fi2, err := os.Stat(db)
+	if err != nil {
+		return
+	}
+	if size != fi.Size() || !statCacheMatch(newStatCacheEntry(fi, ""), fi2) ||
+		time.Since(fi2.ModTime()) < statCacheMinAge {
+		return
+	}
+	cache[name] = newStatCacheEntry(fi2, shaSum)
+	err = saveStatCache(db, cache)
+	return
+}
+
+// Calculates the SHA256 of a file, streaming it from disk rather than reading it all into memory
+func fileSHA256(path string) (shaSum string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	shaSum = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// Loads the stat cache for a database.  A missing or unreadable cache is treated as empty, as it's only an optimisation
+func loadStatCache(db string) (cache map[string]statCacheEntry, err error) {
+	cache = make(map[string]statCacheEntry)
+	b, err := ioutil.ReadFile(filepath.Join(dioDir(db), "statcache.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if json.Unmarshal(b, &cache) != nil {
+		cache = make(map[string]statCacheEntry)
+	}
+	return
+}
+
+// Creates a stat cache entry from the file info of a database file
+func newStatCacheEntry(fi os.FileInfo, shaSum string) statCacheEntry {
+	return statCacheEntry{
+		Inode:        fileInode(fi),
+		LastModified: fi.ModTime().UTC(),
+		Sha256:       shaSum,
+		Size:         fi.Size(),
+	}
+}
+
+// Saves the stat cache for a database
+func saveStatCache(db string, cache map[string]statCacheEntry) (err error) {
+	err = os.MkdirAll(dioDir(db), 0770)
+	if err != nil {
+		return
+	}
+	j, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(dioDir(db), "statcache.json"), j, 0644)
+	return
+}
+
+// Returns true if a stat cache entry still matches the file on disk
+func statCacheMatch(e statCacheEntry, fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.LastModified.Equal(fi.ModTime()) && e.Inode == fileInode(fi)
+}
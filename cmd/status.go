@@ -1,16 +1,41 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 )
 
+// The states a database file can be in, compared to the head commit of its active branch
+const (
+	STATUS_MISSING   = "missing"
+	STATUS_MODIFIED  = "modified"
+	STATUS_UNCHANGED = "unchanged"
+)
+
+var (
+	statusCmdJobs   int
+	statusCmdRemote string
+)
+
 // Displays whether a database has been modified since the last commit
 var statusCmd = &cobra.Command{
-	Use:   "status [database name]",
+	Use:   "status [database name...]",
 	Short: "Displays whether a database has been modified since the last commit",
+	Long: `Displays whether a database has been modified since the last commit
+
+With no database given, every database with local metadata in the current
+directory is shown.  For each database, its active branch and the number of
+local commits not yet pushed are shown too, based on the remote-tracking branch
+from the last fetch, push, or pull.  With --remote, the server is also checked
+to see whether the branch has moved on there.  A remote other than 'origin' can
+be chosen with --remote=name.
+
+Several databases can be given, including glob patterns such as "*.sqlite".
+They're checked concurrently, with --jobs controlling how many at once.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return status(args)
 	},
@@ -18,51 +43,228 @@ var statusCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().IntVarP(&statusCmdJobs, "jobs", "j", defaultJobs,
+		"Number of databases to check at once")
+	statusCmd.Flags().StringVar(&statusCmdRemote, "remote", "",
+		"Check whether the branch has moved on the server, for the given remote (default is 'origin')")
+	statusCmd.Flags().Lookup("remote").NoOptDefVal = DEFAULT_REMOTE
 }
 
 func status(args []string) error {
-	var db string
-	var err error
-	if len(args) == 0 {
-		// TODO: If no database name is given, we should show the status for all known databases (eg in local .dio cache)
-		//       in the current directory instead
-		db, err = getDefaultDatabase()
+	// Unpushed commits are counted against the remote given with --remote, which is also the one checked
+	if statusCmdRemote != "" {
+		selectedRemote = statusCmdRemote
+	}
+
+	// If no database names were given, show all of the databases in the current directory.  If there aren't any, fall
+	// back to the default database
+	dbs, err := localDatabases()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 || len(dbs) == 0 {
+		dbs, err = resolveDatabases(args, true)
 		if err != nil {
 			return err
 		}
-		if db == "" {
-			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+	}
+
+	// Check each of the databases
+	entries := make([]statusEntry, len(dbs))
+	idx := make(map[string]int)
+	for i, db := range dbs {
+		idx[db] = i
+	}
+	errs, err := runDatabases(dbs, statusCmdJobs, func(out io.Writer, db string) (err error) {
+		entries[idx[db]], err = statusDatabase(db)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if len(dbs) == 1 && errs[0] != nil {
+		return errs[0]
+	}
+	failed := 0
+	for i, e := range errs {
+		entries[i].Database = dbs[i]
+		if e != nil {
+			entries[i].Error = e.Error()
+			failed++
 		}
+	}
+
+	// Let the user know the results
+	if structuredOutput() {
+		err = writeOutput(entries)
 	} else {
-		db = args[0]
+		for _, j := range entries {
+			err = statusDisplay(j)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	// TODO: Allow giving multiple database files on the command line.  Hopefully just needs turning this
-	// TODO  into a for loop
-	if len(args) > 1 {
-		return errors.New("Only one database can be worked with at a time (for now)")
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d databases failed", failed, len(dbs))
 	}
+	return nil
+}
 
+// Returns the status of a database.  The server is only contacted when --remote is given, or when there's no local
+// metadata for the database
+func statusDatabase(db string) (entry statusEntry, err error) {
 	// If there is a local metadata cache for the requested database, use that.  Otherwise, retrieve it from the
 	// server first (without storing it)
-	var meta metaData
-	meta, err = localFetchMetadata(db, true)
+	_, err = os.Stat(filepath.Join(dioDir(db), "metadata.json"))
+	localMeta := err == nil
+	meta, err := localFetchMetadata(db, true)
 	if err != nil {
-		return err
+		return
 	}
+	entry.ActiveBranch = meta.ActiveBranch
 
-	// Check if the file has changed, and let the user know
-	changed, err := dbChanged(db, meta)
+	// Check if the file has changed
+	_, err = os.Stat(db)
+	if os.IsNotExist(err) {
+		entry.State = STATUS_MISSING
+	} else if err != nil {
+		return
+	} else {
+		entry.Changed, err = dbChanged(db, meta)
+		if err != nil {
+			return
+		}
+		entry.State = STATUS_UNCHANGED
+		if entry.Changed {
+			entry.State = STATUS_MODIFIED
+		}
+	}
+
+	// Count the local commits which haven't been pushed.  Metadata straight from the server has none
+	unpushed := 0
+	if localMeta {
+		var known bool
+		unpushed, known, err = unpushedCommits(meta, selectedRemote, meta.ActiveBranch)
+		if err != nil {
+			return
+		}
+		if known {
+			entry.Unpushed = &unpushed
+		}
+	} else {
+		entry.Unpushed = &unpushed
+	}
+	if statusCmdRemote == "" {
+		return
+	}
+
+	// Check whether the branch has moved on the server since it was last fetched or pushed
+	remoteMeta, found, err := retrieveMetadata(db)
 	if err != nil {
-		return err
+		return
+	}
+	entry.Remote = &statusRemote{OnServer: found}
+	remoteHead, ok := remoteMeta.Branches[meta.ActiveBranch]
+	if !found || !ok {
+		return
+	}
+	entry.Remote.BranchOnServer = true
+	tracked := meta.RemoteBranches[remoteBranchName(selectedRemote, meta.ActiveBranch)]
+	if remoteHead.Commit == tracked.Commit {
+		return
+	}
+	entry.Remote.HeadMoved = true
+	remoteHistory, err := commitHistory(remoteMeta, remoteHead.Commit)
+	if err != nil {
+		return
+	}
+	for id := range remoteHistory {
+		if _, ok := meta.Commits[id]; !ok {
+			entry.Remote.NewCommits++
+		}
+	}
+	return
+}
+
+// Displays the status of a database, in the same style as "git status"
+func statusDisplay(e statusEntry) (err error) {
+	switch {
+	case e.Error != "":
+		_, err = fmt.Fprintf(fOut, "  * '%s': failed - %s\n", e.Database, e.Error)
+		return
+	case e.State == STATUS_MISSING:
+		_, err = fmt.Fprintf(fOut, "  * '%s': missing\n", e.Database)
+	case e.Changed:
+		_, err = fmt.Fprintf(fOut, "  * '%s': has been changed\n", e.Database)
+	default:
+		_, err = fmt.Fprintf(fOut, "  * '%s': unchanged\n", e.Database)
+	}
+	if err != nil {
+		return
 	}
-	if changed {
-		_, err = fmt.Fprintf(fOut, "  * '%s': has been changed\n", db)
+	_, err = fmt.Fprintf(fOut, "    Branch: %s\n", e.ActiveBranch)
+	if err != nil {
+		return
+	}
+	switch {
+	case e.Unpushed == nil:
+		_, err = fmt.Fprintln(fOut, "    Unpushed commits: unknown (no remote-tracking branch, use 'dio fetch' to "+
+			"update)")
+	case *e.Unpushed > 0:
+		_, err = fmt.Fprintf(fOut, "    Unpushed commits: %d\n", *e.Unpushed)
+	}
+	if err != nil {
+		return
+	}
+	if e.Remote == nil {
+		return
+	}
+	switch {
+	case !e.Remote.OnServer:
+		_, err = fmt.Fprintln(fOut, "    Remote: not on the server")
+	case !e.Remote.BranchOnServer:
+		_, err = fmt.Fprintln(fOut, "    Remote: branch not on the server")
+	case e.Remote.NewCommits > 0:
+		_, err = fmt.Fprintf(fOut, "    Remote: branch has moved, with %d new commit(s) on the server\n",
+			e.Remote.NewCommits)
+	case e.Remote.HeadMoved:
+		_, err = fmt.Fprintln(fOut, "    Remote: branch has moved on the server")
+	default:
+		_, err = fmt.Fprintln(fOut, "    Remote: up to date")
+	}
+	return
+}
+
+// Returns the number of commits on a local branch which aren't on its remote-tracking branch for a remote.  When
+// there's no remote-tracking branch (eg the branch has never been fetched), the number isn't known
+func unpushedCommits(meta metaData, remote, branch string) (count int, known bool, err error) {
+	head, ok := meta.Branches[branch]
+	if !ok {
+		return 0, false, fmt.Errorf("That branch ('%s') doesn't exist", branch)
+	}
+	if head.Commit == "" {
+		return 0, true, nil
+	}
+	tracked, ok := meta.RemoteBranches[remoteBranchName(remote, branch)]
+	if !ok {
+		return 0, false, nil
+	}
+	history, err := commitHistory(meta, head.Commit)
+	if err != nil {
+		return
+	}
+	if tracked.Commit != "" {
+		remoteHistory, err := commitHistory(meta, tracked.Commit)
 		if err != nil {
-			return err
+			return 0, false, err
+		}
+		for id := range remoteHistory {
+			delete(history, id)
 		}
-		return nil
 	}
-	_, err = fmt.Fprintf(fOut, "  * '%s': unchanged\n", db)
-	return err
+	return len(history), true, nil
 }
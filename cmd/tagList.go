@@ -34,7 +34,7 @@ func tagList(args []string) error {
 		}
 		if db == "" {
 			// No database name was given on the command line, and we don't have a default database selected
-			return errors.New("No database file specified")
+			return errNoDatabase
 		}
 	} else {
 		db = args[0]
@@ -50,6 +50,12 @@ func tagList(args []string) error {
 		return err
 	}
 
+	if structuredOutput() {
+		if meta.Tags == nil {
+			meta.Tags = make(map[string]tagEntry)
+		}
+		return writeOutput(tagListOutput{Database: db, Tags: meta.Tags})
+	}
 	if len(meta.Tags) == 0 {
 		_, err = fmt.Fprintf(fOut, "Database %s has no tags\n", db)
 		return err
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// Sends the tags for a database to the server
+var tagPushCmd = &cobra.Command{
+	Use:   "push [database name]",
+	Short: "Creates and removes tags on the server, to match the local ones",
+	Long: `Creates and removes tags on the server, to match the local ones
+
+Tags created locally are added to the server, and tags removed locally are
+removed from it.  A tag with the same name pointing at a different commit on
+the server is reported as a conflict, and left alone.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tagPush(args)
+	},
+}
+
+func init() {
+	tagCmd.AddCommand(tagPushCmd)
+	tagPushCmd.Flags().StringVar(&selectedRemote, "remote", DEFAULT_REMOTE, "Remote to push to")
+}
+
+func tagPush(args []string) error {
+	return pushNamedRefsCmd(args, pushTags)
+}
+
+// Creates and removes tags on the server so they match the local ones.  Each tag which can't be pushed is
+// reported individually on out, with the others still being sent
+func pushTags(out io.Writer, db string) error {
+	meta, remoteMeta, err := loadPushMetadata(db)
+	if err != nil {
+		return err
+	}
+	cl, remoteDB, err := newRemoteClient(out, db)
+	if err != nil {
+		return err
+	}
+	ctx := cmdContext()
+
+	// Keep track of the tags on the server as they're changed
+	serverTags := make(map[string]tagEntry)
+	for name, tag := range remoteMeta.Tags {
+		serverTags[name] = tag
+	}
+	baseTags, _ := remoteTagsReleases(meta, selectedRemote)
+	failed, err := pushNamedRefs(out, remoteMeta.Commits, namedRefs{
+		kind:   "tag",
+		local:  tagCommits(meta.Tags),
+		server: tagCommits(remoteMeta.Tags),
+		base:   tagCommits(baseTags),
+		create: func(name string) error {
+			err := cl.CreateTag(ctx, remoteDB, name, meta.Tags[name])
+			if err == nil {
+				serverTags[name] = meta.Tags[name]
+			}
+			return err
+		},
+		remove: func(name string) error {
+			err := cl.RemoveTag(ctx, remoteDB, name)
+			if err == nil {
+				delete(serverTags, name)
+			}
+			return err
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Save what's now on the server, so later pushes know which tags have been removed locally
+	setRemoteTags(&meta, selectedRemote, serverTags)
+	err = saveMetadata(db, meta)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tag(s) couldn't be pushed", failed)
+	}
+	return nil
+}
+
+// Returns the commit each of the given tags points to
+func tagCommits(tags map[string]tagEntry) map[string]string {
+	commits := make(map[string]string)
+	for name, tag := range tags {
+		commits[name] = tag.Commit
+	}
+	return commits
+}
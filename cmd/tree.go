@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns the files committed along with a database in one commit (eg a branch head), with the changes to them between
+// two other commits applied.  Files added or changed between from and to are added or changed the same way, and
+// those removed are removed, with the result ordered by path
+func applyAttachmentChanges(db string, meta metaData, head, from, to string) (files []dbTreeEntry) {
+	before := make(map[string]dbTreeEntry)
+	for _, e := range commitAttachments(meta.Commits[from], db) {
+		before[e.Name] = e
+	}
+	after := make(map[string]dbTreeEntry)
+	for _, e := range commitAttachments(meta.Commits[head], db) {
+		after[e.Name] = e
+	}
+	for _, e := range commitAttachments(meta.Commits[to], db) {
+		if b, ok := before[e.Name]; !ok || b.Sha256 != e.Sha256 {
+			after[e.Name] = e
+		}
+		delete(before, e.Name)
+	}
+	for name := range before {
+		delete(after, name)
+	}
+	for _, e := range after {
+		files = append(files, e)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return
+}
+
+// Returns true if any of the files committed along with a database have been changed or removed since the commit
+func attachmentsChanged(db string, c commitEntry) (bool, error) {
+	for _, e := range commitAttachments(c, db) {
+		fi, err := os.Stat(filepath.FromSlash(e.Name))
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		lastModified := fi.ModTime().Truncate(time.Second).UTC()
+		if fi.Size() != e.Size || !lastModified.Equal(e.LastModified.Truncate(time.Second).UTC()) {
+			return true, nil
+		}
+		shaSum, _, err := fileSHA256(filepath.FromSlash(e.Name))
+		if err != nil {
+			return false, err
+		}
+		if shaSum != e.Sha256 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns an error if committing the given files along with the database on a branch which tracks a remote branch
+// would add files its head commit doesn't have.  DBHub.io servers can't store files other than the database, so the
+// branch could no longer be pushed
+func checkNewAttachments(db string, meta metaData, branch string, files []dbTreeEntry) error {
+	var tracking string
+	for name := range meta.RemoteBranches {
+		i := strings.Index(name, "/")
+		if i != -1 && name[i+1:] == branch && (tracking == "" || name < tracking) {
+			tracking = name
+		}
+	}
+	if tracking == "" {
+		return nil
+	}
+	existing := make(map[string]struct{})
+	for _, e := range commitAttachments(meta.Commits[meta.Branches[branch].Commit], db) {
+		existing[e.Name] = struct{}{}
+	}
+	for _, e := range files {
+		if _, ok := existing[e.Name]; !ok {
+			return fmt.Errorf("Branch '%s' tracks '%s', so files can't be attached to it (eg '%s'), as DBHub.io "+
+				"servers can't store them and the branch could no longer be pushed.  Keep them on a local branch "+
+				"instead", branch, tracking, e.Name)
+		}
+	}
+	return nil
+}
+
+// Returns the files committed along with a database (eg other databases, or a README), ordered by path
+func commitAttachments(c commitEntry, db string) (files []dbTreeEntry) {
+	dbEntry, _ := c.Tree.Database(db)
+	for _, e := range c.Tree.Files() {
+		if e.Name != dbEntry.Name {
+			files = append(files, e)
+		}
+	}
+	return
+}
+
+// Returns the tree entry for a database in a commit
+func commitDBEntry(c commitEntry, db string) (dbTreeEntry, error) {
+	e, ok := c.Tree.Database(db)
+	if !ok {
+		return dbTreeEntry{}, fmt.Errorf("Commit '%s' doesn't have the database '%s' in it", c.ID, db)
+	}
+	return e, nil
+}
+
+// Creates a tree entry for a file in the working directory, adding the file to the local cache of the database it's
+// committed with.  SQLite databases get a database entry, licence files a licence entry, and anything else a file
+// entry
+func fileTreeEntry(db, filePath string) (e dbTreeEntry, err error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		err = fmt.Errorf("'%s' isn't a file", filePath)
+		return
+	}
+	shaSum, _, err := fileSHA256(filePath)
+	if err != nil {
+		return
+	}
+	e.EntryType = FILE
+	upper := strings.ToUpper(filepath.Base(filePath))
+	if strings.HasPrefix(upper, "LICENCE") || strings.HasPrefix(upper, "LICENSE") || strings.HasPrefix(upper,
+		"COPYING") {
+		e.EntryType = LICENCE
+	}
+	isDB, err := isSQLiteFile(filePath)
+	if err != nil {
+		return
+	}
+	if isDB {
+		e.EntryType = DATABASE
+	}
+	e.LastModified = fi.ModTime().UTC()
+	e.Name = filepath.ToSlash(filepath.Clean(filePath))
+	e.Sha256 = shaSum
+	e.Size = fi.Size()
+	err = cacheStore(db, shaSum, filePath)
+	return
+}
+
+// Returns true if a file is a SQLite database
+func isSQLiteFile(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	_, err = io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(header, []byte("SQLite format 3\x00")), nil
+}
+
+// Works out the files to commit along with a database.  The files from the parent commit are updated from the working
+// directory, the attached files are added, and the detached ones left out
+func updateAttachments(db string, current []dbTreeEntry, attach, detach []string) (files []dbTreeEntry, err error) {
+	paths := make(map[string]struct{})
+	for _, e := range current {
+		paths[e.Name] = struct{}{}
+	}
+	for _, p := range attach {
+		name, err := validateAttachment(db, p)
+		if err != nil {
+			return nil, err
+		}
+		paths[name] = struct{}{}
+	}
+	for _, p := range detach {
+		name := path.Clean(filepath.ToSlash(p))
+		if _, ok := paths[name]; !ok {
+			return nil, fmt.Errorf("'%s' isn't part of the commits for '%s'", p, db)
+		}
+		delete(paths, name)
+	}
+
+	var names []string
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err = os.Stat(filepath.FromSlash(name)); os.IsNotExist(err) {
+			return nil, fmt.Errorf("'%s' is part of the commits for '%s', but is missing.  Use --detach to stop "+
+				"committing it", name, db)
+		}
+		e, err := fileTreeEntry(db, filepath.FromSlash(name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, e)
+	}
+	return
+}
+
+// Checks a file can be committed along with a database, returning its path in the commit tree.  Files need to be in
+// the working directory or a folder inside it
+func validateAttachment(db, filePath string) (string, error) {
+	if filepath.IsAbs(filePath) {
+		return "", fmt.Errorf("'%s' needs to be a path inside the current directory", filePath)
+	}
+	name := path.Clean(filepath.ToSlash(filePath))
+	if name == ".." || strings.HasPrefix(name, "../") || name == "." {
+		return "", fmt.Errorf("'%s' needs to be a path inside the current directory", filePath)
+	}
+	if name == path.Clean(filepath.ToSlash(db)) {
+		return "", fmt.Errorf("'%s' is the database being committed", filePath)
+	}
+	if name == filepath.Base(db) {
+		return "", fmt.Errorf("'%s' has the same name as the database being committed", filePath)
+	}
+	if strings.HasPrefix(name, ".dio/") {
+		return "", fmt.Errorf("'%s' is inside dio's own folder", filePath)
+	}
+	return name, nil
+}
+
+// Puts the files committed along with a database in the working directory back to those of a commit (eg a branch
+// head), after a cancelled command changed them to the given ones.  Files the command added are removed
+func restoreAttachments(db string, meta metaData, head string, changed []dbTreeEntry) error {
+	files := commitAttachments(meta.Commits[head], db)
+	keep := make(map[string]struct{})
+	for _, e := range files {
+		keep[e.Name] = struct{}{}
+	}
+	for _, e := range changed {
+		if _, ok := keep[e.Name]; ok {
+			continue
+		}
+		err := os.Remove(filepath.FromSlash(e.Name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeAttachmentChanges(db, meta, head, files)
+}
+
+// Updates the files committed along with a database in the working directory, from those of a commit (eg a branch
+// head) to the given ones.  Files which aren't in the new list are removed
+func writeAttachmentChanges(db string, meta metaData, head string, files []dbTreeEntry) error {
+	keep := make(map[string]struct{})
+	for _, e := range files {
+		keep[e.Name] = struct{}{}
+	}
+	for _, e := range commitAttachments(meta.Commits[head], db) {
+		if _, ok := keep[e.Name]; ok {
+			continue
+		}
+		err := os.Remove(filepath.FromSlash(e.Name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeAttachments(db, files)
+}
+
+// Writes files committed along with a database from the local cache to the working directory, creating any folders
+// needed
+func writeAttachments(db string, files []dbTreeEntry) error {
+	for _, e := range files {
+		if !cacheExists(db, e.Sha256) {
+			return fmt.Errorf("'%s' isn't in the local cache", e.Name)
+		}
+		dst := filepath.FromSlash(e.Name)
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		err = cacheCopyTo(db, e.Sha256, dst)
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(dst, time.Now(), e.LastModified)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the files committed along with a database in a commit from the local cache to the working directory
+func writeCommitAttachments(db string, c commitEntry) error {
+	return writeAttachments(db, commitAttachments(c, db))
+}
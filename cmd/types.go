@@ -1,96 +1,243 @@
 package cmd
 
-import "time"
-
-type branchEntry struct {
-	Commit      string `json:"commit"`
-	CommitCount int    `json:"commit_count"`
-	Description string `json:"description"`
-}
-
-type commitEntry struct {
-	AuthorEmail    string    `json:"author_email"`
-	AuthorName     string    `json:"author_name"`
-	CommitterEmail string    `json:"committer_email"`
-	CommitterName  string    `json:"committer_name"`
-	ID             string    `json:"id"`
-	Message        string    `json:"message"`
-	OtherParents   []string  `json:"other_parents"`
-	Parent         string    `json:"parent"`
-	Timestamp      time.Time `json:"timestamp"`
-	Tree           dbTree    `json:"tree"`
-}
-
-type dbListEntry struct {
-	CommitID     string `json:"commit_id"`
-	DefBranch    string `json:"default_branch"`
-	LastModified string `json:"last_modified"`
-	Licence      string `json:"licence"`
-	Name         string `json:"name"`
-	OneLineDesc  string `json:"one_line_description"`
-	Public       bool   `json:"public"`
-	RepoModified string `json:"repo_modified"`
-	SHA256       string `json:"sha256"`
-	Size         int64  `json:"size"`
-	Type         string `json:"type"`
-	URL          string `json:"url"`
-}
-
-type dbTreeEntryType string
+import (
+	"database/sql"
+	"time"
 
-const (
-	TREE     dbTreeEntryType = "tree"
-	DATABASE                 = "db"
-	LICENCE                  = "licence"
+	"github.com/sqlitebrowser/dio/client"
 )
 
-type dbTree struct {
-	ID      string        `json:"id"`
-	Entries []dbTreeEntry `json:"entries"`
+// The types exchanged with the DBHub.io server are defined in the client package
+type branchEntry = client.BranchEntry
+
+// Structured output for "dio branch list"
+type branchListOutput struct {
+	ActiveBranch string                 `json:"active_branch"`
+	Branches     map[string]branchEntry `json:"branches"`
+	Database     string                 `json:"database"`
+}
+
+type changeConflict struct {
+	ObjectName string      `json:"object_name"`
+	ObjectType string      `json:"object_type"`
+	Pk         []dataValue `json:"pk,omitempty"`
+	Reason     string      `json:"reason"`
+}
+
+// The state of a paused cherry-pick or revert-commit, saved while its conflicts are being resolved
+type changesetState struct {
+	ActiveBranch string           `json:"active_branch,omitempty"`
+	Branch       string           `json:"branch"`
+	Commit       string           `json:"commit"`
+	Conflicts    []changeConflict `json:"conflicts"`
+	Head         string           `json:"head"`
+	Message      string           `json:"message,omitempty"`
+}
+
+// Lists the chunks a database file in the local cache has been split into
+type chunkManifest struct {
+	Chunks    []string `json:"chunks"`
+	ChunkSize int64    `json:"chunk_size"`
+	Size      int64    `json:"size"`
+}
+
+type commitEntry = client.CommitEntry
+
+type dataDiff struct {
+	ActionType diffType      `json:"action_type"`
+	Pk         []dataValue   `json:"pk"`
+	DataBefore []interface{} `json:"data_before,omitempty"`
+	DataAfter  []interface{} `json:"data_after,omitempty"`
+}
+
+type dataValue struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type dbDiffs struct {
+	Diff []diffObjectChangeset `json:"diff"`
+}
+
+type dbListEntry = client.DBListEntry
+
+// Structured output for "dio list"
+type dbListOutput struct {
+	Cloud     string        `json:"cloud"`
+	Databases []dbListEntry `json:"databases"`
 }
-type dbTreeEntry struct {
-	EntryType    dbTreeEntryType `json:"entry_type"`
-	LastModified time.Time       `json:"last_modified"`
-	LicenceSHA   string          `json:"licence"`
-	Name         string          `json:"name"`
-	Sha256       string          `json:"sha256"`
-	Size         int64           `json:"size"`
+
+// Used for running queries either directly on a SQLite database, or inside a transaction
+type dbQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
 }
 
+type dbTreeEntryType = client.DBTreeEntryType
+
+const (
+	TREE     = client.TREE
+	DATABASE = client.DATABASE
+	FILE     = client.FILE
+	LICENCE  = client.LICENCE
+)
+
+type dbTree = client.DBTree
+type dbTreeEntry = client.DBTreeEntry
+
 type defaultSettings struct {
+	Profile          string `json:"profile,omitempty"` // The config file profile used in this directory
 	SelectedDatabase string `json:"selected_database"`
 }
 
-type licenceEntry struct {
-	FileFormat string `json:"file_format"`
-	FullName   string `json:"full_name"`
-	Order      int    `json:"order"`
-	Sha256     string `json:"sha256"`
-	URL        string `json:"url"`
+type diffObjectChangeset struct {
+	ObjectName string      `json:"object_name"`
+	ObjectType string      `json:"object_type"`
+	ColsBefore []string    `json:"columns_before,omitempty"`
+	ColsAfter  []string    `json:"columns_after,omitempty"`
+	Schema     *schemaDiff `json:"schema,omitempty"`
+	Data       []dataDiff  `json:"data,omitempty"`
+}
+
+type diffType string
+
+const (
+	ACTION_ADD    diffType = "add"
+	ACTION_DELETE diffType = "delete"
+	ACTION_MODIFY diffType = "modify"
+)
+
+// Structured output for errors, when machine readable output has been requested
+type errorOutput struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+type licenceEntry = client.LicenceEntry
+
+// Structured output for "dio licence list"
+type licenceListOutput struct {
+	Cloud    string                  `json:"cloud"`
+	Licences map[string]licenceEntry `json:"licences"`
+}
+
+// Structured output for "dio log".  The commits are ordered from newest to oldest
+type logOutput struct {
+	Branch   string        `json:"branch"`
+	Commits  []commitEntry `json:"commits"`
+	Database string        `json:"database"`
+}
+
+type mergeState struct {
+	ActiveBranch string           `json:"active_branch,omitempty"`
+	Base         string           `json:"base"`
+	Branch       string           `json:"branch"`
+	Conflicts    []changeConflict `json:"conflicts"`
+	Into         string           `json:"into"`
+	Message      string           `json:"message"`
+	Ours         string           `json:"ours"`
+	Theirs       string           `json:"theirs"`
 }
 
+// The metadata for a database kept in its .dio folder.  This is the metadata from the server, along with the active
+// branch and the branches, tags and releases on the remotes
 type metaData struct {
-	ActiveBranch string                  `json:"active_branch"` // The local branch
-	Branches     map[string]branchEntry  `json:"branches"`
-	Commits      map[string]commitEntry  `json:"commits"`
-	DefBranch    string                  `json:"default_branch"` // The default branch *on the server*
-	Releases     map[string]releaseEntry `json:"releases"`
-	Tags         map[string]tagEntry     `json:"tags"`
-}
-
-type releaseEntry struct {
-	Commit        string    `json:"commit"`
-	Date          time.Time `json:"date"`
-	Description   string    `json:"description"`
-	ReleaserEmail string    `json:"email"`
-	ReleaserName  string    `json:"name"`
-	Size          int64     `json:"size"`
-}
-
-type tagEntry struct {
-	Commit      string    `json:"commit"`
-	Date        time.Time `json:"date"`
-	Description string    `json:"description"`
-	TaggerEmail string    `json:"email"`
-	TaggerName  string    `json:"name"`
+	client.MetaData
+	ActiveBranch   string                  `json:"active_branch"`             // The local branch
+	OtherRemotes   map[string]remoteRefs   `json:"other_remotes,omitempty"`   // Tags and releases on the other remotes
+	RemoteBranches map[string]branchEntry  `json:"remote_branches,omitempty"` // As of the last fetch
+	RemoteReleases map[string]releaseEntry `json:"remote_releases,omitempty"` // As of the last fetch or push
+	RemoteTags     map[string]tagEntry     `json:"remote_tags,omitempty"`     // As of the last fetch or push
+}
+
+// A profile in the config file, as displayed by "dio profiles"
+type profileEntry struct {
+	Cert  string `json:"cert,omitempty"`
+	Cloud string `json:"cloud,omitempty"`
+	Email string `json:"email,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Structured output for "dio profiles"
+type profileListOutput struct {
+	Profiles map[string]profileEntry `json:"profiles"`
+	Selected string                  `json:"selected"`
+}
+
+type rebaseState struct {
+	Branch    string           `json:"branch"`
+	Conflicts []changeConflict `json:"conflicts"`
+	Current   string           `json:"current"`
+	OrigHead  branchEntry      `json:"original_head"`
+	Onto      string           `json:"onto"`
+	Remaining []string         `json:"remaining"`
+}
+
+type releaseEntry = client.ReleaseEntry
+
+// Structured output for "dio releases"
+type releaseListOutput struct {
+	Database string                  `json:"database"`
+	Releases map[string]releaseEntry `json:"releases"`
+}
+
+// A DBHub.io cloud a database is pushed to and pulled from
+type remoteEntry struct {
+	Folder string `json:"folder,omitempty"` // Folder the database is in on the remote, "/" when not set
+	URL    string `json:"url,omitempty"`    // Left out for the default remote when it uses the configured cloud
+}
+
+// Structured output for "dio remote list"
+type remoteListOutput struct {
+	Database string                 `json:"database"`
+	Remotes  map[string]remoteEntry `json:"remotes"`
+}
+
+type remoteRefs = client.RemoteRefs
+
+type schemaDiff struct {
+	ActionType diffType `json:"action_type"`
+	Before     string   `json:"before,omitempty"`
+	After      string   `json:"after,omitempty"`
+}
+
+type schemaObject struct {
+	Name    string
+	SQL     string
+	TblName string
+	Type    string
+}
+
+// File info for a database in the working directory, as of when its SHA256 was last calculated
+type statCacheEntry struct {
+	Inode        uint64    `json:"inode"`
+	LastModified time.Time `json:"last_modified"`
+	Sha256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+}
+
+// Structured output for "dio status", with one entry per database
+type statusEntry struct {
+	ActiveBranch string        `json:"active_branch"`
+	Changed      bool          `json:"changed"`
+	Database     string        `json:"database"`
+	Error        string        `json:"error,omitempty"`
+	Remote       *statusRemote `json:"remote,omitempty"` // Only filled in when the server was checked
+	State        string        `json:"state"`
+	Unpushed     *int          `json:"unpushed_commits"` // Nil when there's no remote-tracking branch to compare with
+}
+
+// The state of a database's active branch on the server, as shown by "dio status --remote"
+type statusRemote struct {
+	BranchOnServer bool `json:"branch_on_server"`
+	HeadMoved      bool `json:"head_moved"`
+	NewCommits     int  `json:"new_commits"`
+	OnServer       bool `json:"on_server"`
+}
+
+type tagEntry = client.TagEntry
+
+// Structured output for "dio tags"
+type tagListOutput struct {
+	Database string              `json:"database"`
+	Tags     map[string]tagEntry `json:"tags"`
 }